@@ -1,16 +1,55 @@
 package ring
 
 import (
-	"compress/gzip"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// builderFormatVersion is the version of the persisted Builder format written
+// by Persist; LoadBuilder can read this version and all earlier versions.
+const builderFormatVersion = 16
+
+// DefaultMaxAddressesPerNode is the number of addresses a node may have in a
+// new Builder; see Builder.SetMaxAddressesPerNode.
+const DefaultMaxAddressesPerNode = 16
+
+// ErrBuilderFrozen is returned by the Builder methods that would alter the
+// ring's assignments while the Builder is frozen; see Builder.Freeze.
+var ErrBuilderFrozen = errors.New("builder is frozen")
+
+// ErrInsufficientNodes is returned when the replica count cannot be satisfied
+// without placing more than one replica of a partition on the same node or,
+// with strict tier separation, in the same tier; see
+// Builder.SetReplicaCount.
+var ErrInsufficientNodes = errors.New("not enough active nodes, or distinct tiers with strict tier separation, to place each replica separately; add nodes or lower the replica count")
+
+// ErrBuildInProgress is returned by the Builder methods that rebuild or change
+// the ring's assignments if another such call is already in progress on the
+// same Builder; see Builder.Ring.
+var ErrBuildInProgress = errors.New("build already in progress")
+
 // Builder is used to construct Rings over time. Rings are the immutable state
 // of a Builder's assignments at a given point in time.
+//
+// A Builder is not safe for concurrent use, except that concurrent calls to
+// the methods that rebuild its assignments (Ring, BuildStreaming,
+// BuildWithReport, RepairReplication, and ApplyDelta) or change them
+// directly (AddNode, AddNodeWithID, AddNodes, RemoveNode, SetReplicaCount,
+// SetReplicaCountForRange, MovePartition, and PretendElapsed) are detected
+// and all but the first return ErrBuildInProgress rather than racing. Any
+// other change, such as to a node through its BuilderNode, made while a build
+// is in progress is unsafe.
 type Builder struct {
 	tierBase
 	version                       int64
@@ -24,6 +63,119 @@ type Builder struct {
 	moveWait                      uint16
 	moveWaitBase                  int64
 	conf                          []byte
+	compression                   Compression
+	// tombstones are the nodes that have been removed; their IDs may not be
+	// reused.
+	tombstones []*nodeTombstone
+	rampUps    []*nodeRampUp
+	// affinityGroupSize is the number of consecutive partitions the
+	// rebalancer tries to keep on identical replica sets.
+	affinityGroupSize int
+	frozen            bool
+	hashFuncName      string
+	label             string
+	// strictTierSeparation requires enough distinct tier values at every
+	// level to keep each replica of a partition in a different tier.
+	strictTierSeparation bool
+	drains               []*nodeDrain
+	replicaConstraints   []*replicaConstraint
+	id                   string
+	// replicaCount is the number of replicas of the partitions outside all
+	// of the replicaCountRanges; replicaToPartitionToNodeIndex has as many
+	// replicas as any partition has.
+	replicaCount       int
+	replicaCountRanges []*replicaCountRange
+	// deltas are the assignment changes made since the Builder was created
+	// or loaded, and deltaBase is the assignments as of the latest of them,
+	// with node indexes into deltaBaseNodeIDs; see Builder.PersistDelta.
+	deltas           []*builderDelta
+	deltaBase        [][]int32
+	deltaBaseNodeIDs []uint64
+	// buildStability is the fraction of replica slots the latest build left
+	// unchanged; see Builder.StabilityVsPrevious.
+	buildStability   float64
+	capacityProvider func(nodeID uint64) (uint32, error)
+	building         int32 // 1 while a build is in progress; see beginBuild
+	// tierCosts are the costs of replicas of a partition being separated at
+	// each tier level; see Builder.SetTierCost.
+	tierCosts []float64
+	// maxAddressesPerNode limits len(node.addresses); 0 is no limit.
+	maxAddressesPerNode int
+	// partitionOffset is added to the externally exposed partition numbers
+	// of the Rings created; see Builder.SetPartitionOffset.
+	partitionOffset uint32
+	// antiAffinities are the pairs of nodes kept out of the same partition's
+	// replica set; see Builder.SetAntiAffinity.
+	antiAffinities []*nodeAntiAffinity
+}
+
+// nodeRampUp tracks a node whose effective capacity is growing from zero to
+// its full capacity over a duration; see Builder.SetNodeRampUp.
+type nodeRampUp struct {
+	id       uint64
+	start    int64
+	duration int64
+}
+
+// nodeTombstone records a removed node; see Builder.TombstonedNodeIDs.
+type nodeTombstone struct {
+	id uint64
+	// removed is when the node was removed, in nanoseconds since the epoch;
+	// it is 0 for nodes removed before removal times were kept.
+	removed int64
+}
+
+// nodeDrain tracks a node being decommissioned; see Builder.BeginDrain.
+type nodeDrain struct {
+	id       uint64
+	migrated bool
+}
+
+// replicaConstraint limits a replica to nodes with a meta value; see
+// Builder.SetReplicaConstraint.
+type replicaConstraint struct {
+	replica int
+	key     string
+	value   string
+}
+
+func (rc *replicaConstraint) allows(n *node) bool {
+	v, ok := metaValue(n.meta, rc.key)
+	return ok && v == rc.value
+}
+
+// nodeAntiAffinity keeps two nodes out of the same partition's replica set;
+// see Builder.SetAntiAffinity. nodeA is always the lower ID.
+type nodeAntiAffinity struct {
+	nodeA uint64
+	nodeB uint64
+}
+
+// replicaCountRange gives the partitions with keys from start to end,
+// inclusive, a replica count other than the Builder's; see
+// Builder.SetReplicaCountForRange. The range is kept in terms of the top 32
+// bits of the partition number, so it covers the same keys as the partition
+// count grows.
+type replicaCountRange struct {
+	start uint32
+	end   uint32
+	count int
+}
+
+// partitionReplicaCount returns the number of replicas the partition has given
+// the default count and any ranges with other counts; where ranges overlap,
+// the later range takes precedence.
+func partitionReplicaCount(defaultCount int, ranges []*replicaCountRange, partition int, partitionBitCount uint16) int {
+	if len(ranges) == 0 {
+		return defaultCount
+	}
+	key := uint32(uint64(partition) << (32 - partitionBitCount))
+	for i := len(ranges) - 1; i >= 0; i-- {
+		if key >= ranges[i].start && key <= ranges[i].end {
+			return ranges[i].count
+		}
+	}
+	return defaultCount
 }
 
 // NewBuilder creates an empty Builder with all default settings.
@@ -33,24 +185,39 @@ func NewBuilder() *Builder {
 		partitionBitCount:             1,
 		replicaToPartitionToNodeIndex: make([][]int32, 1),
 		replicaToPartitionToLastMove:  make([][]uint16, 1),
+		replicaCount:                  1,
 		pointsAllowed:                 1,
 		// 1 << 23 is 8388608 which, with 3 replicas, would use about 100M of
 		// memory.
 		maxPartitionBitCount: 23,
 		moveWait:             60, // 1 hour default
+		hashFuncName:         DefaultHashFunc,
+		id:                   newUUID(),
+		maxAddressesPerNode:  DefaultMaxAddressesPerNode,
+		buildStability:       1,
 	}
 	b.replicaToPartitionToNodeIndex[0] = []int32{-1, -1}
 	b.replicaToPartitionToLastMove[0] = []uint16{math.MaxUint16, math.MaxUint16}
+	b.resetDeltaBase()
 	return b
 }
 
 // LoadBuilder creates a new Builder instance based on the persisted data from
 // the Reader (presumably previously saved with the Persist method).
 func LoadBuilder(r io.Reader) (*Builder, error) {
+	b, err := loadBuilder(r)
+	if err != nil {
+		return nil, err
+	}
+	b.resetDeltaBase()
+	return b, nil
+}
+
+func loadBuilder(r io.Reader) (*Builder, error) {
 	// CONSIDER: This code uses binary.Read which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
 	// binary.Put* calls instead.
-	gr, err := gzip.NewReader(r)
+	gr, compression, err := newDecompressReader(r)
 	if err != nil {
 		return nil, err
 	}
@@ -60,10 +227,15 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
-	if string(header) != "RINGBUILDERv0001" {
+	if string(header[:12]) != "RINGBUILDERv" {
+		return nil, fmt.Errorf("unknown header %s", string(header))
+	}
+	formatVersion, err := strconv.Atoi(string(header[12:]))
+	if err != nil || formatVersion < 1 || formatVersion > builderFormatVersion {
 		return nil, fmt.Errorf("unknown header %s", string(header))
 	}
-	b := &Builder{}
+	// Builders persisted before IDs were kept are given a new one.
+	b := &Builder{compression: compression, hashFuncName: DefaultHashFunc, id: newUUID(), maxAddressesPerNode: DefaultMaxAddressesPerNode, buildStability: 1}
 	err = binary.Read(gr, binary.BigEndian, &b.version)
 	if err != nil {
 		return nil, err
@@ -188,6 +360,7 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 		return nil, err
 	}
 	b.replicaToPartitionToNodeIndex = make([][]int32, vint32)
+	b.replicaCount = int(vint32)
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
 		err = binary.Read(gr, binary.BigEndian, &vvint32)
@@ -223,6 +396,250 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
+	if formatVersion < 2 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.rampUps = make([]*nodeRampUp, vint32)
+	for i := int32(0); i < vint32; i++ {
+		ru := &nodeRampUp{}
+		err = binary.Read(gr, binary.BigEndian, &ru.id)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &ru.start)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &ru.duration)
+		if err != nil {
+			return nil, err
+		}
+		b.rampUps[i] = ru
+	}
+	if formatVersion < 3 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.affinityGroupSize = int(vint32)
+	if formatVersion < 4 {
+		return b, nil
+	}
+	tf := byte(0)
+	err = binary.Read(gr, binary.BigEndian, &tf)
+	if err != nil {
+		return nil, err
+	}
+	b.frozen = tf == 1
+	if formatVersion < 5 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts := make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	b.hashFuncName = string(byts)
+	if _, err = lookupHashFunc(b.hashFuncName); err != nil {
+		return nil, err
+	}
+	if formatVersion < 6 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts = make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	b.label = string(byts)
+	if formatVersion < 7 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &tf)
+	if err != nil {
+		return nil, err
+	}
+	b.strictTierSeparation = tf == 1
+	if formatVersion < 8 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.drains = make([]*nodeDrain, vint32)
+	for i := int32(0); i < vint32; i++ {
+		nd := &nodeDrain{}
+		err = binary.Read(gr, binary.BigEndian, &nd.id)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &tf)
+		if err != nil {
+			return nil, err
+		}
+		nd.migrated = tf == 1
+		b.drains[i] = nd
+	}
+	if formatVersion < 9 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.replicaConstraints = make([]*replicaConstraint, vint32)
+	for i := int32(0); i < vint32; i++ {
+		rc := &replicaConstraint{}
+		var replica int32
+		err = binary.Read(gr, binary.BigEndian, &replica)
+		if err != nil {
+			return nil, err
+		}
+		if replica < 0 {
+			return nil, fmt.Errorf("invalid replica constraint index %d", replica)
+		}
+		rc.replica = int(replica)
+		for _, s := range []*string{&rc.key, &rc.value} {
+			var length int32
+			err = binary.Read(gr, binary.BigEndian, &length)
+			if err != nil {
+				return nil, err
+			}
+			byts := make([]byte, length)
+			_, err = io.ReadFull(gr, byts)
+			if err != nil {
+				return nil, err
+			}
+			*s = string(byts)
+		}
+		b.replicaConstraints[i] = rc
+	}
+	if formatVersion < 10 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts = make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	b.id = string(byts)
+	if formatVersion < 11 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.tierCosts = make([]float64, vint32)
+	err = binary.Read(gr, binary.BigEndian, b.tierCosts)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 12 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.tombstones = make([]*nodeTombstone, vint32)
+	for i := int32(0); i < vint32; i++ {
+		t := &nodeTombstone{}
+		err = binary.Read(gr, binary.BigEndian, &t.id)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &t.removed)
+		if err != nil {
+			return nil, err
+		}
+		b.tombstones[i] = t
+	}
+	if formatVersion < 13 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.replicaCount = int(vint32)
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.replicaCountRanges = make([]*replicaCountRange, vint32)
+	for i := int32(0); i < vint32; i++ {
+		rcr := &replicaCountRange{}
+		err = binary.Read(gr, binary.BigEndian, &rcr.start)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &rcr.end)
+		if err != nil {
+			return nil, err
+		}
+		var count int32
+		err = binary.Read(gr, binary.BigEndian, &count)
+		if err != nil {
+			return nil, err
+		}
+		rcr.count = int(count)
+		b.replicaCountRanges[i] = rcr
+	}
+	if formatVersion < 14 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.maxAddressesPerNode = int(vint32)
+	if formatVersion < 15 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &b.partitionOffset)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 16 {
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	b.antiAffinities = make([]*nodeAntiAffinity, vint32)
+	for i := int32(0); i < vint32; i++ {
+		aa := &nodeAntiAffinity{}
+		err = binary.Read(gr, binary.BigEndian, &aa.nodeA)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &aa.nodeB)
+		if err != nil {
+			return nil, err
+		}
+		b.antiAffinities[i] = aa
+	}
 	return b, nil
 }
 
@@ -233,9 +650,12 @@ func (b *Builder) Persist(w io.Writer) error {
 	// CONSIDER: This code uses binary.Write which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
 	// binary.Put* calls instead.
-	gw := gzip.NewWriter(w)
+	gw, err := newCompressWriter(w, b.compression)
+	if err != nil {
+		return err
+	}
 	defer gw.Close() // does not close the underlying writer
-	_, err := gw.Write([]byte("RINGBUILDERv0001"))
+	_, err = gw.Write([]byte(fmt.Sprintf("RINGBUILDERv%04d", builderFormatVersion)))
 	if err != nil {
 		return err
 	}
@@ -422,101 +842,1281 @@ func (b *Builder) Persist(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (b *Builder) minimizeTiers() {
-	u := make([][]bool, len(b.tiers))
-	for i, t := range b.tiers {
-		u[i] = make([]bool, len(t))
+	if len(b.rampUps) > math.MaxInt32 {
+		return fmt.Errorf("%d ramp ups is too large; max is %d", len(b.rampUps), math.MaxInt32)
 	}
-	for _, n := range b.nodes {
-		for lv, i := range n.tierIndexes {
-			u[lv][i] = true
-		}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.rampUps)))
+	if err != nil {
+		return err
 	}
-	for lv, us := range u {
-		for i := len(us) - 1; i > 0; i-- {
-			if us[i] {
-				continue
-			}
-			b.tiers[lv][i] = ""
-			for _, n := range b.nodes {
-				if n.tierIndexes[lv] > int32(i) {
-					n.tierIndexes[lv]--
-				}
-			}
+	for _, ru := range b.rampUps {
+		err = binary.Write(gw, binary.BigEndian, ru.id)
+		if err != nil {
+			return err
 		}
-	}
-	for lv := 0; lv < len(b.tiers); lv++ {
-		ts := make([]string, 1, len(b.tiers[lv]))
-		for _, t := range b.tiers[lv][1:] {
-			if t != "" {
-				ts = append(ts, t)
-			}
+		err = binary.Write(gw, binary.BigEndian, ru.start)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, ru.duration)
+		if err != nil {
+			return err
 		}
-		b.tiers[lv] = ts
 	}
-}
-
-func (b *Builder) ReplicaCount() int {
-	return len(b.replicaToPartitionToNodeIndex)
-}
-
-func (b *Builder) SetReplicaCount(count int) {
-	if count < 1 {
-		count = 1
+	err = binary.Write(gw, binary.BigEndian, int32(b.affinityGroupSize))
+	if err != nil {
+		return err
 	}
-	if count < len(b.replicaToPartitionToNodeIndex) {
-		b.dirty = true
-		b.replicaToPartitionToNodeIndex = b.replicaToPartitionToNodeIndex[:count]
-		b.replicaToPartitionToLastMove = b.replicaToPartitionToLastMove[:count]
-	} else if count > len(b.replicaToPartitionToNodeIndex) {
-		b.dirty = true
-		partitionCount := len(b.replicaToPartitionToNodeIndex[0])
-		for count > len(b.replicaToPartitionToNodeIndex) {
-			newPartitionToNodeIndex := make([]int32, partitionCount)
-			newPartitionToLastMove := make([]uint16, partitionCount)
-			for i := 0; i < partitionCount; i++ {
-				newPartitionToNodeIndex[i] = -1
-				newPartitionToLastMove[i] = math.MaxUint16
-			}
-			b.replicaToPartitionToNodeIndex = append(b.replicaToPartitionToNodeIndex, newPartitionToNodeIndex)
-			b.replicaToPartitionToLastMove = append(b.replicaToPartitionToLastMove, newPartitionToLastMove)
-		}
+	tf := byte(0)
+	if b.frozen {
+		tf = 1
 	}
-}
-
-// PointsAllowed is the number of percentage points over or under that the ring
-// will try to keep data assignments within. The default is 1 for one percent
-// extra or less data.
-func (b *Builder) PointsAllowed() byte {
-	return b.pointsAllowed
-}
+	err = binary.Write(gw, binary.BigEndian, tf)
+	if err != nil {
+		return err
+	}
+	byts := []byte(b.hashFuncName)
+	if len(byts) > math.MaxInt32 {
+		return fmt.Errorf("%d hash func name length is too large; max is %d", len(byts), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	byts = []byte(b.label)
+	if len(byts) > math.MaxInt32 {
+		return fmt.Errorf("%d label length is too large; max is %d", len(byts), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	tf = 0
+	if b.strictTierSeparation {
+		tf = 1
+	}
+	err = binary.Write(gw, binary.BigEndian, tf)
+	if err != nil {
+		return err
+	}
+	if len(b.drains) > math.MaxInt32 {
+		return fmt.Errorf("%d drains is too large; max is %d", len(b.drains), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.drains)))
+	if err != nil {
+		return err
+	}
+	for _, nd := range b.drains {
+		err = binary.Write(gw, binary.BigEndian, nd.id)
+		if err != nil {
+			return err
+		}
+		tf = 0
+		if nd.migrated {
+			tf = 1
+		}
+		err = binary.Write(gw, binary.BigEndian, tf)
+		if err != nil {
+			return err
+		}
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.replicaConstraints)))
+	if err != nil {
+		return err
+	}
+	for _, rc := range b.replicaConstraints {
+		if rc.replica < 0 || rc.replica > math.MaxInt32 {
+			return fmt.Errorf("%d replica constraint index is invalid; max is %d", rc.replica, math.MaxInt32)
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(rc.replica))
+		if err != nil {
+			return err
+		}
+		for _, s := range []string{rc.key, rc.value} {
+			byts = []byte(s)
+			if len(byts) > math.MaxInt32 {
+				return fmt.Errorf("%d replica constraint length is too large; max is %d", len(byts), math.MaxInt32)
+			}
+			err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+			if err != nil {
+				return err
+			}
+			_, err = gw.Write(byts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	byts = []byte(b.id)
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.tierCosts)))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, b.tierCosts)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.tombstones)))
+	if err != nil {
+		return err
+	}
+	for _, t := range b.tombstones {
+		err = binary.Write(gw, binary.BigEndian, t.id)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, t.removed)
+		if err != nil {
+			return err
+		}
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(b.replicaCount))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.replicaCountRanges)))
+	if err != nil {
+		return err
+	}
+	for _, rcr := range b.replicaCountRanges {
+		err = binary.Write(gw, binary.BigEndian, rcr.start)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, rcr.end)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(rcr.count))
+		if err != nil {
+			return err
+		}
+	}
+	if b.maxAddressesPerNode > math.MaxInt32 {
+		return fmt.Errorf("%d max addresses per node is too large; max is %d", b.maxAddressesPerNode, math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(b.maxAddressesPerNode))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, b.partitionOffset)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.antiAffinities)))
+	if err != nil {
+		return err
+	}
+	for _, aa := range b.antiAffinities {
+		err = binary.Write(gw, binary.BigEndian, aa.nodeA)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, aa.nodeB)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PersistCanonical is the same as Persist except that the output depends only
+// on the Builder's logical state, so Builders with the same state persist to
+// identical bytes, such as for content addressed storage or diffing. Nodes,
+// and the ramp ups, drains, and tombstones referring to them, are written in
+// ID order; tier values are written in sorted order; and the state that
+// differs between otherwise identical Builders is omitted: the ID and version
+// are written empty and zero, the replicas' latest move times as long ago, as
+// if the MoveWait had passed, and the times nodes were removed as unknown, so
+// TombstoneTime will give the zero time for them. The Builder loaded from the
+// output assigns partitions the same as this one but will not be Equal to it.
+func (b *Builder) PersistCanonical(w io.Writer) error {
+	return b.canonical().Persist(w)
+}
+
+// canonical returns a copy of the Builder ordered as described for
+// PersistCanonical; the copy shares the Builder's slices where they need no
+// reordering, so it must not be modified other than by Persist.
+func (b *Builder) canonical() *Builder {
+	c := *b
+	c.id = ""
+	c.version = 0
+	c.replicaToPartitionToLastMove = make([][]uint16, len(b.replicaToPartitionToLastMove))
+	for replica, partitionToLastMove := range b.replicaToPartitionToLastMove {
+		c.replicaToPartitionToLastMove[replica] = make([]uint16, len(partitionToLastMove))
+		for partition := range partitionToLastMove {
+			c.replicaToPartitionToLastMove[replica][partition] = math.MaxUint16
+		}
+	}
+	ids := sortedNodeIDs(b.nodes, true)
+	oldIndexes := make(map[uint64]int32, len(b.nodes))
+	for i, n := range b.nodes {
+		oldIndexes[n.id] = int32(i)
+	}
+	oldToNewIndex := make([]int32, len(b.nodes))
+	for newIndex, id := range ids {
+		oldToNewIndex[oldIndexes[id]] = int32(newIndex)
+	}
+	// Tier values are reindexed in sorted order, dropping unused values and
+	// trailing unused levels.
+	var values []map[string]bool
+	for _, n := range b.nodes {
+		for level := range n.tierIndexes {
+			if v := n.Tier(level); v != "" {
+				for len(values) <= level {
+					values = append(values, map[string]bool{})
+				}
+				values[level][v] = true
+			}
+		}
+	}
+	c.tierBase = tierBase{tiers: make([][]string, len(values))}
+	valueIndexes := make([]map[string]int32, len(values))
+	for level, vs := range values {
+		sorted := make([]string, 0, len(vs))
+		for v := range vs {
+			sorted = append(sorted, v)
+		}
+		sort.Strings(sorted)
+		c.tiers[level] = append([]string{""}, sorted...)
+		valueIndexes[level] = make(map[string]int32, len(sorted))
+		for i, v := range sorted {
+			valueIndexes[level][v] = int32(i + 1)
+		}
+	}
+	c.nodes = make([]*node, len(b.nodes))
+	for i, n := range b.nodes {
+		nn := *n
+		nn.tierBase = &c.tierBase
+		nn.tierIndexes = nil
+		for level := range n.tierIndexes {
+			if v := n.Tier(level); v != "" {
+				for len(nn.tierIndexes) <= level {
+					nn.tierIndexes = append(nn.tierIndexes, 0)
+				}
+				nn.tierIndexes[level] = valueIndexes[level][v]
+			}
+		}
+		c.nodes[oldToNewIndex[i]] = &nn
+	}
+	c.replicaToPartitionToNodeIndex = make([][]int32, len(b.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		c.replicaToPartitionToNodeIndex[replica] = make([]int32, len(partitionToNodeIndex))
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				nodeIndex = oldToNewIndex[nodeIndex]
+			}
+			c.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
+		}
+	}
+	rampUps := make(map[uint64]*nodeRampUp, len(b.rampUps))
+	drains := make(map[uint64]*nodeDrain, len(b.drains))
+	tombstones := make(map[uint64]*nodeTombstone, len(b.tombstones))
+	var rampUpIDs, drainIDs, tombstoneIDs []uint64
+	for _, ru := range b.rampUps {
+		rampUps[ru.id] = ru
+		rampUpIDs = append(rampUpIDs, ru.id)
+	}
+	for _, nd := range b.drains {
+		drains[nd.id] = nd
+		drainIDs = append(drainIDs, nd.id)
+	}
+	for _, t := range b.tombstones {
+		tombstones[t.id] = t
+		tombstoneIDs = append(tombstoneIDs, t.id)
+	}
+	sort.Sort(uint64Slice(rampUpIDs))
+	sort.Sort(uint64Slice(drainIDs))
+	sort.Sort(uint64Slice(tombstoneIDs))
+	c.rampUps = make([]*nodeRampUp, len(rampUpIDs))
+	for i, id := range rampUpIDs {
+		c.rampUps[i] = rampUps[id]
+	}
+	c.drains = make([]*nodeDrain, len(drainIDs))
+	for i, id := range drainIDs {
+		c.drains[i] = drains[id]
+	}
+	c.tombstones = make([]*nodeTombstone, len(tombstoneIDs))
+	for i, id := range tombstoneIDs {
+		c.tombstones[i] = &nodeTombstone{id: id}
+	}
+	return &c
+}
+
+func (b *Builder) minimizeTiers() {
+	u := make([][]bool, len(b.tiers))
+	for i, t := range b.tiers {
+		u[i] = make([]bool, len(t))
+	}
+	for _, n := range b.nodes {
+		for lv, i := range n.tierIndexes {
+			// Index 0, the empty string, is always kept; a level with only
+			// empty values has no entries at all.
+			if i > 0 {
+				u[lv][i] = true
+			}
+		}
+	}
+	for lv, us := range u {
+		for i := len(us) - 1; i > 0; i-- {
+			if us[i] {
+				continue
+			}
+			b.tiers[lv][i] = ""
+			for _, n := range b.nodes {
+				if lv < len(n.tierIndexes) && n.tierIndexes[lv] > int32(i) {
+					n.tierIndexes[lv]--
+				}
+			}
+		}
+	}
+	for lv := 0; lv < len(b.tiers); lv++ {
+		if len(b.tiers[lv]) == 0 {
+			continue
+		}
+		ts := make([]string, 1, len(b.tiers[lv]))
+		for _, t := range b.tiers[lv][1:] {
+			if t != "" {
+				ts = append(ts, t)
+			}
+		}
+		b.tiers[lv] = ts
+	}
+}
+
+// ReplicaCount is the number of replicas each partition has, other than those
+// in ranges given a different count; see SetReplicaCountForRange.
+func (b *Builder) ReplicaCount() int {
+	return b.replicaCount
+}
+
+// SetReplicaCount sets the number of replicas each partition will have. Once
+// the Builder has active nodes, this will return ErrInsufficientNodes, and
+// leave the replica count unchanged, if there are fewer active nodes than
+// replicas, or fewer distinct tier values at any level with strict tier
+// separation. An empty Builder accepts any count since nodes are usually added
+// afterward; Ring checks the count again once there are active nodes. This
+// will return ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) SetReplicaCount(count int) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	if count < 1 {
+		count = 1
+	}
+	for _, n := range b.nodes {
+		if !n.inactive {
+			if err := b.checkReplicaCount(count); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if count != b.replicaCount {
+		b.dirty = true
+		b.replicaCount = count
+	}
+	if b.resizeReplicas() {
+		b.dirty = true
+	}
+	return nil
+}
+
+// SetReplicaCountForRange gives the partitions from start to end, inclusive,
+// the replica count given rather than the Builder's replica count; for
+// example, to map a class of data needing more, or less, durability to a range
+// of partitions. The partition numbers are as of the current partition count;
+// as the partition count grows the range continues to cover the same keys.
+// Where ranges overlap the latest takes precedence, and a range's count may be
+// set back to the Builder's replica count to undo it.
+//
+// Each range's count must be satisfiable just as with SetReplicaCount: once
+// the Builder has active nodes this returns ErrInsufficientNodes, and leaves
+// the ranges unchanged, if the count cannot be placed; and Ring checks the
+// largest count of any range once there are active nodes. An error is also
+// returned for an invalid range or a count less than 1, and ErrBuilderFrozen
+// if the Builder is frozen.
+func (b *Builder) SetReplicaCountForRange(start uint32, end uint32, count int) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	partitionCount := uint64(len(b.replicaToPartitionToNodeIndex[0]))
+	if start > end || uint64(end) >= partitionCount {
+		return fmt.Errorf("invalid partition range %d to %d; must be within 0 to %d with start <= end", start, end, partitionCount-1)
+	}
+	if count < 1 {
+		return fmt.Errorf("invalid replica count %d; must be at least 1", count)
+	}
+	for _, n := range b.nodes {
+		if !n.inactive {
+			if err := b.checkReplicaCount(count); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	shift := 32 - b.partitionBitCount
+	rcr := &replicaCountRange{
+		start: uint32(uint64(start) << shift),
+		end:   uint32((uint64(end)+1)<<shift - 1),
+		count: count,
+	}
+	// Ranges entirely covered by the new one no longer have any effect.
+	ranges := b.replicaCountRanges[:0]
+	for _, r := range b.replicaCountRanges {
+		if r.start < rcr.start || r.end > rcr.end {
+			ranges = append(ranges, r)
+		}
+	}
+	b.replicaCountRanges = append(ranges, rcr)
+	b.dirty = true
+	b.resizeReplicas()
+	return nil
+}
+
+// PartitionReplicaCount returns the number of replicas the partition has, as
+// of the current partition count; see SetReplicaCountForRange.
+func (b *Builder) PartitionReplicaCount(partition uint32) int {
+	if uint64(partition) >= uint64(len(b.replicaToPartitionToNodeIndex[0])) {
+		return 0
+	}
+	return b.partitionReplicaCount(int(partition))
+}
+
+func (b *Builder) partitionReplicaCount(partition int) int {
+	return partitionReplicaCount(b.replicaCount, b.replicaCountRanges, partition, b.partitionBitCount)
+}
+
+// replicaSlotCount returns the total number of partition replicas, across all
+// partitions, that should be assigned.
+func (b *Builder) replicaSlotCount() int {
+	partitionCount := len(b.replicaToPartitionToNodeIndex[0])
+	if len(b.replicaCountRanges) == 0 {
+		return b.replicaCount * partitionCount
+	}
+	slots := 0
+	for partition := 0; partition < partitionCount; partition++ {
+		slots += b.partitionReplicaCount(partition)
+	}
+	return slots
+}
+
+// resizeReplicas grows or shrinks the replica assignments to the most replicas
+// any partition has, and unassigns each partition's replicas beyond its own
+// replica count; true is returned if any assignments changed.
+func (b *Builder) resizeReplicas() bool {
+	changed := false
+	count := b.replicaCount
+	for _, rcr := range b.replicaCountRanges {
+		if rcr.count > count {
+			count = rcr.count
+		}
+	}
+	if count < len(b.replicaToPartitionToNodeIndex) {
+		changed = true
+		b.replicaToPartitionToNodeIndex = b.replicaToPartitionToNodeIndex[:count]
+		b.replicaToPartitionToLastMove = b.replicaToPartitionToLastMove[:count]
+	} else if count > len(b.replicaToPartitionToNodeIndex) {
+		changed = true
+		partitionCount := len(b.replicaToPartitionToNodeIndex[0])
+		for count > len(b.replicaToPartitionToNodeIndex) {
+			newPartitionToNodeIndex := make([]int32, partitionCount)
+			newPartitionToLastMove := make([]uint16, partitionCount)
+			for i := 0; i < partitionCount; i++ {
+				newPartitionToNodeIndex[i] = -1
+				newPartitionToLastMove[i] = math.MaxUint16
+			}
+			b.replicaToPartitionToNodeIndex = append(b.replicaToPartitionToNodeIndex, newPartitionToNodeIndex)
+			b.replicaToPartitionToLastMove = append(b.replicaToPartitionToLastMove, newPartitionToLastMove)
+		}
+	}
+	if len(b.replicaCountRanges) == 0 {
+		return changed
+	}
+	for partition := range b.replicaToPartitionToNodeIndex[0] {
+		for replica := b.partitionReplicaCount(partition); replica < count; replica++ {
+			if b.replicaToPartitionToNodeIndex[replica][partition] >= 0 {
+				changed = true
+				b.replicaToPartitionToNodeIndex[replica][partition] = -1
+				b.replicaToPartitionToLastMove[replica][partition] = math.MaxUint16
+			}
+		}
+	}
+	return changed
+}
+
+// checkReplicaCount returns ErrInsufficientNodes if the replica count given
+// cannot be placed without doubling up replicas on a node or, with strict tier
+// separation, in a tier.
+func (b *Builder) checkReplicaCount(count int) error {
+	active := 0
+	for _, n := range b.nodes {
+		if !n.inactive {
+			active++
+		}
+	}
+	if active < count {
+		return ErrInsufficientNodes
+	}
+	if !b.strictTierSeparation {
+		return nil
+	}
+	for level := range b.tiers {
+		values := make(map[int32]bool)
+		for _, n := range b.nodes {
+			if n.inactive {
+				continue
+			}
+			value := int32(0)
+			if level < len(n.tierIndexes) {
+				value = n.tierIndexes[level]
+			}
+			values[value] = true
+		}
+		if len(values) < count {
+			return ErrInsufficientNodes
+		}
+	}
+	return nil
+}
+
+// StrictTierSeparation indicates whether each replica of a partition must be
+// placeable in a different tier at every tier level. When enabled,
+// SetReplicaCount and Ring will return ErrInsufficientNodes if there aren't
+// enough distinct tier values for the replica count, as they always do if
+// there aren't enough active nodes. The default is false, where the
+// rebalancer separates replicas as best it can.
+func (b *Builder) StrictTierSeparation() bool {
+	return b.strictTierSeparation
+}
+
+// SetStrictTierSeparation sets whether each replica of a partition must be
+// placeable in a different tier at every tier level; see
+// StrictTierSeparation. ErrBuilderFrozen is returned if the Builder is frozen.
+func (b *Builder) SetStrictTierSeparation(strict bool) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	b.strictTierSeparation = strict
+	return nil
+}
+
+// PointsAllowed is the number of percentage points over or under that the ring
+// will try to keep data assignments within. The default is 1 for one percent
+// extra or less data.
+func (b *Builder) PointsAllowed() byte {
+	return b.pointsAllowed
+}
+
+func (b *Builder) SetPointsAllowed(points byte) {
+	b.pointsAllowed = points
+}
+
+// MaxPartitionBitCount caps how large the ring can grow. The default is 23,
+// which means 2**23 or 8,388,608 partitions, which is about 100M for a 3
+// replica ring (each partition replica assignment is an int32).
+func (b *Builder) MaxPartitionBitCount() uint16 {
+	return b.maxPartitionBitCount
+}
+
+func (b *Builder) SetMaxPartitionBitCount(count uint16) {
+	b.maxPartitionBitCount = count
+}
+
+// MaxAddressesPerNode caps how many addresses a node may have, as every node's
+// addresses are included in every copy of the ring. The default is
+// DefaultMaxAddressesPerNode; 0 means no limit.
+func (b *Builder) MaxAddressesPerNode() int {
+	return b.maxAddressesPerNode
+}
+
+// SetMaxAddressesPerNode sets the cap checked by AddNode, AddNodeWithID,
+// AddNodes, and SetNodeAddresses; 0 or less means no limit. Existing nodes
+// with more addresses are left as they are. BuilderNode.SetAddress has no way
+// to report an error and so is not limited; use SetNodeAddresses instead.
+func (b *Builder) SetMaxAddressesPerNode(n int) {
+	if n < 0 {
+		n = 0
+	}
+	b.maxAddressesPerNode = n
+}
+
+func (b *Builder) checkAddressCount(count int) error {
+	if b.maxAddressesPerNode > 0 && count > b.maxAddressesPerNode {
+		return fmt.Errorf("%d addresses is too many; max per node is %d", count, b.maxAddressesPerNode)
+	}
+	return nil
+}
+
+// MoveWait is the number of minutes that should elapse before reassigning a
+// replica of a partition again.
+func (b *Builder) MoveWait() uint16 {
+	return b.moveWait
+}
+
+func (b *Builder) SetMoveWait(minutes uint16) {
+	b.moveWait = minutes
+}
+
+// AffinityGroupSize is the number of consecutive partitions the rebalancer
+// will try to keep on identical replica sets; for example, with a group size of
+// 4, partitions 0-3 would be assigned to the same nodes, as would partitions
+// 4-7, and so on. This is useful when neighboring partitions are frequently
+// accessed together. The default of 0 (or 1) disables affinity grouping.
+//
+// Grouping trades some balance for locality: a node may be assigned up to the
+// group size more partition replicas than its capacity would indicate in
+// order to keep a group together, and larger groups give the rebalancer less
+// flexibility to balance the ring. RingStats reports how cohesive the groups
+// ended up being.
+func (b *Builder) AffinityGroupSize() int {
+	return b.affinityGroupSize
+}
+
+func (b *Builder) SetAffinityGroupSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	if n != b.affinityGroupSize {
+		b.dirty = true
+	}
+	b.affinityGroupSize = n
+}
+
+// TierCost returns the cost of replicas of a partition being separated at the
+// tier level given; see SetTierCost.
+func (b *Builder) TierCost(level int) float64 {
+	if level < 0 || level >= len(b.tierCosts) {
+		return 0
+	}
+	return b.tierCosts[level]
+}
+
+// SetTierCost sets the cost of replicas of a partition being separated at
+// each tier level from fromLevel through toLevel, such as the bandwidth
+// expense of replicating across regions. Two replicas are separated at the
+// highest tier level at which their nodes' tier values differ, and each pair
+// of replicas of a partition incurs the cost of their separation level.
+//
+// When choosing a node for a replica, the rebalancer still goes to the most
+// distinct tier available, but among the candidates there it prefers the
+// lowest total cost with the partition's other replicas before the usual
+// preference for the node most wanting partitions; this can trade some
+// balance for lower cost. RingStats reports the total placement cost. The
+// default cost of every level is 0.
+func (b *Builder) SetTierCost(fromLevel int, toLevel int, cost float64) {
+	if fromLevel > toLevel {
+		fromLevel, toLevel = toLevel, fromLevel
+	}
+	if fromLevel < 0 {
+		fromLevel = 0
+	}
+	if toLevel < 0 {
+		return
+	}
+	for len(b.tierCosts) <= toLevel {
+		b.tierCosts = append(b.tierCosts, 0)
+	}
+	for level := fromLevel; level <= toLevel; level++ {
+		if b.tierCosts[level] != cost {
+			b.tierCosts[level] = cost
+			b.dirty = true
+		}
+	}
+	for len(b.tierCosts) > 0 && b.tierCosts[len(b.tierCosts)-1] == 0 {
+		b.tierCosts = b.tierCosts[:len(b.tierCosts)-1]
+	}
+}
+
+// separationLevel returns the highest tier level at which the nodes' tier
+// values differ, or -1 if they don't differ at any level.
+func separationLevel(a *node, b *node) int {
+	level := len(a.tierIndexes) - 1
+	if len(b.tierIndexes) > len(a.tierIndexes) {
+		level = len(b.tierIndexes) - 1
+	}
+	for ; level >= 0; level-- {
+		var av, bv int32
+		if level < len(a.tierIndexes) {
+			av = a.tierIndexes[level]
+		}
+		if level < len(b.tierIndexes) {
+			bv = b.tierIndexes[level]
+		}
+		if av != bv {
+			return level
+		}
+	}
+	return -1
+}
+
+// placementCost returns the tier cost of replicas being on the nodes given.
+func placementCost(tierCosts []float64, a *node, b *node) float64 {
+	level := separationLevel(a, b)
+	if level < 0 || level >= len(tierCosts) {
+		return 0
+	}
+	return tierCosts[level]
+}
+
+// SetCapacityProvider sets a function called for each node at the start of
+// every build to refresh the node's capacity, such as from the storage the
+// node actually has available. If the function returns an error the node
+// keeps its last known capacity and the error is logged. A nil function, the
+// default, leaves capacities as they were set. The provider is not persisted
+// with the Builder.
+func (b *Builder) SetCapacityProvider(provider func(nodeID uint64) (uint32, error)) {
+	b.capacityProvider = provider
+}
+
+// refreshCapacities updates each node's capacity from the capacity provider,
+// if there is one.
+func (b *Builder) refreshCapacities() {
+	if b.capacityProvider == nil {
+		return
+	}
+	for _, n := range b.nodes {
+		capacity, err := b.capacityProvider(n.id)
+		if err != nil {
+			log.Printf("capacity provider error for node %016x; keeping capacity %d: %s", n.id, n.capacity, err)
+			continue
+		}
+		if capacity != n.capacity {
+			n.SetCapacity(capacity)
+		}
+	}
+}
+
+// SetNodeRampUp will have the node's effective capacity start at zero and grow
+// linearly to its full capacity over the duration given, so that a newly added
+// node gradually takes on partitions over successive Ring calls rather than
+// all at once. A duration of zero or less removes any ramp up for the node.
+//
+// Note that ramp up only lowers how much the rebalancer desires to assign to
+// the node; the usual movement limits still apply (see MoveWait), so the
+// node's assignments may lag behind its ramped capacity. Once the duration has
+// elapsed the ramp up is discarded.
+func (b *Builder) SetNodeRampUp(nodeID uint64, duration time.Duration) {
+	for i, ru := range b.rampUps {
+		if ru.id == nodeID {
+			copy(b.rampUps[i:], b.rampUps[i+1:])
+			b.rampUps = b.rampUps[:len(b.rampUps)-1]
+			break
+		}
+	}
+	if duration <= 0 || b.Node(nodeID) == nil {
+		return
+	}
+	b.dirty = true
+	b.rampUps = append(b.rampUps, &nodeRampUp{id: nodeID, start: time.Now().UnixNano(), duration: int64(duration)})
+}
+
+// SetReplicaConstraint has the rebalancer place the replica index given only
+// on nodes whose meta has the key with the value, where meta contains
+// whitespace separated key=value fields, such as "disk=ssd rack=12". For
+// example, SetReplicaConstraint(0, "disk", "ssd") keeps the first replica of
+// each partition on SSD nodes. An empty key removes any constraint for the
+// replica.
+//
+// A constraint takes precedence over tier separation: a constrained replica
+// is placed on a matching node in a tier not already used by the partition if
+// there is one, but otherwise on a matching node in a used tier rather than a
+// non-matching node. If no active node matches, the constraint is ignored.
+// Constraints also take precedence over capacity, so matching nodes may end up
+// overweight. Replicas that could not be placed per their constraints are
+// reported by Validate.
+//
+// An error is returned for a replica index less than 0 or greater than
+// math.MaxInt32, and ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) SetReplicaConstraint(replicaIndex int, requiredMetaKey string, value string) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if replicaIndex < 0 || replicaIndex > math.MaxInt32 {
+		return fmt.Errorf("invalid replica index %d; must be within 0 to %d", replicaIndex, math.MaxInt32)
+	}
+	b.dirty = true
+	for i, rc := range b.replicaConstraints {
+		if rc.replica == replicaIndex {
+			copy(b.replicaConstraints[i:], b.replicaConstraints[i+1:])
+			b.replicaConstraints = b.replicaConstraints[:len(b.replicaConstraints)-1]
+			break
+		}
+	}
+	if requiredMetaKey == "" {
+		return nil
+	}
+	b.replicaConstraints = append(b.replicaConstraints, &replicaConstraint{replica: replicaIndex, key: requiredMetaKey, value: value})
+	return nil
+}
+
+// SetAntiAffinity has the rebalancer keep the two nodes out of the same
+// partition's replica set, for nodes sharing a failure mode the tiers don't
+// capture, such as a power circuit. An error is returned if the nodes are the
+// same or either is unknown.
+//
+// Anti-affinity takes precedence over tier separation and capacity, but not
+// over replica constraints (see SetReplicaConstraint); and a replica that
+// cannot be placed elsewhere, such as when there are too few other active
+// nodes, is still placed on an anti-affine node. Replicas already placed in
+// violation are moved subject to the usual movement limits (see MoveWait).
+// Violations remaining are reported by Validate.
+func (b *Builder) SetAntiAffinity(nodeA uint64, nodeB uint64) error {
+	if nodeA == nodeB {
+		return fmt.Errorf("node %016x cannot be anti-affine to itself", nodeA)
+	}
+	for _, id := range []uint64{nodeA, nodeB} {
+		if b.Node(id) == nil {
+			return fmt.Errorf("no such node %016x", id)
+		}
+	}
+	if nodeA > nodeB {
+		nodeA, nodeB = nodeB, nodeA
+	}
+	i := sort.Search(len(b.antiAffinities), func(i int) bool {
+		aa := b.antiAffinities[i]
+		return aa.nodeA > nodeA || (aa.nodeA == nodeA && aa.nodeB >= nodeB)
+	})
+	if i < len(b.antiAffinities) && b.antiAffinities[i].nodeA == nodeA && b.antiAffinities[i].nodeB == nodeB {
+		return nil
+	}
+	b.dirty = true
+	b.antiAffinities = append(b.antiAffinities, nil)
+	copy(b.antiAffinities[i+1:], b.antiAffinities[i:])
+	b.antiAffinities[i] = &nodeAntiAffinity{nodeA: nodeA, nodeB: nodeB}
+	return nil
+}
+
+// ClearAntiAffinity removes any anti-affinity between the two nodes set with
+// SetAntiAffinity.
+func (b *Builder) ClearAntiAffinity(nodeA uint64, nodeB uint64) {
+	if nodeA > nodeB {
+		nodeA, nodeB = nodeB, nodeA
+	}
+	for i, aa := range b.antiAffinities {
+		if aa.nodeA == nodeA && aa.nodeB == nodeB {
+			b.dirty = true
+			copy(b.antiAffinities[i:], b.antiAffinities[i+1:])
+			b.antiAffinities = b.antiAffinities[:len(b.antiAffinities)-1]
+			return
+		}
+	}
+}
+
+// AntiAffinities returns the pairs of nodes set with SetAntiAffinity, each
+// with the lower node ID first, in ascending order.
+func (b *Builder) AntiAffinities() [][2]uint64 {
+	pairs := make([][2]uint64, len(b.antiAffinities))
+	for i, aa := range b.antiAffinities {
+		pairs[i] = [2]uint64{aa.nodeA, aa.nodeB}
+	}
+	return pairs
+}
+
+// Validate checks the partition assignments as of the most recent Ring call,
+// returning an error describing any problems found: structural problems, as
+// a Builder loaded from a corrupt file might have, such as assignments to
+// unknown nodes (see RingOrBuilderValidated); replicas assigned to nodes not
+// meeting the replica's constraint (see SetReplicaConstraint); and partitions
+// with replicas on both of a pair of anti-affine nodes (see
+// SetAntiAffinity).
+func (b *Builder) Validate() error {
+	problems := validateStructure(b.nodes, b.tiers, b.partitionBitCount, b.replicaToPartitionToNodeIndex, b.replicaCountRanges)
+	if len(b.replicaToPartitionToLastMove) != len(b.replicaToPartitionToNodeIndex) {
+		problems = append(problems, fmt.Sprintf("%d replicas have move times instead of %d", len(b.replicaToPartitionToLastMove), len(b.replicaToPartitionToNodeIndex)))
+	} else {
+		for replica, partitionToLastMove := range b.replicaToPartitionToLastMove {
+			if len(partitionToLastMove) != len(b.replicaToPartitionToNodeIndex[replica]) {
+				problems = append(problems, fmt.Sprintf("replica %d has %d move times instead of %d", replica, len(partitionToLastMove), len(b.replicaToPartitionToNodeIndex[replica])))
+			}
+		}
+	}
+	if b.replicaCount < 1 || b.replicaCount > len(b.replicaToPartitionToNodeIndex) {
+		problems = append(problems, fmt.Sprintf("invalid replica count %d", b.replicaCount))
+	}
+	// The remaining checks rely on the structure being sound.
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	for _, rc := range b.replicaConstraints {
+		if rc.replica >= len(b.replicaToPartitionToNodeIndex) {
+			continue
+		}
+		violations := 0
+		for _, nodeIndex := range b.replicaToPartitionToNodeIndex[rc.replica] {
+			if nodeIndex >= 0 && !rc.allows(b.nodes[nodeIndex]) {
+				violations++
+			}
+		}
+		if violations > 0 {
+			problems = append(problems, fmt.Sprintf("%d partitions have replica %d on nodes without %s=%s", violations, rc.replica, rc.key, rc.value))
+		}
+	}
+	if len(b.antiAffinities) > 0 {
+		idToNodeIndex := make(map[uint64]int32, len(b.nodes))
+		for nodeIndex, n := range b.nodes {
+			idToNodeIndex[n.id] = int32(nodeIndex)
+		}
+		for _, aa := range b.antiAffinities {
+			nodeIndexA, okA := idToNodeIndex[aa.nodeA]
+			nodeIndexB, okB := idToNodeIndex[aa.nodeB]
+			if !okA || !okB {
+				continue
+			}
+			violations := 0
+			for partition := range b.replicaToPartitionToNodeIndex[0] {
+				var hasA, hasB bool
+				for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+					switch partitionToNodeIndex[partition] {
+					case nodeIndexA:
+						hasA = true
+					case nodeIndexB:
+						hasB = true
+					}
+				}
+				if hasA && hasB {
+					violations++
+				}
+			}
+			if violations > 0 {
+				problems = append(problems, fmt.Sprintf("%d partitions have replicas on both anti-affine nodes %016x and %016x", violations, aa.nodeA, aa.nodeB))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// BeginDrain starts decommissioning the node: it will be given no new
+// partition replicas but will keep those it already has, giving the
+// application time to copy the node's data elsewhere. Once the application
+// calls ConfirmMigrated, CompleteDrain will deactivate the node so the next
+// Ring call reassigns its replicas. Draining an unknown or inactive node does
+// nothing. ErrBuilderFrozen is returned if the Builder is frozen.
+func (b *Builder) BeginDrain(nodeID uint64) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if b.drain(nodeID) != nil {
+		return nil
+	}
+	for _, n := range b.nodes {
+		if n.id == nodeID && !n.inactive {
+			b.dirty = true
+			b.drains = append(b.drains, &nodeDrain{id: nodeID})
+			return nil
+		}
+	}
+	return nil
+}
+
+// Draining returns true if BeginDrain has been called for the node and the
+// drain has not yet completed.
+func (b *Builder) Draining(nodeID uint64) bool {
+	return b.drain(nodeID) != nil
+}
+
+// ConfirmMigrated records that the application has migrated the data of the
+// draining node, allowing CompleteDrain. An error is returned if the node is
+// not draining, and ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) ConfirmMigrated(nodeID uint64) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	nd := b.drain(nodeID)
+	if nd == nil {
+		return fmt.Errorf("node %016x is not draining", nodeID)
+	}
+	b.dirty = true
+	nd.migrated = true
+	return nil
+}
+
+// CompleteDrain finishes decommissioning the node by marking it inactive, so
+// the next Ring call will reassign its partition replicas. An error is
+// returned if the node is not draining or ConfirmMigrated has not been called
+// for it, and ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) CompleteDrain(nodeID uint64) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	nd := b.drain(nodeID)
+	if nd == nil {
+		return fmt.Errorf("node %016x is not draining", nodeID)
+	}
+	if !nd.migrated {
+		return fmt.Errorf("node %016x has not had its data migrated", nodeID)
+	}
+	b.endDrain(nodeID)
+	for _, n := range b.nodes {
+		if n.id == nodeID {
+			n.SetActive(false)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) drain(nodeID uint64) *nodeDrain {
+	for _, nd := range b.drains {
+		if nd.id == nodeID {
+			return nd
+		}
+	}
+	return nil
+}
+
+func (b *Builder) endDrain(nodeID uint64) {
+	for i, nd := range b.drains {
+		if nd.id == nodeID {
+			b.dirty = true
+			copy(b.drains[i:], b.drains[i+1:])
+			b.drains = b.drains[:len(b.drains)-1]
+			return
+		}
+	}
+}
+
+// effectiveCapacity is the node's capacity as reduced by any ramp up in
+// effect at the time given.
+func (b *Builder) effectiveCapacity(n *node, now int64) uint32 {
+	for _, ru := range b.rampUps {
+		if ru.id != n.id {
+			continue
+		}
+		elapsed := now - ru.start
+		if elapsed < 0 {
+			return 0
+		}
+		if elapsed >= ru.duration {
+			return n.capacity
+		}
+		return uint32(float64(n.capacity) * float64(elapsed) / float64(ru.duration))
+	}
+	return n.capacity
+}
+
+// nodeIndexToCapacity returns the capacities the rebalancer uses for each
+// node, which are as reduced by any ramp ups in effect unless that would leave
+// no capacity at all, and the total of those capacities for active nodes.
+// Draining nodes are given no capacity.
+func (b *Builder) nodeIndexToCapacity(now int64) ([]uint32, float64) {
+	nodeIndexToCapacity := make([]uint32, len(b.nodes))
+	totalCapacity := float64(0)
+	for nodeIndex, n := range b.nodes {
+		if b.drain(n.id) != nil {
+			continue
+		}
+		nodeIndexToCapacity[nodeIndex] = b.effectiveCapacity(n, now)
+		if !n.inactive {
+			totalCapacity += float64(nodeIndexToCapacity[nodeIndex])
+		}
+	}
+	if totalCapacity == 0 {
+		for nodeIndex, n := range b.nodes {
+			if b.drain(n.id) != nil {
+				continue
+			}
+			nodeIndexToCapacity[nodeIndex] = n.capacity
+			if !n.inactive {
+				totalCapacity += float64(n.capacity)
+			}
+		}
+	}
+	return nodeIndexToCapacity, totalCapacity
+}
+
+// targetPartitions is the ideal number of partition replicas for a node with
+// the capacity given out of the total capacity and count of all partition
+// replicas.
+func targetPartitions(capacity uint32, totalCapacity float64, allPartitionsCount float64) int {
+	if totalCapacity == 0 {
+		return 0
+	}
+	return int(float64(capacity)/totalCapacity*allPartitionsCount + 0.5)
+}
+
+// TotalCapacity returns the sum of the capacities of all active nodes.
+func (b *Builder) TotalCapacity() uint64 {
+	var total uint64
+	for _, n := range b.nodes {
+		if !n.inactive {
+			total += uint64(n.capacity)
+		}
+	}
+	return total
+}
+
+// TargetPartitions returns the ideal number of partition replicas the node
+// should be assigned given its share of the total capacity, the replica count,
+// and the current partition count; this is the same target the rebalancer
+// works toward, including the reduction from any ramp up in effect. Inactive
+// and unknown nodes have a target of 0. Note that the next Ring call may
+// increase the partition count, and with it the targets.
+func (b *Builder) TargetPartitions(nodeID uint64) int {
+	nodeIndexToCapacity, totalCapacity := b.nodeIndexToCapacity(time.Now().UnixNano())
+	allPartitionsCount := float64(b.replicaSlotCount())
+	for nodeIndex, n := range b.nodes {
+		if n.id == nodeID {
+			if n.inactive {
+				return 0
+			}
+			return targetPartitions(nodeIndexToCapacity[nodeIndex], totalCapacity, allPartitionsCount)
+		}
+	}
+	return 0
+}
 
-func (b *Builder) SetPointsAllowed(points byte) {
-	b.pointsAllowed = points
+// EstimateNodesNeeded estimates the fewest nodes needed for a ring with the
+// partition bit count and replica count given, where each node can hold
+// perNodeCapacity partition replicas, such that no node has more than
+// maxImbalance percent more or less than its share of the partition replicas;
+// the same percentages as RingStats.MaxOverNodePercentage and
+// MaxUnderNodePercentage. There are always at least as many nodes as
+// replicas. This is only an estimate, useful for sizing a cluster before
+// provisioning it: it assumes every node has the same capacity and that the
+// rebalancer achieves the best possible distribution, which tiers and
+// replica constraints may prevent. Note the Builder may also grow the
+// partition count to reduce imbalance; see SetPointsAllowed. 0 is returned if
+// the arguments are invalid.
+func EstimateNodesNeeded(partitionBitCount int, replicaCount int, perNodeCapacity uint32, maxImbalance float64) int {
+	if partitionBitCount < 0 || partitionBitCount > 32 || replicaCount < 1 || perNodeCapacity == 0 || maxImbalance < 0 {
+		return 0
+	}
+	total := uint64(replicaCount) << uint(partitionBitCount)
+	nodes := uint64(replicaCount)
+	if n := (total + uint64(perNodeCapacity) - 1) / uint64(perNodeCapacity); n > nodes {
+		nodes = n
+	}
+	// Each node holds either the floor or the ceiling of its share, so a node
+	// count evenly dividing the total, as one will before long, is balanced.
+	for ; total%nodes != 0; nodes++ {
+		share := float64(total) / float64(nodes)
+		over := 100 * (math.Ceil(share) - share) / share
+		under := 100 * (share - math.Floor(share)) / share
+		if over <= maxImbalance && under <= maxImbalance {
+			break
+		}
+	}
+	return int(nodes)
 }
 
-// MaxPartitionBitCount caps how large the ring can grow. The default is 23,
-// which means 2**23 or 8,388,608 partitions, which is about 100M for a 3
-// replica ring (each partition replica assignment is an int32).
-func (b *Builder) MaxPartitionBitCount() uint16 {
-	return b.maxPartitionBitCount
+// Freeze prevents any changes to the ring's assignments until Unfreeze is
+// called: AddNode, AddNodeWithID, RemoveNode, SetReplicaCount, SetHashFunc,
+// SetReplicaConstraint, SetStrictTierSeparation, BeginDrain, ConfirmMigrated,
+// CompleteDrain, and Ring will all return ErrBuilderFrozen. The frozen state
+// is persisted, making this a safety interlock against automation reshuffling
+// a production ring; the rebuild has to go through an explicit Unfreeze.
+func (b *Builder) Freeze() {
+	b.frozen = true
 }
 
-func (b *Builder) SetMaxPartitionBitCount(count uint16) {
-	b.maxPartitionBitCount = count
+func (b *Builder) Unfreeze() {
+	b.frozen = false
 }
 
-// MoveWait is the number of minutes that should elapse before reassigning a
-// replica of a partition again.
-func (b *Builder) MoveWait() uint16 {
-	return b.moveWait
+func (b *Builder) Frozen() bool {
+	return b.frozen
 }
 
-func (b *Builder) SetMoveWait(minutes uint16) {
-	b.moveWait = minutes
+// HashFunc is the name of the HashFunc the Rings created will use to map keys
+// to partitions; the default is DefaultHashFunc.
+func (b *Builder) HashFunc() string {
+	return b.hashFuncName
+}
+
+// SetHashFunc sets the HashFunc, by its registered name, that the Rings
+// created will use to map keys to partitions; see RegisterHashFunc. Note that
+// changing the HashFunc of an established ring will remap nearly every key to
+// a different partition. This will return an error if the name is not
+// registered or ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) SetHashFunc(name string) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if _, err := lookupHashFunc(name); err != nil {
+		return err
+	}
+	if name != b.hashFuncName {
+		b.dirty = true
+	}
+	b.hashFuncName = name
+	return nil
+}
+
+// Compression is how the Builder, and the Rings it creates, will be compressed
+// when persisted. The default is CompressionGzip.
+func (b *Builder) Compression() Compression {
+	return b.compression
+}
+
+func (b *Builder) SetCompression(c Compression) {
+	b.compression = c
+}
+
+// ID is a UUID identifying the Builder, generated when the Builder is first
+// created and kept when persisted; it is stamped into the Rings the Builder
+// produces so a Ring can be traced back to the Builder it came from (see
+// Ring.BuilderID). A copy of the persisted Builder will have the same ID.
+func (b *Builder) ID() string {
+	return b.id
+}
+
+// Label is an optional human readable label, such as "prod-us-east migration
+// 2024-06", that the Rings created will carry; useful for telling ring files
+// apart.
+func (b *Builder) Label() string {
+	return b.label
+}
+
+func (b *Builder) SetLabel(label string) {
+	b.label = label
+}
+
+// PartitionOffset is added to the partition numbers the Rings created expose
+// externally, so that several rings dividing up a larger partition space can
+// number their partitions without colliding in external systems; the default
+// is 0. See Ring.PartitionOffset.
+func (b *Builder) PartitionOffset() uint32 {
+	return b.partitionOffset
+}
+
+// SetPartitionOffset sets the offset stamped into the Rings created; see
+// PartitionOffset. Routing within a ring, and all the Builder and Ring methods
+// taking or returning partitions other than Ring.ExternalPartitionForKey and
+// Ring.PartitionForExternal, still use the ring's own numbering from 0. Ring
+// will return an error if the offset plus the partition count exceeds the
+// 32-bit partition number space.
+func (b *Builder) SetPartitionOffset(offset uint32) {
+	if offset != b.partitionOffset {
+		b.dirty = true
+	}
+	b.partitionOffset = offset
 }
 
 // Conf is the raw encoded global configuration.
@@ -533,10 +2133,20 @@ func (b *Builder) SetConf(conf []byte) {
 // given. This can be useful in testing, as the ring algorithms will not
 // reassign replicas for a partition more often than once per MoveWait in order
 // to let reassignments take effect before moving the same data yet again.
-func (b *Builder) PretendElapsed(minutes uint16) {
+// This will return ErrBuildInProgress if a build is in progress.
+func (b *Builder) PretendElapsed(minutes uint16) error {
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	b.pretendElapsed(minutes)
+	return nil
+}
+
+func (b *Builder) pretendElapsed(minutes uint16) {
 	for _, partitionToLastMove := range b.replicaToPartitionToLastMove {
 		for partition := len(partitionToLastMove) - 1; partition >= 0; partition-- {
-			if math.MaxUint16-partitionToLastMove[partition] > minutes {
+			if math.MaxUint16-partitionToLastMove[partition] < minutes {
 				partitionToLastMove[partition] = math.MaxUint16
 			} else {
 				partitionToLastMove[partition] += minutes
@@ -555,14 +2165,125 @@ func (b *Builder) Nodes() NodeSlice {
 	return nodes
 }
 
+// NodeIDs returns the IDs of the Builder's nodes in ascending order, including
+// inactive nodes only if requested.
+func (b *Builder) NodeIDs(includeInactive bool) []uint64 {
+	return sortedNodeIDs(b.nodes, includeInactive)
+}
+
 // AddNode will add a new node to the builder for data assigment. Actual data
 // assignment won't ocurr until the Ring method is called, so you can add
-// multiple nodes or alter node values after creation if desired.
-func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresses []string, meta string, conf []byte) BuilderNode {
+// multiple nodes or alter node values after creation if desired. This will
+// return an error if there are more addresses than MaxAddressesPerNode, or
+// ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresses []string, meta string, conf []byte) (BuilderNode, error) {
+	if b.frozen {
+		return nil, ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return nil, err
+	}
+	defer b.endBuild()
+	if err := b.checkAddressCount(len(addresses)); err != nil {
+		return nil, err
+	}
+	n := newNode(b, &b.tierBase, b.nodes)
+	for b.tombstoned(n.id) {
+		n = newNode(b, &b.tierBase, b.nodes)
+	}
+	b.addNode(n, active, capacity, tiers, addresses, meta, conf)
+	return n, nil
+}
+
+// AddNodeWithID is the same as AddNode except that the node ID is given
+// rather than randomly assigned; this is useful when node IDs are managed
+// externally and need to remain stable across rebuilds. An error will be
+// returned if the ID is zero, already in use, or had been used by a node that
+// was removed, if there are more addresses than MaxAddressesPerNode, or
+// ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) AddNodeWithID(id uint64, active bool, capacity uint32, tiers []string, addresses []string, meta string, conf []byte) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	if id == 0 {
+		return fmt.Errorf("node id 0 is reserved to indicate no node")
+	}
+	for _, n := range b.nodes {
+		if n.id == id {
+			return fmt.Errorf("node id %016x already in use", id)
+		}
+	}
+	if b.tombstoned(id) {
+		return fmt.Errorf("node id %016x was used by a removed node", id)
+	}
+	if err := b.checkAddressCount(len(addresses)); err != nil {
+		return err
+	}
+	b.addNode(&node{builder: b, tierBase: &b.tierBase, id: id}, active, capacity, tiers, addresses, meta, conf)
+	return nil
+}
+
+// AddNodes adds a copy of each node given, as AddNode does, in a single call;
+// this is convenient when constructing a large topology, such as from another
+// Ring's nodes. A node with a non-zero ID keeps that ID, as with
+// AddNodeWithID, and the others are given new IDs; the IDs of all the nodes
+// are returned in the order given. The IDs and address counts are checked
+// before any nodes are added, so on error none are. As with AddNode, no
+// assignments are made until the next Ring call, which rebalances once for
+// all the nodes added. This will return ErrBuilderFrozen if the Builder is
+// frozen.
+func (b *Builder) AddNodes(nodes []Node) ([]uint64, error) {
+	if b.frozen {
+		return nil, ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return nil, err
+	}
+	defer b.endBuild()
+	used := make(map[uint64]bool, len(b.nodes)+len(nodes))
+	for _, n := range b.nodes {
+		used[n.id] = true
+	}
+	for _, n := range nodes {
+		if err := b.checkAddressCount(len(n.Addresses())); err != nil {
+			return nil, err
+		}
+		id := n.ID()
+		if id == 0 {
+			continue
+		}
+		if used[id] {
+			return nil, fmt.Errorf("node id %016x already in use", id)
+		}
+		if b.tombstoned(id) {
+			return nil, fmt.Errorf("node id %016x was used by a removed node", id)
+		}
+		used[id] = true
+	}
+	source := rand.NewSource(time.Now().UnixNano())
+	ids := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		nn := &node{builder: b, tierBase: &b.tierBase, id: n.ID()}
+		if nn.id == 0 {
+			for nn.id == 0 || used[nn.id] || b.tombstoned(nn.id) {
+				nn = newNodeWithSource(b, &b.tierBase, nil, source)
+			}
+		}
+		used[nn.id] = true
+		b.addNode(nn, n.Active(), n.Capacity(), n.Tiers(), n.Addresses(), n.Meta(), n.Conf())
+		ids[i] = nn.id
+	}
+	return ids, nil
+}
+
+func (b *Builder) addNode(n *node, active bool, capacity uint32, tiers []string, addresses []string, meta string, conf []byte) {
 	b.dirty = true
 	addressesCopy := make([]string, len(addresses))
 	copy(addressesCopy, addresses)
-	n := newNode(b, &b.tierBase, b.nodes)
 	n.inactive = !active
 	n.capacity = capacity
 	n.addresses = addressesCopy
@@ -572,7 +2293,59 @@ func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresse
 		n.SetTier(level, value)
 	}
 	b.nodes = append(b.nodes, n)
-	return n
+}
+
+// SetNodeAddresses replaces the addresses of the node with a copy of those
+// given. An error is returned if the node is unknown or there are more
+// addresses than MaxAddressesPerNode, or ErrBuilderFrozen if the Builder is
+// frozen.
+func (b *Builder) SetNodeAddresses(nodeID uint64, addresses []string) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.checkAddressCount(len(addresses)); err != nil {
+		return err
+	}
+	for _, n := range b.nodes {
+		if n.id == nodeID {
+			b.dirty = true
+			n.addresses = make([]string, len(addresses))
+			copy(n.addresses, addresses)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown node %016x", nodeID)
+}
+
+func (b *Builder) tombstoned(nodeID uint64) bool {
+	for _, t := range b.tombstones {
+		if t.id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// TombstonedNodeIDs returns the IDs of the nodes that have been removed, in
+// the order they were removed; these IDs may not be reused.
+func (b *Builder) TombstonedNodeIDs() []uint64 {
+	ids := make([]uint64, len(b.tombstones))
+	for i, t := range b.tombstones {
+		ids[i] = t.id
+	}
+	return ids
+}
+
+// TombstoneTime returns when the node identified was removed; it returns the
+// zero time if the node has not been removed or was removed by a version of
+// this package that didn't keep removal times.
+func (b *Builder) TombstoneTime(nodeID uint64) time.Time {
+	for _, t := range b.tombstones {
+		if t.id == nodeID && t.removed != 0 {
+			return time.Unix(0, t.removed)
+		}
+	}
+	return time.Time{}
 }
 
 // RemoveNode will remove the node from the list of nodes for this
@@ -582,10 +2355,28 @@ func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresse
 // replica-to-partition-to-node indexing will have to be updated, as well as
 // clearing any assignments that were to the removed node. Normally it is
 // better to just leave a "dead" node in place and simply set it as inactive.
-func (b *Builder) RemoveNode(nodeID uint64) {
+// The removed node's ID is tombstoned and will not be reused. This will return
+// ErrBuilderFrozen if the Builder is frozen.
+func (b *Builder) RemoveNode(nodeID uint64) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
 	for i, n := range b.nodes {
 		if n.id == nodeID {
 			b.dirty = true
+			b.tombstones = append(b.tombstones, &nodeTombstone{id: nodeID, removed: time.Now().UnixNano()})
+			b.SetNodeRampUp(nodeID, 0)
+			b.endDrain(nodeID)
+			for j := len(b.antiAffinities) - 1; j >= 0; j-- {
+				if aa := b.antiAffinities[j]; aa.nodeA == nodeID || aa.nodeB == nodeID {
+					copy(b.antiAffinities[j:], b.antiAffinities[j+1:])
+					b.antiAffinities = b.antiAffinities[:len(b.antiAffinities)-1]
+				}
+			}
 			copy(b.nodes[i:], b.nodes[i+1:])
 			b.nodes = b.nodes[:len(b.nodes)-1]
 			for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
@@ -600,6 +2391,7 @@ func (b *Builder) RemoveNode(nodeID uint64) {
 			break
 		}
 	}
+	return nil
 }
 
 // Node returns the node instance identified, if there is one.
@@ -627,36 +2419,267 @@ func (b *Builder) Tiers() [][]string {
 // Ring returns a Ring instance of the data defined by the builder. This will
 // cause any pending rebalancing actions to be performed. The Ring returned
 // will be immutable; to obtain updated ring data, Ring() must be called again.
-func (b *Builder) Ring() Ring {
+// This will return ErrBuilderFrozen if the Builder is frozen, or
+// ErrBuildInProgress if another build is in progress.
+func (b *Builder) Ring() (Ring, error) {
+	if err := b.beginBuild(); err != nil {
+		return nil, err
+	}
+	defer b.endBuild()
+	return b.build(nil)
+}
+
+// beginBuild marks a build, or a change to the assignments that would race
+// with one, as in progress, returning ErrBuildInProgress if one already is;
+// endBuild must be called once it is done.
+func (b *Builder) beginBuild() error {
+	if !atomic.CompareAndSwapInt32(&b.building, 0, 1) {
+		return ErrBuildInProgress
+	}
+	return nil
+}
+
+func (b *Builder) endBuild() {
+	atomic.StoreInt32(&b.building, 0)
+}
+
+// MoveEvent describes a partition replica reassigned during a build; see
+// Builder.BuildStreaming. A FromNode of 0 indicates the replica was
+// previously unassigned.
+type MoveEvent struct {
+	Partition uint32
+	FromNode  uint64
+	ToNode    uint64
+}
+
+// BuildStreaming is the same as Ring but also sends a MoveEvent to the
+// channel for each partition replica reassigned as it is computed, closing
+// the channel once the build completes, even if it fails. The build waits on
+// each send, so the events must be received for the build to progress.
+func (b *Builder) BuildStreaming(events chan<- MoveEvent) (Ring, error) {
+	defer close(events)
+	if err := b.beginBuild(); err != nil {
+		return nil, err
+	}
+	defer b.endBuild()
+	return b.build(events)
+}
+
+func (b *Builder) build(events chan<- MoveEvent) (Ring, error) {
+	if b.frozen {
+		return nil, ErrBuilderFrozen
+	}
 	validNodes := false
 	for _, n := range b.nodes {
 		if !n.inactive {
 			validNodes = true
 		}
 	}
-	if !validNodes {
-		panic("no valid nodes yet")
+	// With no active nodes there is nothing to assign to, so the ring is
+	// built with its replicas left as they are, possibly all unassigned.
+	if validNodes {
+		if err := b.checkReplicaCount(len(b.replicaToPartitionToNodeIndex)); err != nil {
+			return nil, err
+		}
 	}
 	newBase := time.Now().UnixNano()
-	d := (time.Now().UnixNano() - b.moveWaitBase) / 6000000000 // minutes
+	d := (newBase - b.moveWaitBase) / int64(time.Minute)
 	if d > 0 {
 		var d16 uint16 = math.MaxUint16
 		if d < math.MaxUint16 {
 			d16 = uint16(d)
 		}
-		b.PretendElapsed(d16)
+		b.pretendElapsed(d16)
 		b.moveWaitBase = newBase
 	}
-	if b.resizeIfNeeded() {
-		b.dirty = true
+	for i := len(b.rampUps) - 1; i >= 0; i-- {
+		if newBase-b.rampUps[i].start >= b.rampUps[i].duration {
+			copy(b.rampUps[i:], b.rampUps[i+1:])
+			b.rampUps = b.rampUps[:len(b.rampUps)-1]
+		}
+	}
+	b.refreshCapacities()
+	if validNodes {
+		if b.resizeIfNeeded() {
+			b.dirty = true
+		}
+		rb := newRebalancer(b)
+		rb.events = events
+		if rb.rebalance() {
+			b.dirty = true
+		}
+	}
+	if partitionCount := uint64(len(b.replicaToPartitionToNodeIndex[0])); uint64(b.partitionOffset)+partitionCount > math.MaxUint32+1 {
+		return nil, fmt.Errorf("partition offset %d with %d partitions exceeds the 32-bit partition number space", b.partitionOffset, partitionCount)
+	}
+	b.buildStability = 1
+	if b.dirty {
+		b.dirty = false
+		fromVersion := b.version
+		b.advanceVersion(newBase)
+		b.recordDelta(fromVersion)
+		b.buildStability = b.deltas[len(b.deltas)-1].stability
+	}
+	return b.newRing(), nil
+}
+
+// StabilityVsPrevious returns the fraction, from 0 to 1, of partition replica
+// slots whose assignment the latest build left unchanged from the build
+// before it, useful for tuning settings such as MoveWait and node ramp-ups.
+// When the partition count grew, each new slot is compared with the slot it
+// was split from; replicas added by the build count as changed. A build that
+// changed nothing, or no build since the Builder was created or loaded,
+// gives 1.
+func (b *Builder) StabilityVsPrevious() float64 {
+	return b.buildStability
+}
+
+// BuildReport describes the work done by Builder.BuildWithReport.
+type BuildReport struct {
+	// Duration is the wall-clock time the build took.
+	Duration time.Duration
+	// PartitionsMoved is the number of partition replicas assigned to a
+	// different node than before the build, including previously unassigned
+	// replicas. Partitions split by a partition count increase are not counted
+	// as moved unless reassigned.
+	PartitionsMoved int
+	// NodesConsidered is the number of active nodes available for assignment.
+	NodesConsidered int
+	// NodeDeltas gives, by node ID, the change in the number of partition
+	// replicas assigned to each node whose assignments changed.
+	NodeDeltas map[uint64]int
+}
+
+// BuildWithReport is the same as Ring but also reports on the work the build
+// did, useful for understanding the impact of a change and for tuning
+// settings such as MoveWait.
+func (b *Builder) BuildWithReport() (Ring, *BuildReport, error) {
+	if err := b.beginBuild(); err != nil {
+		return nil, nil, err
+	}
+	defer b.endBuild()
+	start := time.Now()
+	before := make([][]uint64, len(b.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		before[replica] = make([]uint64, len(partitionToNodeIndex))
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				before[replica][partition] = b.nodes[nodeIndex].id
+			}
+		}
+	}
+	beforePartitionBitCount := b.partitionBitCount
+	r, err := b.build(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &BuildReport{NodeDeltas: make(map[uint64]int)}
+	for _, n := range b.nodes {
+		if !n.inactive {
+			report.NodesConsidered++
+		}
+	}
+	shift := b.partitionBitCount - beforePartitionBitCount
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for partition, nodeIndex := range partitionToNodeIndex {
+			var beforeID, afterID uint64
+			if replica < len(before) {
+				beforeID = before[replica][partition>>shift]
+			}
+			if nodeIndex >= 0 {
+				afterID = b.nodes[nodeIndex].id
+			}
+			if beforeID == afterID {
+				continue
+			}
+			if afterID != 0 {
+				report.PartitionsMoved++
+				report.NodeDeltas[afterID]++
+			}
+			if beforeID != 0 {
+				report.NodeDeltas[beforeID]--
+			}
+		}
+	}
+	for id, delta := range report.NodeDeltas {
+		if delta == 0 {
+			delete(report.NodeDeltas, id)
+		}
+	}
+	report.Duration = time.Now().Sub(start)
+	return r, report, nil
+}
+
+// RepairReplication is like Ring except that the only changes made are to
+// assign the partition replicas that are unassigned, such as after a node
+// removal, or assigned to inactive nodes; see Ring.UnderReplicatedPartitions.
+// Healthy partition replicas are left alone, making this a targeted repair
+// after a node failure rather than a full rebalance; a later Ring call will
+// still perform any pending rebalancing. This will return ErrBuilderFrozen if
+// the Builder is frozen.
+func (b *Builder) RepairReplication() (Ring, error) {
+	if err := b.beginBuild(); err != nil {
+		return nil, err
+	}
+	defer b.endBuild()
+	if b.frozen {
+		return nil, ErrBuilderFrozen
+	}
+	validNodes := false
+	for _, n := range b.nodes {
+		if !n.inactive {
+			validNodes = true
+		}
 	}
-	if newRebalancer(b).rebalance() {
+	if validNodes && newRebalancer(b).repair() {
 		b.dirty = true
 	}
 	if b.dirty {
 		b.dirty = false
-		b.version = newBase
+		fromVersion := b.version
+		b.advanceVersion(time.Now().UnixNano())
+		b.recordDelta(fromVersion)
+	}
+	return b.newRing(), nil
+}
+
+// Version returns the version of the Ring most recently built; it is
+// persisted with the Builder and increases with every build that changes the
+// ring, so the rings from the Builder can be compared for freshness.
+func (b *Builder) Version() int64 {
+	return b.version
+}
+
+// SetVersion sets the version the Builder's rings are numbered from; the
+// next build that changes the ring will have a greater version. An error is
+// returned if the version is less than the current version, as that could
+// make newer rings appear older than ones already distributed.
+func (b *Builder) SetVersion(version int64) error {
+	if version < b.version {
+		return fmt.Errorf("version %d is less than the current version %d", version, b.version)
+	}
+	if version != b.version {
+		fromVersion := b.version
+		b.version = version
+		b.recordDelta(fromVersion)
 	}
+	return nil
+}
+
+// advanceVersion sets the version to the time given, or to one more than the
+// current version if the time isn't later, such as when the clock has gone
+// backward; versions only ever increase.
+func (b *Builder) advanceVersion(now int64) {
+	if now <= b.version {
+		now = b.version + 1
+	}
+	b.version = now
+}
+
+// newRing returns a Ring of the Builder's current data.
+func (b *Builder) newRing() Ring {
+	// The name was checked when set or loaded.
+	hashFunc, _ := lookupHashFunc(b.hashFuncName)
 	tiers := make([][]string, len(b.tiers))
 	for i, tier := range b.tiers {
 		tiers[i] = make([]string, len(tier))
@@ -670,13 +2693,237 @@ func (b *Builder) Ring() Ring {
 		copy(replicaToPartitionToNodeIndex[i], b.replicaToPartitionToNodeIndex[i])
 	}
 	return &ring{
-		tierBase:          tierBase{tiers: tiers},
-		version:           b.version,
-		localNodeIndex:    -1,
-		partitionBitCount: b.partitionBitCount,
-		nodes:             nodes,
+		tierBase:                      tierBase{tiers: tiers},
+		version:                       b.version,
+		localNodeIndex:                -1,
+		partitionBitCount:             b.partitionBitCount,
+		nodes:                         nodes,
 		replicaToPartitionToNodeIndex: replicaToPartitionToNodeIndex,
+		compression:                   b.compression,
+		affinityGroupSize:             b.affinityGroupSize,
+		hashFuncName:                  b.hashFuncName,
+		hashFunc:                      hashFunc,
+		label:                         b.label,
+		createdAt:                     time.Now().UnixNano(),
+		builderID:                     b.id,
+		tierCosts:                     append([]float64(nil), b.tierCosts...),
+		replicaCount:                  b.replicaCount,
+		replicaCountRanges:            append([]*replicaCountRange(nil), b.replicaCountRanges...),
+		partitionOffset:               b.partitionOffset,
+	}
+}
+
+// MovePartition reassigns the replica of the partition held by fromNode to
+// toNode, for correcting a placement the rebalancer got wrong. The move counts
+// as the replica's latest move, so later Ring calls leave it in place for at
+// least the MoveWait, as with the rebalancer's own moves. The move is not
+// pinned beyond that: once the MoveWait has passed, the rebalancer is free to
+// move the replica again, including back to fromNode if that is where it
+// would place it. An error is returned if the partition is out of range,
+// fromNode holds no replica of it, toNode is unknown, inactive, draining,
+// already holds a replica of it, is anti-affine to a node holding another of
+// its replicas (see SetAntiAffinity), or doesn't meet the replica's
+// constraint (see SetReplicaConstraint), or, with strict tier separation,
+// toNode shares a tier value with another of the partition's replicas.
+func (b *Builder) MovePartition(partition uint32, fromNode uint64, toNode uint64) error {
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	if int(partition) >= len(b.replicaToPartitionToNodeIndex[0]) {
+		return fmt.Errorf("partition %d is out of range; there are %d partitions", partition, len(b.replicaToPartitionToNodeIndex[0]))
+	}
+	toNodeIndex := int32(-1)
+	for i, n := range b.nodes {
+		if n.id == toNode {
+			toNodeIndex = int32(i)
+		}
+	}
+	if toNodeIndex < 0 {
+		return fmt.Errorf("unknown node %016x", toNode)
+	}
+	to := b.nodes[toNodeIndex]
+	if to.inactive {
+		return fmt.Errorf("node %016x is inactive", toNode)
+	}
+	if b.Draining(toNode) {
+		return fmt.Errorf("node %016x is draining", toNode)
+	}
+	fromReplica := -1
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		nodeIndex := partitionToNodeIndex[partition]
+		if nodeIndex < 0 {
+			continue
+		}
+		if nodeIndex == toNodeIndex {
+			return fmt.Errorf("node %016x already holds replica %d of partition %d", toNode, replica, partition)
+		}
+		if b.nodes[nodeIndex].id == fromNode {
+			fromReplica = replica
+		}
+	}
+	if fromReplica < 0 {
+		return fmt.Errorf("node %016x holds no replica of partition %d", fromNode, partition)
+	}
+	for _, rc := range b.replicaConstraints {
+		if rc.replica == fromReplica && !rc.allows(to) {
+			return fmt.Errorf("node %016x does not meet replica %d's constraint %s=%s", toNode, fromReplica, rc.key, rc.value)
+		}
+	}
+	for _, aa := range b.antiAffinities {
+		otherID := aa.nodeA
+		if aa.nodeA == toNode {
+			otherID = aa.nodeB
+		} else if aa.nodeB != toNode {
+			continue
+		}
+		for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+			nodeIndex := partitionToNodeIndex[partition]
+			if replica != fromReplica && nodeIndex >= 0 && b.nodes[nodeIndex].id == otherID {
+				return fmt.Errorf("node %016x is anti-affine to node %016x, which holds replica %d of partition %d", toNode, otherID, replica, partition)
+			}
+		}
+	}
+	if b.strictTierSeparation {
+		for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+			nodeIndex := partitionToNodeIndex[partition]
+			if replica == fromReplica || nodeIndex < 0 {
+				continue
+			}
+			other := b.nodes[nodeIndex]
+			for level := range b.tiers {
+				if tierIndex(to, level) == tierIndex(other, level) {
+					return fmt.Errorf("node %016x shares tier %d value %q with node %016x, which holds replica %d of partition %d", toNode, level, b.tiers[level][tierIndex(to, level)], other.id, replica, partition)
+				}
+			}
+		}
+	}
+	b.replicaToPartitionToNodeIndex[fromReplica][partition] = toNodeIndex
+	b.replicaToPartitionToLastMove[fromReplica][partition] = 0
+	b.dirty = true
+	return nil
+}
+
+// tierIndex returns the node's index into the values of the tier level, with
+// 0 for levels the node has no value for.
+func tierIndex(n *node, level int) int32 {
+	if level < len(n.tierIndexes) {
+		return n.tierIndexes[level]
+	}
+	return 0
+}
+
+// AssignmentMap returns a copy of the partition to replica node IDs mapping as
+// of the most recent Ring call, useful for external analysis. A node ID of 0
+// indicates a replica that is currently unassigned, such as after a node
+// removal.
+func (b *Builder) AssignmentMap() map[uint32][]uint64 {
+	partitionCount := len(b.replicaToPartitionToNodeIndex[0])
+	m := make(map[uint32][]uint64, partitionCount)
+	for partition := 0; partition < partitionCount; partition++ {
+		ids := make([]uint64, len(b.replicaToPartitionToNodeIndex))
+		for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+			if nodeIndex := partitionToNodeIndex[partition]; nodeIndex >= 0 {
+				ids[replica] = b.nodes[nodeIndex].id
+			}
+		}
+		m[uint32(partition)] = ids
+	}
+	return m
+}
+
+// Equal returns true if the other Builder has the same state as this one:
+// the same version, settings, nodes (compared by tier values rather than
+// internal indexes), tombstones, ramp ups, drains, and partition assignments.
+// Transient state, such as whether changes are pending for the next Ring
+// call, is not compared.
+func (b *Builder) Equal(other *Builder) bool {
+	if b == other {
+		return true
+	}
+	if other == nil ||
+		b.version != other.version ||
+		b.id != other.id ||
+		!bytes.Equal(b.conf, other.conf) ||
+		b.partitionBitCount != other.partitionBitCount ||
+		b.pointsAllowed != other.pointsAllowed ||
+		b.maxPartitionBitCount != other.maxPartitionBitCount ||
+		b.moveWait != other.moveWait ||
+		b.compression != other.compression ||
+		b.affinityGroupSize != other.affinityGroupSize ||
+		b.frozen != other.frozen ||
+		b.hashFuncName != other.hashFuncName ||
+		b.label != other.label ||
+		b.strictTierSeparation != other.strictTierSeparation ||
+		b.replicaCount != other.replicaCount ||
+		b.maxAddressesPerNode != other.maxAddressesPerNode ||
+		b.partitionOffset != other.partitionOffset ||
+		len(b.nodes) != len(other.nodes) ||
+		len(b.tombstones) != len(other.tombstones) ||
+		len(b.rampUps) != len(other.rampUps) ||
+		len(b.drains) != len(other.drains) ||
+		len(b.replicaConstraints) != len(other.replicaConstraints) ||
+		len(b.antiAffinities) != len(other.antiAffinities) ||
+		len(b.tierCosts) != len(other.tierCosts) ||
+		len(b.replicaCountRanges) != len(other.replicaCountRanges) ||
+		len(b.replicaToPartitionToNodeIndex) != len(other.replicaToPartitionToNodeIndex) {
+		return false
+	}
+	for i, cost := range b.tierCosts {
+		if other.tierCosts[i] != cost {
+			return false
+		}
+	}
+	for i, n := range b.nodes {
+		if !n.equal(other.nodes[i]) {
+			return false
+		}
+	}
+	for i, t := range b.tombstones {
+		if *other.tombstones[i] != *t {
+			return false
+		}
+	}
+	for i, ru := range b.rampUps {
+		if *other.rampUps[i] != *ru {
+			return false
+		}
+	}
+	for i, nd := range b.drains {
+		if *other.drains[i] != *nd {
+			return false
+		}
+	}
+	for i, rc := range b.replicaConstraints {
+		if *other.replicaConstraints[i] != *rc {
+			return false
+		}
+	}
+	for i, aa := range b.antiAffinities {
+		if *other.antiAffinities[i] != *aa {
+			return false
+		}
+	}
+	for i, rcr := range b.replicaCountRanges {
+		if *other.replicaCountRanges[i] != *rcr {
+			return false
+		}
+	}
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		otherPartitionToNodeIndex := other.replicaToPartitionToNodeIndex[replica]
+		if len(partitionToNodeIndex) != len(otherPartitionToNodeIndex) {
+			return false
+		}
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if otherPartitionToNodeIndex[partition] != nodeIndex || other.replicaToPartitionToLastMove[replica][partition] != b.replicaToPartitionToLastMove[replica][partition] {
+				return false
+			}
+		}
 	}
+	return true
 }
 
 func (b *Builder) resizeIfNeeded() bool {
@@ -684,6 +2931,8 @@ func (b *Builder) resizeIfNeeded() bool {
 		return false
 	}
 	replicaCount := len(b.replicaToPartitionToNodeIndex)
+	// With ranges of other replica counts, this is the average.
+	replicasPerPartition := float64(b.replicaSlotCount()) / float64(len(b.replicaToPartitionToNodeIndex[0]))
 	// Calculate the partition count needed.
 	// Each node is examined to see how much under or overweight it would be
 	// and increasing the partition count until the difference is under the
@@ -701,7 +2950,7 @@ func (b *Builder) resizeIfNeeded() bool {
 		if n.inactive {
 			continue
 		}
-		desiredPartitionCount := float64(partitionCount) * float64(replicaCount) * (float64(n.capacity) / float64(totalCapacity))
+		desiredPartitionCount := float64(partitionCount) * replicasPerPartition * (float64(n.capacity) / float64(totalCapacity))
 		under := (desiredPartitionCount - float64(int(desiredPartitionCount))) / desiredPartitionCount
 		over := float64(0)
 		if desiredPartitionCount > float64(int(desiredPartitionCount)) {
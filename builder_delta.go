@@ -0,0 +1,386 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+)
+
+// deltaFormatVersion is the version of the delta records written by
+// PersistDelta; ApplyDelta can read this version and all earlier versions.
+const deltaFormatVersion = 1
+
+// _MAX_BUILDER_DELTAS is the most version changes a Builder keeps in its
+// history of deltas; see Builder.PersistDelta.
+const _MAX_BUILDER_DELTAS = 64
+
+// builderDelta records the assignment changes made by one version change of
+// a Builder; see Builder.PersistDelta.
+type builderDelta struct {
+	fromVersion       int64
+	toVersion         int64
+	replicaCount      int
+	partitionBitCount uint16
+	// full indicates the replica or partition count changed and entries
+	// holds every assignment rather than just the changed ones.
+	full    bool
+	entries []deltaEntry
+	// stability is the fraction of assignments left unchanged; it is not
+	// persisted.
+	stability float64
+}
+
+// deltaEntry is a single assignment; a nodeID of 0 indicates the replica is
+// unassigned.
+type deltaEntry struct {
+	replica   int32
+	partition uint32
+	nodeID    uint64
+}
+
+// resetDeltaBase records the Builder's current assignments as the base the
+// next delta is computed against.
+func (b *Builder) resetDeltaBase() {
+	b.deltaBaseNodeIDs = make([]uint64, len(b.nodes))
+	for i, n := range b.nodes {
+		b.deltaBaseNodeIDs[i] = n.id
+	}
+	b.deltaBase = make([][]int32, len(b.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		b.deltaBase[replica] = make([]int32, len(partitionToNodeIndex))
+		copy(b.deltaBase[replica], partitionToNodeIndex)
+	}
+}
+
+// recordDelta adds the assignment changes since the delta base to the
+// Builder's history as the change from the version given to the current
+// version, and then resets the delta base.
+func (b *Builder) recordDelta(fromVersion int64) {
+	d := &builderDelta{
+		fromVersion:       fromVersion,
+		toVersion:         b.version,
+		replicaCount:      len(b.replicaToPartitionToNodeIndex),
+		partitionBitCount: b.partitionBitCount,
+	}
+	d.full = len(b.deltaBase) != d.replicaCount || len(b.deltaBase[0]) != len(b.replicaToPartitionToNodeIndex[0])
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for partition, nodeIndex := range partitionToNodeIndex {
+			var nodeID uint64
+			if nodeIndex >= 0 {
+				nodeID = b.nodes[nodeIndex].id
+			}
+			if !d.full {
+				var baseNodeID uint64
+				if baseNodeIndex := b.deltaBase[replica][partition]; baseNodeIndex >= 0 {
+					baseNodeID = b.deltaBaseNodeIDs[baseNodeIndex]
+				}
+				if nodeID == baseNodeID {
+					continue
+				}
+			}
+			d.entries = append(d.entries, deltaEntry{replica: int32(replica), partition: uint32(partition), nodeID: nodeID})
+		}
+	}
+	d.stability = b.deltaStability(d.entries, d.full)
+	b.deltas = append(b.deltas, d)
+	b.trimDeltas()
+	b.resetDeltaBase()
+}
+
+// trimDeltas drops the oldest deltas from the Builder's history, keeping the
+// latest delta and as many before it as fit within _MAX_BUILDER_DELTAS
+// version changes and, in all, no more entries than there are assignments.
+// The history thereby takes no more memory than a copy of the assignments.
+func (b *Builder) trimDeltas() {
+	slots := len(b.replicaToPartitionToNodeIndex) * len(b.replicaToPartitionToNodeIndex[0])
+	start := len(b.deltas) - 1
+	entries := len(b.deltas[start].entries)
+	for start > 0 && len(b.deltas)-start < _MAX_BUILDER_DELTAS && entries+len(b.deltas[start-1].entries) <= slots {
+		start--
+		entries += len(b.deltas[start].entries)
+	}
+	if start > 0 {
+		b.deltas = append([]*builderDelta(nil), b.deltas[start:]...)
+	}
+}
+
+// deltaStability returns the fraction of the current assignments unchanged
+// from the delta base, given the entries of a delta against it. For a full
+// delta each partition is compared with the partition it was split from,
+// should the partition count have grown. Unassigned replicas are left out
+// entirely, neither counted as changed nor as unchanged.
+func (b *Builder) deltaStability(entries []deltaEntry, full bool) float64 {
+	slots := 0
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				slots++
+			}
+		}
+	}
+	if slots == 0 {
+		return 1
+	}
+	if !full {
+		changed := 0
+		for _, e := range entries {
+			if e.nodeID != 0 {
+				changed++
+			}
+		}
+		return 1 - float64(changed)/float64(slots)
+	}
+	var shift uint
+	basePartitionCount := len(b.deltaBase[0])
+	for basePartitionCount<<shift < len(b.replicaToPartitionToNodeIndex[0]) {
+		shift++
+	}
+	if basePartitionCount<<shift != len(b.replicaToPartitionToNodeIndex[0]) {
+		return 0
+	}
+	unchanged := 0
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		if replica >= len(b.deltaBase) {
+			break
+		}
+		for partition, nodeIndex := range partitionToNodeIndex {
+			baseNodeIndex := b.deltaBase[replica][partition>>shift]
+			if nodeIndex >= 0 && baseNodeIndex >= 0 && b.nodes[nodeIndex].id == b.deltaBaseNodeIDs[baseNodeIndex] {
+				unchanged++
+			}
+		}
+	}
+	return float64(unchanged) / float64(slots)
+}
+
+// PersistDelta writes the assignment changes made since the version given,
+// one checksummed record per version change. The records are independent, so
+// the output of successive calls may be appended to the same log and later
+// replayed with ApplyDelta to bring a copy of the Builder up to date without
+// writing the full Builder each time.
+//
+// Only the partition assignments are included; node additions, removals, and
+// other settings must be applied to the copy separately, before the deltas
+// that refer to them.
+//
+// The history of changes is kept only in memory: it is not persisted with the
+// Builder, so a Builder from LoadBuilder starts with no history, and only the
+// most recent changes are kept, up to 64 version changes and in all no more
+// changed assignments than the ring has. An error is returned if the version
+// given is older than the history goes back; the full Builder must be copied
+// over instead. Note that computing the changes also keeps a copy of the
+// assignments as of the current version.
+func (b *Builder) PersistDelta(w io.Writer, sinceVersion int64) error {
+	start := b.version
+	if len(b.deltas) > 0 {
+		start = b.deltas[0].fromVersion
+	}
+	if sinceVersion < start {
+		return fmt.Errorf("changes since version %d are not available; history starts at version %d", sinceVersion, start)
+	}
+	for _, d := range b.deltas {
+		if d.toVersion <= sinceVersion {
+			continue
+		}
+		if err := d.persist(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *builderDelta) persist(w io.Writer) error {
+	if len(d.entries) > math.MaxInt32 {
+		return fmt.Errorf("%d delta entries is too many; max is %d", len(d.entries), math.MaxInt32)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("RINGDELTAv%04d", deltaFormatVersion))
+	binary.Write(buf, binary.BigEndian, d.fromVersion)
+	binary.Write(buf, binary.BigEndian, d.toVersion)
+	binary.Write(buf, binary.BigEndian, int32(d.replicaCount))
+	binary.Write(buf, binary.BigEndian, d.partitionBitCount)
+	tf := byte(0)
+	if d.full {
+		tf = 1
+	}
+	buf.WriteByte(tf)
+	binary.Write(buf, binary.BigEndian, int32(len(d.entries)))
+	for _, e := range d.entries {
+		binary.Write(buf, binary.BigEndian, e.replica)
+		binary.Write(buf, binary.BigEndian, e.partition)
+		binary.Write(buf, binary.BigEndian, e.nodeID)
+	}
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// loadDelta reads a delta record, returning io.EOF if there are no more.
+func loadDelta(r io.Reader) (*builderDelta, error) {
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	header := make([]byte, 14)
+	_, err := io.ReadFull(tr, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:10]) != "RINGDELTAv" {
+		return nil, fmt.Errorf("unknown delta header %s", string(header))
+	}
+	formatVersion, err := strconv.Atoi(string(header[10:]))
+	if err != nil || formatVersion < 1 || formatVersion > deltaFormatVersion {
+		return nil, fmt.Errorf("unknown delta header %s", string(header))
+	}
+	d := &builderDelta{}
+	err = binary.Read(tr, binary.BigEndian, &d.fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(tr, binary.BigEndian, &d.toVersion)
+	if err != nil {
+		return nil, err
+	}
+	var vint32 int32
+	err = binary.Read(tr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	d.replicaCount = int(vint32)
+	err = binary.Read(tr, binary.BigEndian, &d.partitionBitCount)
+	if err != nil {
+		return nil, err
+	}
+	tf := byte(0)
+	err = binary.Read(tr, binary.BigEndian, &tf)
+	if err != nil {
+		return nil, err
+	}
+	d.full = tf == 1
+	err = binary.Read(tr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	if vint32 < 0 {
+		return nil, fmt.Errorf("invalid delta entry count %d", vint32)
+	}
+	d.entries = make([]deltaEntry, vint32)
+	for i := range d.entries {
+		err = binary.Read(tr, binary.BigEndian, &d.entries[i].replica)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(tr, binary.BigEndian, &d.entries[i].partition)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(tr, binary.BigEndian, &d.entries[i].nodeID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum := crc.Sum32()
+	var checksum uint32
+	err = binary.Read(r, binary.BigEndian, &checksum)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != sum {
+		return nil, fmt.Errorf("delta record for version %d has checksum %08x instead of %08x", d.toVersion, checksum, sum)
+	}
+	return d, nil
+}
+
+// ApplyDelta reads delta records written by PersistDelta and applies them in
+// order to the Builder's assignments. Records for versions the Builder
+// already has are skipped, so a whole log may be replayed; an error is
+// returned if a record doesn't follow on from the Builder's current version,
+// if its checksum doesn't match, or if it refers to a node the Builder
+// doesn't have. Records before the one in error will have been applied.
+func (b *Builder) ApplyDelta(r io.Reader) error {
+	if err := b.beginBuild(); err != nil {
+		return err
+	}
+	defer b.endBuild()
+	if b.frozen {
+		return ErrBuilderFrozen
+	}
+	for {
+		d, err := loadDelta(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.toVersion <= b.version {
+			continue
+		}
+		if d.fromVersion != b.version {
+			return fmt.Errorf("delta from version %d does not apply to version %d", d.fromVersion, b.version)
+		}
+		if err = b.applyDelta(d); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Builder) applyDelta(d *builderDelta) error {
+	if d.replicaCount < 1 || d.partitionBitCount > 31 {
+		return fmt.Errorf("delta for version %d has invalid replica count %d or partition bit count %d", d.toVersion, d.replicaCount, d.partitionBitCount)
+	}
+	partitionCount := 1 << d.partitionBitCount
+	if d.full && len(d.entries) != d.replicaCount*partitionCount {
+		return fmt.Errorf("delta for version %d has %d entries instead of %d", d.toVersion, len(d.entries), d.replicaCount*partitionCount)
+	}
+	if !d.full && (d.replicaCount != len(b.replicaToPartitionToNodeIndex) || d.partitionBitCount != b.partitionBitCount) {
+		return fmt.Errorf("delta for version %d does not match the replica and partition counts", d.toVersion)
+	}
+	idToNodeIndex := make(map[uint64]int32, len(b.nodes))
+	for i, n := range b.nodes {
+		idToNodeIndex[n.id] = int32(i)
+	}
+	nodeIndexes := make([]int32, len(d.entries))
+	for i, e := range d.entries {
+		if e.replica < 0 || int(e.replica) >= d.replicaCount || e.partition >= uint32(partitionCount) {
+			return fmt.Errorf("delta for version %d has an invalid entry for replica %d partition %d", d.toVersion, e.replica, e.partition)
+		}
+		nodeIndexes[i] = -1
+		if e.nodeID != 0 {
+			nodeIndex, ok := idToNodeIndex[e.nodeID]
+			if !ok {
+				return fmt.Errorf("delta for version %d refers to unknown node %016x", d.toVersion, e.nodeID)
+			}
+			nodeIndexes[i] = nodeIndex
+		}
+	}
+	if d.full {
+		// The move wait times aren't carried in deltas, so partitions are
+		// treated as not having moved recently.
+		b.replicaToPartitionToNodeIndex = make([][]int32, d.replicaCount)
+		b.replicaToPartitionToLastMove = make([][]uint16, d.replicaCount)
+		for replica := 0; replica < d.replicaCount; replica++ {
+			b.replicaToPartitionToNodeIndex[replica] = make([]int32, partitionCount)
+			b.replicaToPartitionToLastMove[replica] = make([]uint16, partitionCount)
+			for partition := 0; partition < partitionCount; partition++ {
+				b.replicaToPartitionToLastMove[replica][partition] = math.MaxUint16
+			}
+		}
+		b.partitionBitCount = d.partitionBitCount
+		if len(b.replicaCountRanges) == 0 {
+			b.replicaCount = d.replicaCount
+		}
+	}
+	for i, e := range d.entries {
+		b.replicaToPartitionToNodeIndex[e.replica][e.partition] = nodeIndexes[i]
+		if !d.full {
+			b.replicaToPartitionToLastMove[e.replica][e.partition] = 0
+		}
+	}
+	b.version = d.toVersion
+	b.recordDelta(d.fromVersion)
+	return nil
+}
@@ -0,0 +1,84 @@
+package ring
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuilderDelta(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	for i := 0; i < 4; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	b.Ring()
+	buf := &bytes.Buffer{}
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &bytes.Buffer{}
+	since := b.Version()
+	for i := 0; i < 3; i++ {
+		// Node changes are carried over separately; the deltas only hold the
+		// assignments.
+		n, _ := b.AddNode(true, uint32(i+2), nil, nil, "", nil)
+		b2.AddNodeWithID(n.ID(), true, uint32(i+2), nil, nil, "", nil)
+		b.PretendElapsed(60)
+		b.Ring()
+		if err = b.PersistDelta(log, since); err != nil {
+			t.Fatal(err)
+		}
+		since = b.Version()
+	}
+	b.SetReplicaCount(2)
+	b.Ring()
+	if err = b.PersistDelta(log, since); err != nil {
+		t.Fatal(err)
+	}
+	logBytes := log.Bytes()
+	if err = b2.ApplyDelta(bytes.NewReader(logBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if b2.Version() != b.Version() {
+		t.Fatalf("applied delta gave version %d instead of %d", b2.Version(), b.Version())
+	}
+	if !reflect.DeepEqual(b2.AssignmentMap(), b.AssignmentMap()) {
+		t.Fatal("applied delta didn't reproduce the assignments")
+	}
+	// Replaying the whole log skips the records already applied.
+	if err = b2.ApplyDelta(bytes.NewReader(logBytes)); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupted record is rejected.
+	b3 := NewBuilder()
+	corrupt := &bytes.Buffer{}
+	b.PersistDelta(corrupt, b.Version()-1)
+	corruptBytes := corrupt.Bytes()
+	corruptBytes[len(corruptBytes)-5] ^= 0xff
+	if err = b3.ApplyDelta(bytes.NewReader(corruptBytes)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("corrupted delta should've given a checksum error; gave %v", err)
+	}
+	if err = b2.PersistDelta(&bytes.Buffer{}, 0); err == nil {
+		t.Fatal("delta from before the history should've given an error")
+	}
+	// Only the most recent history is kept.
+	since = b.Version()
+	for i := 0; i < _MAX_BUILDER_DELTAS+1; i++ {
+		b.SetVersion(b.Version() + 1)
+	}
+	if len(b.deltas) != _MAX_BUILDER_DELTAS {
+		t.Fatalf("history kept %d deltas instead of %d", len(b.deltas), _MAX_BUILDER_DELTAS)
+	}
+	if err = b.PersistDelta(&bytes.Buffer{}, since); err == nil {
+		t.Fatal("delta from before the trimmed history should've given an error")
+	}
+	if err = b.PersistDelta(&bytes.Buffer{}, b.Version()-1); err != nil {
+		t.Fatal(err)
+	}
+}
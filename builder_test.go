@@ -2,14 +2,25 @@ package ring
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewBuilder(t *testing.T) {
 	b := NewBuilder()
 	b.SetReplicaCount(3)
 	b.AddNode(true, 1, nil, nil, "", []byte("nodeconf"))
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
 	pa := b.PointsAllowed()
 	if pa != 1 {
 		t.Fatalf("NewBuilder's PointsAllowed was %d not 1", pa)
@@ -19,24 +30,26 @@ func TestNewBuilder(t *testing.T) {
 	if pa != 10 {
 		t.Fatalf("NewBuilder's PointsAllowed was %d not 10", pa)
 	}
-	rc := b.Ring().ReplicaCount()
+	r, _ := b.Ring()
+	rc := r.ReplicaCount()
 	if rc != 3 {
 		t.Fatalf("NewBuilder's ReplicaCount was %d not 3", rc)
 	}
-	u16 := b.Ring().PartitionBitCount()
+	u16 := r.PartitionBitCount()
 	if u16 != 1 {
 		t.Fatalf("NewBuilder's PartitionBitCount was %d not 1", u16)
 	}
-	n := b.Ring().Nodes()
-	if len(n) != 1 {
-		t.Fatalf("NewBuilder's Nodes count was %d not 1", len(n))
+	n := r.Nodes()
+	if len(n) != 3 {
+		t.Fatalf("NewBuilder's Nodes count was %d not 3", len(n))
 	}
 	b.SetConf([]byte("testconf"))
 	c := b.Conf()
 	if !bytes.Equal(c, []byte("testconf")) {
 		t.Fatalf("NewBuilder's Conf %v was not %v", c, []byte("testconf"))
 	}
-	c = b.Ring().Nodes()[0].Conf()
+	r, _ = b.Ring()
+	c = r.Nodes()[0].Conf()
 	if !bytes.Equal(c, []byte("nodeconf")) {
 		t.Fatalf("NewBuilder's Nodes Conf %v was not %v", c, []byte("nodeconf"))
 	}
@@ -143,6 +156,37 @@ func helperTestBuilderPersistence(t *testing.T, conf []byte) {
 	}
 }
 
+func TestBuilderLoadFormatVersion1(t *testing.T) {
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.SetNodeRampUp(b.Nodes()[0].ID(), time.Hour)
+	b.Ring()
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(raw, []byte("RINGBUILDERv0001"))
+	buf.Reset()
+	gw := gzip.NewWriter(buf)
+	gw.Write(raw)
+	gw.Close()
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b2.Nodes()) != 1 || len(b2.rampUps) != 0 {
+		t.Fatalf("format version 1 load gave %d nodes and %d ramp ups", len(b2.Nodes()), len(b2.rampUps))
+	}
+}
+
 func TestBuilderLoadGarbage(t *testing.T) {
 	b, err := LoadBuilder(bytes.NewBuffer([]byte{
 		0, 1, 2, 3, 4, 5, 6, 7, 8, 9,
@@ -158,39 +202,98 @@ func TestBuilderLoadGarbage(t *testing.T) {
 
 func TestBuilderAddRemoveNodes(t *testing.T) {
 	b := NewBuilder()
-	b.SetReplicaCount(3)
-	nA := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	nB := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	b.SetReplicaCount(2)
+	nA, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	nB, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	nC, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n := r.Nodes()
-	if len(n) != 2 {
-		t.Fatalf("Ring had %d nodes instead of 2", len(n))
+	if len(n) != 3 {
+		t.Fatalf("Ring had %d nodes instead of 3", len(n))
 	}
 	b.RemoveNode(nA.ID())
-	r = b.Ring()
+	r, _ = b.Ring()
 	n = r.Nodes()
-	if len(n) != 1 {
-		t.Fatalf("Ring had %d nodes instead of 1", len(n))
+	if len(n) != 2 {
+		t.Fatalf("Ring had %d nodes instead of 2", len(n))
 	}
 	pc := uint32(1) << r.PartitionBitCount()
 	for p := uint32(0); p < pc; p++ {
 		n = r.ResponsibleNodes(p)
-		if len(n) != 3 {
-			t.Fatalf("Supposed to get 3 replicas, got %d", len(n))
+		if len(n) != 2 {
+			t.Fatalf("Supposed to get 2 replicas, got %d", len(n))
 		}
-		if n[0].ID() != nB.ID() ||
-			n[1].ID() != nB.ID() ||
-			n[2].ID() != nB.ID() {
-			t.Fatalf("Supposed only have node id:2 and got %#v %#v %#v", n[0], n[1], n[2])
+		if !(n[0].ID() == nB.ID() && n[1].ID() == nC.ID()) &&
+			!(n[0].ID() == nC.ID() && n[1].ID() == nB.ID()) {
+			t.Fatalf("Supposed to have nodes %d and %d and got %#v %#v", nB.ID(), nC.ID(), n[0], n[1])
 		}
 	}
+	b.RemoveNode(nB.ID())
+	if _, err := b.Ring(); err != ErrInsufficientNodes {
+		t.Fatalf("Ring with fewer active nodes than replicas gave %v", err)
+	}
+}
+
+func TestBuilderAddNodeWithID(t *testing.T) {
+	b := NewBuilder()
+	if err := b.AddNodeWithID(0, true, 1, nil, nil, "", nil); err == nil {
+		t.Fatal("AddNodeWithID(0) should have given an error")
+	}
+	if err := b.AddNodeWithID(123, true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.Node(123); n == nil || n.ID() != 123 || n.Capacity() != 1 {
+		t.Fatalf("Node lookup should've given id:123 but instead gave %#v", n)
+	}
+	if err := b.AddNodeWithID(123, true, 1, nil, nil, "", nil); err == nil {
+		t.Fatal("AddNodeWithID(123) should have given an error for an existing id")
+	}
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.RemoveNode(nA.ID())
+	if err := b.AddNodeWithID(nA.ID(), true, 1, nil, nil, "", nil); err == nil {
+		t.Fatal("AddNodeWithID should have given an error for a tombstoned id")
+	}
+	if r, _ := b.Ring(); len(r.Nodes()) != 1 {
+		t.Fatal("Ring should have had just 1 node")
+	}
+}
+
+func TestBuilderTombstonedNodeIDs(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	before := time.Now()
+	b.RemoveNode(nB.ID())
+	b.RemoveNode(nA.ID())
+	if ids := b.TombstonedNodeIDs(); len(ids) != 2 || ids[0] != nB.ID() || ids[1] != nA.ID() {
+		t.Fatalf("TombstonedNodeIDs gave %v", ids)
+	}
+	buf := bytes.NewBuffer(nil)
+	b.Persist(buf)
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) {
+		t.Fatal("tombstones were not persisted")
+	}
+	if err = b2.AddNodeWithID(nA.ID(), true, 1, nil, nil, "", nil); err == nil {
+		t.Fatal("AddNodeWithID should have given an error for an id tombstoned before reloading")
+	}
+	if tm := b2.TombstoneTime(nA.ID()); tm.Before(before) || tm.After(time.Now()) {
+		t.Fatalf("TombstoneTime gave %v", tm)
+	}
+	if tm := b2.TombstoneTime(123); !tm.IsZero() {
+		t.Fatalf("TombstoneTime for a live id gave %v", tm)
+	}
 }
 
 func TestBuilderNodeLookup(t *testing.T) {
 	b := NewBuilder()
 	b.SetReplicaCount(3)
-	nA := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	nB := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	nA, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	nB, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
 	n := b.Node(nA.ID())
 	if n.ID() != nA.ID() {
 		t.Fatalf("Node lookup should've given id:1 but instead gave %#v", n)
@@ -207,10 +310,10 @@ func TestBuilderNodeLookup(t *testing.T) {
 
 func TestBuilderRing(t *testing.T) {
 	b := NewBuilder()
-	b.SetReplicaCount(3)
-	nA := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	b.SetReplicaCount(2)
+	nA, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	n := r.LocalNode()
 	if n != nil {
 		t.Fatalf("Ring() should've returned an unbound ring; instead LocalNode gave %#v", n)
@@ -226,7 +329,7 @@ func TestBuilderRing(t *testing.T) {
 	}
 	// Make sure a new Ring call doesn't alter the previous Ring.
 	b.AddNode(true, 3, nil, nil, "", []byte("Conf"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	r2.SetLocalNode(nA.ID())
 	pbc = r2.PartitionBitCount()
 	if pbc == 1 {
@@ -246,31 +349,146 @@ func TestBuilderRing(t *testing.T) {
 	}
 }
 
-func TestBuilderResizeIfNeeded(t *testing.T) {
+func TestBuilderAssignmentMap(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	m := b.AssignmentMap()
+	if len(m) != 1<<r.PartitionBitCount() {
+		t.Fatalf("AssignmentMap gave %d partitions instead of %d", len(m), 1<<r.PartitionBitCount())
+	}
+	for p, ids := range m {
+		ns := r.ResponsibleNodes(p)
+		if len(ids) != 2 || ids[0] != ns[0].ID() || ids[1] != ns[1].ID() {
+			t.Fatalf("AssignmentMap gave %v for partition %d", ids, p)
+		}
+	}
+	m[0][0] = 0
+	if b.AssignmentMap()[0][0] == 0 {
+		t.Fatal("AssignmentMap did not return a copy")
+	}
+	b.RemoveNode(nA.ID())
+	for p, ids := range b.AssignmentMap() {
+		for _, id := range ids {
+			if id != 0 && id != nB.ID() {
+				t.Fatalf("AssignmentMap gave %v for partition %d", ids, p)
+			}
+		}
+	}
+}
+
+func TestBuilderTargetPartitions(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 3, nil, nil, "", nil)
+	nC, _ := b.AddNode(false, 5, nil, nil, "", nil)
+	if b.TotalCapacity() != 4 {
+		t.Fatalf("TotalCapacity gave %d", b.TotalCapacity())
+	}
+	r, _ := b.Ring()
+	all := 1 << r.PartitionBitCount()
+	if b.TargetPartitions(nA.ID()) != all/4 || b.TargetPartitions(nB.ID()) != all*3/4 {
+		t.Fatalf("TargetPartitions gave %d and %d of %d", b.TargetPartitions(nA.ID()), b.TargetPartitions(nB.ID()), all)
+	}
+	if b.TargetPartitions(nC.ID()) != 0 || b.TargetPartitions(12345) != 0 {
+		t.Fatal("TargetPartitions should be 0 for inactive and unknown nodes")
+	}
+	counts := make(map[uint64]int)
+	for _, ids := range b.AssignmentMap() {
+		for _, id := range ids {
+			counts[id]++
+		}
+	}
+	if counts[nA.ID()] != b.TargetPartitions(nA.ID()) || counts[nB.ID()] != b.TargetPartitions(nB.ID()) {
+		t.Fatalf("assignments %v do not match targets", counts)
+	}
+}
+
+func TestBuilderNodeRampUp(t *testing.T) {
 	b := NewBuilder()
 	b.SetReplicaCount(3)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.Ring()
+	b.PretendElapsed(math.MaxUint16)
+	nD, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.SetNodeRampUp(nD.ID(), time.Hour)
+	count := func(r Ring) int {
+		c := 0
+		for p := uint32(1<<r.PartitionBitCount()) - 1; ; p-- {
+			for _, n := range r.ResponsibleNodes(p) {
+				if n.ID() == nD.ID() {
+					c++
+				}
+			}
+			if p == 0 {
+				return c
+			}
+		}
+	}
+	r, _ := b.Ring()
+	full := (1 << r.PartitionBitCount()) * 3 / 4
+	if c := count(r); c != 0 {
+		t.Fatalf("Ramping node had %d partitions instead of 0", c)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b2.rampUps) != 1 || *b2.rampUps[0] != *b.rampUps[0] {
+		t.Fatalf("Ramp ups did not persist: %v", b2.rampUps)
+	}
+	b.rampUps[0].start -= int64(30 * time.Minute)
+	b.PretendElapsed(math.MaxUint16)
+	r, _ = b.Ring()
+	if c := count(r); c < full/4 || c >= full {
+		t.Fatalf("Half ramped node had %d partitions; full share is %d", c, full)
+	}
+	b.rampUps[0].start -= int64(30 * time.Minute)
+	b.PretendElapsed(math.MaxUint16)
+	r, _ = b.Ring()
+	if len(b.rampUps) != 0 {
+		t.Fatal("Completed ramp up was not discarded")
+	}
+	b.PretendElapsed(math.MaxUint16)
+	r, _ = b.Ring()
+	if c := count(r); c < full*9/10 {
+		t.Fatalf("Fully ramped node had %d partitions; full share is %d", c, full)
+	}
+}
+
+func TestBuilderResizeIfNeeded(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	pbc := r.PartitionBitCount()
 	if pbc != 1 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 1", pbc)
 	}
-	nC := b.AddNode(false, 3, nil, nil, "", []byte("Conf"))
-	r = b.Ring()
+	nC, _ := b.AddNode(false, 3, nil, nil, "", []byte("Conf"))
+	r, _ = b.Ring()
 	pbc = r.PartitionBitCount()
 	if pbc != 1 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 1", pbc)
 	}
 	nC.SetActive(true)
-	r = b.Ring()
+	r, _ = b.Ring()
 	pbc = r.PartitionBitCount()
 	if pbc != 4 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 4", pbc)
 	}
 	// Test that shrinking does not happen (at least for now).
 	b.RemoveNode(nC.ID())
-	r = b.Ring()
+	r, _ = b.Ring()
 	pbc = r.PartitionBitCount()
 	if pbc != 4 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 4", pbc)
@@ -288,14 +506,14 @@ func TestBuilderResizeIfNeeded(t *testing.T) {
 	for i := 4; i < 14; i++ {
 		b.AddNode(true, uint32(i), nil, nil, "", []byte("Conf"))
 	}
-	r = b.Ring()
+	r, _ = b.Ring()
 	pbc = r.PartitionBitCount()
 	if pbc != 6 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 6", pbc)
 	}
 	// Just exercises the "already at max" short-circuit.
 	b.AddNode(true, 14, nil, nil, "", []byte("Conf"))
-	r = b.Ring()
+	r, _ = b.Ring()
 	pbc = r.PartitionBitCount()
 	if pbc != 6 {
 		t.Fatalf("Ring's PartitionBitCount was %d and should've been 6", pbc)
@@ -304,7 +522,7 @@ func TestBuilderResizeIfNeeded(t *testing.T) {
 
 func TestBuilderMinimizeTiers(t *testing.T) {
 	b := NewBuilder()
-	n := b.AddNode(true, 1, []string{"one"}, nil, "", []byte("Conf"))
+	n, _ := b.AddNode(true, 1, []string{"one"}, nil, "", []byte("Conf"))
 	b.AddNode(true, 1, []string{"two"}, nil, "", []byte("Conf"))
 	b.minimizeTiers()
 	if len(b.tiers) != 1 {
@@ -411,9 +629,9 @@ func TestBuilderLowerReplicaCount(t *testing.T) {
 func TestVersionChangesWithNewActiveWeightedNode(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -422,9 +640,9 @@ func TestVersionChangesWithNewActiveWeightedNode(t *testing.T) {
 func TestVersionChangesWithNewActiveNoWeightNode(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	b.AddNode(true, 0, nil, nil, "", []byte("Conf"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -433,9 +651,9 @@ func TestVersionChangesWithNewActiveNoWeightNode(t *testing.T) {
 func TestVersionChangesWithNewInactiveNode(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	b.AddNode(false, 0, nil, nil, "", []byte("Conf"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -444,10 +662,10 @@ func TestVersionChangesWithNewInactiveNode(t *testing.T) {
 func TestVersionChangesWithNodeRemoval(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	b.RemoveNode(n.ID())
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -456,9 +674,9 @@ func TestVersionChangesWithNodeRemoval(t *testing.T) {
 func TestVersionChangesWithConfChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	r, _ := b.Ring()
 	b.SetConf([]byte("testing"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -467,9 +685,11 @@ func TestVersionChangesWithConfChange(t *testing.T) {
 func TestVersionChangesWithReplicaCountChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	b.SetReplicaCount(3)
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -478,10 +698,10 @@ func TestVersionChangesWithReplicaCountChange(t *testing.T) {
 func TestVersionChangesWithNodeActiveChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetActive(false)
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -490,10 +710,10 @@ func TestVersionChangesWithNodeActiveChange(t *testing.T) {
 func TestVersionChangesWithNodeCapacityChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetCapacity(2)
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -502,10 +722,10 @@ func TestVersionChangesWithNodeCapacityChange(t *testing.T) {
 func TestVersionChangesWithNodeTierChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetTier(0, "testing")
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -514,10 +734,10 @@ func TestVersionChangesWithNodeTierChange(t *testing.T) {
 func TestVersionChangesWithNodeAddressChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetAddress(0, "1.2.3.4")
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -526,10 +746,10 @@ func TestVersionChangesWithNodeAddressChange(t *testing.T) {
 func TestVersionChangesWithNodeMetaChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetMeta("testing")
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
@@ -538,11 +758,984 @@ func TestVersionChangesWithNodeMetaChange(t *testing.T) {
 func TestVersionChangesWithNodeConfChange(t *testing.T) {
 	b := NewBuilder()
 	b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	n := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
-	r := b.Ring()
+	n, _ := b.AddNode(true, 1, nil, nil, "", []byte("Conf"))
+	r, _ := b.Ring()
 	n.SetConf([]byte("testing"))
-	r2 := b.Ring()
+	r2, _ := b.Ring()
 	if r.Version() == r2.Version() {
 		t.Fatal("")
 	}
 }
+
+func TestBuilderFreeze(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	b.Freeze()
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != ErrBuilderFrozen {
+		t.Fatalf("AddNode gave %v", err)
+	}
+	if err := b.AddNodeWithID(123, true, 1, nil, nil, "", nil); err != ErrBuilderFrozen {
+		t.Fatalf("AddNodeWithID gave %v", err)
+	}
+	if err := b.RemoveNode(nA.ID()); err != ErrBuilderFrozen {
+		t.Fatalf("RemoveNode gave %v", err)
+	}
+	if err := b.SetReplicaCount(3); err != ErrBuilderFrozen {
+		t.Fatalf("SetReplicaCount gave %v", err)
+	}
+	if _, err := b.Ring(); err != ErrBuilderFrozen {
+		t.Fatalf("Ring gave %v", err)
+	}
+	if len(b.Nodes()) != 1 || b.ReplicaCount() != 1 {
+		t.Fatal("frozen Builder was changed")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b2.Frozen() {
+		t.Fatal("frozen state was not persisted")
+	}
+	b2.Unfreeze()
+	b2.AddNode(true, 1, nil, nil, "", nil)
+	b2.AddNode(true, 1, nil, nil, "", nil)
+	if err := b2.SetReplicaCount(3); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := b2.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.ReplicaCount() != 3 || r2.Version() == r.Version() {
+		t.Fatalf("unfrozen Ring gave %d replicas and version %d", r2.ReplicaCount(), r2.Version())
+	}
+}
+
+func TestBuilderBuildWithReport(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 4; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	b.AddNode(false, 1, nil, nil, "", nil)
+	r, report, err := b.BuildWithReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := r.ReplicaCount() << r.PartitionBitCount()
+	if report.PartitionsMoved != all || report.NodesConsidered != 4 {
+		t.Fatalf("first build gave %d moved and %d considered; expected %d and 4", report.PartitionsMoved, report.NodesConsidered, all)
+	}
+	total := 0
+	for _, delta := range report.NodeDeltas {
+		total += delta
+	}
+	if total != all {
+		t.Fatalf("first build deltas %v did not total %d", report.NodeDeltas, all)
+	}
+	n, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.PretendElapsed(math.MaxUint16)
+	r, report, err = b.BuildWithReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PartitionsMoved == 0 || report.NodeDeltas[n.ID()] != report.PartitionsMoved {
+		t.Fatalf("adding a node gave %d moved and deltas %v", report.PartitionsMoved, report.NodeDeltas)
+	}
+	total = 0
+	for _, delta := range report.NodeDeltas {
+		total += delta
+	}
+	if total != 0 {
+		t.Fatalf("deltas %v should have totaled 0", report.NodeDeltas)
+	}
+}
+
+func TestBuilderNodeIDs(t *testing.T) {
+	b := NewBuilder()
+	b.AddNodeWithID(3, true, 1, nil, nil, "", nil)
+	b.AddNodeWithID(1, false, 1, nil, nil, "", nil)
+	b.AddNodeWithID(2, true, 1, nil, nil, "", nil)
+	if v := b.NodeIDs(true); len(v) != 3 || v[0] != 1 || v[1] != 2 || v[2] != 3 {
+		t.Fatalf("NodeIDs(true) gave %v instead of [1 2 3]", v)
+	}
+	if v := b.NodeIDs(false); len(v) != 2 || v[0] != 2 || v[1] != 3 {
+		t.Fatalf("NodeIDs(false) gave %v instead of [2 3]", v)
+	}
+}
+
+func TestBuilderReplicaCountValidation(t *testing.T) {
+	b := NewBuilder()
+	if err := b.SetReplicaCount(5); err != nil {
+		t.Fatalf("empty Builder gave %v", err)
+	}
+	// Nodes added after the count is set are checked when building.
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	if _, err := b.Ring(); err != ErrInsufficientNodes {
+		t.Fatalf("Ring with 2 active nodes for 5 replicas gave %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	if r, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	} else if v := r.ResponsibleNodes(0); len(v) != 5 {
+		t.Fatalf("ResponsibleNodes gave %v", v)
+	}
+	b = NewBuilder()
+	b.AddNode(true, 1, []string{"server1", "zone1"}, nil, "", nil)
+	b.AddNode(true, 1, []string{"server2", "zone1"}, nil, "", nil)
+	b.AddNode(false, 1, []string{"server3", "zone2"}, nil, "", nil)
+	if err := b.SetReplicaCount(3); err != ErrInsufficientNodes {
+		t.Fatalf("SetReplicaCount(3) with 2 active nodes gave %v", err)
+	}
+	if b.ReplicaCount() != 1 {
+		t.Fatalf("failed SetReplicaCount changed the replica count to %d", b.ReplicaCount())
+	}
+	if err := b.SetReplicaCount(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetStrictTierSeparation(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Ring(); err != ErrInsufficientNodes {
+		t.Fatalf("Ring with only 1 active zone gave %v", err)
+	}
+	b.AddNode(true, 1, []string{"server4", "zone2"}, nil, "", nil)
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetReplicaCount(3); err != ErrInsufficientNodes {
+		t.Fatalf("SetReplicaCount(3) with 2 active zones gave %v", err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b2.StrictTierSeparation() {
+		t.Fatal("strict tier separation was not persisted")
+	}
+	b2.Freeze()
+	if err := b2.SetStrictTierSeparation(false); err != ErrBuilderFrozen {
+		t.Fatalf("SetStrictTierSeparation on a frozen builder gave %v", err)
+	}
+}
+
+func TestBuilderDrain(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.Ring()
+	count := func(nodeID uint64) int {
+		c := 0
+		for _, ids := range b.AssignmentMap() {
+			for _, id := range ids {
+				if id == nodeID {
+					c++
+				}
+			}
+		}
+		return c
+	}
+	b.Freeze()
+	if err := b.BeginDrain(nA.ID()); err != ErrBuilderFrozen {
+		t.Fatalf("BeginDrain on a frozen builder gave %v", err)
+	}
+	b.Unfreeze()
+	if err := b.BeginDrain(nA.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Draining(nA.ID()) {
+		t.Fatal("node was not draining")
+	}
+	// The partition count may grow, splitting each of the node's partitions.
+	partitions := len(b.AssignmentMap())
+	before := count(nA.ID())
+	if before == 0 {
+		t.Fatal("node had no partitions to begin with")
+	}
+	b.AddNode(true, 2, nil, nil, "", nil)
+	b.PretendElapsed(math.MaxUint16)
+	b.Ring()
+	before *= len(b.AssignmentMap()) / partitions
+	if c := count(nA.ID()); c != before {
+		t.Fatalf("draining node went from %d to %d partitions", before, c)
+	}
+	if err := b.CompleteDrain(nA.ID()); err == nil {
+		t.Fatal("CompleteDrain before ConfirmMigrated should have errored")
+	}
+	if err := b.ConfirmMigrated(123); err == nil {
+		t.Fatal("ConfirmMigrated for a node not draining should have errored")
+	}
+	b.Freeze()
+	if err := b.ConfirmMigrated(nA.ID()); err != ErrBuilderFrozen {
+		t.Fatalf("ConfirmMigrated on a frozen builder gave %v", err)
+	}
+	b.Unfreeze()
+	if err := b.ConfirmMigrated(nA.ID()); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Freeze()
+	if err = b.CompleteDrain(nA.ID()); err != ErrBuilderFrozen {
+		t.Fatalf("CompleteDrain on a frozen builder gave %v", err)
+	}
+	b.Unfreeze()
+	if err = b.CompleteDrain(nA.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if b.Draining(nA.ID()) || b.Node(nA.ID()).Active() {
+		t.Fatal("drained node was still draining or active")
+	}
+	b.Ring()
+	if c := count(nA.ID()); c != 0 {
+		t.Fatalf("drained node still had %d partitions", c)
+	}
+}
+
+func TestBuilderBuildStreaming(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	stream := func() (Ring, []MoveEvent) {
+		events := make(chan MoveEvent)
+		var moves []MoveEvent
+		done := make(chan struct{})
+		go func() {
+			for ev := range events {
+				moves = append(moves, ev)
+			}
+			close(done)
+		}()
+		r, err := b.BuildStreaming(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		return r, moves
+	}
+	r, moves := stream()
+	if len(moves) != 1<<r.PartitionBitCount() {
+		t.Fatalf("first build gave %d events for %d partitions", len(moves), 1<<r.PartitionBitCount())
+	}
+	countA := 0
+	for _, ev := range moves {
+		if ev.FromNode != 0 {
+			t.Fatalf("first build moved from node %d", ev.FromNode)
+		}
+		if ev.ToNode == nA.ID() {
+			countA++
+		}
+	}
+	nA.SetActive(false)
+	_, moves = stream()
+	if len(moves) != countA {
+		t.Fatalf("deactivation gave %d events instead of %d", len(moves), countA)
+	}
+	for _, ev := range moves {
+		if ev.FromNode != nA.ID() || ev.ToNode != nB.ID() {
+			t.Fatalf("deactivation gave %#v", ev)
+		}
+	}
+}
+
+func TestBuilderEqual(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"1.2.3.4:5"}, "meta", []byte("conf"))
+	b.AddNode(true, 2, []string{"server2", "zone2"}, nil, "", nil)
+	b.SetLabel("label")
+	b.Ring()
+	if !b.Equal(b) {
+		t.Fatal("Builder was not equal to itself")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) || !b2.Equal(b) {
+		t.Fatal("loaded Builder was not equal")
+	}
+	b2.Nodes()[1].(BuilderNode).SetTier(0, "server3")
+	if b.Equal(b2) {
+		t.Fatal("Builders with different tiers were equal")
+	}
+	b2.Nodes()[1].(BuilderNode).SetTier(0, "server2")
+	if !b.Equal(b2) {
+		t.Fatal("Builders with tiers restored were not equal")
+	}
+	b2.SetMoveWait(1)
+	if b.Equal(b2) {
+		t.Fatal("Builders with different settings were equal")
+	}
+	if b.Equal(nil) {
+		t.Fatal("Builder was equal to nil")
+	}
+}
+
+func TestBuilderVersion(t *testing.T) {
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.Ring()
+	v := b.Version()
+	if v == 0 {
+		t.Fatal("build did not set a version")
+	}
+	// A version ahead of the clock must still be exceeded by the next build.
+	future := time.Now().Add(time.Hour).UnixNano()
+	if err := b.SetVersion(future); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetVersion(v); err == nil {
+		t.Fatal("SetVersion to an older version should have errored")
+	}
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	if r.Version() != future+1 || b.Version() != future+1 {
+		t.Fatalf("build gave version %d after %d", r.Version(), future)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2.AddNode(true, 1, nil, nil, "", nil)
+	r2, _ := b2.Ring()
+	if r2.Version() <= r.Version() {
+		t.Fatalf("reloaded Builder gave version %d after %d", r2.Version(), r.Version())
+	}
+}
+
+func TestBuilderCapacityProvider(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	b.SetCapacityProvider(func(nodeID uint64) (uint32, error) {
+		if nodeID == nB.ID() {
+			return 0, errors.New("disk unavailable")
+		}
+		return 5, nil
+	})
+	b.Ring()
+	if nA.Capacity() != 5 {
+		t.Fatalf("provided capacity gave %d instead of 5", nA.Capacity())
+	}
+	if nB.Capacity() != 1 {
+		t.Fatalf("provider error should've kept capacity 1; gave %d", nB.Capacity())
+	}
+	if b.TotalCapacity() != 6 {
+		t.Fatalf("TotalCapacity gave %d instead of 6", b.TotalCapacity())
+	}
+}
+
+func TestBuilderConcurrentBuilds(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	for i := 0; i < 10; i++ {
+		b.AddNode(true, uint32(i+1), nil, nil, "", nil)
+	}
+	ids := b.NodeIDs(false)
+	var succeeded int32
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var err error
+				switch i % 6 {
+				case 0:
+					_, err = b.Ring()
+				case 1:
+					_, _, err = b.BuildWithReport()
+				case 2:
+					_, err = b.RepairReplication()
+				case 3:
+					var n BuilderNode
+					if n, err = b.AddNode(true, 1, nil, nil, "", nil); err == nil {
+						err = b.RemoveNode(n.ID())
+						for err == ErrBuildInProgress {
+							err = b.RemoveNode(n.ID())
+						}
+					}
+				case 4:
+					if err = b.SetReplicaCount(3); err == nil {
+						err = b.PretendElapsed(1)
+					}
+				case 5:
+					// Moves are often refused as invalid; only whether they
+					// race with the builds matters here.
+					if err = b.MovePartition(0, ids[0], ids[1]); err != ErrBuildInProgress {
+						err = nil
+					}
+				}
+				if err == nil {
+					atomic.AddInt32(&succeeded, 1)
+				} else if err != ErrBuildInProgress {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded == 0 {
+		t.Fatal("no build succeeded")
+	}
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuilderTierCost(t *testing.T) {
+	build := func(costFirst bool) (*Builder, Ring) {
+		b := NewBuilder()
+		b.SetReplicaCount(4)
+		for i := 0; i < 12; i++ {
+			b.AddNode(true, uint32(1+i%3), []string{fmt.Sprintf("server%d", i), fmt.Sprintf("region%d", i%2)}, nil, "", nil)
+		}
+		if costFirst {
+			b.SetTierCost(1, 1, 10)
+		}
+		b.Ring()
+		if !costFirst {
+			// The cost is only set for the stats; the move wait keeps the
+			// assignments from changing.
+			b.SetTierCost(1, 1, 10)
+		}
+		r, _ := b.Ring()
+		return b, r
+	}
+	_, plain := build(false)
+	b, costed := build(true)
+	if costed.Stats().PlacementCost >= plain.Stats().PlacementCost {
+		t.Fatalf("tier cost placement cost %v was not less than %v without", costed.Stats().PlacementCost, plain.Stats().PlacementCost)
+	}
+	if b.TierCost(0) != 0 || b.TierCost(1) != 10 {
+		t.Fatalf("TierCost gave %v and %v instead of 0 and 10", b.TierCost(0), b.TierCost(1))
+	}
+	buf := bytes.NewBuffer(nil)
+	b.Persist(buf)
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) {
+		t.Fatal("tier costs were not persisted")
+	}
+	buf.Reset()
+	costed.Persist(buf)
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Stats().PlacementCost != costed.Stats().PlacementCost {
+		t.Fatalf("loaded ring placement cost %v instead of %v", r2.Stats().PlacementCost, costed.Stats().PlacementCost)
+	}
+}
+
+func TestBuilderReplicaCountForRange(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 6; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitionCount := r.PartitionCount()
+	if partitionCount < 8 {
+		t.Fatalf("partition count %d is too small to test with", partitionCount)
+	}
+	if err = b.SetReplicaCountForRange(0, partitionCount, 3); err == nil {
+		t.Fatal("SetReplicaCountForRange beyond the partition count should have given an error")
+	}
+	if err = b.SetReplicaCountForRange(0, 0, 7); err != ErrInsufficientNodes {
+		t.Fatalf("SetReplicaCountForRange with too few nodes gave %v", err)
+	}
+	quarter := partitionCount / 4
+	if err = b.SetReplicaCountForRange(0, 2*quarter-1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetReplicaCountForRange(3*quarter, partitionCount-1, 1); err != nil {
+		t.Fatal(err)
+	}
+	r, err = b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(r Ring) {
+		if r.ReplicaCount() != 2 {
+			t.Fatalf("ReplicaCount gave %d instead of 2", r.ReplicaCount())
+		}
+		for partition := uint32(0); partition < r.PartitionCount(); partition++ {
+			want := 2
+			if partition < 2*quarter*(r.PartitionCount()/partitionCount) {
+				want = 3
+			} else if partition >= 3*quarter*(r.PartitionCount()/partitionCount) {
+				want = 1
+			}
+			if got := r.PartitionReplicaCount(partition); got != want {
+				t.Fatalf("partition %d has a replica count of %d instead of %d", partition, got, want)
+			}
+			nodes := r.ResponsibleNodes(partition)
+			if len(nodes) != want {
+				t.Fatalf("partition %d has %d responsible nodes instead of %d", partition, len(nodes), want)
+			}
+			seen := make(map[uint64]bool)
+			for _, n := range nodes {
+				if seen[n.ID()] {
+					t.Fatalf("partition %d has node %016x more than once", partition, n.ID())
+				}
+				seen[n.ID()] = true
+			}
+		}
+		if p := r.UnderReplicatedPartitions(); len(p) != 0 {
+			t.Fatalf("%d partitions under replicated", len(p))
+		}
+	}
+	check(r)
+	buf := bytes.NewBuffer(nil)
+	if err = r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(r2)
+	if err = r.PersistVersion(ioutil.Discard, 6); err == nil {
+		t.Fatal("PersistVersion 6 should have given an error with replica count ranges")
+	}
+	buf.Reset()
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) {
+		t.Fatal("replica count ranges were not persisted")
+	}
+	// The ranges keep covering the same keys as the partition count grows.
+	for i := 0; i < 6; i++ {
+		b2.AddNode(true, uint32(2+i), nil, nil, "", nil)
+	}
+	r, err = b2.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PartitionCount() == partitionCount {
+		t.Fatal("partition count did not grow")
+	}
+	check(r)
+}
+
+func TestEstimateNodesNeeded(t *testing.T) {
+	for _, c := range []struct {
+		partitionBitCount int
+		replicaCount      int
+		perNodeCapacity   uint32
+		maxImbalance      float64
+		nodes             int
+	}{
+		// 48 partition replicas over 5 nodes is 9.6 each; the nodes with 9
+		// are 6.25% under.
+		{4, 3, 10, 10, 5},
+		{4, 3, 10, 1, 6},
+		{4, 3, 100, 0, 3},
+		{4, 3, 1, 0, 48},
+		{4, 0, 10, 1, 0},
+		{4, 3, 0, 1, 0},
+	} {
+		if n := EstimateNodesNeeded(c.partitionBitCount, c.replicaCount, c.perNodeCapacity, c.maxImbalance); n != c.nodes {
+			t.Errorf("EstimateNodesNeeded(%d, %d, %d, %v) gave %d instead of %d", c.partitionBitCount, c.replicaCount, c.perNodeCapacity, c.maxImbalance, n, c.nodes)
+		}
+	}
+}
+
+// zeroIDNode is a Node without an ID, as might be described by a topology
+// file before being added to a Builder.
+type zeroIDNode struct {
+	Node
+}
+
+func (n zeroIDNode) ID() uint64 {
+	return 0
+}
+
+func TestBuilderAddNodes(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 4; i++ {
+		b.AddNode(i%2 == 0, uint32(i+1), []string{fmt.Sprintf("server%d", i)}, []string{fmt.Sprintf("10.0.0.%d:1234", i)}, fmt.Sprintf("node%d", i), []byte("conf"))
+	}
+	nodes := b.Nodes()
+	b2 := NewBuilder()
+	b2.SetReplicaCount(2)
+	version := b2.Version()
+	ids, err := b2.AddNodes([]Node{nodes[0], nodes[1], zeroIDNode{nodes[2]}, nodes[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Version() != version {
+		t.Fatal("AddNodes rebuilt the ring")
+	}
+	if len(ids) != 4 || ids[0] != nodes[0].ID() || ids[1] != nodes[1].ID() || ids[2] == 0 || ids[2] == nodes[2].ID() || ids[3] != nodes[3].ID() {
+		t.Fatalf("AddNodes gave ids %v", ids)
+	}
+	for i, id := range ids {
+		n := b2.Node(id)
+		if n == nil || n.Active() != nodes[i].Active() || n.Capacity() != nodes[i].Capacity() || n.Tier(0) != nodes[i].Tier(0) || n.Address(0) != nodes[i].Address(0) || n.Meta() != nodes[i].Meta() || string(n.Conf()) != "conf" {
+			t.Fatalf("node %d was not copied: %#v", i, n)
+		}
+	}
+	if _, err = b2.AddNodes([]Node{zeroIDNode{nodes[0]}, nodes[1]}); err == nil {
+		t.Fatal("AddNodes with an id in use should have given an error")
+	}
+	if len(b2.Nodes()) != 4 {
+		t.Fatalf("failed AddNodes left %d nodes instead of 4", len(b2.Nodes()))
+	}
+	if _, err = b2.Ring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuilderMaxAddressesPerNode(t *testing.T) {
+	b := NewBuilder()
+	if b.MaxAddressesPerNode() != DefaultMaxAddressesPerNode {
+		t.Fatalf("MaxAddressesPerNode was %d instead of %d", b.MaxAddressesPerNode(), DefaultMaxAddressesPerNode)
+	}
+	b.SetMaxAddressesPerNode(2)
+	n, err := b.AddNode(true, 1, nil, []string{"a", "b"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, nil, []string{"a", "b", "c"}, "", nil); err == nil {
+		t.Fatal("AddNode with too many addresses should have given an error")
+	}
+	if err = b.AddNodeWithID(123, true, 1, nil, []string{"a", "b", "c"}, "", nil); err == nil {
+		t.Fatal("AddNodeWithID with too many addresses should have given an error")
+	}
+	if err = b.SetNodeAddresses(n.ID(), []string{"a", "b", "c"}); err == nil {
+		t.Fatal("SetNodeAddresses with too many addresses should have given an error")
+	}
+	if len(b.Nodes()) != 1 || len(n.Addresses()) != 2 {
+		t.Fatalf("failed calls changed the nodes: %d nodes, %v", len(b.Nodes()), n.Addresses())
+	}
+	if err = b.SetNodeAddresses(n.ID(), []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	if a := n.Addresses(); len(a) != 1 || a[0] != "c" {
+		t.Fatalf("SetNodeAddresses gave addresses %v", a)
+	}
+	if err = b.SetNodeAddresses(n.ID()+1, []string{"c"}); err == nil {
+		t.Fatal("SetNodeAddresses for an unknown node should have given an error")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.MaxAddressesPerNode() != 2 {
+		t.Fatalf("loaded MaxAddressesPerNode was %d instead of 2", b2.MaxAddressesPerNode())
+	}
+	b2.SetMaxAddressesPerNode(0)
+	if err = b2.SetNodeAddresses(n.ID(), make([]string, 100)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuilderStabilityVsPrevious(t *testing.T) {
+	b := NewBuilder()
+	if s := b.StabilityVsPrevious(); s != 1 {
+		t.Fatalf("StabilityVsPrevious gave %f before any build", s)
+	}
+	b.SetReplicaCount(3)
+	for i := 0; i < 4; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	b.Ring()
+	if s := b.StabilityVsPrevious(); s != 0 {
+		t.Fatalf("StabilityVsPrevious gave %f after the first assignments instead of 0", s)
+	}
+	b.Ring()
+	if s := b.StabilityVsPrevious(); s != 1 {
+		t.Fatalf("StabilityVsPrevious gave %f after a build that changed nothing instead of 1", s)
+	}
+	before, _ := b.Ring()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.PretendElapsed(math.MaxUint16)
+	after, _ := b.Ring()
+	s := b.StabilityVsPrevious()
+	if s <= 0 || s >= 1 {
+		t.Fatalf("StabilityVsPrevious gave %f after adding a node", s)
+	}
+	// Should the partition count have grown, each partition is compared with
+	// the one it was split from; unassigned replicas are left out.
+	checkStability := func(before Ring, after Ring) {
+		s := b.StabilityVsPrevious()
+		shift := after.PartitionBitCount() - before.PartitionBitCount()
+		unchanged := 0
+		slots := 0
+		for partition := uint32(0); partition < after.PartitionCount(); partition++ {
+			a := before.ResponsibleNodes(partition >> shift)
+			c := after.ResponsibleNodes(partition)
+			for replica := range c {
+				slots++
+				if a[replica].ID() == c[replica].ID() {
+					unchanged++
+				}
+			}
+		}
+		if expected := float64(unchanged) / float64(slots); s != expected {
+			t.Fatalf("StabilityVsPrevious gave %f instead of %f", s, expected)
+		}
+	}
+	checkStability(before, after)
+	if err := b.SetReplicaCountForRange(0, after.PartitionCount()/2, 2); err != nil {
+		t.Fatal(err)
+	}
+	before = after
+	after, _ = b.Ring()
+	checkStability(before, after)
+}
+
+func TestBuilderMovePartition(t *testing.T) {
+	b := NewBuilder()
+	if err := b.SetReplicaCount(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetStrictTierSeparation(true); err != nil {
+		t.Fatal(err)
+	}
+	nA, _ := b.AddNode(true, 1, []string{"server1", "zone1"}, nil, "", nil)
+	nB, _ := b.AddNode(true, 1, []string{"server2", "zone2"}, nil, "", nil)
+	nC, _ := b.AddNode(true, 1, []string{"server3", "zone1"}, nil, "", nil)
+	nD, _ := b.AddNode(true, 1, []string{"server4", "zone3"}, nil, "", nil)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partition uint32
+	var held, other Node
+	for partition = 0; partition < r.PartitionCount(); partition++ {
+		nodes := r.ResponsibleNodes(partition)
+		if nodes[0].ID() == nA.ID() || nodes[1].ID() == nA.ID() {
+			held = nA
+			other = nodes[0]
+			if other.ID() == nA.ID() {
+				other = nodes[1]
+			}
+			break
+		}
+	}
+	if held == nil {
+		t.Fatal("node A holds no partitions")
+	}
+	if err := b.MovePartition(r.PartitionCount(), nA.ID(), nD.ID()); err == nil {
+		t.Fatal("MovePartition allowed a partition out of range")
+	}
+	if err := b.MovePartition(partition, nA.ID(), other.ID()); err == nil {
+		t.Fatal("MovePartition allowed a node to hold two replicas")
+	}
+	if err := b.MovePartition(partition, nA.ID(), 12345); err == nil {
+		t.Fatal("MovePartition allowed an unknown node")
+	}
+	var toNode Node
+	for _, n := range []Node{nB, nC, nD} {
+		if n.ID() == other.ID() {
+			continue
+		}
+		if n.Tier(1) == other.Tier(1) {
+			if err := b.MovePartition(partition, nA.ID(), n.ID()); err == nil {
+				t.Fatal("MovePartition allowed replicas to share a tier")
+			}
+		} else {
+			toNode = n
+		}
+	}
+	for replica := 0; replica < 2; replica++ {
+		b.SetReplicaConstraint(replica, "disk", "ssd")
+	}
+	if err := b.MovePartition(partition, nA.ID(), toNode.ID()); err == nil {
+		t.Fatal("MovePartition allowed a node not meeting the replica's constraint")
+	}
+	for replica := 0; replica < 2; replica++ {
+		b.SetReplicaConstraint(replica, "", "")
+	}
+	if err := b.SetAntiAffinity(toNode.ID(), other.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.MovePartition(partition, nA.ID(), toNode.ID()); err == nil {
+		t.Fatal("MovePartition allowed a node anti-affine to another replica's node")
+	}
+	b.ClearAntiAffinity(toNode.ID(), other.ID())
+	if err := b.MovePartition(partition, nA.ID(), toNode.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.MovePartition(partition, nA.ID(), toNode.ID()); err == nil {
+		t.Fatal("MovePartition allowed a move from a node holding no replica")
+	}
+	r, err = b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range r.ResponsibleNodes(partition) {
+		if n.ID() == nA.ID() {
+			t.Fatal("the next build undid the move")
+		}
+		if n.ID() == toNode.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("the move was not kept by the next build")
+	}
+	// Builds later on, but within the MoveWait, must keep the move as well.
+	b.moveWaitBase -= int64(30 * time.Minute)
+	if r, err = b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	found = false
+	for _, n := range r.ResponsibleNodes(partition) {
+		if n.ID() == nA.ID() {
+			t.Fatal("a build 30 minutes later undid the move")
+		}
+		if n.ID() == toNode.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("the move was not kept by a build 30 minutes later")
+	}
+	b.PretendElapsed(1)
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		if b.nodes[partitionToNodeIndex[partition]].id != toNode.ID() {
+			continue
+		}
+		if v := b.replicaToPartitionToLastMove[replica][partition]; v != 31 {
+			t.Fatalf("the move was %d minutes ago rather than 31", v)
+		}
+	}
+}
+
+func TestBuilderPersistCanonical(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	b.AddNodeWithID(3, true, 1, []string{"server3", "zoneB"}, []string{"3"}, "", nil)
+	b.AddNodeWithID(1, true, 1, []string{"server1", "zoneA"}, []string{"1"}, "", nil)
+	b.AddNodeWithID(2, true, 1, []string{"server2", "zoneB"}, []string{"2"}, "", nil)
+	b.AddNodeWithID(4, true, 1, []string{"server4", "zoneA"}, []string{"4"}, "", nil)
+	b.AddNodeWithID(5, true, 1, nil, nil, "", nil)
+	b.RemoveNode(5)
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	persist := func(b *Builder) []byte {
+		buf := &bytes.Buffer{}
+		if err := b.PersistCanonical(buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	first := persist(b)
+	if second := persist(b); !bytes.Equal(first, second) {
+		t.Fatal("persisting the same Builder twice gave different bytes")
+	}
+	// The same state reached with the nodes added in another order, and the
+	// node removed at another time, should persist the same.
+	b2 := NewBuilder()
+	b2.SetReplicaCount(2)
+	b2.AddNodeWithID(5, true, 1, nil, nil, "", nil)
+	b2.AddNodeWithID(4, true, 1, []string{"server4", "zoneA"}, []string{"4"}, "", nil)
+	b2.AddNodeWithID(2, true, 1, []string{"server2", "zoneB"}, []string{"2"}, "", nil)
+	b2.AddNodeWithID(1, true, 1, []string{"server1", "zoneA"}, []string{"1"}, "", nil)
+	b2.AddNodeWithID(3, true, 1, []string{"server3", "zoneB"}, []string{"3"}, "", nil)
+	time.Sleep(time.Millisecond)
+	b2.RemoveNode(5)
+	b2.replicaToPartitionToNodeIndex = make([][]int32, len(b.replicaToPartitionToNodeIndex))
+	b2.replicaToPartitionToLastMove = make([][]uint16, len(b.replicaToPartitionToLastMove))
+	for replica := range b2.replicaToPartitionToLastMove {
+		b2.replicaToPartitionToLastMove[replica] = make([]uint16, len(b.replicaToPartitionToLastMove[replica]))
+	}
+	b2.partitionBitCount = b.partitionBitCount
+	idToIndex := map[uint64]int32{}
+	for i, n := range b2.nodes {
+		idToIndex[n.id] = int32(i)
+	}
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		b2.replicaToPartitionToNodeIndex[replica] = make([]int32, len(partitionToNodeIndex))
+		for partition, nodeIndex := range partitionToNodeIndex {
+			b2.replicaToPartitionToNodeIndex[replica][partition] = idToIndex[b.nodes[nodeIndex].id]
+		}
+	}
+	if !bytes.Equal(first, persist(b2)) {
+		t.Fatal("Builders with the same state gave different bytes")
+	}
+	b3, err := LoadBuilder(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, persist(b3)) {
+		t.Fatal("reloaded Builder gave different bytes")
+	}
+	if !reflect.DeepEqual(b.AssignmentMap(), b3.AssignmentMap()) {
+		t.Fatal("reloaded Builder has different assignments")
+	}
+	// Builders built independently, with different IDs and versions, should
+	// persist the same once they have reached the same assignments.
+	build := func() *Builder {
+		b := NewBuilder()
+		b.SetReplicaCount(2)
+		for id := uint64(1); id <= 4; id++ {
+			b.AddNodeWithID(id, true, 1, []string{fmt.Sprintf("server%d", id)}, nil, "", nil)
+		}
+		if _, err := b.Ring(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b4 := build()
+	time.Sleep(time.Millisecond)
+	b5 := build()
+	if b4.ID() == b5.ID() || b4.Version() == b5.Version() {
+		t.Fatal("independent Builders should have different IDs and versions")
+	}
+	if !reflect.DeepEqual(b4.AssignmentMap(), b5.AssignmentMap()) {
+		t.Fatal("independent Builders made different assignments")
+	}
+	if !bytes.Equal(persist(b4), persist(b5)) {
+		t.Fatal("independent Builders with the same state gave different bytes")
+	}
+}
@@ -0,0 +1,76 @@
+package ring
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression selects how persisted Ring and Builder data is compressed. The
+// compression in use is detected automatically when loading, so a loaded Ring
+// or Builder will persist with the same compression it was loaded with unless
+// changed.
+type Compression int
+
+const (
+	// CompressionGzip is the default and is always available.
+	CompressionGzip Compression = iota
+	// CompressionZstd is much faster to compress and decompress than gzip at
+	// comparable ratios, but it is only available when this package is built
+	// with the "zstd" build tag; this keeps the dependency optional.
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// zstdMagic starts every zstd frame; gzip streams instead start with 0x1f8b.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// newZstdWriter and newZstdReader are set by compression_zstd.go when built
+// with the zstd tag.
+var newZstdWriter func(w io.Writer) (io.WriteCloser, error)
+var newZstdReader func(r io.Reader) (io.ReadCloser, error)
+
+func newCompressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		if newZstdWriter == nil {
+			return nil, fmt.Errorf("zstd compression not available; build with -tags zstd")
+		}
+		return newZstdWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %s", c)
+}
+
+// newDecompressReader detects the compression used by the data in the reader
+// and returns a reader of the decompressed data. Note that the returned
+// reader may have read ahead from the given reader and closing it does not
+// close the given reader.
+func newDecompressReader(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	if bytes.Equal(magic, zstdMagic) {
+		if newZstdReader == nil {
+			return nil, CompressionZstd, fmt.Errorf("zstd compression not available; build with -tags zstd")
+		}
+		zr, err := newZstdReader(br)
+		return zr, CompressionZstd, err
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, CompressionGzip, err
+	}
+	return gr, CompressionGzip, nil
+}
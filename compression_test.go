@@ -0,0 +1,41 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionDetected(t *testing.T) {
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	r, _ := b.Ring()
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != 0x1f || buf.Bytes()[1] != 0x8b {
+		t.Fatalf("default compression was not gzip: %x", buf.Bytes()[:2])
+	}
+	r, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.(*ring).compression != CompressionGzip {
+		t.Fatalf("detected compression was %s instead of gzip", r.(*ring).compression)
+	}
+}
+
+func TestCompressionZstdUnavailable(t *testing.T) {
+	if newZstdWriter != nil {
+		t.Skip("built with zstd support")
+	}
+	b := NewBuilder()
+	b.SetCompression(CompressionZstd)
+	if err := b.Persist(&bytes.Buffer{}); err == nil {
+		t.Fatal("persisting with zstd should have failed without zstd support")
+	}
+	_, err := LoadBuilder(bytes.NewBuffer(append(zstdMagic, 0, 0, 0, 0)))
+	if err == nil {
+		t.Fatal("loading zstd data should have failed without zstd support")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build zstd
+// +build zstd
+
+package ring
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	newZstdWriter = func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	}
+	newZstdReader = func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+}
@@ -0,0 +1,103 @@
+//go:build zstd
+// +build zstd
+
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCompressionZstdPersistence(t *testing.T) {
+	b := NewBuilder()
+	b.SetCompression(CompressionZstd)
+	b.SetReplicaCount(2)
+	b.AddNode(true, 1, []string{"server1"}, []string{"1.2.3.4:56789"}, "", nil)
+	b.AddNode(true, 1, []string{"server2"}, []string{"1.2.3.5:56789"}, "", nil)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), zstdMagic) {
+		t.Fatalf("persisted builder was not zstd: %x", buf.Bytes()[:4])
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Compression() != CompressionZstd || len(b2.Nodes()) != 2 {
+		t.Fatalf("loaded builder gave %s and %d nodes", b2.Compression(), len(b2.Nodes()))
+	}
+	buf.Reset()
+	if err = r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Version() != r.Version() || len(r2.Nodes()) != 2 {
+		t.Fatalf("loaded ring gave version %d and %d nodes", r2.Version(), len(r2.Nodes()))
+	}
+}
+
+func benchmarkRing(c Compression) Ring {
+	b := NewBuilder()
+	b.SetCompression(c)
+	b.SetReplicaCount(3)
+	for i := 0; i < 200; i++ {
+		b.AddNode(true, uint32(1000+i%7), []string{fmt.Sprintf("server%d", i/4), fmt.Sprintf("zone%d", i%10)}, []string{fmt.Sprintf("10.0.%d.%d:12345", i/250, i%250)}, "", nil)
+	}
+	r, _ := b.Ring()
+	return r
+}
+
+func benchmarkPersist(bm *testing.B, c Compression) {
+	r := benchmarkRing(c)
+	buf := bytes.NewBuffer(make([]byte, 0, 1<<20))
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		buf.Reset()
+		if err := r.Persist(buf); err != nil {
+			bm.Fatal(err)
+		}
+	}
+	bm.SetBytes(int64(buf.Len()))
+}
+
+func benchmarkLoad(bm *testing.B, c Compression) {
+	r := benchmarkRing(c)
+	buf := bytes.NewBuffer(make([]byte, 0, 1<<20))
+	if err := r.Persist(buf); err != nil {
+		bm.Fatal(err)
+	}
+	byts := buf.Bytes()
+	bm.SetBytes(int64(len(byts)))
+	bm.ResetTimer()
+	for i := 0; i < bm.N; i++ {
+		if _, err := LoadRing(bytes.NewReader(byts)); err != nil {
+			bm.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPersistGzip(b *testing.B) {
+	benchmarkPersist(b, CompressionGzip)
+}
+
+func BenchmarkPersistZstd(b *testing.B) {
+	benchmarkPersist(b, CompressionZstd)
+}
+
+func BenchmarkLoadGzip(b *testing.B) {
+	benchmarkLoad(b, CompressionGzip)
+}
+
+func BenchmarkLoadZstd(b *testing.B) {
+	benchmarkLoad(b, CompressionZstd)
+}
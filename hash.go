@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// HashFunc maps a key to the 64-bit value used to determine the key's
+// partition; the partition is the top PartitionBitCount bits of the value, so
+// those bits should be well distributed.
+type HashFunc func(key []byte) uint64
+
+// DefaultHashFunc is the name of the HashFunc used unless the Builder is told
+// otherwise; it is the first eight bytes, big endian, of the key's MD5 sum.
+const DefaultHashFunc = "md5"
+
+func md5HashFunc(key []byte) uint64 {
+	sum := md5.Sum(key)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+var hashFuncsLock sync.RWMutex
+var hashFuncs = map[string]HashFunc{DefaultHashFunc: md5HashFunc}
+
+// RegisterHashFunc makes the function available under the name given for use
+// with Builder.SetHashFunc. Only the name is persisted with a Ring or Builder,
+// so the same function must be registered under the same name by every
+// program loading them; loading a Ring or Builder that names an unregistered
+// function is an error rather than risking keys being routed to the wrong
+// partitions. An error is returned for an empty name, a nil function, or a
+// name already registered.
+func RegisterHashFunc(name string, fn func(key []byte) uint64) error {
+	if name == "" {
+		return fmt.Errorf("hash func name cannot be empty")
+	}
+	if fn == nil {
+		return fmt.Errorf("hash func %q cannot be nil", name)
+	}
+	hashFuncsLock.Lock()
+	defer hashFuncsLock.Unlock()
+	if _, ok := hashFuncs[name]; ok {
+		return fmt.Errorf("hash func %q is already registered", name)
+	}
+	hashFuncs[name] = fn
+	return nil
+}
+
+func lookupHashFunc(name string) (HashFunc, error) {
+	hashFuncsLock.RLock()
+	fn := hashFuncs[name]
+	hashFuncsLock.RUnlock()
+	if fn == nil {
+		return nil, fmt.Errorf("hash func %q is not registered", name)
+	}
+	return fn, nil
+}
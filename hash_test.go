@@ -0,0 +1,138 @@
+package ring
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDefaultHashFunc(t *testing.T) {
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	if r.HashFunc() != DefaultHashFunc {
+		t.Fatalf("HashFunc gave %q", r.HashFunc())
+	}
+	key := []byte("some key")
+	sum := md5.Sum(key)
+	if p := r.PartitionForKey(key); p != uint32(binary.BigEndian.Uint64(sum[:8])>>(64-r.PartitionBitCount())) {
+		t.Fatalf("PartitionForKey gave %d", p)
+	}
+}
+
+func testFirst8HashFunc(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
+func TestRegisterHashFunc(t *testing.T) {
+	if err := RegisterHashFunc("", testFirst8HashFunc); err == nil {
+		t.Fatal("RegisterHashFunc should have errored for an empty name")
+	}
+	if err := RegisterHashFunc("test-nil", nil); err == nil {
+		t.Fatal("RegisterHashFunc should have errored for a nil func")
+	}
+	if err := RegisterHashFunc(DefaultHashFunc, testFirst8HashFunc); err == nil {
+		t.Fatal("RegisterHashFunc should have errored for a name already taken")
+	}
+	// Closures from the same literal are distinct funcs under their names.
+	seeded := func(seed uint64) func([]byte) uint64 {
+		return func(key []byte) uint64 {
+			return seed << 63
+		}
+	}
+	for i, name := range []string{"test-seed0", "test-seed1"} {
+		if err := RegisterHashFunc(name, seeded(uint64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		hashFuncsLock.Lock()
+		delete(hashFuncs, "test-seed0")
+		delete(hashFuncs, "test-seed1")
+		hashFuncsLock.Unlock()
+	}()
+	for i, name := range []string{"test-seed0", "test-seed1"} {
+		b := NewBuilder()
+		if err := b.SetHashFunc(name); err != nil {
+			t.Fatal(err)
+		}
+		b.AddNode(true, 1, nil, nil, "", nil)
+		r, err := b.Ring()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.HashFunc() != name || r.PartitionForKey([]byte("key")) != uint32(i) {
+			t.Fatalf("%s gave %q and partition %d", name, r.HashFunc(), r.PartitionForKey([]byte("key")))
+		}
+	}
+}
+
+func TestPartitionForKeyWithoutHashFunc(t *testing.T) {
+	r := &ring{partitionBitCount: 4}
+	key := []byte("some key")
+	if r.PartitionForKey(key) != uint32(md5HashFunc(key)>>60) {
+		t.Fatalf("PartitionForKey gave %d", r.PartitionForKey(key))
+	}
+}
+
+func TestCustomHashFunc(t *testing.T) {
+	if err := RegisterHashFunc("test-first8", testFirst8HashFunc); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		hashFuncsLock.Lock()
+		delete(hashFuncs, "test-first8")
+		hashFuncsLock.Unlock()
+	}()
+	b := NewBuilder()
+	if err := b.SetHashFunc("test-unregistered"); err == nil {
+		t.Fatal("SetHashFunc should have errored for an unregistered name")
+	}
+	if err := b.SetHashFunc("test-first8"); err != nil {
+		t.Fatal(err)
+	}
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	// With one bit of partitions, the top bit of the key picks the partition.
+	if r.PartitionBitCount() != 1 {
+		t.Fatalf("expected 1 partition bit, got %d", r.PartitionBitCount())
+	}
+	lo := []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	hi := []byte{0x80, 0, 0, 0, 0, 0, 0, 0}
+	if r.PartitionForKey(lo) != 0 || r.PartitionForKey(hi) != 1 {
+		t.Fatalf("PartitionForKey gave %d and %d", r.PartitionForKey(lo), r.PartitionForKey(hi))
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	persisted := buf.Bytes()
+	r2, err := LoadRing(bytes.NewReader(persisted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.HashFunc() != "test-first8" || r2.PartitionForKey(lo) != 0 || r2.PartitionForKey(hi) != 1 {
+		t.Fatal("loaded ring did not route keys the same")
+	}
+	if err = r.PersistVersion(buf, 2); err == nil {
+		t.Fatal("PersistVersion should have errored for a custom hash func in version 2")
+	}
+	buf.Reset()
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.HashFunc() != "test-first8" {
+		t.Fatalf("loaded builder gave HashFunc %q", b2.HashFunc())
+	}
+	hashFuncsLock.Lock()
+	delete(hashFuncs, "test-first8")
+	hashFuncsLock.Unlock()
+	if _, err = LoadRing(bytes.NewReader(persisted)); err == nil {
+		t.Fatal("LoadRing should have errored for an unregistered hash func")
+	}
+}
@@ -1,6 +1,14 @@
 package ring
 
-import "io"
+import (
+	"io"
+	"time"
+)
+
+// ReservedMsgTypeStart is the first of the message types reserved for the
+// package's own messages; MsgRing.SetMsgHandler will not accept handlers for
+// message types from this value on.
+const ReservedMsgTypeStart = uint64(0xffffffff00000000)
 
 // MsgRing will send and receive Msg instances to and from ring nodes. See
 // TCPMsgRing for a concrete implementation.
@@ -15,17 +23,21 @@ type MsgRing interface {
 	// SetMsgHandler associates a message type with a handler; any incoming
 	// messages with the type will be delivered to the handler. Message types
 	// just need to be unique uint64 values; usually picking 64 bits of a UUID
-	// is fine.
-	SetMsgHandler(msgType uint64, handler MsgUnmarshaller)
-	// MsgToNode attempts to the deliver the message to the indicated node.
-	MsgToNode(nodeID uint64, msg Msg)
-	// MsgToNode attempts to the deliver the message to all other replicas of a
-	// partition. If the ring is not bound to a specific node (LocalNode()
-	// returns nil) then the delivery attempts will be to all replicas. The
-	// ring version is used to short circuit any messages based on a different
-	// ring version; if the ring version does not match Version(), the message
-	// will simply be discarded.
-	MsgToOtherReplicas(ringVersion int64, partition uint32, msg Msg)
+	// is fine. An error is returned if the message type is reserved; see
+	// ReservedMsgTypeStart.
+	SetMsgHandler(msgType uint64, handler MsgUnmarshaller) error
+	// MsgToNode attempts to the deliver the message to the indicated node,
+	// returning nil once delivered or the error from the final attempt.
+	MsgToNode(nodeID uint64, msg Msg) error
+	// MsgToOtherReplicas attempts to the deliver the message to all other
+	// replicas of a partition, returning nil once delivered to all of them or
+	// the error from one of the failed deliveries. If the ring is not bound to
+	// a specific node (LocalNode() returns nil) then the delivery attempts
+	// will be to all replicas. The ring version is used to short circuit any
+	// messages based on a different ring version; if the ring version does not
+	// match Version(), the message is discarded and an error matching
+	// ErrRingVersionMismatch is returned.
+	MsgToOtherReplicas(ringVersion int64, partition uint32, msg Msg) error
 }
 
 // Msg is a single message to be sent to another node or nodes.
@@ -46,6 +58,41 @@ type Msg interface {
 	Done()
 }
 
+// TimeoutMsg may be implemented by a Msg that needs a different write timeout
+// than the MsgRing's default, such as a large bulk transfer sharing a
+// connection with latency sensitive messages. The timeout applies to sending
+// this message only; a zero or negative timeout uses the default.
+type TimeoutMsg interface {
+	Msg
+	Timeout() time.Duration
+}
+
+// DedupMsg may be implemented by a Msg whose repeated sends should be
+// suppressed, such as when a caller retries after a reconnection; see
+// TCPMsgRing.SetDedupWindow. DedupKey returns the key identifying the message
+// and true, or false if this particular message should not be deduplicated.
+type DedupMsg interface {
+	Msg
+	DedupKey() (uint64, bool)
+}
+
+// UrgentMsg may be implemented by a Msg that should be flushed to the network
+// as soon as it is written even when flushes are batched, such as a latency
+// sensitive request; see TCPMsgRing.SetFlushInterval.
+type UrgentMsg interface {
+	Msg
+	Urgent() bool
+}
+
+// RetryableMsg may be implemented by a Msg that can safely be sent again after
+// a failed send, such as one whose WriteContent can be replayed and whose
+// handler tolerates a duplicate should the failed send have been delivered
+// after all; see TCPMsgRing.SetSendRetry. Other messages are attempted once.
+type RetryableMsg interface {
+	Msg
+	Retryable() bool
+}
+
 // MsgUnmarshaller will attempt to read desiredBytesToRead from the reader and
 // will return the number of bytes actually read as well as any error that may
 // have occurred. If error is nil then actualBytesRead must equal
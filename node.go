@@ -1,6 +1,7 @@
 package ring
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 	"regexp"
@@ -29,10 +30,16 @@ type Node interface {
 	// example, the lowest tier, tier 0, might be the server ip (where each
 	// node represents a drive on that server). The next tier, 1, might then be
 	// the power zone the server is in. The number of tiers is flexible, so
-	// later an additional tier for geographic region could be added.
+	// later an additional tier for geographic region could be added. The
+	// slice returned is a copy of the node's tier path, with an empty string
+	// for each level without a value.
 	Tiers() []string
 	// Tier returns just the single tier value for the level.
 	Tier(level int) string
+	// LookupTier is the same as Tier except that it also reports whether the
+	// level is within the node's tier path, to tell a level set to the empty
+	// string apart from one beyond the node's tiers.
+	LookupTier(level int) (string, bool)
 	// Addresses give location information for the node; probably something
 	// like ip:port. This is a list for those use cases where different
 	// processes use different networks (such as replication using a
@@ -125,6 +132,13 @@ func (n *node) Tier(level int) string {
 	return n.tierBase.tiers[level][index]
 }
 
+func (n *node) LookupTier(level int) (string, bool) {
+	if level < 0 || len(n.tierIndexes) <= level {
+		return "", false
+	}
+	return n.Tier(level), true
+}
+
 func (n *node) Addresses() []string {
 	addresses := make([]string, len(n.addresses))
 	copy(addresses, n.addresses)
@@ -218,6 +232,29 @@ func (n *node) SetConf(conf []byte) {
 	n.conf = conf
 }
 
+// equal returns true if the other node has the same attributes; tiers are
+// compared by value, as each node's tierBase may index them differently.
+func (n *node) equal(other *node) bool {
+	if n.id != other.id || n.inactive != other.inactive || n.capacity != other.capacity || n.meta != other.meta || !bytes.Equal(n.conf, other.conf) || len(n.addresses) != len(other.addresses) {
+		return false
+	}
+	for i, address := range n.addresses {
+		if other.addresses[i] != address {
+			return false
+		}
+	}
+	levels := len(n.tierIndexes)
+	if len(other.tierIndexes) > levels {
+		levels = len(other.tierIndexes)
+	}
+	for level := 0; level < levels; level++ {
+		if n.Tier(level) != other.Tier(level) {
+			return false
+		}
+	}
+	return true
+}
+
 type NodeSlice []Node
 
 // Filter will return a new NodeSlice with just the nodes that match the
@@ -2,6 +2,7 @@ package ring
 
 import "testing"
 import "bytes"
+import "strings"
 
 type testSource struct {
 	// The repeat part will cause an id == 0 when starting with repeat = false
@@ -204,6 +205,39 @@ func TestTierCoalescing(t *testing.T) {
 	}
 }
 
+func TestNodeLookupTier(t *testing.T) {
+	b := NewBuilder()
+	n1, _ := b.AddNode(true, 1, []string{"server1", "", "dc1"}, nil, "", nil)
+	n2, _ := b.AddNode(true, 1, []string{"server2"}, nil, "", nil)
+	// Leaves an unused value at a level beyond n2's tiers.
+	n1.SetTier(2, "dc2")
+	if v, ok := n1.LookupTier(1); v != "" || !ok {
+		t.Fatalf("LookupTier(1) gave %q, %v for an empty level", v, ok)
+	}
+	if v, ok := n2.LookupTier(1); v != "" || ok {
+		t.Fatalf("LookupTier(1) gave %q, %v beyond the node's tiers", v, ok)
+	}
+	tiers := n1.Tiers()
+	tiers[0] = "changed"
+	if n1.Tier(0) != "server1" {
+		t.Fatal("changing the slice from Tiers changed the node")
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range b2.Nodes() {
+		want := [][]string{{"server1", "", "dc2"}, {"server2"}}[i]
+		if got := n.Tiers(); len(got) != len(want) || strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("loaded node %d has tiers %q instead of %q", i, got, want)
+		}
+	}
+}
+
 func TestNodeFilterCommonErrors(t *testing.T) {
 	_, err := NodeSlice{}.Filter([]string{"randomstringwithoutequals"})
 	if err == nil {
@@ -0,0 +1,105 @@
+package ring
+
+import "math/bits"
+
+// PartitionBitmap is a set of partitions stored one bit per partition, as
+// given by Ring.PartitionBitmapForNode. For rings with millions of
+// partitions this is far more compact than a []uint32, at an eighth of a byte
+// per partition rather than four bytes per member, and set operations between
+// bitmaps work a word at a time. The operations return new bitmaps, leaving
+// their operands unchanged; bitmaps of differing lengths are treated as if
+// the shorter had its missing partitions unset.
+type PartitionBitmap struct {
+	words []uint64
+	// length is the number of partitions the bitmap covers.
+	length uint32
+}
+
+// NewPartitionBitmap returns an empty bitmap covering the number of
+// partitions given.
+func NewPartitionBitmap(partitionCount uint32) *PartitionBitmap {
+	return &PartitionBitmap{words: make([]uint64, (uint64(partitionCount)+63)/64), length: partitionCount}
+}
+
+// Len is the number of partitions the bitmap covers, set or not.
+func (b *PartitionBitmap) Len() uint32 {
+	return b.length
+}
+
+// Has returns true if the partition is in the set.
+func (b *PartitionBitmap) Has(partition uint32) bool {
+	if partition >= b.length {
+		return false
+	}
+	return b.words[partition/64]&(1<<(partition%64)) != 0
+}
+
+// Add puts the partition in the set; partitions beyond Len are ignored.
+func (b *PartitionBitmap) Add(partition uint32) {
+	if partition < b.length {
+		b.words[partition/64] |= 1 << (partition % 64)
+	}
+}
+
+// Remove takes the partition out of the set.
+func (b *PartitionBitmap) Remove(partition uint32) {
+	if partition < b.length {
+		b.words[partition/64] &^= 1 << (partition % 64)
+	}
+}
+
+// Count returns the number of partitions in the set.
+func (b *PartitionBitmap) Count() int {
+	count := 0
+	for _, w := range b.words {
+		count += bits.OnesCount64(w)
+	}
+	return count
+}
+
+// Partitions returns the partitions in the set, in ascending order.
+func (b *PartitionBitmap) Partitions() []uint32 {
+	partitions := make([]uint32, 0, b.Count())
+	for i, w := range b.words {
+		for w != 0 {
+			partitions = append(partitions, uint32(i*64+bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+	return partitions
+}
+
+// And returns the partitions in both sets.
+func (b *PartitionBitmap) And(other *PartitionBitmap) *PartitionBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x & y })
+}
+
+// Or returns the partitions in either set.
+func (b *PartitionBitmap) Or(other *PartitionBitmap) *PartitionBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x | y })
+}
+
+// AndNot returns the partitions in this set but not the other, such as those
+// a node would have to receive when taking over from another.
+func (b *PartitionBitmap) AndNot(other *PartitionBitmap) *PartitionBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x &^ y })
+}
+
+func (b *PartitionBitmap) combine(other *PartitionBitmap, op func(x, y uint64) uint64) *PartitionBitmap {
+	length := b.length
+	if other.length > length {
+		length = other.length
+	}
+	c := NewPartitionBitmap(length)
+	for i := range c.words {
+		var x, y uint64
+		if i < len(b.words) {
+			x = b.words[i]
+		}
+		if i < len(other.words) {
+			y = other.words[i]
+		}
+		c.words[i] = op(x, y)
+	}
+	return c
+}
@@ -0,0 +1,40 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPartitionBitmap(t *testing.T) {
+	a := NewPartitionBitmap(130)
+	for _, p := range []uint32{0, 63, 64, 129, 130} {
+		a.Add(p)
+	}
+	if a.Len() != 130 || a.Count() != 4 || !a.Has(129) || a.Has(130) || a.Has(1) {
+		t.Fatalf("bitmap has %v of %d", a.Partitions(), a.Len())
+	}
+	a.Remove(63)
+	if fmt.Sprint(a.Partitions()) != "[0 64 129]" {
+		t.Fatalf("bitmap has %v after Remove", a.Partitions())
+	}
+	b := NewPartitionBitmap(65)
+	b.Add(0)
+	b.Add(1)
+	b.Add(64)
+	for name, test := range map[string]struct {
+		got  *PartitionBitmap
+		want string
+	}{
+		"And":      {a.And(b), "[0 64]"},
+		"Or":       {a.Or(b), "[0 1 64 129]"},
+		"AndNot":   {a.AndNot(b), "[129]"},
+		"b.AndNot": {b.AndNot(a), "[1]"},
+	} {
+		if test.got.Len() != 130 || fmt.Sprint(test.got.Partitions()) != test.want {
+			t.Fatalf("%s gave %v of %d instead of %s", name, test.got.Partitions(), test.got.Len(), test.want)
+		}
+	}
+	if a.Count() != 3 || b.Count() != 3 {
+		t.Fatal("set operations changed their operands")
+	}
+}
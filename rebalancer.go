@@ -3,6 +3,7 @@ package ring
 import (
 	"math"
 	"sort"
+	"time"
 )
 
 type rebalancer struct {
@@ -13,12 +14,26 @@ type rebalancer struct {
 	nodeIndexToDesire        []int32
 	nodeIndexesByDesire      []int32
 	nodeIndexToUsed          []bool
+	nodeIndexToDraining      []bool
 	tierToTierSeps           [][]*tierSeparation
 	tierToNodeIndexToTierSep [][]*tierSeparation
 	partitionToMovementsLeft []byte
 	altered                  bool
 	usedNodeIndexes          []int32
 	tierToUsedTierSeps       [][]*tierSeparation
+	// replicaToNodeIndexToAllowed gives, for each replica with a constraint
+	// (see Builder.SetReplicaConstraint), the nodes meeting the constraint;
+	// it is nil for unconstrained replicas or if no node meets the
+	// constraint.
+	replicaToNodeIndexToAllowed [][]bool
+	// nodeIndexToAntiAffine gives the nodes anti-affine to each node (see
+	// Builder.SetAntiAffinity), and nodeIndexToAvoided counts, for each node,
+	// the nodes anti-affine to it among those marked by markUsed.
+	nodeIndexToAntiAffine [][]int32
+	nodeIndexToAvoided    []int32
+	// events, if set, is sent a MoveEvent for each reassignment; see
+	// Builder.BuildStreaming.
+	events chan<- MoveEvent
 }
 
 type tierSeparation struct {
@@ -37,7 +52,12 @@ func newRebalancer(builder *Builder) *rebalancer {
 	rb.initNodeDesires()
 	rb.initTierInfo()
 	rb.initMovementsLeft()
+	rb.initReplicaConstraints()
+	rb.initAntiAffinities()
 	rb.usedNodeIndexes = make([]int32, rb.maxReplica+1)
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		rb.usedNodeIndexes[replica] = -1
+	}
 	rb.tierToUsedTierSeps = make([][]*tierSeparation, rb.maxTier+1)
 	for tier := rb.maxTier; tier >= 0; tier-- {
 		rb.tierToUsedTierSeps[tier] = make([]*tierSeparation, rb.maxReplica+1)
@@ -50,12 +70,7 @@ func (rb *rebalancer) initMaxTier() {
 }
 
 func (rb *rebalancer) initNodeDesires() {
-	totalCapacity := float64(0)
-	for _, node := range rb.builder.nodes {
-		if !node.inactive {
-			totalCapacity += (float64)(node.capacity)
-		}
-	}
+	nodeIndexToCapacity, totalCapacity := rb.builder.nodeIndexToCapacity(time.Now().UnixNano())
 	nodeIndexToPartitionCount := make([]int32, len(rb.builder.nodes))
 	for _, partitionToNodeIndex := range rb.builder.replicaToPartitionToNodeIndex {
 		for _, nodeIndex := range partitionToNodeIndex {
@@ -65,12 +80,15 @@ func (rb *rebalancer) initNodeDesires() {
 		}
 	}
 	rb.nodeIndexToDesire = make([]int32, len(rb.builder.nodes))
-	allPartitionsCount := float64(len(rb.builder.replicaToPartitionToNodeIndex) * len(rb.builder.replicaToPartitionToNodeIndex[0]))
+	rb.nodeIndexToDraining = make([]bool, len(rb.builder.nodes))
+	allPartitionsCount := float64(rb.builder.replicaSlotCount())
 	for nodeIndex, node := range rb.builder.nodes {
-		if node.inactive {
+		// Draining nodes keep the replicas they have but are given no more.
+		rb.nodeIndexToDraining[nodeIndex] = rb.builder.drain(node.id) != nil
+		if node.inactive || rb.nodeIndexToDraining[nodeIndex] {
 			rb.nodeIndexToDesire[nodeIndex] = math.MinInt32
 		} else {
-			rb.nodeIndexToDesire[nodeIndex] = int32(float64(node.capacity)/totalCapacity*allPartitionsCount+0.5) - nodeIndexToPartitionCount[nodeIndex]
+			rb.nodeIndexToDesire[nodeIndex] = int32(targetPartitions(nodeIndexToCapacity[nodeIndex], totalCapacity, allPartitionsCount)) - nodeIndexToPartitionCount[nodeIndex]
 		}
 	}
 	rb.nodeIndexesByDesire = make([]int32, len(rb.builder.nodes))
@@ -100,6 +118,47 @@ func (rb *rebalancer) initMovementsLeft() {
 	}
 }
 
+func (rb *rebalancer) initReplicaConstraints() {
+	rb.replicaToNodeIndexToAllowed = make([][]bool, rb.maxReplica+1)
+	for _, rc := range rb.builder.replicaConstraints {
+		if rc.replica > rb.maxReplica {
+			continue
+		}
+		allowed := make([]bool, len(rb.builder.nodes))
+		any := false
+		for nodeIndex, n := range rb.builder.nodes {
+			if !n.inactive && rb.builder.drain(n.id) == nil && rc.allows(n) {
+				allowed[nodeIndex] = true
+				any = true
+			}
+		}
+		if any {
+			rb.replicaToNodeIndexToAllowed[rc.replica] = allowed
+		}
+	}
+}
+
+func (rb *rebalancer) initAntiAffinities() {
+	rb.nodeIndexToAntiAffine = make([][]int32, len(rb.builder.nodes))
+	rb.nodeIndexToAvoided = make([]int32, len(rb.builder.nodes))
+	if len(rb.builder.antiAffinities) == 0 {
+		return
+	}
+	idToNodeIndex := make(map[uint64]int32, len(rb.builder.nodes))
+	for nodeIndex, n := range rb.builder.nodes {
+		idToNodeIndex[n.id] = int32(nodeIndex)
+	}
+	for _, aa := range rb.builder.antiAffinities {
+		nodeIndexA, okA := idToNodeIndex[aa.nodeA]
+		nodeIndexB, okB := idToNodeIndex[aa.nodeB]
+		if !okA || !okB {
+			continue
+		}
+		rb.nodeIndexToAntiAffine[nodeIndexA] = append(rb.nodeIndexToAntiAffine[nodeIndexA], nodeIndexB)
+		rb.nodeIndexToAntiAffine[nodeIndexB] = append(rb.nodeIndexToAntiAffine[nodeIndexB], nodeIndexA)
+	}
+}
+
 func (rb *rebalancer) initTierInfo() {
 	rb.tierToNodeIndexToTierSep = make([][]*tierSeparation, rb.maxTier+1)
 	rb.tierToTierSeps = make([][]*tierSeparation, rb.maxTier+1)
@@ -155,8 +214,11 @@ func (rb *rebalancer) initTierInfo() {
 
 func (rb *rebalancer) clearUsed() {
 	for replica := rb.maxReplica; replica >= 0; replica-- {
-		if rb.usedNodeIndexes[replica] != -1 {
-			rb.nodeIndexToUsed[rb.usedNodeIndexes[replica]] = false
+		if nodeIndex := rb.usedNodeIndexes[replica]; nodeIndex != -1 {
+			rb.nodeIndexToUsed[nodeIndex] = false
+			for _, otherNodeIndex := range rb.nodeIndexToAntiAffine[nodeIndex] {
+				rb.nodeIndexToAvoided[otherNodeIndex]--
+			}
 			rb.usedNodeIndexes[replica] = -1
 		}
 	}
@@ -178,6 +240,14 @@ func (rb *rebalancer) markUsed(partition int) {
 		}
 		rb.usedNodeIndexes[replica] = nodeIndex
 		rb.nodeIndexToUsed[nodeIndex] = true
+		for _, otherNodeIndex := range rb.nodeIndexToAntiAffine[nodeIndex] {
+			rb.nodeIndexToAvoided[otherNodeIndex]++
+		}
+		// The tiers of an inactive node don't count as used since its
+		// replica is about to be reassigned elsewhere.
+		if rb.builder.nodes[nodeIndex].inactive {
+			continue
+		}
 		for tier := rb.maxTier; tier >= 0; tier-- {
 			tierSep := rb.tierToNodeIndexToTierSep[tier][nodeIndex]
 			tierSep.used = true
@@ -186,9 +256,21 @@ func (rb *rebalancer) markUsed(partition int) {
 	}
 }
 
-func (rb *rebalancer) bestNodeIndex() int32 {
+// bestNodeIndex returns the node that should be given the replica of the
+// partition marked by markUsed; if the replica is constrained, a node meeting
+// the constraint is returned whenever there is one not already used by the
+// partition. A node anti-affine to one used by the partition is only returned
+// if no other node is available.
+func (rb *rebalancer) bestNodeIndex(replica int) int32 {
+	if allowed := rb.replicaToNodeIndexToAllowed[replica]; allowed != nil {
+		if nodeIndex := rb.bestAllowedNodeIndex(allowed); nodeIndex >= 0 {
+			return nodeIndex
+		}
+	}
 	bestNodeIndex := int32(-1)
 	bestDesire := int32(math.MinInt32)
+	var bestCost float64
+	costs := len(rb.builder.tierCosts) > 0
 	var tierSep *tierSeparation
 	var nodeIndex int32
 	tierToTierSeps := rb.tierToTierSeps
@@ -197,8 +279,22 @@ func (rb *rebalancer) bestNodeIndex() int32 {
 		// node at that tier.
 		for _, tierSep = range tierToTierSeps[tier] {
 			if !tierSep.used {
-				nodeIndex = tierSep.nodeIndexesByDesire[0]
-				if bestDesire < rb.nodeIndexToDesire[nodeIndex] {
+				if nodeIndex = rb.firstUnavoided(tierSep.nodeIndexesByDesire); nodeIndex < 0 {
+					continue
+				}
+				if costs {
+					// With tier costs, the cheapest candidate wins and
+					// desire only breaks ties.
+					if rb.nodeIndexToDesire[nodeIndex] == math.MinInt32 {
+						continue
+					}
+					cost := rb.placementCost(replica, nodeIndex)
+					if bestNodeIndex < 0 || cost < bestCost || (cost == bestCost && bestDesire < rb.nodeIndexToDesire[nodeIndex]) {
+						bestNodeIndex = nodeIndex
+						bestDesire = rb.nodeIndexToDesire[nodeIndex]
+						bestCost = cost
+					}
+				} else if bestDesire < rb.nodeIndexToDesire[nodeIndex] {
 					bestNodeIndex = nodeIndex
 					bestDesire = rb.nodeIndexToDesire[nodeIndex]
 				}
@@ -212,7 +308,12 @@ func (rb *rebalancer) bestNodeIndex() int32 {
 	}
 	// If we found no good higher tiered candidates, we'll have to just
 	// take the node with the highest desire that hasn't already been
-	// selected.
+	// selected, avoiding anti-affine nodes if we can.
+	for _, nodeIndex := range rb.nodeIndexesByDesire {
+		if !rb.nodeIndexToUsed[nodeIndex] && rb.nodeIndexToAvoided[nodeIndex] == 0 {
+			return nodeIndex
+		}
+	}
 	for _, nodeIndex := range rb.nodeIndexesByDesire {
 		if !rb.nodeIndexToUsed[nodeIndex] {
 			return nodeIndex
@@ -222,6 +323,74 @@ func (rb *rebalancer) bestNodeIndex() int32 {
 	return -1
 }
 
+// bestAllowedNodeIndex is the same as bestNodeIndex but only considers the
+// allowed nodes, returning -1 if none are available.
+func (rb *rebalancer) bestAllowedNodeIndex(allowed []bool) int32 {
+	bestNodeIndex := int32(-1)
+	bestDesire := int32(math.MinInt32)
+	for tier := rb.maxTier; tier >= 0; tier-- {
+		for _, tierSep := range rb.tierToTierSeps[tier] {
+			if tierSep.used {
+				continue
+			}
+			for _, nodeIndex := range tierSep.nodeIndexesByDesire {
+				if allowed[nodeIndex] && rb.nodeIndexToAvoided[nodeIndex] == 0 {
+					if bestDesire < rb.nodeIndexToDesire[nodeIndex] {
+						bestNodeIndex = nodeIndex
+						bestDesire = rb.nodeIndexToDesire[nodeIndex]
+					}
+					break
+				}
+			}
+		}
+		if bestNodeIndex >= 0 {
+			return bestNodeIndex
+		}
+	}
+	for _, nodeIndex := range rb.nodeIndexesByDesire {
+		if allowed[nodeIndex] && !rb.nodeIndexToUsed[nodeIndex] && rb.nodeIndexToAvoided[nodeIndex] == 0 {
+			return nodeIndex
+		}
+	}
+	for _, nodeIndex := range rb.nodeIndexesByDesire {
+		if allowed[nodeIndex] && !rb.nodeIndexToUsed[nodeIndex] {
+			return nodeIndex
+		}
+	}
+	return -1
+}
+
+// firstUnavoided returns the first of the nodes not anti-affine to any node
+// used by the partition marked by markUsed, or -1 if there is none.
+func (rb *rebalancer) firstUnavoided(nodeIndexes []int32) int32 {
+	for _, nodeIndex := range nodeIndexes {
+		if rb.nodeIndexToAvoided[nodeIndex] == 0 {
+			return nodeIndex
+		}
+	}
+	return -1
+}
+
+// placementCost returns the tier cost of giving the node the replica of the
+// partition marked by markUsed, with respect to the partition's other
+// replicas.
+func (rb *rebalancer) placementCost(replica int, nodeIndex int32) float64 {
+	var cost float64
+	for otherReplica, otherNodeIndex := range rb.usedNodeIndexes {
+		if otherReplica != replica && otherNodeIndex >= 0 {
+			cost += placementCost(rb.builder.tierCosts, rb.builder.nodes[nodeIndex], rb.builder.nodes[otherNodeIndex])
+		}
+	}
+	return cost
+}
+
+// allowed returns true if the node may be given the replica under any
+// constraint on the replica.
+func (rb *rebalancer) allowed(replica int, nodeIndex int32) bool {
+	allowed := rb.replicaToNodeIndexToAllowed[replica]
+	return allowed == nil || allowed[nodeIndex]
+}
+
 func (rb *rebalancer) changeDesire(nodeIndex int32, increment bool) {
 	nodeIndexesByDesire := rb.nodeIndexesByDesire
 	prev := 0
@@ -306,31 +475,109 @@ func (rb *rebalancer) changeDesire(nodeIndex int32, increment bool) {
 	rb.nodeIndexToDesire[nodeIndex] = newDesire
 }
 
+// moved sends a MoveEvent for the reassignment to any events channel.
+func (rb *rebalancer) moved(partition int, fromNodeIndex int32, toNodeIndex int32) {
+	if rb.events == nil {
+		return
+	}
+	ev := MoveEvent{Partition: uint32(partition), ToNode: rb.builder.nodes[toNodeIndex].id}
+	if fromNodeIndex >= 0 {
+		ev.FromNode = rb.builder.nodes[fromNodeIndex].id
+	}
+	rb.events <- ev
+}
+
 func (rb *rebalancer) rebalance() bool {
 	rb.assignUnassigned()
 	rb.reassignDeactivated()
+	rb.reassignConstraintViolations()
+	rb.reassignAntiAffinityViolations()
 	rb.reassignedSameNodeDups()
 	rb.reassignedSameTierDups()
 	rb.reassignOverweighted()
+	rb.reassignForAffinity()
+	return rb.altered
+}
+
+// repair only reassigns the partition replicas that are unassigned or assigned
+// to inactive nodes; see Builder.RepairReplication.
+func (rb *rebalancer) repair() bool {
+	rb.assignUnassigned()
+	rb.reassignDeactivated()
 	return rb.altered
 }
 
+// affinityNodeIndex returns the node index assigned to the replica of another
+// partition in the same affinity group as the partition given, as long as that
+// node can also take this partition's replica without sharing a tier with the
+// partition's other replicas; -1 is returned otherwise. Note that
+// markUsed(partition) should have been called beforehand.
+func (rb *rebalancer) affinityNodeIndex(replica int, partition int) int32 {
+	size := rb.builder.affinityGroupSize
+	if size < 2 {
+		return -1
+	}
+	start := partition - partition%size
+	end := start + size
+	if end > rb.maxPartition+1 {
+		end = rb.maxPartition + 1
+	}
+	partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
+	for p := start; p < end; p++ {
+		nodeIndex := partitionToNodeIndex[p]
+		if p == partition || nodeIndex < 0 || rb.builder.nodes[nodeIndex].inactive || rb.nodeIndexToUsed[nodeIndex] || rb.nodeIndexToAvoided[nodeIndex] > 0 || !rb.allowed(replica, nodeIndex) || rb.tierConflict(replica, partition, nodeIndex) {
+			continue
+		}
+		// A node may go overweight by up to the group size to keep a group
+		// together.
+		if rb.nodeIndexToDesire[nodeIndex] <= -int32(size) {
+			continue
+		}
+		return nodeIndex
+	}
+	return -1
+}
+
+// tierConflict returns true if the node shares a tier, at any level, with the
+// node of another replica of the partition. Nodes sharing a tier at one level
+// share it at every level above, so only the top level need be compared; the
+// level above that is the one separation all nodes share.
+func (rb *rebalancer) tierConflict(replica int, partition int, nodeIndex int32) bool {
+	if rb.maxTier < 1 {
+		return false
+	}
+	tierSep := rb.tierToNodeIndexToTierSep[rb.maxTier-1][nodeIndex]
+	for otherReplica := rb.maxReplica; otherReplica >= 0; otherReplica-- {
+		otherNodeIndex := rb.builder.replicaToPartitionToNodeIndex[otherReplica][partition]
+		if otherReplica != replica && otherNodeIndex >= 0 && rb.tierToNodeIndexToTierSep[rb.maxTier-1][otherNodeIndex] == tierSep {
+			return true
+		}
+	}
+	return false
+}
+
 // Assign any partitions assigned as -1 (happens with new ring and can happen
-// with a node removed with the Remove() method).
+// with a node removed with the Remove() method). Replicas beyond a
+// partition's own replica count are left unassigned; see
+// Builder.SetReplicaCountForRange.
 func (rb *rebalancer) assignUnassigned() {
 	for replica := rb.maxReplica; replica >= 0; replica-- {
 		partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
 		for partition := rb.maxPartition; partition >= 0; partition-- {
-			if partitionToNodeIndex[partition] >= 0 {
+			if partitionToNodeIndex[partition] >= 0 || replica >= rb.builder.partitionReplicaCount(partition) {
 				continue
 			}
 			rb.clearUsed()
 			rb.markUsed(partition)
-			nodeIndex := rb.bestNodeIndex()
+			nodeIndex := rb.affinityNodeIndex(replica, partition)
+			if nodeIndex < 0 {
+				nodeIndex = rb.bestNodeIndex(replica)
+			}
 			if nodeIndex < 0 {
 				nodeIndex = rb.nodeIndexesByDesire[0]
 			}
 			partitionToNodeIndex[partition] = nodeIndex
+			rb.moved(partition, -1, nodeIndex)
 			rb.changeDesire(nodeIndex, false)
 			rb.partitionToMovementsLeft[partition]--
 			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
@@ -354,11 +601,15 @@ func (rb *rebalancer) reassignDeactivated() {
 				}
 				rb.clearUsed()
 				rb.markUsed(partition)
-				nodeIndex := rb.bestNodeIndex()
+				nodeIndex := rb.affinityNodeIndex(replica, partition)
+				if nodeIndex < 0 {
+					nodeIndex = rb.bestNodeIndex(replica)
+				}
 				if nodeIndex < 0 {
 					nodeIndex = rb.nodeIndexesByDesire[0]
 				}
 				partitionToNodeIndex[partition] = nodeIndex
+				rb.moved(partition, int32(deletedNodeIndex), nodeIndex)
 				rb.changeDesire(nodeIndex, false)
 				rb.partitionToMovementsLeft[partition]--
 				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
@@ -368,6 +619,68 @@ func (rb *rebalancer) reassignDeactivated() {
 	}
 }
 
+// Move replicas off nodes that don't meet the replica's constraint, if there
+// are nodes that do; see Builder.SetReplicaConstraint.
+func (rb *rebalancer) reassignConstraintViolations() {
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		allowed := rb.replicaToNodeIndexToAllowed[replica]
+		if allowed == nil {
+			continue
+		}
+		partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
+		for partition := rb.maxPartition; partition >= 0; partition-- {
+			fromNodeIndex := partitionToNodeIndex[partition]
+			if fromNodeIndex < 0 || allowed[fromNodeIndex] || rb.partitionToMovementsLeft[partition] < 1 || rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+				continue
+			}
+			rb.clearUsed()
+			rb.markUsed(partition)
+			nodeIndex := rb.bestAllowedNodeIndex(allowed)
+			if nodeIndex < 0 {
+				continue
+			}
+			rb.changeDesire(fromNodeIndex, true)
+			partitionToNodeIndex[partition] = nodeIndex
+			rb.moved(partition, fromNodeIndex, nodeIndex)
+			rb.changeDesire(nodeIndex, false)
+			rb.partitionToMovementsLeft[partition]--
+			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+			rb.altered = true
+		}
+	}
+}
+
+// Move replicas off nodes anti-affine to another node used by the partition,
+// if there are other nodes to move them to; see Builder.SetAntiAffinity.
+func (rb *rebalancer) reassignAntiAffinityViolations() {
+	if len(rb.builder.antiAffinities) == 0 {
+		return
+	}
+	for partition := rb.maxPartition; partition >= 0; partition-- {
+		rb.clearUsed()
+		rb.markUsed(partition)
+		for replica := rb.maxReplica; replica >= 0; replica-- {
+			fromNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+			if fromNodeIndex < 0 || rb.nodeIndexToAvoided[fromNodeIndex] == 0 || rb.partitionToMovementsLeft[partition] < 1 || rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+				continue
+			}
+			nodeIndex := rb.bestNodeIndex(replica)
+			if nodeIndex < 0 || rb.nodeIndexToAvoided[nodeIndex] > 0 || rb.nodeIndexToDesire[nodeIndex] == math.MinInt32 || !rb.allowed(replica, nodeIndex) {
+				continue
+			}
+			rb.changeDesire(fromNodeIndex, true)
+			rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
+			rb.moved(partition, fromNodeIndex, nodeIndex)
+			rb.changeDesire(nodeIndex, false)
+			rb.partitionToMovementsLeft[partition]--
+			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+			rb.altered = true
+			rb.clearUsed()
+			rb.markUsed(partition)
+		}
+	}
+}
+
 // Look for replicas assigned to the same node more than once. This shouldn't
 // be a common use case; but if it turns out to be, it might be worthwhile to
 // reassign the worst duplicates first. For example, a partition with only 1
@@ -382,15 +695,15 @@ DupLoopPartition:
 		}
 	DupLoopReplica:
 		for replica := rb.maxReplica; replica > 0; replica-- {
-			if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+			if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait || rb.builder.replicaToPartitionToNodeIndex[replica][partition] < 0 {
 				continue
 			}
 			for replicaB := replica - 1; replicaB >= 0; replicaB-- {
 				if rb.builder.replicaToPartitionToNodeIndex[replica][partition] == rb.builder.replicaToPartitionToNodeIndex[replicaB][partition] {
 					rb.clearUsed()
 					rb.markUsed(partition)
-					nodeIndex := rb.bestNodeIndex()
-					if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+					nodeIndex := rb.bestNodeIndex(replica)
+					if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 || rb.nodeIndexToAvoided[nodeIndex] > 0 || !rb.allowed(replica, nodeIndex) {
 						continue
 					}
 					// No sense reassigning a duplicate to another duplicate.
@@ -399,6 +712,7 @@ DupLoopPartition:
 							continue DupLoopReplica
 						}
 					}
+					rb.moved(partition, rb.builder.replicaToPartitionToNodeIndex[replica][partition], nodeIndex)
 					rb.changeDesire(rb.builder.replicaToPartitionToNodeIndex[replica][partition], true)
 					rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
 					rb.changeDesire(nodeIndex, false)
@@ -423,24 +737,28 @@ func (rb *rebalancer) reassignedSameTierDups() {
 			}
 		DupTierLoopReplica:
 			for replica := rb.maxReplica; replica > 0; replica-- {
-				if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+				if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait || rb.builder.replicaToPartitionToNodeIndex[replica][partition] < 0 {
 					continue
 				}
 				for replicaB := replica - 1; replicaB >= 0; replicaB-- {
+					if rb.builder.replicaToPartitionToNodeIndex[replicaB][partition] < 0 {
+						continue
+					}
 					if rb.tierToNodeIndexToTierSep[tier][rb.builder.replicaToPartitionToNodeIndex[replica][partition]] == rb.tierToNodeIndexToTierSep[tier][rb.builder.replicaToPartitionToNodeIndex[replicaB][partition]] {
 						rb.clearUsed()
 						rb.markUsed(partition)
-						nodeIndex := rb.bestNodeIndex()
-						if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+						nodeIndex := rb.bestNodeIndex(replica)
+						if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 || rb.nodeIndexToAvoided[nodeIndex] > 0 || !rb.allowed(replica, nodeIndex) {
 							continue
 						}
 						// No sense reassigning a duplicate to another
 						// duplicate.
 						for replicaC := rb.maxReplica; replicaC >= 0; replicaC-- {
-							if rb.tierToNodeIndexToTierSep[tier][nodeIndex] == rb.tierToNodeIndexToTierSep[tier][rb.builder.replicaToPartitionToNodeIndex[replicaC][partition]] {
+							if otherNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replicaC][partition]; otherNodeIndex >= 0 && rb.tierToNodeIndexToTierSep[tier][nodeIndex] == rb.tierToNodeIndexToTierSep[tier][otherNodeIndex] {
 								continue DupTierLoopReplica
 							}
 						}
+						rb.moved(partition, rb.builder.replicaToPartitionToNodeIndex[replica][partition], nodeIndex)
 						rb.changeDesire(rb.builder.replicaToPartitionToNodeIndex[replica][partition], true)
 						rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
 						rb.changeDesire(nodeIndex, false)
@@ -472,7 +790,7 @@ OverweightLoop:
 		if rb.nodeIndexToDesire[overweightNodeIndex] >= 0 {
 			break
 		}
-		if visited[overweightNodeIndex] || rb.builder.nodes[overweightNodeIndex].inactive {
+		if visited[overweightNodeIndex] || rb.builder.nodes[overweightNodeIndex].inactive || rb.nodeIndexToDraining[overweightNodeIndex] {
 			continue
 		}
 		// First pass to reassign to only underweight nodes.
@@ -484,12 +802,13 @@ OverweightLoop:
 				}
 				rb.clearUsed()
 				rb.markUsed(partition)
-				nodeIndex := rb.bestNodeIndex()
-				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+				nodeIndex := rb.bestNodeIndex(replica)
+				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 || rb.nodeIndexToAvoided[nodeIndex] > 0 || !rb.allowed(replica, nodeIndex) {
 					continue
 				}
 				rb.changeDesire(overweightNodeIndex, true)
 				partitionToNodeIndex[partition] = nodeIndex
+				rb.moved(partition, overweightNodeIndex, nodeIndex)
 				rb.changeDesire(nodeIndex, false)
 				rb.partitionToMovementsLeft[partition]--
 				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
@@ -510,12 +829,13 @@ OverweightLoop:
 				}
 				rb.clearUsed()
 				rb.markUsed(partition)
-				nodeIndex := rb.bestNodeIndex()
-				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] <= rb.nodeIndexToDesire[overweightNodeIndex] {
+				nodeIndex := rb.bestNodeIndex(replica)
+				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] <= rb.nodeIndexToDesire[overweightNodeIndex] || rb.nodeIndexToAvoided[nodeIndex] > 0 || !rb.allowed(replica, nodeIndex) {
 					continue
 				}
 				rb.changeDesire(overweightNodeIndex, true)
 				partitionToNodeIndex[partition] = nodeIndex
+				rb.moved(partition, overweightNodeIndex, nodeIndex)
 				rb.changeDesire(nodeIndex, false)
 				rb.partitionToMovementsLeft[partition]--
 				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
@@ -530,3 +850,60 @@ OverweightLoop:
 		visited[overweightNodeIndex] = true
 	}
 }
+
+// Try to bring the partitions of each affinity group onto the same nodes,
+// moving replicas to the node most of the group already uses, unless that
+// would put two of a partition's replicas in the same tier.
+func (rb *rebalancer) reassignForAffinity() {
+	size := rb.builder.affinityGroupSize
+	if size < 2 {
+		return
+	}
+	counts := make(map[int32]int, size)
+	for start := 0; start <= rb.maxPartition; start += size {
+		end := start + size
+		if end > rb.maxPartition+1 {
+			end = rb.maxPartition + 1
+		}
+		for replica := rb.maxReplica; replica >= 0; replica-- {
+			partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
+			for nodeIndex := range counts {
+				delete(counts, nodeIndex)
+			}
+			targetNodeIndex := int32(-1)
+			for partition := start; partition < end; partition++ {
+				nodeIndex := partitionToNodeIndex[partition]
+				counts[nodeIndex]++
+				if targetNodeIndex < 0 || counts[nodeIndex] > counts[targetNodeIndex] {
+					targetNodeIndex = nodeIndex
+				}
+			}
+			if targetNodeIndex < 0 || counts[targetNodeIndex] == end-start || rb.builder.nodes[targetNodeIndex].inactive || !rb.allowed(replica, targetNodeIndex) {
+				continue
+			}
+			for partition := start; partition < end; partition++ {
+				nodeIndex := partitionToNodeIndex[partition]
+				if nodeIndex == targetNodeIndex || (nodeIndex >= 0 && rb.nodeIndexToDraining[nodeIndex]) || replica >= rb.builder.partitionReplicaCount(partition) || rb.partitionToMovementsLeft[partition] < 1 || rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+					continue
+				}
+				if rb.nodeIndexToDesire[targetNodeIndex] <= -int32(size) {
+					break
+				}
+				rb.clearUsed()
+				rb.markUsed(partition)
+				if rb.nodeIndexToUsed[targetNodeIndex] || rb.nodeIndexToAvoided[targetNodeIndex] > 0 || rb.tierConflict(replica, partition, targetNodeIndex) {
+					continue
+				}
+				if nodeIndex >= 0 {
+					rb.changeDesire(nodeIndex, true)
+				}
+				partitionToNodeIndex[partition] = targetNodeIndex
+				rb.moved(partition, nodeIndex, targetNodeIndex)
+				rb.changeDesire(targetNodeIndex, false)
+				rb.partitionToMovementsLeft[partition]--
+				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+				rb.altered = true
+			}
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package ring
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -304,3 +307,287 @@ func TestRebalancerTier1b(t *testing.T) {
 		}
 	}
 }
+
+func TestRebalancerAffinityGroups(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	b.SetAffinityGroupSize(4)
+	for i := 0; i < 7; i++ {
+		b.AddNode(true, uint32(1+i%3), []string{fmt.Sprintf("server%d", i)}, nil, "", nil)
+	}
+	r, _ := b.Ring()
+	s := r.Stats()
+	if s.AffinityGroupSize != 4 {
+		t.Fatalf("AffinityGroupSize was %d instead of 4", s.AffinityGroupSize)
+	}
+	if s.AffinityGroupCohesion < 90 {
+		t.Fatalf("AffinityGroupCohesion was only %.02f%%", s.AffinityGroupCohesion)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Stats().AffinityGroupCohesion != s.AffinityGroupCohesion {
+		t.Fatalf("Loaded ring gave AffinityGroupCohesion %.02f%% instead of %.02f%%", r2.Stats().AffinityGroupCohesion, s.AffinityGroupCohesion)
+	}
+	b.SetAffinityGroupSize(0)
+	if r, _ := b.Ring(); r.Stats().AffinityGroupSize != 0 {
+		t.Fatal("AffinityGroupSize was not cleared")
+	}
+}
+
+func TestRebalancerAffinityGroupsTierSeparation(t *testing.T) {
+	zoneViolations := func(b *Builder) int {
+		violations := 0
+		for p := range b.replicaToPartitionToNodeIndex[0] {
+			zones := map[string]bool{}
+			for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+				if partitionToNodeIndex[p] < 0 {
+					continue
+				}
+				zone := b.nodes[partitionToNodeIndex[p]].Tier(1)
+				if zones[zone] {
+					violations++
+				}
+				zones[zone] = true
+			}
+		}
+		return violations
+	}
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	b.SetAffinityGroupSize(4)
+	var nodes []BuilderNode
+	for i := 0; i < 12; i++ {
+		n, _ := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil)
+		nodes = append(nodes, n)
+	}
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if v := zoneViolations(b); v != 0 {
+		t.Fatalf("%d zone violations", v)
+	}
+	// The zone of the node being replaced doesn't count as used.
+	nodes[0].SetActive(false)
+	b.PretendElapsed(math.MaxUint16)
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if v := zoneViolations(b); v != 0 {
+		t.Fatalf("%d zone violations after deactivating a node", v)
+	}
+	// Partitions are not moved onto the node the rest of their group uses if
+	// that node shares a zone with another of their replicas.
+	b = NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 4; i++ {
+		b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i/2)}, nil, "", nil)
+	}
+	b.Ring()
+	b.SetAffinityGroupSize(2)
+	b.PretendElapsed(math.MaxUint16)
+	for p := range b.replicaToPartitionToNodeIndex[0] {
+		if p%2 == 0 {
+			b.replicaToPartitionToNodeIndex[0][p] = 0
+			b.replicaToPartitionToNodeIndex[1][p] = 2
+		} else {
+			b.replicaToPartitionToNodeIndex[0][p] = 3
+			b.replicaToPartitionToNodeIndex[1][p] = 1
+		}
+	}
+	newRebalancer(b).reassignForAffinity()
+	if v := zoneViolations(b); v != 0 {
+		t.Fatalf("%d zone violations after reassigning for affinity", v)
+	}
+	for p := 1; p < len(b.replicaToPartitionToNodeIndex[0]); p += 2 {
+		b.replicaToPartitionToNodeIndex[0][p] = -1
+	}
+	newRebalancer(b).assignUnassigned()
+	if v := zoneViolations(b); v != 0 {
+		t.Fatalf("%d zone violations after assigning for affinity", v)
+	}
+}
+
+func TestRebalancerRepairReplication(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	var nodes []BuilderNode
+	for i := 0; i < 6; i++ {
+		n, _ := b.AddNode(true, 1, nil, nil, "", nil)
+		nodes = append(nodes, n)
+	}
+	r, _ := b.Ring()
+	if len(r.UnderReplicatedPartitions()) != 0 {
+		t.Fatalf("new ring gave under replicated partitions %v", r.UnderReplicatedPartitions())
+	}
+	before := b.AssignmentMap()
+	nodes[0].SetActive(false)
+	b.RemoveNode(nodes[1].ID())
+	// The nodes slice is shared, so the ring sees the deactivation.
+	under := r.UnderReplicatedPartitions()
+	if len(under) == 0 {
+		t.Fatal("no under replicated partitions after deactivating a node")
+	}
+	r, err := b.RepairReplication()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.UnderReplicatedPartitions()) != 0 {
+		t.Fatalf("repaired ring gave under replicated partitions %v", r.UnderReplicatedPartitions())
+	}
+	for partition, ids := range b.AssignmentMap() {
+		for replica, id := range ids {
+			was := before[partition][replica]
+			if was != nodes[0].ID() && was != nodes[1].ID() && id != was {
+				t.Fatalf("healthy replica %d of partition %d moved from %016x to %016x", replica, partition, was, id)
+			}
+			if id == nodes[0].ID() || id == 0 {
+				t.Fatalf("replica %d of partition %d was not repaired", replica, partition)
+			}
+		}
+	}
+}
+
+func TestRebalancerReplicaConstraint(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	for i := 0; i < 6; i++ {
+		meta := "disk=hdd"
+		if i < 2 {
+			meta = "disk=ssd rack=1"
+		}
+		b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i)}, nil, meta, nil)
+	}
+	b.Ring()
+	if err := b.SetReplicaConstraint(-1, "disk", "ssd"); err == nil {
+		t.Fatal("SetReplicaConstraint should have rejected a negative replica index")
+	}
+	if _, err := b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetReplicaConstraint(0, "disk", "ssd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Validate(); err == nil {
+		t.Fatal("Validate should have reported replicas not yet on ssd nodes")
+	}
+	for i := 0; i < 3; i++ {
+		b.PretendElapsed(math.MaxUint16)
+		b.Ring()
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for partition, ids := range b.AssignmentMap() {
+		if b.Node(ids[0]).Meta() == "disk=hdd" {
+			t.Fatalf("partition %d replica 0 was on an hdd node", partition)
+		}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) {
+		t.Fatal("replica constraint was not persisted")
+	}
+	if err := b.SetReplicaConstraint(1, "disk", "nvme"); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	if err := b.Validate(); err == nil || !strings.Contains(err.Error(), "replica 1") {
+		t.Fatalf("Validate with an unmeetable constraint gave %v", err)
+	}
+	b.Freeze()
+	if err := b.SetReplicaConstraint(1, "", ""); err != ErrBuilderFrozen {
+		t.Fatalf("SetReplicaConstraint on a frozen builder gave %v", err)
+	}
+}
+
+func TestRebalancerAntiAffinity(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	var nodes []BuilderNode
+	for i := 0; i < 6; i++ {
+		n, _ := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i)}, nil, "", nil)
+		nodes = append(nodes, n)
+	}
+	b.Ring()
+	if err := b.SetAntiAffinity(nodes[0].ID(), nodes[0].ID()); err == nil {
+		t.Fatal("SetAntiAffinity should have errored for the same node twice")
+	}
+	if err := b.SetAntiAffinity(nodes[0].ID(), 1); err == nil {
+		t.Fatal("SetAntiAffinity should have errored for an unknown node")
+	}
+	for _, pair := range [][2]int{{1, 0}, {2, 3}, {0, 1}} {
+		if err := b.SetAntiAffinity(nodes[pair[0]].ID(), nodes[pair[1]].ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pairs := b.AntiAffinities(); len(pairs) != 2 {
+		t.Fatalf("AntiAffinities gave %v", pairs)
+	}
+	if err := b.Validate(); err == nil || !strings.Contains(err.Error(), "anti-affine") {
+		t.Fatalf("Validate should have reported partitions on anti-affine nodes; gave %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		b.PretendElapsed(math.MaxUint16)
+		b.Ring()
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Equal(b2) {
+		t.Fatal("anti-affinities were not persisted")
+	}
+	// Adding a node keeps the pairs apart.
+	b.AddNode(true, 1, []string{"server6"}, nil, "", nil)
+	for i := 0; i < 3; i++ {
+		b.PretendElapsed(math.MaxUint16)
+		b.Ring()
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b.ClearAntiAffinity(nodes[3].ID(), nodes[2].ID())
+	b.RemoveNode(nodes[0].ID())
+	if pairs := b.AntiAffinities(); len(pairs) != 0 {
+		t.Fatalf("AntiAffinities gave %v after clearing and removing", pairs)
+	}
+	// With only as many nodes as replicas the violation is unavoidable.
+	b = NewBuilder()
+	b.SetReplicaCount(3)
+	nodes = nodes[:0]
+	for i := 0; i < 3; i++ {
+		n, _ := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i)}, nil, "", nil)
+		nodes = append(nodes, n)
+	}
+	b.SetAntiAffinity(nodes[0].ID(), nodes[1].ID())
+	if _, err = b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Validate(); err == nil || !strings.Contains(err.Error(), "anti-affine") {
+		t.Fatalf("Validate should have reported the unavoidable violation; gave %v", err)
+	}
+	for partition, ids := range b.AssignmentMap() {
+		if len(ids) != 3 || ids[0] == ids[1] || ids[0] == ids[2] || ids[1] == ids[2] {
+			t.Fatalf("partition %d was assigned %v", partition, ids)
+		}
+	}
+}
@@ -8,18 +8,43 @@
 package ring
 
 import (
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ringFormatVersion is the version of the persisted Ring format written by
+// Persist; LoadRing can read this version and all earlier versions.
+const ringFormatVersion = 10
+
 // Ring is the immutable snapshot of data assignments to nodes.
 type Ring interface {
 	// Version is the time.Now().UnixNano() of when the Ring data was
 	// established.
 	Version() int64
+	// Label is the optional human readable label given with
+	// Builder.SetLabel.
+	Label() string
+	// CreatedAt is when the Ring was created by Builder.Ring; this differs
+	// from Version in that it changes with every Ring call, even if the Ring
+	// data did not change. It is the zero time for Rings loaded from format
+	// versions that predate it.
+	CreatedAt() time.Time
+	// BuilderID is the ID of the Builder that produced the Ring; see
+	// Builder.ID. It is empty for Rings loaded from format versions that
+	// predate it.
+	BuilderID() string
 	// Conf returns the raw encoded global configuration.
 	Conf() []byte
 	// SetConf stores the provided config bytes.
@@ -28,32 +53,193 @@ type Ring interface {
 	Node(nodeID uint64) Node
 	// Nodes returns a NodeSlice of the nodes the Ring references.
 	Nodes() NodeSlice
+	// NodeIDs returns the IDs of all the nodes the Ring references, active
+	// or not, in ascending order.
+	NodeIDs() []uint64
+	// NodeByAddress returns the node with the address given. If no node has
+	// the exact address, a node whose address has the same host will be
+	// returned, as long as only one node matches on the host; this is useful
+	// for identifying the remote node of an inbound connection, whose source
+	// port will differ from the node's listening port.
+	NodeByAddress(addr string) (Node, bool)
 	// Tiers returns the tier values in use at each level. Note that an empty
 	// string is always an available value at any level, although it is not
 	// returned from this method.
 	Tiers() [][]string
+	// NodesInTier returns the active nodes with the value at the tier level
+	// given, such as all the nodes in a data center.
+	NodesInTier(level int, value string) NodeSlice
 	// PartitionBitCount indicates how many partitions the Ring has. For
 	// example, a PartitionBitCount of 16 would indicate 2**16 or 65,536
 	// partitions.
 	PartitionBitCount() uint16
-	// ReplicaCount specifies how many replicas the Ring has.
+	// PartitionCount is the number of partitions the Ring has; that is,
+	// 2**PartitionBitCount.
+	PartitionCount() uint32
+	// PartitionRange returns the node IDs of the replicas of each partition
+	// from start up to but not including end, indexed by partition - start
+	// and then by replica; a node ID of 0 indicates an unassigned replica.
+	// This allows a caller to go through the partitions of a large ring in
+	// bounded chunks. An error is returned unless start <= end <=
+	// PartitionCount. The partitions are numbered from 0; see
+	// ExternalPartition.
+	PartitionRange(start uint32, end uint32) ([][]uint64, error)
+	// ReplicaCount specifies how many replicas the Ring has, other than for
+	// partitions given a different count; see PartitionReplicaCount.
 	ReplicaCount() int
+	// PartitionReplicaCount returns the number of replicas the partition
+	// has, which differs from ReplicaCount for partitions in a range given a
+	// different count with Builder.SetReplicaCountForRange; 0 is returned for
+	// a partition beyond the partition count.
+	PartitionReplicaCount(partition uint32) int
 	// LocalNode returns the node the ring is locally bound to, if any. This
 	// local node binding is used by things such as MsgRing to know what items
 	// are bound for the local instance or need to be sent to remote ones, etc.
 	LocalNode() Node
 	SetLocalNode(nodeID uint64)
+	// DetectLocalNode sets the local node to the one node with an address
+	// matching one of the local addresses given, such as those of the local
+	// network interfaces, and returns its ID. Addresses match if equal or, if
+	// either lacks a port, if their hosts are equal. An error is returned,
+	// and the local node left unchanged, if no node or more than one node
+	// matches.
+	DetectLocalNode(localAddrs []string) (uint64, error)
+	// SetLocalNodeByAddress sets the local node to the one node with the
+	// address given, such as a bind address from a config file. Addresses
+	// are matched exactly as host:port or, if no node matches that way, by
+	// host alone. An error is returned, and the local node left unchanged,
+	// if no node or more than one node matches.
+	SetLocalNodeByAddress(addr string) error
 	// Responsible will return true if LocalNode is set and one of the
-	// partition's replicas is assigned to that local node.
+	// partition's replicas is assigned to that local node; it returns false if
+	// no LocalNode is set. It only checks the partition's replica assignments,
+	// so prefer it over scanning ResponsibleNodes for the local node's ID.
 	Responsible(partition uint32) bool
+	// LocalPartitions returns the partitions, in ascending order, that
+	// LocalNode has a replica of; it returns nil if no LocalNode is set. The
+	// partitions are numbered from 0; see ExternalPartition.
+	LocalPartitions() []uint32
+	// LocalPartitionRanges returns LocalPartitions collapsed into contiguous
+	// ranges, each [start, end] inclusive and in ascending order; this is
+	// much more compact when ownership is mostly contiguous and suits
+	// storage engines that scan ranges.
+	LocalPartitionRanges() [][2]uint32
+	// HashFunc returns the name of the HashFunc used to map keys to
+	// partitions; see RegisterHashFunc.
+	HashFunc() string
+	// PartitionForKey returns the partition the key maps to.
+	PartitionForKey(key []byte) uint32
+	// PartitionOffset is the offset set with Builder.SetPartitionOffset, for
+	// rings that each cover part of a larger partition space. It applies
+	// only to externally exposed partition numbers; the other methods taking
+	// or returning partitions use the ring's own numbering from 0, as does
+	// routing within the ring.
+	PartitionOffset() uint32
+	// ExternalPartitionForKey returns the partition the key maps to with the
+	// PartitionOffset added, for use outside the ring.
+	ExternalPartitionForKey(key []byte) uint32
+	// ExternalPartition returns the externally exposed number of the ring's
+	// own partition given, that is with the PartitionOffset added, such as
+	// for the partitions from LocalPartitions, LocalPartitionRanges,
+	// PartitionRange, PartitionsForKeyRange, or a HandoffHandler.
+	ExternalPartition(partition uint32) uint32
+	// PartitionForExternal returns the ring's own partition number for the
+	// externally exposed one given, as from ExternalPartitionForKey; false is
+	// returned if the partition is not within this ring.
+	PartitionForExternal(external uint32) (uint32, bool)
+	// ResponsibleForKey is the same as Responsible for the key's partition.
+	ResponsibleForKey(key []byte) bool
+	// PartitionsForKeyRange returns, in order, the partitions from that of
+	// startKey through that of endKey, wrapping around past the last
+	// partition should endKey's partition come before startKey's. This is a
+	// range of ring positions, not of keys: hashing scatters keys, so keys
+	// between the two bounds in key order can be in any partition and even a
+	// small key range may span many, or all, partitions. It suits
+	// applications whose scans are over hash order, such as resuming a scan
+	// from the hash position of the last key seen. The partitions are
+	// numbered from 0; see ExternalPartition.
+	PartitionsForKeyRange(startKey []byte, endKey []byte) []uint32
 	// ResponsibleNodes will return the list of nodes that are responsible for
-	// the replicas of the partition.
+	// the replicas of the partition; unassigned replicas are left out, so the
+	// list is empty for a ring built before any nodes were added.
 	ResponsibleNodes(partition uint32) NodeSlice
+	// ReplicaAddressesWithPortOverride returns the hosts of the first
+	// addresses of the nodes responsible for the partition, in the order of
+	// ResponsibleNodes, each joined with the port given; this suits clients
+	// connecting to a service on a different port than the one used between
+	// nodes. IPv6 hosts are bracketed as needed, and nodes without an address
+	// are left out.
+	ReplicaAddressesWithPortOverride(partition uint32, port int) []string
+	// WalkNodesForKey returns up to count distinct active nodes for the key:
+	// those holding replicas of the key's partition followed by those
+	// holding replicas of the partitions after it, in ring order. The nodes
+	// beyond the replica set are useful as fallback targets, such as for
+	// hinted handoff when a replica is down.
+	WalkNodesForKey(key []byte, count int) NodeSlice
+	// PickReplicaForKey returns one of the active nodes holding a replica of
+	// the key's partition, chosen at random weighted by node capacity, such
+	// as to spread reads toward larger nodes. The choice is deterministic
+	// for a given seed. Nil is returned if no replica is on an active node.
+	PickReplicaForKey(key []byte, seed int64) Node
+	// PickLiveReplicaForKey is the same as PickReplicaForKey, with a random
+	// seed, except that only the replicas on nodes the liveness function
+	// reports as alive are considered, such as to avoid nodes the transport
+	// layer knows to be down. False is returned if none are alive.
+	PickLiveReplicaForKey(key []byte, liveness func(nodeID uint64) bool) (Node, bool)
+	// CommonPartitions returns the partitions, in ascending order, that both
+	// nodes identified have a replica of; useful for estimating the data
+	// transfer when replacing one node with another, or for finding unwanted
+	// correlation between nodes.
+	CommonPartitions(a uint64, b uint64) []uint32
+	// PartitionBitmapForNode returns the partitions the node identified has a
+	// replica of as a bitmap covering PartitionCount partitions; nil is
+	// returned if the node is not in the ring. This is much more compact than
+	// a slice of partitions for large rings and suits set operations between
+	// nodes, such as with the bitmaps of another ring for migration planning.
+	PartitionBitmapForNode(nodeID uint64) *PartitionBitmap
+	// UnderReplicatedPartitions returns the partitions, in ascending order,
+	// with replicas that are unassigned or assigned to inactive nodes; see
+	// Builder.RepairReplication.
+	UnderReplicatedPartitions() []uint32
 	// Stats returns information about the ring for reporting purposes.
 	Stats() *RingStats
+	// TierStats returns, by tier value at the level given, the number of
+	// partition replicas assigned to nodes with that value compared to its
+	// target based on the value's share of the total capacity. This shows
+	// when a tier, such as a rack, is overloaded even though its individual
+	// nodes look balanced, as can happen with uneven tier sizes. Nodes
+	// without a value at the level are reported under the empty string.
+	TierStats(level int) map[string]TierStat
+	// Validate checks the structure of the ring's data, such as that every
+	// replica assignment refers to a node in the ring, returning an error
+	// describing any problems found. A Ring from a Builder is always valid,
+	// but one loaded from a corrupt or hand edited file may not be; see
+	// RingOrBuilderValidated.
+	Validate() error
+	// Fingerprint returns a SHA-256 hash of the ring's logical content: its
+	// nodes, in ID order, tiers, assignments, replica counts, hash function,
+	// and settings. The version, label, creation time, builder ID,
+	// compression, and local node are left out, so two rings with the same
+	// topology have the same fingerprint however and whenever they were
+	// built; compare Version as well to also tell apart rebuilds that changed
+	// nothing. It is cheaper to compare and log than the rings themselves.
+	Fingerprint() [32]byte
+	// FingerprintWithVersion is the same as Fingerprint but with the Version
+	// included, so a rebuild that changed nothing gives a different
+	// fingerprint.
+	FingerprintWithVersion() [32]byte
+	// WriteGraphviz writes a Graphviz DOT graph of the ring's nodes, grouped
+	// into nested clusters by tier value from the outermost tier level
+	// inward, with each node annotated with its address and partition
+	// replica count. The output is deterministic for a given ring.
+	WriteGraphviz(w io.Writer) error
 	// Persist saves the Ring state to the given Writer for later reloading via
 	// the LoadBuilder method.
 	Persist(w io.Writer) error
+	// PersistVersion is the same as Persist but writes the format version
+	// given, for use by nodes running older code. An error is returned if the
+	// version is unknown or the Ring's data cannot be represented in it.
+	PersistVersion(w io.Writer, formatVersion int) error
 }
 
 type tierBase struct {
@@ -68,6 +254,19 @@ type ring struct {
 	partitionBitCount             uint16
 	nodes                         []*node
 	replicaToPartitionToNodeIndex [][]int32
+	compression                   Compression
+	affinityGroupSize             int
+	hashFuncName                  string
+	hashFunc                      HashFunc
+	label                         string
+	createdAt                     int64
+	builderID                     string
+	tierCosts                     []float64
+	// replicaCount and replicaCountRanges are only used if there are ranges
+	// with other replica counts; see Builder.SetReplicaCountForRange.
+	replicaCount       int
+	replicaCountRanges []*replicaCountRange
+	partitionOffset    uint32
 }
 
 // LoadRing creates a new Ring instance based on the persisted data from the
@@ -76,7 +275,7 @@ func LoadRing(rd io.Reader) (Ring, error) {
 	// CONSIDER: This code uses binary.Read which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
 	// binary.Put* calls instead.
-	gr, err := gzip.NewReader(rd)
+	gr, compression, err := newDecompressReader(rd)
 	if err != nil {
 		return nil, err
 	}
@@ -86,14 +285,35 @@ func LoadRing(rd io.Reader) (Ring, error) {
 	if err != nil {
 		return nil, err
 	}
-	if string(header) != "RINGv00000000001" {
+	if string(header[:5]) != "RINGv" {
+		return nil, fmt.Errorf("unknown header %s", string(header))
+	}
+	formatVersion, err := strconv.Atoi(string(header[5:]))
+	if err != nil || formatVersion < 1 || formatVersion > ringFormatVersion {
 		return nil, fmt.Errorf("unknown header %s", string(header))
 	}
-	r := &ring{}
+	r := &ring{compression: compression, hashFuncName: DefaultHashFunc}
+	r.hashFunc, _ = lookupHashFunc(r.hashFuncName)
 	err = binary.Read(gr, binary.BigEndian, &r.version)
 	if err != nil {
 		return nil, err
 	}
+	if formatVersion >= 10 {
+		// The info block is only stored for RingInfo; everything in it is
+		// stored again, or recomputed, from the rest of the Ring.
+		var infoLength int32
+		err = binary.Read(gr, binary.BigEndian, &infoLength)
+		if err != nil {
+			return nil, err
+		}
+		if infoLength < 0 {
+			return nil, fmt.Errorf("invalid info block length %d", infoLength)
+		}
+		_, err = io.CopyN(ioutil.Discard, gr, int64(infoLength))
+		if err != nil {
+			return nil, err
+		}
+	}
 	var confbytes int32
 	err = binary.Read(gr, binary.BigEndian, &confbytes)
 	if err != nil {
@@ -227,16 +447,163 @@ func LoadRing(rd io.Reader) (Ring, error) {
 		r.replicaToPartitionToNodeIndex[i] = make([]int32, vvint32)
 		err = binary.Read(gr, binary.BigEndian, r.replicaToPartitionToNodeIndex[i])
 	}
+	if formatVersion < 2 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	r.affinityGroupSize = int(vint32)
+	if formatVersion < 3 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts := make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	r.hashFuncName = string(byts)
+	r.hashFunc, err = lookupHashFunc(r.hashFuncName)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 4 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts = make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	r.label = string(byts)
+	err = binary.Read(gr, binary.BigEndian, &r.createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 5 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	byts = make([]byte, vint32)
+	_, err = io.ReadFull(gr, byts)
+	if err != nil {
+		return nil, err
+	}
+	r.builderID = string(byts)
+	if formatVersion < 6 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	r.tierCosts = make([]float64, vint32)
+	err = binary.Read(gr, binary.BigEndian, r.tierCosts)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 7 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	r.replicaCount = int(vint32)
+	err = binary.Read(gr, binary.BigEndian, &vint32)
+	if err != nil {
+		return nil, err
+	}
+	r.replicaCountRanges = make([]*replicaCountRange, vint32)
+	for i := int32(0); i < vint32; i++ {
+		rcr := &replicaCountRange{}
+		err = binary.Read(gr, binary.BigEndian, &rcr.start)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(gr, binary.BigEndian, &rcr.end)
+		if err != nil {
+			return nil, err
+		}
+		var count int32
+		err = binary.Read(gr, binary.BigEndian, &count)
+		if err != nil {
+			return nil, err
+		}
+		rcr.count = int(count)
+		r.replicaCountRanges[i] = rcr
+	}
+	if formatVersion < 8 {
+		return r, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &r.partitionOffset)
+	if err != nil {
+		return nil, err
+	}
+	if formatVersion < 9 {
+		return r, nil
+	}
+	// The fingerprint is only stored for RingInfo; it's recomputed as needed
+	// from the Ring itself.
+	_, err = io.CopyN(ioutil.Discard, gr, 32)
+	if err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
 func (r *ring) Persist(w io.Writer) error {
+	return r.PersistVersion(w, ringFormatVersion)
+}
+
+func (r *ring) PersistVersion(w io.Writer, formatVersion int) error {
+	if formatVersion < 1 || formatVersion > ringFormatVersion {
+		return fmt.Errorf("unknown ring format version %d", formatVersion)
+	}
+	if formatVersion < 2 {
+		// Version 1 readers only understood gzip and had no affinity groups.
+		if r.compression != CompressionGzip {
+			return fmt.Errorf("%s compression cannot be represented in ring format version %d", r.compression, formatVersion)
+		}
+		if r.affinityGroupSize > 1 {
+			return fmt.Errorf("affinity group size %d cannot be represented in ring format version %d", r.affinityGroupSize, formatVersion)
+		}
+	}
+	if formatVersion < 3 && r.hashFuncName != DefaultHashFunc {
+		return fmt.Errorf("hash func %q cannot be represented in ring format version %d", r.hashFuncName, formatVersion)
+	}
+	// The creation time, builder ID, and tier costs are simply omitted from
+	// older versions.
+	if formatVersion < 4 && r.label != "" {
+		return fmt.Errorf("label cannot be represented in ring format version %d", formatVersion)
+	}
+	if formatVersion < 7 && len(r.replicaCountRanges) > 0 {
+		return fmt.Errorf("replica count ranges cannot be represented in ring format version %d", formatVersion)
+	}
+	if formatVersion < 8 && r.partitionOffset != 0 {
+		return fmt.Errorf("partition offset cannot be represented in ring format version %d", formatVersion)
+	}
 	// CONSIDER: This code uses binary.Write which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
 	// binary.Put* calls instead.
-	gw := gzip.NewWriter(w)
+	gw, err := newCompressWriter(w, r.compression)
+	if err != nil {
+		return err
+	}
 	defer gw.Close() // does not close the underlying writer
-	_, err := gw.Write([]byte("RINGv00000000001"))
+	_, err = gw.Write([]byte(fmt.Sprintf("RINGv%011d", formatVersion)))
 	if err != nil {
 		return err
 	}
@@ -244,6 +611,20 @@ func (r *ring) Persist(w io.Writer) error {
 	if err != nil {
 		return err
 	}
+	if formatVersion >= 10 {
+		info, err := r.infoBlock()
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(len(info)))
+		if err != nil {
+			return err
+		}
+		_, err = gw.Write(info)
+		if err != nil {
+			return err
+		}
+	}
 	if len(r.conf) > math.MaxInt32 {
 		return fmt.Errorf("%d conf bytes is too large; max is %d", len(r.conf), math.MaxInt32)
 	}
@@ -396,9 +777,135 @@ func (r *ring) Persist(w io.Writer) error {
 			return err
 		}
 	}
+	if formatVersion < 2 {
+		return nil
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(r.affinityGroupSize))
+	if err != nil {
+		return err
+	}
+	if formatVersion < 3 {
+		return nil
+	}
+	byts := []byte(r.hashFuncName)
+	if len(byts) > math.MaxInt32 {
+		return fmt.Errorf("%d hash func name length is too large; max is %d", len(byts), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	if formatVersion < 4 {
+		return nil
+	}
+	byts = []byte(r.label)
+	if len(byts) > math.MaxInt32 {
+		return fmt.Errorf("%d label length is too large; max is %d", len(byts), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, r.createdAt)
+	if err != nil {
+		return err
+	}
+	if formatVersion < 5 {
+		return nil
+	}
+	byts = []byte(r.builderID)
+	err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+	if err != nil {
+		return err
+	}
+	_, err = gw.Write(byts)
+	if err != nil {
+		return err
+	}
+	if formatVersion < 6 {
+		return nil
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(r.tierCosts)))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, r.tierCosts)
+	if err != nil {
+		return err
+	}
+	if formatVersion < 7 {
+		return nil
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(r.replicaCount))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(r.replicaCountRanges)))
+	if err != nil {
+		return err
+	}
+	for _, rcr := range r.replicaCountRanges {
+		err = binary.Write(gw, binary.BigEndian, rcr.start)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, rcr.end)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(rcr.count))
+		if err != nil {
+			return err
+		}
+	}
+	if formatVersion < 8 {
+		return nil
+	}
+	err = binary.Write(gw, binary.BigEndian, r.partitionOffset)
+	if err != nil {
+		return err
+	}
+	if formatVersion < 9 {
+		return nil
+	}
+	fingerprint := r.Fingerprint()
+	_, err = gw.Write(fingerprint[:])
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// infoBlock returns the metadata RingInfo reports, as written near the start
+// of format version 10 and later so RingInfo can stop reading there: the
+// partition bit count, node count, replica count, label, creation time,
+// builder ID, and fingerprint.
+func (r *ring) infoBlock() ([]byte, error) {
+	if len(r.label) > math.MaxInt32 || len(r.builderID) > math.MaxInt32 {
+		return nil, fmt.Errorf("label or builder ID is too large; max is %d", math.MaxInt32)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, r.partitionBitCount)
+	binary.Write(&buf, binary.BigEndian, int32(len(r.nodes)))
+	binary.Write(&buf, binary.BigEndian, int32(r.ReplicaCount()))
+	binary.Write(&buf, binary.BigEndian, int32(len(r.label)))
+	buf.WriteString(r.label)
+	binary.Write(&buf, binary.BigEndian, r.createdAt)
+	binary.Write(&buf, binary.BigEndian, int32(len(r.builderID)))
+	buf.WriteString(r.builderID)
+	fingerprint := r.Fingerprint()
+	buf.Write(fingerprint[:])
+	return buf.Bytes(), nil
+}
+
 // Version can indicate changes in ring data; for example, if a server is
 // currently working with one version of ring data and receives requests that
 // are based on a lesser version of ring data, it can ignore those requests or
@@ -409,6 +916,21 @@ func (r *ring) Version() int64 {
 	return r.version
 }
 
+func (r *ring) Label() string {
+	return r.label
+}
+
+func (r *ring) CreatedAt() time.Time {
+	if r.createdAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.createdAt)
+}
+
+func (r *ring) BuilderID() string {
+	return r.builderID
+}
+
 // GlobalConf is the raw encoded bytes of the config object.
 func (r *ring) Conf() []byte {
 	return r.conf
@@ -427,7 +949,17 @@ func (r *ring) PartitionBitCount() uint16 {
 }
 
 func (r *ring) ReplicaCount() int {
-	return len(r.replicaToPartitionToNodeIndex)
+	if len(r.replicaCountRanges) == 0 {
+		return len(r.replicaToPartitionToNodeIndex)
+	}
+	return r.replicaCount
+}
+
+func (r *ring) PartitionReplicaCount(partition uint32) int {
+	if partition >= r.PartitionCount() {
+		return 0
+	}
+	return partitionReplicaCount(r.ReplicaCount(), r.replicaCountRanges, int(partition), r.partitionBitCount)
 }
 
 // Nodes returns a list of nodes referenced by the ring.
@@ -439,6 +971,10 @@ func (r *ring) Nodes() NodeSlice {
 	return nodes
 }
 
+func (r *ring) NodeIDs() []uint64 {
+	return sortedNodeIDs(r.nodes, true)
+}
+
 func (r *ring) Node(id uint64) Node {
 	for _, n := range r.nodes {
 		if n.id == id {
@@ -448,6 +984,35 @@ func (r *ring) Node(id uint64) Node {
 	return nil
 }
 
+func (r *ring) NodeByAddress(addr string) (Node, bool) {
+	for _, n := range r.nodes {
+		for _, a := range n.addresses {
+			if a == addr {
+				return n, true
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	var match *node
+	for _, n := range r.nodes {
+		for _, a := range n.addresses {
+			if h, _, err := net.SplitHostPort(a); err == nil && h == host {
+				if match != nil && match != n {
+					return nil, false
+				}
+				match = n
+			}
+		}
+	}
+	if match == nil {
+		return nil, false
+	}
+	return match, true
+}
+
 func (r *ring) Tiers() [][]string {
 	rv := make([][]string, len(r.tiers))
 	for i, t := range r.tiers {
@@ -457,6 +1022,16 @@ func (r *ring) Tiers() [][]string {
 	return rv
 }
 
+func (r *ring) NodesInTier(level int, value string) NodeSlice {
+	var nodes NodeSlice
+	for _, n := range r.nodes {
+		if !n.inactive && n.Tier(level) == value {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
 // LocalNode contains the information for the local node; determining which
 // ring partitions/replicas the local node is responsible for as well as being
 // used to direct message delivery. If this instance of the ring has no local
@@ -478,10 +1053,90 @@ func (r *ring) SetLocalNode(id uint64) {
 	}
 }
 
+// hostOf returns the host of the address and true, or the address and false
+// if it has no port.
+func hostOf(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	return host, true
+}
+
+func (r *ring) DetectLocalNode(localAddrs []string) (uint64, error) {
+	var matches []*node
+	for _, n := range r.nodes {
+		matched := false
+		for _, a := range n.addresses {
+			aHost, aPort := hostOf(a)
+			for _, l := range localAddrs {
+				lHost, lPort := hostOf(l)
+				if a == l || (aHost == lHost && (!aPort || !lPort)) {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, n)
+		}
+	}
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no node matches local addresses %v", localAddrs)
+	}
+	if len(matches) > 1 {
+		ids := make([]string, len(matches))
+		for i, n := range matches {
+			ids[i] = fmt.Sprintf("%016x", n.id)
+		}
+		return 0, fmt.Errorf("multiple nodes match local addresses %v: %s", localAddrs, strings.Join(ids, ", "))
+	}
+	r.SetLocalNode(matches[0].id)
+	return matches[0].id, nil
+}
+
+func (r *ring) SetLocalNodeByAddress(addr string) error {
+	var matches []*node
+	for _, n := range r.nodes {
+		for _, a := range n.addresses {
+			if a == addr {
+				matches = append(matches, n)
+				break
+			}
+		}
+	}
+	if len(matches) == 0 {
+		host, _ := hostOf(addr)
+		for _, n := range r.nodes {
+			for _, a := range n.addresses {
+				if aHost, _ := hostOf(a); aHost == host {
+					matches = append(matches, n)
+					break
+				}
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no node has address %s", addr)
+	}
+	if len(matches) > 1 {
+		ids := make([]string, len(matches))
+		for i, n := range matches {
+			ids[i] = fmt.Sprintf("%016x", n.id)
+		}
+		return fmt.Errorf("multiple nodes match address %s: %s", addr, strings.Join(ids, ", "))
+	}
+	r.SetLocalNode(matches[0].id)
+	return nil
+}
+
 // Responsible will return true if the local node is considered responsible for
 // a replica of the partition given.
 func (r *ring) Responsible(partition uint32) bool {
-	if r.localNodeIndex == -1 {
+	if r.localNodeIndex == -1 || partition >= r.PartitionCount() {
 		return false
 	}
 	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
@@ -492,16 +1147,344 @@ func (r *ring) Responsible(partition uint32) bool {
 	return false
 }
 
+func (r *ring) LocalPartitions() []uint32 {
+	if r.localNodeIndex == -1 {
+		return nil
+	}
+	var partitions []uint32
+	partitionCount := len(r.replicaToPartitionToNodeIndex[0])
+	for partition := 0; partition < partitionCount; partition++ {
+		for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+			if partitionToNodeIndex[partition] == r.localNodeIndex {
+				partitions = append(partitions, uint32(partition))
+				break
+			}
+		}
+	}
+	return partitions
+}
+
+func (r *ring) LocalPartitionRanges() [][2]uint32 {
+	var ranges [][2]uint32
+	for _, partition := range r.LocalPartitions() {
+		if last := len(ranges) - 1; last >= 0 && ranges[last][1]+1 == partition {
+			ranges[last][1] = partition
+		} else {
+			ranges = append(ranges, [2]uint32{partition, partition})
+		}
+	}
+	return ranges
+}
+
+func (r *ring) HashFunc() string {
+	return r.hashFuncName
+}
+
+func (r *ring) PartitionForKey(key []byte) uint32 {
+	// Rings are only loaded or built with registered hash funcs, but a ring
+	// value made directly has none; it gets the default rather than a panic.
+	hashFunc := r.hashFunc
+	if hashFunc == nil {
+		hashFunc = md5HashFunc
+	}
+	return uint32(hashFunc(key) >> (64 - r.partitionBitCount))
+}
+
+func (r *ring) PartitionOffset() uint32 {
+	return r.partitionOffset
+}
+
+func (r *ring) ExternalPartitionForKey(key []byte) uint32 {
+	return r.ExternalPartition(r.PartitionForKey(key))
+}
+
+func (r *ring) ExternalPartition(partition uint32) uint32 {
+	return partition + r.partitionOffset
+}
+
+func (r *ring) PartitionForExternal(external uint32) (uint32, bool) {
+	if external < r.partitionOffset || external-r.partitionOffset >= r.PartitionCount() {
+		return 0, false
+	}
+	return external - r.partitionOffset, true
+}
+
+func (r *ring) PartitionsForKeyRange(startKey []byte, endKey []byte) []uint32 {
+	start := r.PartitionForKey(startKey)
+	end := r.PartitionForKey(endKey)
+	count := r.PartitionCount()
+	partitions := make([]uint32, 0, (end+count-start)%count+1)
+	for partition := start; ; partition = (partition + 1) % count {
+		partitions = append(partitions, partition)
+		if partition == end {
+			break
+		}
+	}
+	return partitions
+}
+
+func (r *ring) ResponsibleForKey(key []byte) bool {
+	return r.Responsible(r.PartitionForKey(key))
+}
+
 // ResponsibleNodes will return a list of nodes for considered responsible for
-// the replicas of the partition given.
+// the replicas of the partition given. Unassigned replicas, such as in a ring
+// built before any nodes were added, are left out, as are all replicas of a
+// partition beyond the ring's partition count.
 func (r *ring) ResponsibleNodes(partition uint32) NodeSlice {
-	nodes := make(NodeSlice, r.ReplicaCount())
-	for replica, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
-		nodes[replica] = r.nodes[partitionToNodeIndex[partition]]
+	if partition >= r.PartitionCount() {
+		return NodeSlice{}
+	}
+	nodes := make(NodeSlice, 0, r.ReplicaCount())
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		if nodeIndex := partitionToNodeIndex[partition]; nodeIndex >= 0 {
+			nodes = append(nodes, r.nodes[nodeIndex])
+		}
 	}
 	return nodes
 }
 
+func (r *ring) ReplicaAddressesWithPortOverride(partition uint32, port int) []string {
+	var addrs []string
+	for _, n := range r.ResponsibleNodes(partition) {
+		addr := n.Address(0)
+		if addr == "" {
+			continue
+		}
+		host, _ := hostOf(addr)
+		// A bare IPv6 address may already be bracketed.
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addrs
+}
+
+func (r *ring) WalkNodesForKey(key []byte, count int) NodeSlice {
+	var nodes NodeSlice
+	seen := make(map[int32]bool, count)
+	partitionCount := uint32(len(r.replicaToPartitionToNodeIndex[0]))
+	start := r.PartitionForKey(key)
+	for i := uint32(0); i < partitionCount && len(nodes) < count; i++ {
+		partition := (start + i) % partitionCount
+		for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+			nodeIndex := partitionToNodeIndex[partition]
+			if nodeIndex < 0 || seen[nodeIndex] || r.nodes[nodeIndex].inactive {
+				continue
+			}
+			seen[nodeIndex] = true
+			nodes = append(nodes, r.nodes[nodeIndex])
+			if len(nodes) == count {
+				break
+			}
+		}
+	}
+	return nodes
+}
+
+func (r *ring) PickReplicaForKey(key []byte, seed int64) Node {
+	n := r.pickReplica(key, seed, nil)
+	if n == nil {
+		return nil
+	}
+	return n
+}
+
+func (r *ring) PickLiveReplicaForKey(key []byte, liveness func(nodeID uint64) bool) (Node, bool) {
+	n := r.pickReplica(key, rand.Int63(), liveness)
+	if n == nil {
+		return nil, false
+	}
+	return n, true
+}
+
+// pickReplica returns one of the active nodes holding a replica of the key's
+// partition, chosen at random weighted by capacity, considering only those
+// the liveness function, if given, reports as alive.
+func (r *ring) pickReplica(key []byte, seed int64, liveness func(nodeID uint64) bool) *node {
+	partition := r.PartitionForKey(key)
+	var candidates []*node
+	var total uint64
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		nodeIndex := partitionToNodeIndex[partition]
+		if nodeIndex < 0 || r.nodes[nodeIndex].inactive {
+			continue
+		}
+		if liveness != nil && !liveness(r.nodes[nodeIndex].id) {
+			continue
+		}
+		candidates = append(candidates, r.nodes[nodeIndex])
+		total += uint64(r.nodes[nodeIndex].capacity)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	if total == 0 {
+		// With no capacity to weigh by, the replicas are equally likely.
+		return candidates[rnd.Intn(len(candidates))]
+	}
+	pick := uint64(rnd.Int63n(int64(total)))
+	for _, n := range candidates {
+		if pick < uint64(n.capacity) {
+			return n
+		}
+		pick -= uint64(n.capacity)
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (r *ring) PartitionCount() uint32 {
+	return uint32(len(r.replicaToPartitionToNodeIndex[0]))
+}
+
+func (r *ring) PartitionRange(start uint32, end uint32) ([][]uint64, error) {
+	if start > end || end > r.PartitionCount() {
+		return nil, fmt.Errorf("invalid partition range %d to %d; must be within 0 to %d with start <= end", start, end, r.PartitionCount())
+	}
+	rv := make([][]uint64, end-start)
+	for partition := start; partition < end; partition++ {
+		ids := make([]uint64, len(r.replicaToPartitionToNodeIndex))
+		for replica, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+			if nodeIndex := partitionToNodeIndex[partition]; nodeIndex >= 0 {
+				ids[replica] = r.nodes[nodeIndex].id
+			}
+		}
+		rv[partition-start] = ids
+	}
+	return rv, nil
+}
+
+func (r *ring) PartitionBitmapForNode(nodeID uint64) *PartitionBitmap {
+	nodeIndex := int32(-1)
+	for i, n := range r.nodes {
+		if n.id == nodeID {
+			nodeIndex = int32(i)
+			break
+		}
+	}
+	if nodeIndex < 0 {
+		return nil
+	}
+	bitmap := NewPartitionBitmap(r.PartitionCount())
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		for partition, index := range partitionToNodeIndex {
+			if index == nodeIndex {
+				bitmap.Add(uint32(partition))
+			}
+		}
+	}
+	return bitmap
+}
+
+func (r *ring) CommonPartitions(a uint64, b uint64) []uint32 {
+	aIndex := int32(-1)
+	bIndex := int32(-1)
+	for i, n := range r.nodes {
+		if n.id == a {
+			aIndex = int32(i)
+		}
+		if n.id == b {
+			bIndex = int32(i)
+		}
+	}
+	if aIndex < 0 || bIndex < 0 || aIndex == bIndex {
+		return nil
+	}
+	var partitions []uint32
+	partitionCount := len(r.replicaToPartitionToNodeIndex[0])
+	for partition := 0; partition < partitionCount; partition++ {
+		hasA := false
+		hasB := false
+		for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+			switch partitionToNodeIndex[partition] {
+			case aIndex:
+				hasA = true
+			case bIndex:
+				hasB = true
+			}
+		}
+		if hasA && hasB {
+			partitions = append(partitions, uint32(partition))
+		}
+	}
+	return partitions
+}
+
+func (r *ring) Validate() error {
+	problems := validateStructure(r.nodes, r.tiers, r.partitionBitCount, r.replicaToPartitionToNodeIndex, r.replicaCountRanges)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateStructure returns descriptions of any problems with the structure of
+// the nodes and assignments given, as a Builder or Ring loaded from a corrupt
+// file might have, that would otherwise cause failures later on.
+func validateStructure(nodes []*node, tiers [][]string, partitionBitCount uint16, replicaToPartitionToNodeIndex [][]int32, replicaCountRanges []*replicaCountRange) []string {
+	var problems []string
+	ids := make(map[uint64]bool, len(nodes))
+	for i, n := range nodes {
+		if n.id == 0 {
+			problems = append(problems, fmt.Sprintf("node %d has the reserved id 0", i))
+		} else if ids[n.id] {
+			problems = append(problems, fmt.Sprintf("node id %016x is used more than once", n.id))
+		}
+		ids[n.id] = true
+		for level, index := range n.tierIndexes {
+			// Index 0 is always the empty tier value.
+			if index < 0 || (index > 0 && (level >= len(tiers) || int(index) >= len(tiers[level]))) {
+				problems = append(problems, fmt.Sprintf("node %016x has an invalid tier index %d at level %d", n.id, index, level))
+				break
+			}
+		}
+	}
+	if partitionBitCount > 31 {
+		return append(problems, fmt.Sprintf("invalid partition bit count %d", partitionBitCount))
+	}
+	if len(replicaToPartitionToNodeIndex) == 0 {
+		return append(problems, "no replicas")
+	}
+	partitionCount := 1 << partitionBitCount
+	for replica, partitionToNodeIndex := range replicaToPartitionToNodeIndex {
+		if len(partitionToNodeIndex) != partitionCount {
+			problems = append(problems, fmt.Sprintf("replica %d has %d partitions instead of %d", replica, len(partitionToNodeIndex), partitionCount))
+			continue
+		}
+		invalid := 0
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex < -1 || int(nodeIndex) >= len(nodes) {
+				invalid++
+			}
+		}
+		if invalid > 0 {
+			problems = append(problems, fmt.Sprintf("replica %d has %d partitions assigned to unknown nodes", replica, invalid))
+		}
+	}
+	for _, rcr := range replicaCountRanges {
+		if rcr.count < 1 || rcr.count > len(replicaToPartitionToNodeIndex) {
+			problems = append(problems, fmt.Sprintf("invalid replica count %d for a partition range", rcr.count))
+		}
+	}
+	return problems
+}
+
+func (r *ring) UnderReplicatedPartitions() []uint32 {
+	var partitions []uint32
+	partitionCount := len(r.replicaToPartitionToNodeIndex[0])
+	for partition := 0; partition < partitionCount; partition++ {
+		replicaCount := partitionReplicaCount(r.ReplicaCount(), r.replicaCountRanges, partition, r.partitionBitCount)
+		for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex[:replicaCount] {
+			nodeIndex := partitionToNodeIndex[partition]
+			if nodeIndex < 0 || r.nodes[nodeIndex].inactive {
+				partitions = append(partitions, uint32(partition))
+				break
+			}
+		}
+	}
+	return partitions
+}
+
 // RingStats gives an overview of the state and health of a Ring. It is
 // returned by the Ring.Stats() method.
 type RingStats struct {
@@ -519,6 +1502,89 @@ type RingStats struct {
 	// more data assigned to it than its capacity would indicate it desires.
 	MaxOverNodePercentage float64
 	MaxOverNodeID         uint64
+	// AffinityGroupSize is the number of consecutive partitions the builder
+	// tried to keep on identical replica sets; see
+	// Builder.SetAffinityGroupSize.
+	AffinityGroupSize int
+	// AffinityGroupCohesion is the percentage of affinity groups whose
+	// partitions all have identical replica assignments; it is only
+	// calculated if AffinityGroupSize is greater than 1.
+	AffinityGroupCohesion float64
+	// PlacementCost is the total tier cost of every pair of replicas of every
+	// partition; see Builder.SetTierCost.
+	PlacementCost float64
+}
+
+// replicaSlotCount returns the total number of partition replicas, across all
+// partitions, that should be assigned.
+func (r *ring) replicaSlotCount() int {
+	partitionCount := int(r.PartitionCount())
+	if len(r.replicaCountRanges) == 0 {
+		return r.ReplicaCount() * partitionCount
+	}
+	slots := 0
+	for partition := 0; partition < partitionCount; partition++ {
+		slots += partitionReplicaCount(r.replicaCount, r.replicaCountRanges, partition, r.partitionBitCount)
+	}
+	return slots
+}
+
+// TierStat gives the balance of partition replicas across the nodes with one
+// tier value; see Ring.TierStats.
+type TierStat struct {
+	// NodeCount is the number of active nodes with the tier value.
+	NodeCount int
+	// Capacity is the total capacity of those nodes.
+	Capacity uint64
+	// Assigned is the number of partition replicas assigned to nodes with
+	// the tier value, including any inactive nodes yet to be reassigned.
+	Assigned int
+	// Target is the number of partition replicas the tier value should have
+	// given its share of the total capacity.
+	Target float64
+	// Percentage is how far over, if positive, or under, if negative, the
+	// target the assigned count is, as a percentage of the target; it is 0 if
+	// the target is.
+	Percentage float64
+}
+
+func (r *ring) TierStats(level int) map[string]TierStat {
+	stats := make(map[string]TierStat)
+	var totalCapacity uint64
+	for _, n := range r.nodes {
+		if !n.inactive {
+			totalCapacity += uint64(n.capacity)
+		}
+	}
+	nodeIndexToPartitionCount := make([]int, len(r.nodes))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				nodeIndexToPartitionCount[nodeIndex]++
+			}
+		}
+	}
+	for nodeIndex, n := range r.nodes {
+		value := n.Tier(level)
+		stat := stats[value]
+		if !n.inactive {
+			stat.NodeCount++
+			stat.Capacity += uint64(n.capacity)
+		}
+		stat.Assigned += nodeIndexToPartitionCount[nodeIndex]
+		stats[value] = stat
+	}
+	slots := float64(r.replicaSlotCount())
+	for value, stat := range stats {
+		if totalCapacity > 0 {
+			stat.Target = float64(stat.Capacity) / float64(totalCapacity) * slots
+		}
+		if stat.Target > 0 {
+			stat.Percentage = 100.0 * (float64(stat.Assigned) - stat.Target) / stat.Target
+		}
+		stats[value] = stat
+	}
+	return stats
 }
 
 // Stats gives information about the ring and its health; the MaxUnder and
@@ -535,7 +1601,9 @@ func (r *ring) Stats() *RingStats {
 	nodeIndexToPartitionCount := make([]int, stats.NodeCount)
 	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
 		for _, nodeIndex := range partitionToNodeIndex {
-			nodeIndexToPartitionCount[nodeIndex]++
+			if nodeIndex >= 0 {
+				nodeIndexToPartitionCount[nodeIndex]++
+			}
 		}
 	}
 	for _, n := range r.nodes {
@@ -545,11 +1613,12 @@ func (r *ring) Stats() *RingStats {
 			stats.TotalCapacity += (uint64)(n.capacity)
 		}
 	}
+	slots := float64(r.replicaSlotCount())
 	for nodeIndex, n := range r.nodes {
 		if n.inactive {
 			continue
 		}
-		desiredPartitionCount := float64(n.capacity) / float64(stats.TotalCapacity) * float64(stats.PartitionCount) * float64(stats.ReplicaCount)
+		desiredPartitionCount := float64(n.capacity) / float64(stats.TotalCapacity) * slots
 		actualPartitionCount := float64(nodeIndexToPartitionCount[nodeIndex])
 		if desiredPartitionCount > actualPartitionCount {
 			under := 100.0 * (desiredPartitionCount - actualPartitionCount) / desiredPartitionCount
@@ -565,5 +1634,233 @@ func (r *ring) Stats() *RingStats {
 			}
 		}
 	}
+	if r.affinityGroupSize > 1 {
+		stats.AffinityGroupSize = r.affinityGroupSize
+		groups := 0
+		cohesive := 0
+		for start := 0; start < stats.PartitionCount; start += r.affinityGroupSize {
+			groups++
+			end := start + r.affinityGroupSize
+			if end > stats.PartitionCount {
+				end = stats.PartitionCount
+			}
+			cohesive++
+		GroupLoop:
+			for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+				for partition := start + 1; partition < end; partition++ {
+					if partitionToNodeIndex[partition] != partitionToNodeIndex[start] {
+						cohesive--
+						break GroupLoop
+					}
+				}
+			}
+		}
+		stats.AffinityGroupCohesion = 100.0 * float64(cohesive) / float64(groups)
+	}
+	if len(r.tierCosts) > 0 {
+		for partition := 0; partition < stats.PartitionCount; partition++ {
+			for i, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+				a := partitionToNodeIndex[partition]
+				if a < 0 {
+					continue
+				}
+				for _, otherPartitionToNodeIndex := range r.replicaToPartitionToNodeIndex[i+1:] {
+					if b := otherPartitionToNodeIndex[partition]; b >= 0 {
+						stats.PlacementCost += placementCost(r.tierCosts, r.nodes[a], r.nodes[b])
+					}
+				}
+			}
+		}
+	}
 	return stats
 }
+
+func (r *ring) Fingerprint() [32]byte {
+	h := sha256.New()
+	writeString := func(s string) {
+		binary.Write(h, binary.BigEndian, uint32(len(s)))
+		io.WriteString(h, s)
+	}
+	binary.Write(h, binary.BigEndian, r.partitionBitCount)
+	binary.Write(h, binary.BigEndian, int64(r.replicaCount))
+	binary.Write(h, binary.BigEndian, uint32(len(r.replicaCountRanges)))
+	for _, rcr := range r.replicaCountRanges {
+		binary.Write(h, binary.BigEndian, rcr.start)
+		binary.Write(h, binary.BigEndian, rcr.end)
+		binary.Write(h, binary.BigEndian, int64(rcr.count))
+	}
+	writeString(r.hashFuncName)
+	binary.Write(h, binary.BigEndian, r.partitionOffset)
+	binary.Write(h, binary.BigEndian, int64(r.affinityGroupSize))
+	binary.Write(h, binary.BigEndian, uint32(len(r.tierCosts)))
+	for _, cost := range r.tierCosts {
+		binary.Write(h, binary.BigEndian, cost)
+	}
+	writeString(string(r.conf))
+	byID := make(map[uint64]*node, len(r.nodes))
+	for _, n := range r.nodes {
+		byID[n.id] = n
+	}
+	ids := sortedNodeIDs(r.nodes, true)
+	binary.Write(h, binary.BigEndian, uint32(len(ids)))
+	for _, id := range ids {
+		n := byID[id]
+		binary.Write(h, binary.BigEndian, n.id)
+		binary.Write(h, binary.BigEndian, n.inactive)
+		binary.Write(h, binary.BigEndian, n.capacity)
+		// Trailing empty tier values are left out so unused tier levels
+		// don't change the fingerprint.
+		levels := len(r.tiers)
+		for levels > 0 && n.Tier(levels-1) == "" {
+			levels--
+		}
+		binary.Write(h, binary.BigEndian, uint32(levels))
+		for level := 0; level < levels; level++ {
+			writeString(n.Tier(level))
+		}
+		binary.Write(h, binary.BigEndian, uint32(len(n.addresses)))
+		for _, addr := range n.addresses {
+			writeString(addr)
+		}
+		writeString(n.meta)
+		writeString(string(n.conf))
+	}
+	binary.Write(h, binary.BigEndian, uint32(len(r.replicaToPartitionToNodeIndex)))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			var id uint64
+			// An index beyond the nodes, as Validate would report, is hashed
+			// as unassigned so a corrupt Ring can still be persisted.
+			if nodeIndex >= 0 && int(nodeIndex) < len(r.nodes) {
+				id = r.nodes[nodeIndex].id
+			}
+			binary.Write(h, binary.BigEndian, id)
+		}
+	}
+	var fingerprint [32]byte
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+func (r *ring) FingerprintWithVersion() [32]byte {
+	fingerprint := r.Fingerprint()
+	h := sha256.New()
+	h.Write(fingerprint[:])
+	binary.Write(h, binary.BigEndian, r.version)
+	copy(fingerprint[:], h.Sum(nil))
+	return fingerprint
+}
+
+type graphvizTier struct {
+	level int
+	value string
+}
+
+type graphvizNode struct {
+	n *node
+	// tiers are the node's non-empty tier values from the outermost level
+	// inward, giving the clusters the node is nested within.
+	tiers []graphvizTier
+	count int
+}
+
+type graphvizNodeSorter []*graphvizNode
+
+func (s graphvizNodeSorter) Len() int {
+	return len(s)
+}
+
+func (s graphvizNodeSorter) Swap(a int, b int) {
+	s[a], s[b] = s[b], s[a]
+}
+
+func (s graphvizNodeSorter) Less(a int, b int) bool {
+	for i := 0; i < len(s[a].tiers) && i < len(s[b].tiers); i++ {
+		if s[a].tiers[i] != s[b].tiers[i] {
+			if s[a].tiers[i].level != s[b].tiers[i].level {
+				return s[a].tiers[i].level > s[b].tiers[i].level
+			}
+			return s[a].tiers[i].value < s[b].tiers[i].value
+		}
+	}
+	if len(s[a].tiers) != len(s[b].tiers) {
+		return len(s[a].tiers) < len(s[b].tiers)
+	}
+	return s[a].n.id < s[b].n.id
+}
+
+// graphvizQuote returns the string as a quoted DOT identifier.
+func graphvizQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+func (r *ring) WriteGraphviz(w io.Writer) error {
+	nodeIndexToPartitionCount := make([]int, len(r.nodes))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				nodeIndexToPartitionCount[nodeIndex]++
+			}
+		}
+	}
+	gnodes := make([]*graphvizNode, len(r.nodes))
+	for nodeIndex, n := range r.nodes {
+		gn := &graphvizNode{n: n, count: nodeIndexToPartitionCount[nodeIndex]}
+		tiers := n.Tiers()
+		for level := len(tiers) - 1; level >= 0; level-- {
+			if tiers[level] != "" {
+				gn.tiers = append(gn.tiers, graphvizTier{level: level, value: tiers[level]})
+			}
+		}
+		gnodes[nodeIndex] = gn
+	}
+	sort.Sort(graphvizNodeSorter(gnodes))
+	buf := &bytes.Buffer{}
+	buf.WriteString("digraph ring {\n")
+	if r.label != "" {
+		fmt.Fprintf(buf, "\tlabel=%s;\n", graphvizQuote(r.label))
+	}
+	buf.WriteString("\tnode [shape=box];\n")
+	// The nodes are sorted by their tiers, so the clusters can be opened and
+	// closed as the tiers change from one node to the next.
+	var open []graphvizTier
+	clusters := 0
+	for _, gn := range gnodes {
+		common := 0
+		for common < len(open) && common < len(gn.tiers) && open[common] == gn.tiers[common] {
+			common++
+		}
+		for len(open) > common {
+			open = open[:len(open)-1]
+			fmt.Fprintf(buf, "%s}\n", strings.Repeat("\t", len(open)+1))
+		}
+		for _, t := range gn.tiers[common:] {
+			indent := strings.Repeat("\t", len(open)+1)
+			fmt.Fprintf(buf, "%ssubgraph cluster_%d {\n", indent, clusters)
+			fmt.Fprintf(buf, "%s\tlabel=%s;\n", indent, graphvizQuote(t.value))
+			clusters++
+			open = append(open, t)
+		}
+		label := fmt.Sprintf("%016x", gn.n.id)
+		if addr := gn.n.Address(0); addr != "" {
+			label += "\n" + addr
+		}
+		label += fmt.Sprintf("\n%d partitions", gn.count)
+		style := ""
+		if gn.n.inactive {
+			label += "\ninactive"
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(buf, "%s\"%016x\" [label=%s%s];\n", strings.Repeat("\t", len(open)+1), gn.n.id, graphvizQuote(label), style)
+	}
+	for len(open) > 0 {
+		open = open[:len(open)-1]
+		fmt.Fprintf(buf, "%s}\n", strings.Repeat("\t", len(open)+1))
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
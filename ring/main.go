@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gholt/ring"
 	"gopkg.in/gholt/brimtext.v1"
@@ -22,16 +23,29 @@ func main() {
 }
 
 func mainEntry(args []string) error {
-	var r ring.Ring
-	var b *ring.Builder
-	var err error
 	if len(args) < 2 || (len(args) > 1 && args[1] == "help") {
 		return helpCmd(args)
 	}
 	if len(args) > 2 && args[2] == "create" {
 		return createCmd(args[1], args[3:])
 	}
-	if r, b, err = ring.RingOrBuilder(args[1]); err != nil {
+	if len(args) < 3 {
+		return fileCmd(args)
+	}
+	switch args[2] {
+	case "tier", "tiers", "part", "partition", "print-config":
+		return fileCmd(args)
+	}
+	// The lock is held from loading the file through persisting it so that
+	// another writer's changes made in between aren't lost.
+	return ring.WithRingLock(args[1], func() error {
+		return fileCmd(args)
+	})
+}
+
+func fileCmd(args []string) error {
+	r, b, err := ring.RingOrBuilder(args[1])
+	if err != nil {
 		return err
 	}
 	if len(args) < 3 {
@@ -145,6 +159,14 @@ func helpCmd(args []string) error {
         configfile=<value>
             The <value> is the path to a config file that will be byte encoded
             and stored as the global conf.
+        label=<value>
+            The <value> is a human readable label the rings created will carry,
+            useful for telling ring files apart.
+        partition-offset=<value>
+            The <value> is a number from 0 to 4294967295, defaulting to 0, that
+            is added to the partition numbers the rings created expose
+            externally, for rings that each cover part of a larger partition
+            space.
 
 %[1]s <builder-file> add [<name>=<value>] ...
     Adds a new node to the builder. Available attributes:
@@ -215,6 +237,24 @@ func mainCmd(r ring.Ring, b *ring.Builder) error {
 			[]string{fmt.Sprintf("%.02f%%", s.MaxUnderNodePercentage), fmt.Sprintf("Worst Underweight Node (ID %016x)", s.MaxUnderNodeID)},
 			[]string{fmt.Sprintf("%.02f%%", s.MaxOverNodePercentage), fmt.Sprintf("Worst Overweight Node (ID %016x)", s.MaxOverNodeID)},
 		}
+		if s.AffinityGroupSize > 1 {
+			report = append(report, []string{fmt.Sprintf("%.02f%%", s.AffinityGroupCohesion), fmt.Sprintf("Affinity Group Cohesion (Size %d)", s.AffinityGroupSize)})
+		}
+		if s.PlacementCost > 0 {
+			report = append(report, []string{fmt.Sprintf("%.02f", s.PlacementCost), "Placement Cost"})
+		}
+		if r.Label() != "" {
+			report = append(report, []string{r.Label(), "Label"})
+		}
+		if r.PartitionOffset() != 0 {
+			report = append(report, []string{brimtext.ThousandsSepU(uint64(r.PartitionOffset()), ","), "Partition Offset"})
+		}
+		if !r.CreatedAt().IsZero() {
+			report = append(report, []string{r.CreatedAt().Format(time.RFC3339), "Created"})
+		}
+		if r.BuilderID() != "" {
+			report = append(report, []string{r.BuilderID(), "Builder ID"})
+		}
 		reportOpts := brimtext.NewDefaultAlignOptions()
 		reportOpts.Alignments = []brimtext.Alignment{brimtext.Right, brimtext.Left}
 		fmt.Print(brimtext.Align(report, reportOpts))
@@ -230,6 +270,13 @@ func mainCmd(r ring.Ring, b *ring.Builder) error {
 			[]string{brimtext.ThousandsSep(int64(b.MaxPartitionBitCount()), ","), "Max Partition Bits"},
 			[]string{brimtext.ThousandsSep(int64(b.MoveWait()), ","), "Move Wait"},
 		}
+		if b.Label() != "" {
+			report = append(report, []string{b.Label(), "Label"})
+		}
+		if b.PartitionOffset() != 0 {
+			report = append(report, []string{brimtext.ThousandsSepU(uint64(b.PartitionOffset()), ","), "Partition Offset"})
+		}
+		report = append(report, []string{b.ID(), "Builder ID"})
 		reportOpts := brimtext.NewDefaultAlignOptions()
 		reportOpts.Alignments = []brimtext.Alignment{brimtext.Right, brimtext.Left}
 		fmt.Print(brimtext.Align(report, reportOpts))
@@ -416,6 +463,8 @@ func createCmd(filename string, args []string) error {
 	pointsAllowed := 1
 	maxPartitionBitCount := 23
 	moveWait := 60
+	var label string
+	var partitionOffset uint64
 	var conf []byte
 	var err error
 	for _, arg := range args {
@@ -469,6 +518,12 @@ func createCmd(filename string, args []string) error {
 			if err != nil {
 				return fmt.Errorf("Error reading config file: %v", err)
 			}
+		case "label":
+			label = sarg[1]
+		case "partition-offset":
+			if partitionOffset, err = strconv.ParseUint(sarg[1], 10, 32); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("Invalid arg: '%s' in create cmd", arg)
 		}
@@ -485,7 +540,11 @@ func createCmd(filename string, args []string) error {
 	}
 	b := ring.NewBuilder()
 	b.SetConf(conf)
-	b.SetReplicaCount(replicaCount)
+	b.SetLabel(label)
+	b.SetPartitionOffset(uint32(partitionOffset))
+	if err = b.SetReplicaCount(replicaCount); err != nil {
+		return err
+	}
 	b.SetPointsAllowed(byte(pointsAllowed))
 	b.SetMaxPartitionBitCount(uint16(maxPartitionBitCount))
 	b.SetMoveWait(uint16(moveWait))
@@ -587,6 +646,9 @@ func addOrSetCmd(r ring.Ring, b *ring.Builder, args []string, n ring.BuilderNode
 				if index < 0 {
 					return fmt.Errorf("invalid expression %#v; minimum index is 0", arg)
 				}
+				if max := b.MaxAddressesPerNode(); max > 0 && index >= max {
+					return fmt.Errorf("invalid expression %#v; maximum index is %d", arg, max-1)
+				}
 				if len(addresses) <= index {
 					a := make([]string, index+1)
 					copy(a, addresses)
@@ -602,7 +664,10 @@ func addOrSetCmd(r ring.Ring, b *ring.Builder, args []string, n ring.BuilderNode
 		}
 	}
 	if n == nil {
-		n = b.AddNode(active, capacity, tiers, addresses, meta, conf)
+		var err error
+		if n, err = b.AddNode(active, capacity, tiers, addresses, meta, conf); err != nil {
+			return err
+		}
 		report := [][]string{
 			[]string{"ID:", fmt.Sprintf("%016x", n.ID())},
 			[]string{"Active:", fmt.Sprintf("%v", n.Active())},
@@ -628,19 +693,24 @@ func removeCmd(r ring.Ring, b *ring.Builder, args []string) error {
 	if err != nil {
 		return fmt.Errorf("invalid id %#v", args[0][3:])
 	}
-	b.RemoveNode(id)
-	return nil
+	return b.RemoveNode(id)
 }
 
 func ringCmd(r ring.Ring, b *ring.Builder, filename string) error {
 	if b == nil {
 		return fmt.Errorf("only valid for builder files")
 	}
-	r = b.Ring()
+	var err error
+	if r, err = b.Ring(); err != nil {
+		return err
+	}
 	if err := ring.PersistRingOrBuilder(nil, b, filename); err != nil {
 		return err
 	}
-	return ring.PersistRingOrBuilder(r, nil, strings.TrimSuffix(filename, ".builder")+".ring")
+	ringFilename := strings.TrimSuffix(filename, ".builder") + ".ring"
+	return ring.WithRingLock(ringFilename, func() error {
+		return ring.PersistRingOrBuilder(r, nil, ringFilename)
+	})
 }
 
 func pretendElapsedCmd(r ring.Ring, b *ring.Builder, args []string) error {
@@ -660,8 +730,7 @@ func pretendElapsedCmd(r ring.Ring, b *ring.Builder, args []string) error {
 	if m > math.MaxUint16 {
 		return fmt.Errorf("cannot pretend to elapse more than %d minutes", math.MaxUint16)
 	}
-	b.PretendElapsed(uint16(m))
-	return nil
+	return b.PretendElapsed(uint16(m))
 }
 
 func printConfigCmd(r ring.Ring, b *ring.Builder) error {
@@ -2,7 +2,17 @@ package ring
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRingVersion(t *testing.T) {
@@ -54,6 +64,240 @@ func TestRingNodes(t *testing.T) {
 	}
 }
 
+func TestRingNodesInTier(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, []string{"server1", "zone1"}, nil, "", nil)
+	b.AddNode(true, 1, []string{"server2", "zone2"}, nil, "", nil)
+	b.AddNode(false, 1, []string{"server3", "zone1"}, nil, "", nil)
+	r, _ := b.Ring()
+	v := r.NodesInTier(1, "zone1")
+	if len(v) != 1 || v[0].ID() != nA.ID() {
+		t.Fatalf("NodesInTier(1, \"zone1\") gave %v", v)
+	}
+	if v = r.NodesInTier(2, "zone1"); len(v) != 0 {
+		t.Fatalf("NodesInTier(2, \"zone1\") gave %v", v)
+	}
+}
+
+func TestRingWalkNodesForKey(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 5; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	b.AddNode(false, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	key := []byte("key")
+	v := r.WalkNodesForKey(key, 4)
+	if len(v) != 4 {
+		t.Fatalf("WalkNodesForKey gave %d nodes instead of 4", len(v))
+	}
+	replicas := r.ResponsibleNodes(r.PartitionForKey(key))
+	for i, n := range replicas {
+		if v[i].ID() != n.ID() {
+			t.Fatalf("WalkNodesForKey gave %v which doesn't start with the replicas %v", v, replicas)
+		}
+	}
+	if v = r.WalkNodesForKey(key, 10); len(v) != 5 {
+		t.Fatalf("WalkNodesForKey gave %d nodes instead of the 5 active nodes", len(v))
+	}
+	seen := map[uint64]bool{}
+	for _, n := range v {
+		if !n.Active() || seen[n.ID()] {
+			t.Fatalf("WalkNodesForKey gave an inactive or repeated node in %v", v)
+		}
+		seen[n.ID()] = true
+	}
+}
+
+func TestRingPartitionsForKeyRange(t *testing.T) {
+	b := NewBuilder()
+	for i := 0; i < 5; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	r, _ := b.Ring()
+	var lo, hi []byte
+	for i := 0; lo == nil || hi == nil; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		switch p := r.PartitionForKey(key); {
+		case p == 1 && lo == nil:
+			lo = key
+		case p == r.PartitionCount()-2 && hi == nil:
+			hi = key
+		}
+	}
+	v := r.PartitionsForKeyRange(lo, hi)
+	if len(v) != int(r.PartitionCount())-2 || v[0] != 1 || v[len(v)-1] != r.PartitionCount()-2 {
+		t.Fatalf("PartitionsForKeyRange gave %v", v)
+	}
+	for i := 1; i < len(v); i++ {
+		if v[i] != v[i-1]+1 {
+			t.Fatalf("PartitionsForKeyRange gave %v which is not contiguous", v)
+		}
+	}
+	v = r.PartitionsForKeyRange(hi, lo)
+	if fmt.Sprint(v) != fmt.Sprint([]uint32{r.PartitionCount() - 2, r.PartitionCount() - 1, 0, 1}) {
+		t.Fatalf("PartitionsForKeyRange gave %v for a range wrapping around", v)
+	}
+	if v = r.PartitionsForKeyRange(lo, lo); len(v) != 1 || v[0] != 1 {
+		t.Fatalf("PartitionsForKeyRange gave %v for a single key", v)
+	}
+}
+
+func TestRingPartitionOffset(t *testing.T) {
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.SetPartitionOffset(1000)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	p := r.PartitionForKey(key)
+	if r.PartitionOffset() != 1000 || r.ExternalPartitionForKey(key) != p+1000 {
+		t.Fatalf("ExternalPartitionForKey gave %d for partition %d", r.ExternalPartitionForKey(key), p)
+	}
+	if r.ExternalPartition(p) != p+1000 {
+		t.Fatalf("ExternalPartition gave %d for partition %d", r.ExternalPartition(p), p)
+	}
+	if v, ok := r.PartitionForExternal(p + 1000); !ok || v != p {
+		t.Fatalf("PartitionForExternal gave %d, %v instead of %d", v, ok, p)
+	}
+	for _, external := range []uint32{999, 1000 + r.PartitionCount()} {
+		if _, ok := r.PartitionForExternal(external); ok {
+			t.Fatalf("PartitionForExternal accepted %d outside the ring", external)
+		}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err = r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.PartitionOffset() != 1000 || r2.Fingerprint() != r.Fingerprint() {
+		t.Fatalf("loaded ring has partition offset %d", r2.PartitionOffset())
+	}
+	if err = r.PersistVersion(buf, 7); err == nil {
+		t.Fatal("PersistVersion should have errored for a partition offset in version 7")
+	}
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.PartitionOffset() != 1000 {
+		t.Fatalf("loaded Builder has partition offset %d", b2.PartitionOffset())
+	}
+	b.SetPartitionOffset(math.MaxUint32)
+	if _, err = b.Ring(); err == nil {
+		t.Fatal("Ring should have errored for an offset overflowing the partition numbers")
+	}
+}
+
+func TestRingPickReplicaForKey(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	nA, _ := b.AddNode(true, 1, nil, nil, "", nil)
+	nB, _ := b.AddNode(true, 3, nil, nil, "", nil)
+	r, _ := b.Ring()
+	key := []byte("key")
+	if r.PickReplicaForKey(key, 1).ID() != r.PickReplicaForKey(key, 1).ID() {
+		t.Fatal("PickReplicaForKey gave different nodes for the same seed")
+	}
+	counts := map[uint64]int{}
+	for seed := int64(0); seed < 10000; seed++ {
+		counts[r.PickReplicaForKey(key, seed).ID()]++
+	}
+	// Node B has three times the capacity, so should get about 75% of picks.
+	if counts[nB.ID()] < 7000 || counts[nB.ID()] > 8000 || counts[nA.ID()]+counts[nB.ID()] != 10000 {
+		t.Fatalf("PickReplicaForKey gave %d picks for A and %d for B", counts[nA.ID()], counts[nB.ID()])
+	}
+}
+
+func TestRingPickLiveReplicaForKey(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		n, _ := b.AddNode(true, 1, nil, nil, "", nil)
+		ids = append(ids, n.ID())
+	}
+	r, _ := b.Ring()
+	key := []byte("key")
+	dead := map[uint64]bool{ids[0]: true, ids[2]: true}
+	liveness := func(nodeID uint64) bool { return !dead[nodeID] }
+	for i := 0; i < 100; i++ {
+		n, ok := r.PickLiveReplicaForKey(key, liveness)
+		if !ok || n.ID() != ids[1] {
+			t.Fatalf("PickLiveReplicaForKey gave %v, %v instead of the only live node", n, ok)
+		}
+	}
+	dead[ids[1]] = true
+	if n, ok := r.PickLiveReplicaForKey(key, liveness); ok || n != nil {
+		t.Fatalf("PickLiveReplicaForKey gave %v, %v with no live nodes", n, ok)
+	}
+}
+
+func TestRingPartitionRange(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	for i := 0; i < 3; i++ {
+		b.AddNode(true, uint32(i+1), nil, nil, "", nil)
+	}
+	r, _ := b.Ring()
+	count := r.PartitionCount()
+	if count != 1<<r.PartitionBitCount() {
+		t.Fatalf("PartitionCount gave %d instead of %d", count, 1<<r.PartitionBitCount())
+	}
+	var all [][]uint64
+	for start := uint32(0); start < count; start += 3 {
+		end := start + 3
+		if end > count {
+			end = count
+		}
+		chunk, err := r.PartitionRange(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, chunk...)
+	}
+	if uint32(len(all)) != count {
+		t.Fatalf("PartitionRange chunks gave %d partitions instead of %d", len(all), count)
+	}
+	for partition, ids := range all {
+		for replica, n := range r.ResponsibleNodes(uint32(partition)) {
+			if ids[replica] != n.ID() {
+				t.Fatalf("PartitionRange gave %v for partition %d", ids, partition)
+			}
+		}
+	}
+	if v, err := r.PartitionRange(1, 1); err != nil || len(v) != 0 {
+		t.Fatalf("empty PartitionRange gave %v, %v", v, err)
+	}
+	if _, err := r.PartitionRange(2, 1); err == nil {
+		t.Fatal("PartitionRange with start > end should've given an error")
+	}
+	if _, err := r.PartitionRange(0, count+1); err == nil {
+		t.Fatal("PartitionRange beyond PartitionCount should've given an error")
+	}
+}
+
+func TestRingNodeIDs(t *testing.T) {
+	r := &ring{nodes: []*node{&node{id: 3}, &node{id: 1, inactive: true}, &node{id: 2}}}
+	v := r.NodeIDs()
+	if len(v) != 3 || v[0] != 1 || v[1] != 2 || v[2] != 3 {
+		t.Fatalf("NodeIDs() gave %v instead of [1 2 3]", v)
+	}
+	v[0] = 4
+	if r.NodeIDs()[0] != 1 {
+		t.Fatal("NodeIDs() did not return a fresh slice")
+	}
+}
+
 func TestRingNode(t *testing.T) {
 	v := (&ring{nodes: []*node{&node{id: 1}, &node{id: 2}}}).Node(1)
 	if v.ID() != 1 {
@@ -84,6 +328,59 @@ func TestRingLocalNode(t *testing.T) {
 	}
 }
 
+func TestRingDetectLocalNode(t *testing.T) {
+	r := &ring{
+		localNodeIndex: -1,
+		nodes: []*node{
+			&node{id: 1, addresses: []string{"10.0.0.1:8001"}},
+			&node{id: 2, addresses: []string{"10.0.0.2:8001", "192.168.0.2:8001"}},
+			&node{id: 3, addresses: []string{"10.0.0.2:8002"}},
+		},
+	}
+	if id, err := r.DetectLocalNode([]string{"127.0.0.1", "10.0.0.1"}); err != nil || id != 1 || r.LocalNode().ID() != 1 {
+		t.Fatalf("DetectLocalNode gave %d, %v", id, err)
+	}
+	if id, err := r.DetectLocalNode([]string{"192.168.0.2:8001"}); err != nil || id != 2 {
+		t.Fatalf("DetectLocalNode gave %d, %v", id, err)
+	}
+	if _, err := r.DetectLocalNode([]string{"10.0.0.2"}); err == nil {
+		t.Fatal("DetectLocalNode should have errored for multiple matches")
+	}
+	if _, err := r.DetectLocalNode([]string{"10.0.0.3", "10.0.0.1:9999"}); err == nil {
+		t.Fatal("DetectLocalNode should have errored for no matches")
+	}
+	if r.LocalNode().ID() != 2 {
+		t.Fatal("failed DetectLocalNode changed the local node")
+	}
+}
+
+func TestRingSetLocalNodeByAddress(t *testing.T) {
+	r := &ring{
+		localNodeIndex: -1,
+		nodes: []*node{
+			&node{id: 1, addresses: []string{"10.0.0.1:8001"}},
+			&node{id: 2, addresses: []string{"10.0.0.2:8001", "192.168.0.2:8001"}},
+			&node{id: 3, addresses: []string{"10.0.0.2:8002"}},
+		},
+	}
+	if err := r.SetLocalNodeByAddress("10.0.0.2:8002"); err != nil || r.LocalNode().ID() != 3 {
+		t.Fatalf("SetLocalNodeByAddress gave %v", err)
+	}
+	// No exact match, so falls back to the host.
+	if err := r.SetLocalNodeByAddress("192.168.0.2:9999"); err != nil || r.LocalNode().ID() != 2 {
+		t.Fatalf("SetLocalNodeByAddress gave %v", err)
+	}
+	if err := r.SetLocalNodeByAddress("10.0.0.2:9999"); err == nil {
+		t.Fatal("SetLocalNodeByAddress should have errored for multiple host matches")
+	}
+	if err := r.SetLocalNodeByAddress("10.0.0.3:8001"); err == nil {
+		t.Fatal("SetLocalNodeByAddress should have errored for no matches")
+	}
+	if r.LocalNode().ID() != 2 {
+		t.Fatal("failed SetLocalNodeByAddress changed the local node")
+	}
+}
+
 func TestRingResponsible(t *testing.T) {
 	v := (&ring{localNodeIndex: -1}).Responsible(123)
 	if v {
@@ -103,6 +400,52 @@ func TestRingResponsible(t *testing.T) {
 	}
 }
 
+func TestRingLocalPartitionRanges(t *testing.T) {
+	if v := (&ring{localNodeIndex: -1}).LocalPartitionRanges(); v != nil {
+		t.Fatalf("LocalPartitionRanges gave %v instead of nil", v)
+	}
+	d := [][]int32{
+		[]int32{0, 0, 1, 1, 2, 0, 1, 2},
+		[]int32{1, 2, 0, 2, 0, 2, 0, 0},
+	}
+	r := &ring{localNodeIndex: 0, replicaToPartitionToNodeIndex: d}
+	if v := fmt.Sprint(r.LocalPartitions()); v != "[0 1 2 4 5 6 7]" {
+		t.Fatalf("LocalPartitions gave %s instead of [0 1 2 4 5 6 7]", v)
+	}
+	if v := fmt.Sprint(r.LocalPartitionRanges()); v != "[[0 2] [4 7]]" {
+		t.Fatalf("LocalPartitionRanges gave %s instead of [[0 2] [4 7]]", v)
+	}
+	r.localNodeIndex = 1
+	if v := fmt.Sprint(r.LocalPartitionRanges()); v != "[[0 0] [2 3] [6 6]]" {
+		t.Fatalf("LocalPartitionRanges gave %s instead of [[0 0] [2 3] [6 6]]", v)
+	}
+	r.localNodeIndex = 3
+	if v := r.LocalPartitionRanges(); len(v) != 0 {
+		t.Fatalf("LocalPartitionRanges gave %v instead of none", v)
+	}
+}
+
+func TestRingReplicaAddressesWithPortOverride(t *testing.T) {
+	d := [][]int32{[]int32{0}, []int32{1}, []int32{2}, []int32{3}, []int32{4}}
+	r := &ring{
+		nodes: []*node{
+			&node{id: 10, addresses: []string{"10.0.0.1:5000", "10.1.0.1:5001"}},
+			&node{id: 11, addresses: []string{"[fe80::1]:5000"}},
+			&node{id: 12},
+			&node{id: 13, addresses: []string{"host.example"}},
+			&node{id: 14, addresses: []string{"[::1]"}},
+		},
+		replicaToPartitionToNodeIndex: d,
+	}
+	v := fmt.Sprint(r.ReplicaAddressesWithPortOverride(0, 8080))
+	if v != "[10.0.0.1:8080 [fe80::1]:8080 host.example:8080 [::1]:8080]" {
+		t.Fatalf("ReplicaAddressesWithPortOverride gave %s", v)
+	}
+	if v := r.ReplicaAddressesWithPortOverride(1, 8080); len(v) != 0 {
+		t.Fatalf("ReplicaAddressesWithPortOverride gave %v for a partition beyond the ring", v)
+	}
+}
+
 func TestRingResponsibleIDs(t *testing.T) {
 	d := make([][]int32, 3)
 	d[0] = []int32{0, 1, 2}
@@ -120,11 +463,12 @@ func TestRingResponsibleIDs(t *testing.T) {
 
 func TestRingPersistence(t *testing.T) {
 	b := NewBuilder()
-	b.SetReplicaCount(3)
+	b.SetReplicaCount(2)
 	b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"1.2.3.4:56789"}, "Meta One", []byte("Conf"))
 	b.AddNode(true, 1, []string{"server2", "zone1"}, []string{"1.2.3.5:56789", "1.2.3.5:9876"}, "Meta Four", []byte("Conf"))
 	b.AddNode(false, 0, []string{"server3", "zone1"}, []string{"1.2.3.6:56789"}, "Meta Three", []byte("Conf"))
-	r := b.Ring().(*ring)
+	rr, _ := b.Ring()
+	r := rr.(*ring)
 	buf := bytes.NewBuffer(make([]byte, 0, 65536))
 	confbytes := []byte("three shall be the number thou shalt count")
 	r.SetConf(confbytes)
@@ -194,6 +538,294 @@ func TestRingPersistence(t *testing.T) {
 	}
 }
 
+func TestRingPersistVersion(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := r.PersistVersion(buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(gr, header); err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "RINGv00000000001" {
+		t.Fatalf("PersistVersion wrote header %q", header)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Version() != r.Version() || r2.ReplicaCount() != 2 || len(r2.Nodes()) != 2 {
+		t.Fatal("format version 1 ring did not load correctly")
+	}
+	if err = r.PersistVersion(buf, ringFormatVersion+1); err == nil {
+		t.Fatal("PersistVersion should have errored for an unknown version")
+	}
+	b.SetAffinityGroupSize(2)
+	r, _ = b.Ring()
+	if err = r.PersistVersion(buf, 1); err == nil {
+		t.Fatal("PersistVersion should have errored for affinity groups in version 1")
+	}
+	if err = r.PersistVersion(buf, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingBuilderID(t *testing.T) {
+	b := NewBuilder()
+	if len(b.ID()) != 36 || b.ID() == NewBuilder().ID() {
+		t.Fatalf("Builder ID gave %q", b.ID())
+	}
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	if r.BuilderID() != b.ID() {
+		t.Fatalf("BuilderID gave %q instead of %q", r.BuilderID(), b.ID())
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.ID() != b.ID() {
+		t.Fatalf("loaded Builder ID gave %q instead of %q", b2.ID(), b.ID())
+	}
+	buf.Reset()
+	if err = r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.BuilderID() != b.ID() {
+		t.Fatalf("loaded ring BuilderID gave %q instead of %q", r2.BuilderID(), b.ID())
+	}
+	buf.Reset()
+	if err = r.PersistVersion(buf, 4); err != nil {
+		t.Fatal(err)
+	}
+	if r2, err = LoadRing(buf); err != nil {
+		t.Fatal(err)
+	}
+	if r2.BuilderID() != "" {
+		t.Fatalf("version 4 ring gave BuilderID %q", r2.BuilderID())
+	}
+}
+
+func TestRingLabelAndCreatedAt(t *testing.T) {
+	b := NewBuilder()
+	b.SetLabel("prod-us-east migration")
+	b.AddNode(true, 1, nil, nil, "", nil)
+	before := time.Now()
+	r, _ := b.Ring()
+	if r.Label() != "prod-us-east migration" {
+		t.Fatalf("Label gave %q", r.Label())
+	}
+	if r.CreatedAt().Before(before) || r.CreatedAt().After(time.Now()) {
+		t.Fatalf("CreatedAt gave %s", r.CreatedAt())
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 65536))
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Label() != r.Label() || !r2.CreatedAt().Equal(r.CreatedAt()) {
+		t.Fatalf("loaded ring gave %q and %s", r2.Label(), r2.CreatedAt())
+	}
+	if err = r.PersistVersion(buf, 3); err == nil {
+		t.Fatal("PersistVersion should have errored for a label in version 3")
+	}
+	b.SetLabel("")
+	r, _ = b.Ring()
+	buf.Reset()
+	if err = r.PersistVersion(buf, 3); err != nil {
+		t.Fatal(err)
+	}
+	r2, err = LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r2.CreatedAt().IsZero() {
+		t.Fatalf("version 3 ring gave CreatedAt %s", r2.CreatedAt())
+	}
+}
+
+func TestRingInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newBuilder := func() *Builder {
+		b := NewBuilder()
+		b.SetReplicaCount(3)
+		for i := 0; i < 5; i++ {
+			b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), "zone"}, []string{fmt.Sprintf("127.0.0.1:%d", i)}, "meta", []byte("conf"))
+		}
+		return b
+	}
+	b := newBuilder()
+	b.SetLabel("info")
+	b.SetTierCost(0, 1, 2)
+	b.SetReplicaCountForRange(0, 0, 2)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ringFile := path.Join(dir, "test.ring")
+	if err = PersistRingOrBuilder(r, nil, ringFile); err != nil {
+		t.Fatal(err)
+	}
+	info, err := RingInfo(ringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RingFileInfo{
+		FormatVersion:     ringFormatVersion,
+		Version:           r.Version(),
+		NodeCount:         5,
+		ReplicaCount:      3,
+		PartitionBitCount: r.PartitionBitCount(),
+		Label:             "info",
+		CreatedAt:         r.CreatedAt(),
+		BuilderID:         r.BuilderID(),
+		Fingerprint:       r.Fingerprint(),
+	}
+	if !info.CreatedAt.Equal(want.CreatedAt) {
+		t.Fatalf("RingInfo gave CreatedAt %s instead of %s", info.CreatedAt, want.CreatedAt)
+	}
+	info.CreatedAt = want.CreatedAt
+	if *info != want {
+		t.Fatalf("RingInfo gave %+v instead of %+v", *info, want)
+	}
+	// The current format's info block is all RingInfo needs to read; the
+	// file cut off just after it still gives the same info.
+	buf := &bytes.Buffer{}
+	if err = r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	gr, _, err := newDecompressReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoLength := int(binary.BigEndian.Uint32(raw[16+8:]))
+	cut := &bytes.Buffer{}
+	gw, err := newCompressWriter(cut, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Write(raw[:16+8+4+infoLength])
+	gw.Close()
+	cutInfo, err := readRingFileInfo(bytes.NewReader(cut.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutInfo.CreatedAt = want.CreatedAt
+	if *cutInfo != want {
+		t.Fatalf("RingInfo of the cut off file gave %+v instead of %+v", *cutInfo, want)
+	}
+	// Version 9 holds the same info, just spread through the file.
+	f, err := os.Create(ringFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.PersistVersion(f, 9)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = RingInfo(ringFile); err != nil {
+		t.Fatal(err)
+	}
+	info.CreatedAt = want.CreatedAt
+	want.FormatVersion = 9
+	if *info != want {
+		t.Fatalf("RingInfo gave %+v instead of %+v for a version 9 file", *info, want)
+	}
+	// Older formats leave out what they can't hold.
+	if r, err = newBuilder().Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = os.Create(ringFile); err != nil {
+		t.Fatal(err)
+	}
+	err = r.PersistVersion(f, 3)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = RingInfo(ringFile); err != nil {
+		t.Fatal(err)
+	}
+	if info.FormatVersion != 3 || info.NodeCount != 5 || info.ReplicaCount != 3 || !info.CreatedAt.IsZero() || info.Fingerprint != [32]byte{} {
+		t.Fatalf("RingInfo gave %+v for a version 3 file", *info)
+	}
+	if _, err = RingInfo(path.Join(dir, "missing.ring")); err == nil {
+		t.Fatal("RingInfo should have errored for a missing file")
+	}
+}
+
+func TestRingCommonPartitions(t *testing.T) {
+	r := &ring{
+		nodes: []*node{&node{id: 1}, &node{id: 2}, &node{id: 3}},
+		replicaToPartitionToNodeIndex: [][]int32{
+			{0, 1, 2, 0},
+			{1, 2, 0, 2},
+		},
+	}
+	if v := r.CommonPartitions(1, 2); len(v) != 1 || v[0] != 0 {
+		t.Fatalf("CommonPartitions(1, 2) gave %v instead of [0]", v)
+	}
+	if v := r.CommonPartitions(3, 1); len(v) != 2 || v[0] != 2 || v[1] != 3 {
+		t.Fatalf("CommonPartitions(3, 1) gave %v instead of [2 3]", v)
+	}
+	if v := r.CommonPartitions(1, 4); len(v) != 0 {
+		t.Fatalf("CommonPartitions with an unknown node gave %v", v)
+	}
+	if v := r.CommonPartitions(1, 1); len(v) != 0 {
+		t.Fatalf("CommonPartitions with the same node gave %v", v)
+	}
+}
+
+func TestRingPartitionBitmapForNode(t *testing.T) {
+	r := &ring{
+		partitionBitCount: 2,
+		nodes:             []*node{&node{id: 1}, &node{id: 2}, &node{id: 3}},
+		replicaToPartitionToNodeIndex: [][]int32{
+			{0, 1, 2, 0},
+			{1, 2, 0, 2},
+		},
+	}
+	b1 := r.PartitionBitmapForNode(1)
+	if b1.Len() != 4 || fmt.Sprint(b1.Partitions()) != "[0 2 3]" {
+		t.Fatalf("PartitionBitmapForNode(1) gave %v of %d", b1.Partitions(), b1.Len())
+	}
+	if v := b1.And(r.PartitionBitmapForNode(3)).Partitions(); fmt.Sprint(v) != fmt.Sprint(r.CommonPartitions(1, 3)) {
+		t.Fatalf("bitmap intersection gave %v instead of %v", v, r.CommonPartitions(1, 3))
+	}
+	if r.PartitionBitmapForNode(4) != nil {
+		t.Fatal("PartitionBitmapForNode gave a bitmap for an unknown node")
+	}
+}
+
 func TestRingStats(t *testing.T) {
 	s := (&ring{
 		partitionBitCount: 2,
@@ -242,3 +874,287 @@ func TestRingStats(t *testing.T) {
 		t.Fatalf("RingStats gave MaxOverNodePercentage of %v instead of %v", s.MaxOverNodePercentage, v)
 	}
 }
+
+func TestRingTierStats(t *testing.T) {
+	r := &ring{
+		tierBase:          tierBase{tiers: [][]string{[]string{"", "rack1", "rack2"}}},
+		partitionBitCount: 2,
+		replicaToPartitionToNodeIndex: [][]int32{
+			[]int32{0, 1, 2, 3},
+			[]int32{1, 0, 0, 0},
+			[]int32{2, 3, 4, 4},
+		},
+	}
+	r.nodes = []*node{
+		&node{id: 1, capacity: 100, tierIndexes: []int32{1}, tierBase: &r.tierBase},
+		&node{id: 2, capacity: 100, tierIndexes: []int32{2}, tierBase: &r.tierBase},
+		&node{id: 3, capacity: 100, tierIndexes: []int32{2}, tierBase: &r.tierBase},
+		&node{id: 4, capacity: 100, tierIndexes: []int32{2}, tierBase: &r.tierBase},
+		&node{id: 5, capacity: 100, inactive: true, tierBase: &r.tierBase},
+	}
+	stats := r.TierStats(0)
+	if len(stats) != 3 {
+		t.Fatalf("TierStats gave %d values instead of 3: %#v", len(stats), stats)
+	}
+	s := stats["rack1"]
+	if s.NodeCount != 1 || s.Capacity != 100 || s.Assigned != 4 || s.Target != 3 {
+		t.Fatalf("TierStats gave %#v for rack1", s)
+	}
+	if v := float64(100) * (4 - 3) / 3; s.Percentage != v {
+		t.Fatalf("TierStats gave Percentage %v instead of %v for rack1", s.Percentage, v)
+	}
+	s = stats["rack2"]
+	if s.NodeCount != 3 || s.Capacity != 300 || s.Assigned != 6 || s.Target != 9 {
+		t.Fatalf("TierStats gave %#v for rack2", s)
+	}
+	if v := float64(100) * (6 - 9) / 9; s.Percentage != v {
+		t.Fatalf("TierStats gave Percentage %v instead of %v for rack2", s.Percentage, v)
+	}
+	s = stats[""]
+	if s.NodeCount != 0 || s.Capacity != 0 || s.Assigned != 2 || s.Target != 0 || s.Percentage != 0 {
+		t.Fatalf("TierStats gave %#v for nodes without a tier", s)
+	}
+	stats = r.TierStats(1)
+	if len(stats) != 1 || stats[""].Assigned != 12 || stats[""].Target != 12 {
+		t.Fatalf("TierStats gave %#v for level 1", stats)
+	}
+}
+
+func TestRingNodeByAddress(t *testing.T) {
+	r := &ring{nodes: []*node{
+		&node{id: 1, addresses: []string{"10.0.0.1:9999", "192.168.0.1:9999"}},
+		&node{id: 2, addresses: []string{"10.0.0.2:9999"}},
+		&node{id: 3, addresses: []string{"10.0.0.3:9998"}},
+		&node{id: 4, addresses: []string{"10.0.0.3:9999"}},
+	}}
+	n, ok := r.NodeByAddress("192.168.0.1:9999")
+	if !ok || n.ID() != 1 {
+		t.Fatalf("NodeByAddress gave %v %v instead of 1", n, ok)
+	}
+	n, ok = r.NodeByAddress("10.0.0.3:9999")
+	if !ok || n.ID() != 4 {
+		t.Fatalf("NodeByAddress gave %v %v instead of 4", n, ok)
+	}
+	n, ok = r.NodeByAddress("10.0.0.2:54321")
+	if !ok || n.ID() != 2 {
+		t.Fatalf("NodeByAddress gave %v %v instead of 2", n, ok)
+	}
+	n, ok = r.NodeByAddress("10.0.0.3:54321")
+	if ok {
+		t.Fatalf("NodeByAddress gave %v for an ambiguous host", n)
+	}
+	n, ok = r.NodeByAddress("10.0.0.9:9999")
+	if ok {
+		t.Fatalf("NodeByAddress gave %v for an unknown address", n)
+	}
+}
+
+func TestRingWriteGraphviz(t *testing.T) {
+	b := NewBuilder()
+	b.SetLabel("test")
+	b.AddNodeWithID(1, true, 1, []string{"server1", "zone1"}, []string{"1.2.3.4:5"}, "", nil)
+	b.AddNodeWithID(2, true, 1, []string{"server2", "zone1"}, nil, "", nil)
+	b.AddNodeWithID(3, false, 1, []string{"server3", "zone2"}, nil, "", nil)
+	b.AddNodeWithID(4, true, 1, nil, nil, "", nil)
+	r, _ := b.Ring()
+	buf := &bytes.Buffer{}
+	if err := r.WriteGraphviz(buf); err != nil {
+		t.Fatal(err)
+	}
+	partitions := 1 << r.PartitionBitCount()
+	counts := make([]int, 5)
+	for p := 0; p < partitions; p++ {
+		counts[r.ResponsibleNodes(uint32(p))[0].ID()]++
+	}
+	expected := fmt.Sprintf(`digraph ring {
+	label="test";
+	node [shape=box];
+	"0000000000000004" [label="0000000000000004\n%d partitions"];
+	subgraph cluster_0 {
+		label="zone1";
+		subgraph cluster_1 {
+			label="server1";
+			"0000000000000001" [label="0000000000000001\n1.2.3.4:5\n%d partitions"];
+		}
+		subgraph cluster_2 {
+			label="server2";
+			"0000000000000002" [label="0000000000000002\n%d partitions"];
+		}
+	}
+	subgraph cluster_3 {
+		label="zone2";
+		subgraph cluster_4 {
+			label="server3";
+			"0000000000000003" [label="0000000000000003\n0 partitions\ninactive", style=dashed];
+		}
+	}
+}
+`, counts[4], counts[1], counts[2])
+	if buf.String() != expected {
+		t.Fatalf("WriteGraphviz gave:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(3)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	if v := r.ResponsibleNodes(r.PartitionForKey(key)); len(v) != 0 {
+		t.Fatalf("ResponsibleNodes gave %v", v)
+	}
+	if v := r.ResponsibleNodes(r.PartitionCount()); len(v) != 0 {
+		t.Fatalf("ResponsibleNodes beyond the partition count gave %v", v)
+	}
+	if r.ResponsibleForKey(key) || r.LocalNode() != nil {
+		t.Fatal("empty ring should have no local responsibility")
+	}
+	if n := r.PickReplicaForKey(key, 1); n != nil {
+		t.Fatalf("PickReplicaForKey gave %v", n)
+	}
+	if v := r.WalkNodesForKey(key, 3); len(v) != 0 {
+		t.Fatalf("WalkNodesForKey gave %v", v)
+	}
+	if v := r.UnderReplicatedPartitions(); uint32(len(v)) != r.PartitionCount() {
+		t.Fatalf("UnderReplicatedPartitions gave %v", v)
+	}
+	if s := r.Stats(); s.NodeCount != 0 || s.TotalCapacity != 0 {
+		t.Fatalf("Stats gave %#v", s)
+	}
+	if err = r.WriteGraphviz(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.RepairReplication(); err != nil {
+		t.Fatal(err)
+	}
+	msgring := NewTCPMsgRing(r)
+	msgring.MsgToOtherReplicas(r.Version(), 0, &TestMsg{})
+	if err = msgring.Listen(); err == nil {
+		t.Fatal("Listen without a local node should've given an error")
+	}
+	// Nodes added later are assigned as usual.
+	for i := 0; i < 3; i++ {
+		b.AddNode(true, 1, nil, nil, "", nil)
+	}
+	if r, err = b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if v := r.ResponsibleNodes(0); len(v) != 3 {
+		t.Fatalf("ResponsibleNodes after adding a node gave %v", v)
+	}
+}
+
+func TestRingFingerprint(t *testing.T) {
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	b.AddNode(true, 1, []string{"a"}, []string{"10.0.0.1:1"}, "", nil)
+	b.AddNode(true, 2, []string{"b"}, []string{"10.0.0.2:1"}, "", nil)
+	b.AddNode(true, 1, []string{"c"}, []string{"10.0.0.3:1"}, "", nil)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := r.Fingerprint()
+	var buf bytes.Buffer
+	if err = r.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Fingerprint() != fingerprint {
+		t.Fatal("a reloaded ring has a different fingerprint")
+	}
+	// The same topology with the nodes in reverse order and another
+	// version.
+	rr := *r.(*ring)
+	rr.version++
+	rr.label = "relabeled"
+	rr.nodes = make([]*node, len(r.(*ring).nodes))
+	last := int32(len(rr.nodes) - 1)
+	for i, n := range r.(*ring).nodes {
+		rr.nodes[last-int32(i)] = n
+	}
+	rr.replicaToPartitionToNodeIndex = make([][]int32, len(r.(*ring).replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range r.(*ring).replicaToPartitionToNodeIndex {
+		rr.replicaToPartitionToNodeIndex[replica] = make([]int32, len(partitionToNodeIndex))
+		for partition, nodeIndex := range partitionToNodeIndex {
+			rr.replicaToPartitionToNodeIndex[replica][partition] = last - nodeIndex
+		}
+	}
+	if rr.Fingerprint() != fingerprint {
+		t.Fatal("reordering the nodes changed the fingerprint")
+	}
+	if r2.FingerprintWithVersion() != r.FingerprintWithVersion() {
+		t.Fatal("a reloaded ring has a different fingerprint with version")
+	}
+	if rr.FingerprintWithVersion() == r.FingerprintWithVersion() || r.FingerprintWithVersion() == fingerprint {
+		t.Fatal("the fingerprint with version didn't include the version")
+	}
+	b.nodes[0].SetCapacity(3)
+	r3, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r3.Fingerprint() == fingerprint {
+		t.Fatal("a capacity change kept the same fingerprint")
+	}
+}
+
+func TestRingOrBuilderValidated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := NewBuilder()
+	b.SetReplicaCount(2)
+	b.AddNode(true, 1, []string{"a"}, nil, "", nil)
+	b.AddNode(true, 1, []string{"b"}, nil, "", nil)
+	r, err := b.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ringFile := path.Join(dir, "test.ring")
+	builderFile := path.Join(dir, "test.builder")
+	if err = PersistRingOrBuilder(r, nil, ringFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = PersistRingOrBuilder(nil, b, builderFile); err != nil {
+		t.Fatal(err)
+	}
+	if r2, _, err := RingOrBuilderValidated(ringFile); err != nil || r2 == nil {
+		t.Fatalf("RingOrBuilderValidated gave %v", err)
+	}
+	if _, b2, err := RingOrBuilderValidated(builderFile); err != nil || b2 == nil {
+		t.Fatalf("RingOrBuilderValidated gave %v", err)
+	}
+	// Corrupt the assignments as a damaged file could.
+	r.(*ring).replicaToPartitionToNodeIndex[1][0] = 7
+	b.replicaToPartitionToNodeIndex[0] = b.replicaToPartitionToNodeIndex[0][1:]
+	if err = PersistRingOrBuilder(r, nil, ringFile); err != nil {
+		t.Fatal(err)
+	}
+	if err = PersistRingOrBuilder(nil, b, builderFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = RingOrBuilder(ringFile); err != nil {
+		t.Fatalf("RingOrBuilder gave %v", err)
+	}
+	if _, _, err = RingOrBuilderValidated(ringFile); err == nil || !strings.Contains(err.Error(), "replica 1 has 1 partitions assigned to unknown nodes") {
+		t.Fatalf("RingOrBuilderValidated of a corrupt ring gave %v", err)
+	}
+	if _, _, err = RingOrBuilderValidated(builderFile); err == nil || !strings.Contains(err.Error(), "replica 0 has") {
+		t.Fatalf("RingOrBuilderValidated of a corrupt builder gave %v", err)
+	}
+}
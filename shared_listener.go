@@ -0,0 +1,168 @@
+package ring
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SharedListener accepts connections on a single address for any number of
+// TCPMsgRings, each registered under its own ring ID with
+// TCPMsgRing.RegisterOnListener. Every incoming message carries the ring ID
+// it was sent from and is dispatched to the TCPMsgRing registered under that
+// ID, keeping the message types of each ring separate.
+type SharedListener struct {
+	// listening is accessed atomically.
+	listening int32
+
+	lock                sync.RWMutex
+	rings               map[uint32]*TCPMsgRing
+	chunkSize           int
+	intraMessageTimeout time.Duration
+	interMessageTimeout time.Duration
+	connectionTimeout   time.Duration
+	authenticator       Authenticator
+	tcpOptions          TCPOptions
+}
+
+func NewSharedListener() *SharedListener {
+	return &SharedListener{
+		rings:               make(map[uint32]*TCPMsgRing),
+		chunkSize:           16 * 1024,
+		intraMessageTimeout: 2 * time.Second,
+		interMessageTimeout: 2 * time.Hour,
+		connectionTimeout:   60 * time.Second,
+		tcpOptions:          DefaultTCPOptions(),
+	}
+}
+
+// SetAuthenticator sets the function called with each connection accepted,
+// as TCPMsgRing.SetAuthenticator does for the connections a TCPMsgRing
+// accepts; the remote node is always nil as the connection may be for any of
+// the registered rings. The authenticators of the nodes dialing the
+// SharedListener must agree with this one.
+func (l *SharedListener) SetAuthenticator(authenticator Authenticator) {
+	l.lock.Lock()
+	l.authenticator = authenticator
+	l.lock.Unlock()
+}
+
+// SetTCPOptions sets the socket options for the connections accepted from then
+// on, as TCPMsgRing.SetTCPOptions does for the connections a TCPMsgRing dials
+// or accepts; the default is DefaultTCPOptions.
+func (l *SharedListener) SetTCPOptions(options TCPOptions) {
+	l.lock.Lock()
+	l.tcpOptions = options
+	l.lock.Unlock()
+}
+
+// RegisterOnListener registers the TCPMsgRing to receive the messages for
+// the ring ID arriving at the SharedListener; the messages the TCPMsgRing
+// sends will also be marked with the ring ID so the remote nodes, expected
+// to be listening with a SharedListener as well, can dispatch them. Each
+// ring ID may only be registered once and a TCPMsgRing may only be
+// registered on one SharedListener.
+func (m *TCPMsgRing) RegisterOnListener(l *SharedListener, ringID uint32) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sharedListener != nil {
+		return fmt.Errorf("already registered with ring ID %d", m.ringID)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.rings[ringID]; ok {
+		return fmt.Errorf("ring ID %d already registered", ringID)
+	}
+	l.rings[ringID] = m
+	m.sharedListener = l
+	m.ringID = ringID
+	return nil
+}
+
+func (l *SharedListener) ring(ringID uint32) *TCPMsgRing {
+	l.lock.RLock()
+	m := l.rings[ringID]
+	l.lock.RUnlock()
+	return m
+}
+
+// Listen accepts connections on the address, such as "10.1.2.3:12345",
+// returning only once accepting fails.
+func (l *SharedListener) Listen(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.listening, 1)
+	defer atomic.StoreInt32(&l.listening, 0)
+	for {
+		tcpconn, err := server.AcceptTCP()
+		if err != nil {
+			log.Println("SharedListener/AcceptTCP error:", err)
+			server.Close()
+			return err
+		}
+		l.lock.RLock()
+		options := l.tcpOptions
+		l.lock.RUnlock()
+		applyTCPOptions(tcpconn, options)
+		conn := &ringConn{
+			state:  _STATE_CONNECTED,
+			addr:   tcpconn.RemoteAddr().String(),
+			conn:   tcpconn,
+			reader: newTimeoutReader(tcpconn, l.chunkSize, l.intraMessageTimeout),
+			writer: newTimeoutWriter(tcpconn, l.chunkSize, l.intraMessageTimeout),
+		}
+		l.lock.RLock()
+		authenticator := l.authenticator
+		l.lock.RUnlock()
+		go func() {
+			if err := authenticate(authenticator, l.connectionTimeout, tcpconn, nil); err != nil {
+				log.Printf("SharedListener rejected connection from %s; authentication failed: %s", conn.addr, err)
+				tcpconn.Close()
+				conn.reader.Close()
+				return
+			}
+			l.handleForever(conn)
+		}()
+	}
+}
+
+// handleOne reads the next message from the connection and has the
+// TCPMsgRing registered for its ring ID handle it. Connections accepted by a
+// SharedListener are not associated with a node, so any sequence tracking
+// will be under node ID 0.
+func (l *SharedListener) handleOne(conn *ringConn) error {
+	h, err := readMsgHeader(conn, l.interMessageTimeout, l.intraMessageTimeout)
+	if err != nil {
+		return err
+	}
+	m := l.ring(h.RingID)
+	if m == nil {
+		return fmt.Errorf("no ring registered for ring ID %d", h.RingID)
+	}
+	if err = m.handleMsg(conn, h); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&m.lastReceive, time.Now().UnixNano())
+	return nil
+}
+
+func (l *SharedListener) handleForever(conn *ringConn) {
+	for {
+		if err := l.handleOne(conn); err != nil {
+			log.Println("SharedListener handleForever error:", err)
+			atomic.StoreInt32(&conn.state, _STATE_DISCONNECTING)
+			conn.conn.Close()
+			conn.reader.Close()
+			break
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func Test_SharedListener(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	l := NewSharedListener()
+	var sent bytes.Buffer
+	received := make(map[uint32]int)
+	for _, ringID := range []uint32{1, 2} {
+		ringID := ringID
+		msgring := NewTCPMsgRing(r)
+		if err := msgring.RegisterOnListener(l, ringID); err != nil {
+			t.Fatal(err)
+		}
+		msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+			received[ringID]++
+			return test_stringmarshaller(reader, size)
+		})
+		conn := new(testConn)
+		msgring.setConn(nB.Address(0), newRingConn(conn))
+		for i := uint32(0); i < ringID; i++ {
+			msgring.MsgToNode(nB.ID(), &TestMsg{})
+		}
+		sent.Write(conn.writeBuf.Bytes())
+	}
+	if err := NewTCPMsgRing(r).RegisterOnListener(l, 1); err == nil {
+		t.Fatal("registering a ring ID twice should have errored")
+	}
+	conn := new(testConn)
+	conn.readBuf.Write(sent.Bytes())
+	rc := newRingConn(conn)
+	for i := 0; i < 3; i++ {
+		if err := l.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received[1] != 1 || received[2] != 2 {
+		t.Fatalf("rings received %v", received)
+	}
+	// A ring that isn't shared doesn't accept messages for another ring ID.
+	conn.readBuf.Write(sent.Bytes())
+	if err := NewTCPMsgRing(r).handleOne(rc); err == nil {
+		t.Fatal("a message for ring ID 1 should not have been handled")
+	}
+}
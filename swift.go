@@ -0,0 +1,159 @@
+package ring
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// swiftRingData is the JSON metadata of a serialized Swift ring.
+type swiftRingData struct {
+	Devs         []*swiftDev `json:"devs"`
+	PartShift    uint        `json:"part_shift"`
+	ReplicaCount float64     `json:"replica_count"`
+	ByteOrder    string      `json:"byteorder"`
+}
+
+// swiftDev is a device in a Swift ring; removed devices are left as nulls.
+type swiftDev struct {
+	ID              int     `json:"id"`
+	Region          int     `json:"region"`
+	Zone            int     `json:"zone"`
+	Weight          float64 `json:"weight"`
+	IP              string  `json:"ip"`
+	Port            int     `json:"port"`
+	ReplicationIP   string  `json:"replication_ip"`
+	ReplicationPort int     `json:"replication_port"`
+	Device          string  `json:"device"`
+}
+
+// ImportSwiftRing creates a new Builder from an OpenStack Swift ring, as
+// written by swift-ring-builder to files such as object.ring.gz, gzipped or
+// not. Only version 1 of the format is supported; Swift's pickled .builder
+// files are not. The fields are mapped as follows:
+//
+//	devices          nodes, all active, with new IDs
+//	weight           capacity, rounded to the nearest whole number
+//	ip, port         the first address, as ip:port
+//	replication_*    the second address, if different from the first
+//	ip, zone, region tiers 0, 1, and 2; as the ip, "r<region>z<zone>", and
+//	                 "r<region>"
+//	id, device       meta, as "swift_id=<id> device=<device>"
+//	part_shift       partition bit count, as 32 - part_shift, which may be
+//	                 no more than the default MaxPartitionBitCount
+//	replica2part2dev replica count and partition assignments
+//
+// Swift's device meta, fractional replica counts, and any build history such
+// as partition move times are not carried over; the Builder's assignments
+// will be free to move after import.
+func ImportSwiftRing(r io.Reader) (*Builder, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	header := make([]byte, 6)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "R1NG" {
+		return nil, fmt.Errorf("not a Swift ring; unknown header %q", header[:4])
+	}
+	if v := binary.BigEndian.Uint16(header[4:]); v != 1 {
+		return nil, fmt.Errorf("unsupported Swift ring format version %d", v)
+	}
+	var jsonLen uint32
+	err = binary.Read(br, binary.BigEndian, &jsonLen)
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes := make([]byte, jsonLen)
+	_, err = io.ReadFull(br, jsonBytes)
+	if err != nil {
+		return nil, err
+	}
+	data := &swiftRingData{}
+	if err = json.Unmarshal(jsonBytes, data); err != nil {
+		return nil, err
+	}
+	if data.PartShift > 32 {
+		return nil, fmt.Errorf("invalid Swift part_shift %d", data.PartShift)
+	}
+	b := NewBuilder()
+	partitionBitCount := uint16(32 - data.PartShift)
+	if partitionBitCount > b.maxPartitionBitCount {
+		return nil, fmt.Errorf("too many partition bits %d from Swift part_shift %d; max is %d", partitionBitCount, data.PartShift, b.maxPartitionBitCount)
+	}
+	replicaCount := int(data.ReplicaCount)
+	if float64(replicaCount) != data.ReplicaCount || replicaCount < 1 {
+		return nil, fmt.Errorf("unsupported Swift replica count %v; only whole replica counts can be imported", data.ReplicaCount)
+	}
+	var byteOrder binary.ByteOrder
+	switch data.ByteOrder {
+	case "little":
+		byteOrder = binary.LittleEndian
+	case "big":
+		byteOrder = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown Swift ring byteorder %q", data.ByteOrder)
+	}
+	devToNodeIndex := make(map[int]int32, len(data.Devs))
+	for _, dev := range data.Devs {
+		if dev == nil {
+			continue
+		}
+		addresses := []string{fmt.Sprintf("%s:%d", dev.IP, dev.Port)}
+		if dev.ReplicationIP != "" && (dev.ReplicationIP != dev.IP || dev.ReplicationPort != dev.Port) {
+			addresses = append(addresses, fmt.Sprintf("%s:%d", dev.ReplicationIP, dev.ReplicationPort))
+		}
+		if dev.Weight < 0 || math.IsNaN(dev.Weight) {
+			return nil, fmt.Errorf("invalid Swift weight %v for device %d", dev.Weight, dev.ID)
+		}
+		tiers := []string{dev.IP, fmt.Sprintf("r%dz%d", dev.Region, dev.Zone), fmt.Sprintf("r%d", dev.Region)}
+		capacity := uint32(math.MaxUint32)
+		if dev.Weight < math.MaxUint32 {
+			capacity = uint32(math.Floor(dev.Weight + 0.5))
+		}
+		_, err = b.AddNode(true, capacity, tiers, addresses, fmt.Sprintf("swift_id=%d device=%s", dev.ID, dev.Device), nil)
+		if err != nil {
+			return nil, err
+		}
+		devToNodeIndex[dev.ID] = int32(len(b.nodes) - 1)
+	}
+	partitionCount := 1 << partitionBitCount
+	b.partitionBitCount = partitionBitCount
+	b.replicaToPartitionToNodeIndex = make([][]int32, replicaCount)
+	b.replicaCount = replicaCount
+	b.replicaToPartitionToLastMove = make([][]uint16, replicaCount)
+	devIDs := make([]uint16, partitionCount)
+	for replica := 0; replica < replicaCount; replica++ {
+		err = binary.Read(br, byteOrder, devIDs)
+		if err != nil {
+			return nil, fmt.Errorf("reading Swift assignments for replica %d: %s", replica, err)
+		}
+		partitionToNodeIndex := make([]int32, partitionCount)
+		partitionToLastMove := make([]uint16, partitionCount)
+		for partition, devID := range devIDs {
+			nodeIndex, ok := devToNodeIndex[int(devID)]
+			if !ok {
+				nodeIndex = -1
+			}
+			partitionToNodeIndex[partition] = nodeIndex
+			partitionToLastMove[partition] = math.MaxUint16
+		}
+		b.replicaToPartitionToNodeIndex[replica] = partitionToNodeIndex
+		b.replicaToPartitionToLastMove[replica] = partitionToLastMove
+	}
+	b.resetDeltaBase()
+	return b, nil
+}
@@ -0,0 +1,64 @@
+package ring
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestImportSwiftRing(t *testing.T) {
+	meta := `{"devs": [{"id": 0, "region": 1, "zone": 1, "weight": 100.0, "ip": "10.0.0.1", "port": 6000, "replication_ip": "10.0.1.1", "replication_port": 6000, "device": "sda", "meta": ""}, null, {"id": 2, "region": 1, "zone": 2, "weight": 199.6, "ip": "10.0.0.2", "port": 6000, "replication_ip": "10.0.0.2", "replication_port": 6000, "device": "sdb", "meta": "x"}], "part_shift": 30, "replica_count": 2, "byteorder": "little"}`
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Write([]byte("R1NG"))
+	binary.Write(gw, binary.BigEndian, uint16(1))
+	binary.Write(gw, binary.BigEndian, uint32(len(meta)))
+	gw.Write([]byte(meta))
+	binary.Write(gw, binary.LittleEndian, []uint16{0, 2, 0, 2})
+	binary.Write(gw, binary.LittleEndian, []uint16{2, 0, 2, 0})
+	gw.Close()
+	b, err := ImportSwiftRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := b.Nodes()
+	if len(nodes) != 2 || b.ReplicaCount() != 2 {
+		t.Fatalf("import gave %d nodes and %d replicas instead of 2 and 2", len(nodes), b.ReplicaCount())
+	}
+	n0, n2 := nodes[0], nodes[1]
+	if n0.Capacity() != 100 || n2.Capacity() != 200 {
+		t.Fatalf("import gave capacities %d and %d instead of 100 and 200", n0.Capacity(), n2.Capacity())
+	}
+	if n0.Address(0) != "10.0.0.1:6000" || n0.Address(1) != "10.0.1.1:6000" || n2.Address(1) != "" {
+		t.Fatalf("import gave addresses %v and %v", n0.Addresses(), n2.Addresses())
+	}
+	if tiers := n2.Tiers(); len(tiers) != 3 || tiers[0] != "10.0.0.2" || tiers[1] != "r1z2" || tiers[2] != "r1" {
+		t.Fatalf("import gave tiers %v", tiers)
+	}
+	if !strings.Contains(n2.Meta(), "swift_id=2") {
+		t.Fatalf("import gave meta %q", n2.Meta())
+	}
+	m := b.AssignmentMap()
+	if len(m) != 4 || m[0][0] != n0.ID() || m[0][1] != n2.ID() || m[1][0] != n2.ID() || m[1][1] != n0.ID() {
+		t.Fatalf("import gave assignments %v", m)
+	}
+	if _, err = b.Ring(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ImportSwiftRing(bytes.NewBufferString("RINGBUILDER")); err == nil {
+		t.Fatal("non-Swift data should've given an error")
+	}
+	for good, bad := range map[string]string{`"part_shift": 30`: `"part_shift": 0`, `"weight": 100.0`: `"weight": -1.0`} {
+		badMeta := strings.Replace(meta, good, bad, 1)
+		buf = &bytes.Buffer{}
+		buf.Write([]byte("R1NG"))
+		binary.Write(buf, binary.BigEndian, uint16(1))
+		binary.Write(buf, binary.BigEndian, uint32(len(badMeta)))
+		buf.Write([]byte(badMeta))
+		if _, err = ImportSwiftRing(buf); err == nil {
+			t.Fatalf("%s should've given an error", bad)
+		}
+	}
+}
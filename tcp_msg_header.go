@@ -0,0 +1,137 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MsgFlags indicate how a message's content is encoded and which optional
+// fields follow the fixed part of its header; see MsgHeader.
+type MsgFlags byte
+
+const (
+	// MsgFlagStreamID indicates the header includes the StreamID, matching a
+	// response to its request; see TCPMsgRing.Request.
+	MsgFlagStreamID MsgFlags = 1 << 3
+	// MsgFlagChecksummed indicates the content is followed by a CRC32 of the
+	// content as sent; see TCPMsgRing.EnableFrameChecksums.
+	MsgFlagChecksummed MsgFlags = 1 << 4
+	// MsgFlagRingID indicates the header includes the RingID; see
+	// TCPMsgRing.RegisterOnListener.
+	MsgFlagRingID MsgFlags = 1 << 5
+	// MsgFlagSequenced indicates the header includes the Sequence; see
+	// TCPMsgRing.EnableSequencing.
+	MsgFlagSequenced MsgFlags = 1 << 6
+	// MsgFlagCompressed indicates the content is compressed; see
+	// TCPMsgRing.SetCompressionThreshold.
+	MsgFlagCompressed MsgFlags = 1 << 7
+)
+
+// _MSG_FLAGS_KNOWN are the flags this version understands. The remaining low
+// bits are reserved for later additions; as a header can't be parsed without
+// knowing which fields a flag adds, one with an unknown flag is rejected, so
+// senders should only set a new flag once the receiver is known to support
+// it, such as by negotiating as stream compression does.
+const _MSG_FLAGS_KNOWN = MsgFlagStreamID | MsgFlagChecksummed | MsgFlagRingID | MsgFlagSequenced | MsgFlagCompressed
+
+// _MSG_FLAGS_SHIFT is the position of the flags within the length field of a
+// message's header; the content length takes the bits below.
+const _MSG_FLAGS_SHIFT = 56
+
+// _MSG_MAX_LENGTH is the largest content length a header can hold.
+const _MSG_MAX_LENGTH = uint64(1)<<_MSG_FLAGS_SHIFT - 1
+
+// MsgHeader is the header of a message frame as sent between TCPMsgRings. On
+// the wire it is the MsgType and then the Length, each 8 bytes big endian,
+// with the Flags in the top byte of the Length; then, if flagged, the RingID
+// as 4 bytes, the Sequence as 8 bytes, and the StreamID as 8 bytes, in that
+// order. A header without flags is the original 16 byte header, so new
+// optional fields can be added with new flags without changing the frames of
+// peers that don't use them.
+type MsgHeader struct {
+	MsgType uint64
+	Flags   MsgFlags
+	// Length is the number of content bytes following the header, as sent;
+	// for compressed content this is the compressed length.
+	Length   uint64
+	RingID   uint32
+	Sequence uint64
+	StreamID uint64
+}
+
+// WriteMsgHeader writes the header, including the optional fields its flags
+// indicate. An error is returned if the header has a flag that isn't known or
+// a length too large to be represented.
+func WriteMsgHeader(w io.Writer, h *MsgHeader) error {
+	if h.Flags&^_MSG_FLAGS_KNOWN != 0 {
+		return fmt.Errorf("unknown message header flags %02x", byte(h.Flags&^_MSG_FLAGS_KNOWN))
+	}
+	if h.Length > _MSG_MAX_LENGTH {
+		return fmt.Errorf("message length %d is too large; max is %d", h.Length, _MSG_MAX_LENGTH)
+	}
+	b := make([]byte, 16, 36)
+	binary.BigEndian.PutUint64(b, h.MsgType)
+	binary.BigEndian.PutUint64(b[8:], h.Length|uint64(h.Flags)<<_MSG_FLAGS_SHIFT)
+	if h.Flags&MsgFlagRingID != 0 {
+		b = b[:len(b)+4]
+		binary.BigEndian.PutUint32(b[len(b)-4:], h.RingID)
+	}
+	if h.Flags&MsgFlagSequenced != 0 {
+		b = b[:len(b)+8]
+		binary.BigEndian.PutUint64(b[len(b)-8:], h.Sequence)
+	}
+	if h.Flags&MsgFlagStreamID != 0 {
+		b = b[:len(b)+8]
+		binary.BigEndian.PutUint64(b[len(b)-8:], h.StreamID)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadMsgHeader reads a header written by WriteMsgHeader, returning an error
+// if it has a flag that isn't known.
+func ReadMsgHeader(r io.Reader) (MsgHeader, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return MsgHeader{}, err
+	}
+	return readMsgHeaderRest(r, b[0])
+}
+
+// readMsgHeaderRest reads the remainder of a header whose first byte has
+// already been read.
+func readMsgHeaderRest(r io.Reader, first byte) (MsgHeader, error) {
+	var h MsgHeader
+	b := make([]byte, 16)
+	b[0] = first
+	if _, err := io.ReadFull(r, b[1:]); err != nil {
+		return h, err
+	}
+	h.MsgType = binary.BigEndian.Uint64(b)
+	length := binary.BigEndian.Uint64(b[8:])
+	h.Flags = MsgFlags(length >> _MSG_FLAGS_SHIFT)
+	h.Length = length & _MSG_MAX_LENGTH
+	if h.Flags&^_MSG_FLAGS_KNOWN != 0 {
+		return h, fmt.Errorf("unknown message header flags %02x for message type %x", byte(h.Flags&^_MSG_FLAGS_KNOWN), h.MsgType)
+	}
+	if h.Flags&MsgFlagRingID != 0 {
+		if _, err := io.ReadFull(r, b[:4]); err != nil {
+			return h, err
+		}
+		h.RingID = binary.BigEndian.Uint32(b)
+	}
+	if h.Flags&MsgFlagSequenced != 0 {
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, err
+		}
+		h.Sequence = binary.BigEndian.Uint64(b)
+	}
+	if h.Flags&MsgFlagStreamID != 0 {
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, err
+		}
+		h.StreamID = binary.BigEndian.Uint64(b)
+	}
+	return h, nil
+}
@@ -0,0 +1,77 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestMsgHeaderRoundTrip(t *testing.T) {
+	for _, h := range []MsgHeader{
+		{MsgType: 1, Length: 7},
+		{MsgType: 2, Flags: MsgFlagRingID, Length: 8, RingID: 3},
+		{MsgType: 4, Flags: MsgFlagSequenced | MsgFlagCompressed, Length: 9, Sequence: 5},
+		{MsgType: 9, Flags: MsgFlagStreamID, Length: 10, StreamID: 11},
+		{MsgType: 6, Flags: _MSG_FLAGS_KNOWN, Length: _MSG_MAX_LENGTH, RingID: 7, Sequence: 8, StreamID: 9},
+	} {
+		buf := &bytes.Buffer{}
+		if err := WriteMsgHeader(buf, &h); err != nil {
+			t.Fatal(err)
+		}
+		size := 16
+		if h.Flags&MsgFlagRingID != 0 {
+			size += 4
+		}
+		if h.Flags&MsgFlagSequenced != 0 {
+			size += 8
+		}
+		if h.Flags&MsgFlagStreamID != 0 {
+			size += 8
+		}
+		if buf.Len() != size {
+			t.Fatalf("%#v was written as %d bytes instead of %d", h, buf.Len(), size)
+		}
+		h2, err := ReadMsgHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h2 != h {
+			t.Fatalf("read %#v instead of %#v", h2, h)
+		}
+	}
+}
+
+func TestMsgHeaderOriginalFormat(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteMsgHeader(buf, &MsgHeader{MsgType: 0x0102030405060708, Length: 7}); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 16)
+	binary.BigEndian.PutUint64(want, 0x0102030405060708)
+	binary.BigEndian.PutUint64(want[8:], 7)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("header without flags was %x instead of %x", buf.Bytes(), want)
+	}
+}
+
+func TestMsgHeaderErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteMsgHeader(buf, &MsgHeader{MsgType: 1, Flags: 1}); err == nil {
+		t.Fatal("unknown flag should have given an error")
+	}
+	if err := WriteMsgHeader(buf, &MsgHeader{MsgType: 1, Length: _MSG_MAX_LENGTH + 1}); err == nil {
+		t.Fatal("too long a length should have given an error")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("failed writes wrote %d bytes", buf.Len())
+	}
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[8:], uint64(1)<<_MSG_FLAGS_SHIFT|7)
+	if _, err := ReadMsgHeader(bytes.NewReader(b)); err == nil {
+		t.Fatal("reading an unknown flag should have given an error")
+	}
+	binary.BigEndian.PutUint64(b[8:], uint64(MsgFlagSequenced)<<_MSG_FLAGS_SHIFT|7)
+	if _, err := ReadMsgHeader(bytes.NewReader(b)); err == nil {
+		t.Fatal("reading a header missing its sequence should have given an error")
+	}
+}
@@ -1,16 +1,125 @@
 package ring
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
-	"math"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// _MSG_TYPE_STREAM_COMPRESSION is the reserved message type used to negotiate
+// stream compression when a connection is established; see
+// TCPMsgRing.SetStreamCompression.
+const _MSG_TYPE_STREAM_COMPRESSION = ReservedMsgTypeStart
+
+// _STREAM_COMPRESSION_DECLINED is the reply to a stream compression request
+// the remote node does not agree to.
+const _STREAM_COMPRESSION_DECLINED = 0xff
+
+// _MAX_ABANDONED_HANDLERS is the most handlers that may be left running after
+// timing out on a connection before the connection is closed; see
+// TCPMsgRing.SetHandlerTimeout.
+const _MAX_ABANDONED_HANDLERS = 16
+
+// ErrNodeCircuitOpen is returned when sending to a node the send error handler
+// has stopped sends to; see TCPMsgRing.SetSendErrorHandler.
+var ErrNodeCircuitOpen = errors.New("node circuit open")
+
+// ErrNodeUnreachable is returned, wrapping the dial error, when MsgToNode finds
+// no connection to the node and can't establish one; the error returned
+// matches ErrNodeUnreachable with errors.Is, and its Unwrap method gives the
+// dial error.
+var ErrNodeUnreachable = errors.New("node unreachable")
+
+// nodeUnreachableError is ErrNodeUnreachable with the dial error that caused
+// it.
+type nodeUnreachableError struct {
+	nodeID uint64
+	err    error
+}
+
+func (e *nodeUnreachableError) Error() string {
+	return fmt.Sprintf("%s: node %016x: %s", ErrNodeUnreachable, e.nodeID, e.err)
+}
+
+func (e *nodeUnreachableError) Is(target error) bool {
+	return target == ErrNodeUnreachable
+}
+
+func (e *nodeUnreachableError) Unwrap() error {
+	return e.err
+}
+
+// ErrNodePaused is returned when sending to a node that has been paused; see
+// TCPMsgRing.PauseNode.
+var ErrNodePaused = errors.New("node paused")
+
+// ErrShuttingDown is returned when sending or listening after
+// TCPMsgRing.Shutdown has been called.
+var ErrShuttingDown = errors.New("shutting down")
+
+// The errors below are the kinds of transport failures; the errors returned
+// match them with errors.Is, and their Unwrap methods give the underlying
+// cause, such as a net.Error.
+var (
+	// ErrDialFailed is returned when a connection to a node could not be
+	// established, including failing authentication or negotiation.
+	ErrDialFailed = errors.New("dial failed")
+	// ErrWriteTimeout is returned when writing a message timed out.
+	ErrWriteTimeout = errors.New("write timeout")
+	// ErrReadTimeout is returned when reading a message timed out.
+	ErrReadTimeout = errors.New("read timeout")
+	// ErrConnClosed is returned when the connection was closed, or otherwise
+	// failed, while reading or writing, or there was no open connection.
+	ErrConnClosed = errors.New("connection closed")
+	// ErrNodeNotFound is returned when sending to a node ID the ring doesn't
+	// have.
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrRingVersionMismatch is returned by MsgToOtherReplicas when the
+	// message was for a ring version other than the current one.
+	ErrRingVersionMismatch = errors.New("ring version mismatch")
+)
+
+// transportError is one of the transport error kinds with its cause.
+type transportError struct {
+	kind error
+	err  error
+}
+
+func (e *transportError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.err)
+}
+
+func (e *transportError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// connError classifies an error reading or writing a connection as the
+// timeout kind given, if it was a timeout, or otherwise ErrConnClosed.
+func connError(err error, timeoutKind error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &transportError{kind: timeoutKind, err: err}
+	}
+	return &transportError{kind: ErrConnClosed, err: err}
+}
+
 const (
 	_STATE_UNKNOWN = iota
 	_STATE_CONNECTING
@@ -20,26 +129,168 @@ const (
 
 type ringConn struct {
 	state      int32
+	pending    int32 // sends waiting on or holding the writerLock
 	addr       string
+	nodeID     uint64 // the remote node's ID, if known; 0 otherwise
+	dialed     bool   // true if dialed to the node's address; see SetRing
+	requests   int32  // requests received being handled; see Request
+	abandoned  int32  // handlers timed out but still running; see SetHandlerTimeout
 	conn       net.Conn
 	reader     *timeoutReader
 	writerLock sync.Mutex
 	writer     *timeoutWriter
+
+	// sendSequence is the last sequence number written, guarded by
+	// writerLock; receiveSequence the last read, used only by the read loop.
+	// Both start over with each connection; see EnableSequencing.
+	sendSequence    uint64
+	receiveSequence uint64
+
+	// dialDone is closed once the dial of a connection made by connecting
+	// has finished, with dialErr its result; see ensureConnection.
+	dialDone chan struct{}
+	dialErr  error
+
+	// idle is given a value whenever pending drops to zero; see waitIdle.
+	idleOnce sync.Once
+	idle     chan struct{}
 }
 
+func (c *ringConn) idleSignal() chan struct{} {
+	c.idleOnce.Do(func() { c.idle = make(chan struct{}, 1) })
+	return c.idle
+}
+
+// sendDone ends a send counted in pending, waking any waitIdle. The signal
+// is buffered so a drop to zero just before a waiter arrives is not missed.
+func (c *ringConn) sendDone() {
+	if atomic.AddInt32(&c.pending, -1) == 0 {
+		select {
+		case c.idleSignal() <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// waitIdle waits until no sends are pending on the connection, returning
+// false if the deadline passes or done is closed first.
+func (c *ringConn) waitIdle(deadline time.Time, done <-chan struct{}) bool {
+	if atomic.LoadInt32(&c.pending) == 0 {
+		return true
+	}
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	idle := c.idleSignal()
+	for atomic.LoadInt32(&c.pending) > 0 {
+		select {
+		case <-idle:
+		case <-timer.C:
+			return false
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+// MsgEncoder transforms the content of an outgoing message, such as for
+// compression or signing, returning the encoded content and its length. The
+// message frame written will reflect the encoded length.
+type MsgEncoder func(msgType uint64, content io.Reader) (encoded io.Reader, encodedLength uint64, err error)
+
+// MsgDecoder reverses a MsgEncoder for an incoming message, returning the
+// decoded content and its length to be given to the message handler.
+type MsgDecoder func(msgType uint64, content io.Reader) (decoded io.Reader, decodedLength uint64, err error)
+
+// SequencedReader is implemented by the reader given to a MsgUnmarshaller
+// when the message was sent with a sequence number; see
+// TCPMsgRing.EnableSequencing.
+type SequencedReader interface {
+	io.Reader
+	// MsgSequence is the sequence number the sending node gave the message.
+	MsgSequence() uint64
+}
+
+type sequencedReader struct {
+	io.Reader
+	sequence uint64
+}
+
+func (r *sequencedReader) MsgSequence() uint64 {
+	return r.sequence
+}
+
+// SequenceGapHandler is called when a message arrives from a node with a
+// sequence number other than the one expected, indicating messages were lost;
+// see TCPMsgRing.EnableSequencing.
+type SequenceGapHandler func(nodeID uint64, expected uint64, received uint64)
+
 type TCPMsgRing struct {
+	// These are accessed atomically and are kept first for 64-bit alignment.
+	lastSend           int64
+	lastReceive        int64
+	checksumMismatches uint64
+	listening          int32
+	inbound            int32
+	shuttingDown       int32
+
 	lock sync.RWMutex
 	// addressIndex is the index given to a Node's Address method to determine
 	// the network address to connect to (see Node's Address method for more
 	// information).
-	addressIndex        int
-	chunkSize           int
-	connectionTimeout   time.Duration
-	intraMessageTimeout time.Duration
-	interMessageTimeout time.Duration
-	ring                Ring
-	msgHandlers         map[uint64]MsgUnmarshaller
-	conns               map[string]*ringConn
+	addressIndex         int
+	chunkSize            int
+	connectionTimeout    time.Duration
+	intraMessageTimeout  time.Duration
+	interMessageTimeout  time.Duration
+	ring                 Ring
+	generation           uint64 // incremented by SetRing; see Generation
+	msgHandlers          map[uint64]MsgUnmarshaller
+	conns                map[string]*ringConn
+	rateLimits           map[uint64]*tokenBucket
+	msgEncoder           MsgEncoder
+	msgDecoder           MsgDecoder
+	compressionThreshold int
+	streamCompression    Compression
+	streamCompressing    bool
+	reconnectJitter      float64
+	sendAttempts         int
+	sendBackoff          time.Duration
+	flushInterval        time.Duration
+	flushing             bool // true while flushForever is running
+	drainTimeout         time.Duration
+	maxInboundConns      int
+	readBudgetBytes      uint64
+	readBudgetTime       time.Duration
+	sequencing           bool
+	frameChecksums       bool
+	checksumClose        bool
+	handlerTimeout       time.Duration
+	handlerTimeoutClose  bool
+	sequenceGapHandler   SequenceGapHandler
+	sharedListener       *SharedListener
+	ringID               uint32
+	sendErrorHandler     SendErrorHandler
+	openCircuits         map[uint64]bool
+	pausedNodes          map[uint64]bool
+	dedupWindow          time.Duration
+	// dedupSent is the time each DedupMsg key was sent to each node ID,
+	// pruned of keys older than the dedupWindow every dedupWindow.
+	dedupSent      map[uint64]map[uint64]time.Time
+	dedupPruned    time.Time
+	connStats      map[uint64]*connStats
+	msgTypeStats   map[uint64]*msgTypeStats
+	listener       *net.TCPListener
+	listenCallback func(addr string, err error)
+	authenticator  Authenticator
+	tcpOptions     TCPOptions
+	handoffHandler HandoffHandler
+	// requestHandlers are by message type and requests are the Request
+	// calls waiting on responses, by stream ID.
+	requestHandlers     map[uint64]RequestHandler
+	requests            map[uint64]*pendingRequest
+	lastStreamID        uint64
+	maxRequestsInFlight int32
 }
 
 func NewTCPMsgRing(r Ring) *TCPMsgRing {
@@ -47,10 +298,24 @@ func NewTCPMsgRing(r Ring) *TCPMsgRing {
 		ring:                r,
 		msgHandlers:         make(map[uint64]MsgUnmarshaller),
 		conns:               make(map[string]*ringConn),
+		rateLimits:          make(map[uint64]*tokenBucket),
+		openCircuits:        make(map[uint64]bool),
+		pausedNodes:         make(map[uint64]bool),
+		dedupSent:           make(map[uint64]map[uint64]time.Time),
+		connStats:           make(map[uint64]*connStats),
+		msgTypeStats:        make(map[uint64]*msgTypeStats),
+		requestHandlers:     make(map[uint64]RequestHandler),
+		requests:            make(map[uint64]*pendingRequest),
+		maxRequestsInFlight: DefaultMaxRequestsInFlight,
 		chunkSize:           16 * 1024,
 		connectionTimeout:   60 * time.Second,
 		intraMessageTimeout: 2 * time.Second,
 		interMessageTimeout: 2 * time.Hour,
+		reconnectJitter:     1,
+		sendAttempts:        3,
+		sendBackoff:         time.Second,
+		drainTimeout:        10 * time.Second,
+		tcpOptions:          DefaultTCPOptions(),
 	}
 }
 
@@ -61,140 +326,1638 @@ func (m *TCPMsgRing) Ring() Ring {
 	return r
 }
 
+// Generation is the number of times SetRing has installed a new Ring, 0 for
+// the Ring given to NewTCPMsgRing. Applications that route without holding a
+// lock across each operation can use it, with RingGeneration, to tell whether
+// a routing decision was made against a Ring that has since been replaced.
+func (m *TCPMsgRing) Generation() uint64 {
+	m.lock.RLock()
+	generation := m.generation
+	m.lock.RUnlock()
+	return generation
+}
+
+// RingGeneration returns the current Ring and its Generation, read together
+// so lookups made against the Ring can be checked later; for example, an
+// operation routed with the Ring can be retried if Generation has moved on
+// by the time it completes.
+func (m *TCPMsgRing) RingGeneration() (Ring, uint64) {
+	m.lock.RLock()
+	r := m.ring
+	generation := m.generation
+	m.lock.RUnlock()
+	return r, generation
+}
+
+// SetRing installs a new Ring, such as a newer version from the Builder, and
+// increments the Generation.
+// Connections this TCPMsgRing dialed to nodes whose address has changed, or
+// that are no longer in the ring, are drained and closed, and nodes with a
+// new address are dialed there in the background, so messages go to the new
+// address straight away rather than once the old connection happens to fail.
+// Connections other nodes dialed to this one are left alone.
+func (m *TCPMsgRing) SetRing(r Ring) {
+	var stale []*ringConn
+	var redial []Node
+	m.lock.Lock()
+	m.ring = r
+	m.generation++
+	for addr, conn := range m.conns {
+		if !conn.dialed {
+			continue
+		}
+		n := r.Node(conn.nodeID)
+		if n != nil && n.Address(m.addressIndex) == addr {
+			continue
+		}
+		delete(m.conns, addr)
+		stale = append(stale, conn)
+		if n != nil && n.Active() && n.Address(m.addressIndex) != "" {
+			redial = append(redial, n)
+		}
+	}
+	m.lock.Unlock()
+	for _, conn := range stale {
+		m.drainConn(conn)
+	}
+	for _, n := range redial {
+		go func(n Node) {
+			if err := m.ensureConnection(n); err != nil {
+				log.Printf("reconnecting to node %016x at its new address failed: %s", n.ID(), err)
+			}
+		}(n)
+	}
+}
+
 func (m *TCPMsgRing) MaxMsgLength() uint64 {
-	return math.MaxUint64
+	// The top byte of the length is reserved for the MsgFlags.
+	return _MSG_MAX_LENGTH
+}
+
+func (m *TCPMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) error {
+	if msgType >= ReservedMsgTypeStart {
+		return fmt.Errorf("message type %x is reserved; types from %x on are for internal use", msgType, ReservedMsgTypeStart)
+	}
+	m.setMsgHandler(msgType, handler)
+	return nil
+}
+
+// RegisteredMsgTypes returns, in ascending order, the message types that have
+// a handler set, including any of the package's own reserved types in use,
+// such as those of the handoff protocol; useful for seeing which messages a
+// node will process, such as during a partial upgrade. A message of another
+// type is not skipped by the receiving node: it is logged as an error and the
+// connection it arrived on is closed, losing any other messages in flight on
+// it, until a later send dials again.
+func (m *TCPMsgRing) RegisteredMsgTypes() []uint64 {
+	m.lock.RLock()
+	msgTypes := make([]uint64, 0, len(m.msgHandlers))
+	for msgType, handler := range m.msgHandlers {
+		if handler != nil {
+			msgTypes = append(msgTypes, msgType)
+		}
+	}
+	m.lock.RUnlock()
+	sort.Sort(uint64Slice(msgTypes))
+	return msgTypes
+}
+
+// setMsgHandler is SetMsgHandler without the reserved message type check, for
+// the package's own messages.
+func (m *TCPMsgRing) setMsgHandler(msgType uint64, handler MsgUnmarshaller) {
+	m.lock.Lock()
+	m.msgHandlers[uint64(msgType)] = handler
+	m.lock.Unlock()
+}
+
+// SetMsgEncoder sets the function used to transform the content of every
+// outgoing message; nil, the default, sends the content as is. Note that with
+// an encoder set each message's content is buffered in memory before being
+// encoded. The remote nodes will need the matching MsgDecoder set.
+func (m *TCPMsgRing) SetMsgEncoder(encoder MsgEncoder) {
+	m.lock.Lock()
+	m.msgEncoder = encoder
+	m.lock.Unlock()
+}
+
+// SetMsgDecoder sets the function used to transform the content of every
+// incoming message before it is given to its handler; nil, the default, gives
+// the content as is.
+func (m *TCPMsgRing) SetMsgDecoder(decoder MsgDecoder) {
+	m.lock.Lock()
+	m.msgDecoder = decoder
+	m.lock.Unlock()
+}
+
+// SetCompressionThreshold causes the content of messages longer than threshold
+// bytes to be compressed with gzip before sending; this saves
+// bandwidth for large messages without adding overhead to small ones. A
+// threshold of zero or less, the default, disables compression. Compressed
+// messages are flagged as such and are decompressed by the receiving node
+// regardless of its own threshold. Compression is applied after any
+// MsgEncoder.
+func (m *TCPMsgRing) SetCompressionThreshold(threshold int) {
+	m.lock.Lock()
+	m.compressionThreshold = threshold
+	m.lock.Unlock()
+}
+
+// EnableSequencing turns on, or off, the sending of a sequence number with
+// each message. Sequence numbers are kept per connection, starting at 1 with
+// each new connection and increasing by one with each message written, so a
+// receiving node can tell when messages have been lost on a connection. The
+// receiving node gives the sequence number to handlers through the
+// SequencedReader interface and calls any SequenceGapHandler on a gap;
+// receiving sequenced messages does not require sequencing to be enabled.
+func (m *TCPMsgRing) EnableSequencing(enable bool) {
+	m.lock.Lock()
+	m.sequencing = enable
+	m.lock.Unlock()
+}
+
+// EnableFrameChecksums turns on, or off, the sending of a CRC32 of each
+// message's content after the content. The receiving node verifies the
+// checksum before giving the message to its handler, regardless of its own
+// setting; on a mismatch the message is logged, counted, see
+// ChecksumMismatches, and dropped. This is meant to catch Msg implementations
+// that corrupt their content, such as by reusing a buffer still being sent,
+// during development and hardening; checksummed messages are buffered in full
+// by the receiving node.
+func (m *TCPMsgRing) EnableFrameChecksums(enable bool) {
+	m.lock.Lock()
+	m.frameChecksums = enable
+	m.lock.Unlock()
+}
+
+// SetChecksumMismatchClose sets whether the connection a message with a frame
+// checksum mismatch arrived on is closed, rather than just the message being
+// dropped; see EnableFrameChecksums. The default is false.
+func (m *TCPMsgRing) SetChecksumMismatchClose(closeConn bool) {
+	m.lock.Lock()
+	m.checksumClose = closeConn
+	m.lock.Unlock()
+}
+
+// SetHandlerTimeout bounds how long a message handler may run before the
+// connection's read loop moves on to the next message, so a handler stuck on,
+// say, a full downstream channel cannot stall the connection; zero or less,
+// the default, waits on handlers indefinitely. With a timeout each message's
+// content is read into memory before the handler is called, so the message
+// framing is intact whatever the handler does. A handler that times out is
+// logged and left to finish on its own, with its result ignored, while
+// later messages are handled; see SetHandlerTimeoutClose to close the
+// connection instead, shedding the load from the sending node.
+//
+// Note that once a handler has timed out, handlers for later messages may run
+// alongside it, so handlers must be safe for concurrent use even for messages
+// from a single node. If too many handlers on one connection are left
+// running, the connection is closed regardless of SetHandlerTimeoutClose.
+func (m *TCPMsgRing) SetHandlerTimeout(d time.Duration) {
+	m.lock.Lock()
+	m.handlerTimeout = d
+	m.lock.Unlock()
+}
+
+// SetHandlerTimeoutClose sets whether the connection a message arrived on is
+// closed when its handler times out; see SetHandlerTimeout. The default is
+// false.
+func (m *TCPMsgRing) SetHandlerTimeoutClose(closeConn bool) {
+	m.lock.Lock()
+	m.handlerTimeoutClose = closeConn
+	m.lock.Unlock()
+}
+
+// ChecksumMismatches returns the number of messages received that were
+// dropped because their frame checksums did not match; see
+// EnableFrameChecksums.
+func (m *TCPMsgRing) ChecksumMismatches() uint64 {
+	return atomic.LoadUint64(&m.checksumMismatches)
+}
+
+// SetSequenceGapHandler sets the function called when a sequenced message
+// arrives out of sequence on its connection; see EnableSequencing.
+func (m *TCPMsgRing) SetSequenceGapHandler(handler SequenceGapHandler) {
+	m.lock.Lock()
+	m.sequenceGapHandler = handler
+	m.lock.Unlock()
+}
+
+// SetDrainTimeout sets how long a connection being closed gracefully, such as
+// when replaced by a new connection from the same node, will wait for sends
+// already in progress to finish; after that the connection is closed and the
+// remaining sends fail, to be retried or given up on as usual. The default is
+// 10 seconds.
+func (m *TCPMsgRing) SetDrainTimeout(timeout time.Duration) {
+	m.lock.Lock()
+	m.drainTimeout = timeout
+	m.lock.Unlock()
+}
+
+// SetStreamCompression has the connections this node dials compress their
+// whole stream with the compression given, rather than compressing messages
+// individually (see SetCompressionThreshold); this works better for many
+// small, similar messages. The compression is negotiated when connecting and
+// is only used if the remote node has set the same stream compression;
+// otherwise the connection is left uncompressed. Note that the remote nodes
+// must be running a version that understands the negotiation, as one that
+// does not will refuse the connection. An error is returned if the
+// compression is not available.
+func (m *TCPMsgRing) SetStreamCompression(c Compression) error {
+	switch c {
+	case CompressionGzip:
+	case CompressionZstd:
+		if newZstdWriter == nil {
+			return fmt.Errorf("zstd compression not available; build with -tags zstd")
+		}
+	default:
+		return fmt.Errorf("unknown compression %s", c)
+	}
+	m.lock.Lock()
+	m.streamCompression = c
+	m.streamCompressing = true
+	m.lock.Unlock()
+	return nil
+}
+
+// DisableStreamCompression stops new connections from using stream
+// compression; see SetStreamCompression. This is the default.
+func (m *TCPMsgRing) DisableStreamCompression() {
+	m.lock.Lock()
+	m.streamCompressing = false
+	m.lock.Unlock()
+}
+
+// SetMaxInboundConns limits the number of connections accepted by Listen
+// that may be open at once; connections accepted beyond the limit are closed
+// immediately. A limit of 0, the default, is unlimited.
+func (m *TCPMsgRing) SetMaxInboundConns(n int) {
+	if n < 0 {
+		n = 0
+	}
+	m.lock.Lock()
+	m.maxInboundConns = n
+	m.lock.Unlock()
+}
+
+// SetReadBudget limits each incoming message to maxBytes on the wire,
+// including its header, and to maxTime to read once its header has arrived;
+// a message exceeding either has its connection reset. This defends against
+// a remote node sending a huge message, or sending just fast enough to avoid
+// the timeout on each individual read. A zero value for either is unlimited,
+// the default.
+func (m *TCPMsgRing) SetReadBudget(maxBytes uint64, maxTime time.Duration) {
+	m.lock.Lock()
+	m.readBudgetBytes = maxBytes
+	m.readBudgetTime = maxTime
+	m.lock.Unlock()
+}
+
+// SetDedupWindow has a message implementing DedupMsg skipped, as if sent, if
+// a message with the same key was sent to the same node within the duration
+// given; this is per node rather than per connection, so a resend over a new
+// connection after a reconnection is also skipped. A failed send does not
+// count as sent. A duration of zero or less, the default, disables
+// deduplication.
+func (m *TCPMsgRing) SetDedupWindow(d time.Duration) {
+	m.lock.Lock()
+	m.dedupWindow = d
+	if d <= 0 {
+		m.dedupSent = make(map[uint64]map[uint64]time.Time)
+	}
+	m.lock.Unlock()
+}
+
+// dedup returns true if the message should be skipped as a duplicate;
+// otherwise, if the message has a dedup key, it is recorded as sent to the
+// node and the key is returned with true for undedup to remove should the
+// send fail.
+func (m *TCPMsgRing) dedup(msg Msg, nodeID uint64) (skip bool, key uint64, recorded bool) {
+	dm, ok := msg.(DedupMsg)
+	if !ok {
+		return false, 0, false
+	}
+	key, ok = dm.DedupKey()
+	if !ok {
+		return false, 0, false
+	}
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.dedupWindow <= 0 {
+		return false, 0, false
+	}
+	if now.Sub(m.dedupPruned) >= m.dedupWindow {
+		for id, sent := range m.dedupSent {
+			for k, t := range sent {
+				if now.Sub(t) >= m.dedupWindow {
+					delete(sent, k)
+				}
+			}
+			if len(sent) == 0 {
+				delete(m.dedupSent, id)
+			}
+		}
+		m.dedupPruned = now
+	}
+	sent := m.dedupSent[nodeID]
+	if t, ok := sent[key]; ok && now.Sub(t) < m.dedupWindow {
+		return true, 0, false
+	}
+	if sent == nil {
+		sent = make(map[uint64]time.Time)
+		m.dedupSent[nodeID] = sent
+	}
+	sent[key] = now
+	return false, key, true
+}
+
+func (m *TCPMsgRing) undedup(key uint64, nodeID uint64) {
+	m.lock.Lock()
+	if sent := m.dedupSent[nodeID]; sent != nil {
+		delete(sent, key)
+	}
+	m.lock.Unlock()
+}
+
+// ConnStats are the message counts for the connections with a node since the
+// stats were last reset; see TCPMsgRing.ResetConnStats. The byte counts are of
+// the messages' types, lengths, any sequence numbers, and content, before any
+// stream compression.
+type ConnStats struct {
+	MsgsSent      uint64
+	BytesSent     uint64
+	MsgsReceived  uint64
+	BytesReceived uint64
+	// SendErrors is the number of sends that failed once under way, closing
+	// the connection; SendTimeouts is how many of those timed out.
+	SendErrors   uint64
+	SendTimeouts uint64
+	// Connects is the number of connections dialed to the node, so any more
+	// than one are reconnections.
+	Connects uint64
+}
+
+// connStats holds the counters for a ConnStats, all guarded by the one lock
+// so a snapshot or reset sees every message's counts together.
+type connStats struct {
+	lock   sync.Mutex
+	counts ConnStats
+}
+
+// add adds the counts given to the counters.
+func (s *connStats) add(counts ConnStats) {
+	s.lock.Lock()
+	s.counts.MsgsSent += counts.MsgsSent
+	s.counts.BytesSent += counts.BytesSent
+	s.counts.MsgsReceived += counts.MsgsReceived
+	s.counts.BytesReceived += counts.BytesReceived
+	s.counts.SendErrors += counts.SendErrors
+	s.counts.SendTimeouts += counts.SendTimeouts
+	s.counts.Connects += counts.Connects
+	s.lock.Unlock()
+}
+
+func (s *connStats) snapshot() ConnStats {
+	s.lock.Lock()
+	counts := s.counts
+	s.lock.Unlock()
+	return counts
+}
+
+func (s *connStats) reset() ConnStats {
+	s.lock.Lock()
+	counts := s.counts
+	s.counts = ConnStats{}
+	s.lock.Unlock()
+	return counts
+}
+
+// MsgTypeStats are the message counts for a message type since the
+// TCPMsgRing was created.
+type MsgTypeStats struct {
+	MsgsSent     uint64
+	MsgsReceived uint64
+}
+
+// msgTypeStats holds the counters for a MsgTypeStats, updated atomically.
+type msgTypeStats struct {
+	msgsSent     uint64
+	msgsReceived uint64
+}
+
+func (m *TCPMsgRing) typeStats(msgType uint64) *msgTypeStats {
+	m.lock.RLock()
+	s := m.msgTypeStats[msgType]
+	m.lock.RUnlock()
+	if s != nil {
+		return s
+	}
+	m.lock.Lock()
+	s = m.msgTypeStats[msgType]
+	if s == nil {
+		s = &msgTypeStats{}
+		m.msgTypeStats[msgType] = s
+	}
+	m.lock.Unlock()
+	return s
+}
+
+// TCPMsgRingStats is a snapshot of a TCPMsgRing's counters; see
+// TCPMsgRing.Stats.
+type TCPMsgRingStats struct {
+	// Nodes are the ConnStats by node ID, for the nodes with stats.
+	Nodes map[uint64]ConnStats
+	// MsgTypes are the MsgTypeStats by message type, for the message types
+	// sent or received.
+	MsgTypes           map[uint64]MsgTypeStats
+	ChecksumMismatches uint64
+}
+
+// Stats returns a snapshot of all the TCPMsgRing's counters, such as for
+// exporting to a monitoring system. The node counts are as of the last reset
+// by ResetConnStats or ResetAllStats; the others only ever increase.
+func (m *TCPMsgRing) Stats() *TCPMsgRingStats {
+	m.lock.RLock()
+	nodes := make(map[uint64]*connStats, len(m.connStats))
+	for nodeID, s := range m.connStats {
+		nodes[nodeID] = s
+	}
+	types := make(map[uint64]*msgTypeStats, len(m.msgTypeStats))
+	for msgType, s := range m.msgTypeStats {
+		types[msgType] = s
+	}
+	m.lock.RUnlock()
+	stats := &TCPMsgRingStats{
+		Nodes:              make(map[uint64]ConnStats, len(nodes)),
+		MsgTypes:           make(map[uint64]MsgTypeStats, len(types)),
+		ChecksumMismatches: m.ChecksumMismatches(),
+	}
+	for nodeID, s := range nodes {
+		stats.Nodes[nodeID] = s.snapshot()
+	}
+	for msgType, s := range types {
+		stats.MsgTypes[msgType] = MsgTypeStats{
+			MsgsSent:     atomic.LoadUint64(&s.msgsSent),
+			MsgsReceived: atomic.LoadUint64(&s.msgsReceived),
+		}
+	}
+	return stats
+}
+
+func (m *TCPMsgRing) nodeConnStats(nodeID uint64) *connStats {
+	m.lock.RLock()
+	s := m.connStats[nodeID]
+	m.lock.RUnlock()
+	if s != nil {
+		return s
+	}
+	m.lock.Lock()
+	s = m.connStats[nodeID]
+	if s == nil {
+		s = &connStats{}
+		m.connStats[nodeID] = s
+	}
+	m.lock.Unlock()
+	return s
+}
+
+// ConnStats returns the message counts for the node since the stats were
+// last reset; all zero for a node without stats. Messages received on
+// connections the node dialed are counted under node ID 0, as the remote
+// node's ID is not yet known for those.
+func (m *TCPMsgRing) ConnStats(nodeID uint64) ConnStats {
+	m.lock.RLock()
+	s := m.connStats[nodeID]
+	m.lock.RUnlock()
+	if s == nil {
+		return ConnStats{}
+	}
+	return s.snapshot()
+}
+
+// ResetConnStats zeroes the message counts for the node, returning the counts
+// as of the reset. The counters are read and zeroed together, so every
+// message is counted in exactly one interval between resets; rates should be
+// computed from the returned counts over the time since the previous reset,
+// rather than by reading ConnStats and resetting separately.
+func (m *TCPMsgRing) ResetConnStats(nodeID uint64) ConnStats {
+	m.lock.RLock()
+	s := m.connStats[nodeID]
+	m.lock.RUnlock()
+	if s == nil {
+		return ConnStats{}
+	}
+	return s.reset()
+}
+
+// ResetAllStats is the same as ResetConnStats for every node with stats,
+// returning the counts as of the reset by node ID.
+func (m *TCPMsgRing) ResetAllStats() map[uint64]ConnStats {
+	m.lock.RLock()
+	all := make(map[uint64]*connStats, len(m.connStats))
+	for nodeID, s := range m.connStats {
+		all[nodeID] = s
+	}
+	m.lock.RUnlock()
+	rv := make(map[uint64]ConnStats, len(all))
+	for nodeID, s := range all {
+		rv[nodeID] = s.reset()
+	}
+	return rv
+}
+
+// SendErrorHandler is called with the error from each failed send to a node,
+// returning false to stop sends to the node until TCPMsgRing.ResetNode is
+// called, or true to carry on sending as usual.
+type SendErrorHandler func(nodeID uint64, err error) (retry bool)
+
+// SetSendErrorHandler sets the function called on each failed send, such as
+// to implement a circuit breaker for flaky nodes. While sends to a node are
+// stopped they fail immediately with ErrNodeCircuitOpen, without the handler
+// being called. A nil handler, the default, never stops sends.
+func (m *TCPMsgRing) SetSendErrorHandler(handler SendErrorHandler) {
+	m.lock.Lock()
+	m.sendErrorHandler = handler
+	m.lock.Unlock()
+}
+
+// ResetNode resumes sends to a node stopped by the send error handler.
+func (m *TCPMsgRing) ResetNode(nodeID uint64) {
+	m.lock.Lock()
+	delete(m.openCircuits, nodeID)
+	m.lock.Unlock()
+}
+
+// PauseNode stops sends to the node, such as while it is restarted for
+// maintenance, until ResumeNode is called; sends to it fail immediately with
+// ErrNodePaused and no connections to it are dialed. An existing connection
+// is left open, so messages from the node are still received.
+func (m *TCPMsgRing) PauseNode(nodeID uint64) {
+	m.lock.Lock()
+	m.pausedNodes[nodeID] = true
+	m.lock.Unlock()
+}
+
+// ResumeNode resumes sends to a node paused by PauseNode.
+func (m *TCPMsgRing) ResumeNode(nodeID uint64) {
+	m.lock.Lock()
+	delete(m.pausedNodes, nodeID)
+	m.lock.Unlock()
+}
+
+// SetNodeRateLimit caps the outbound throughput to the node at bytesPerSec;
+// zero or less removes the limit. Time spent waiting on the limit is not
+// counted against the write timeouts.
+func (m *TCPMsgRing) SetNodeRateLimit(nodeID uint64, bytesPerSec int) {
+	m.lock.Lock()
+	if bytesPerSec <= 0 {
+		delete(m.rateLimits, nodeID)
+	} else {
+		m.rateLimits[nodeID] = newTokenBucket(bytesPerSec)
+	}
+	m.lock.Unlock()
+}
+
+// SetReconnectJitter sets the fraction, from 0 to 1, of each retry backoff
+// delay that is randomized; 0 gives the fixed exponential delays and 1, the
+// default, gives "full jitter" where each delay is anywhere from zero up to
+// the full backoff. Jitter keeps many nodes from retrying against a recovering
+// node in lockstep.
+func (m *TCPMsgRing) SetReconnectJitter(fraction float64) {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	m.lock.Lock()
+	m.reconnectJitter = fraction
+	m.lock.Unlock()
+}
+
+// SetSendRetry sets how many times MsgToNode attempts to send a message that
+// implements RetryableMsg, and whose Retryable method returns true, before
+// giving up, and the delay before the first retry, doubling for each retry
+// after; the delays are jittered as per SetReconnectJitter. A connection
+// dropped by a failed send is redialed for the next attempt. Messages that
+// are not retryable are attempted just once, as their WriteContent may not be
+// replayable. The default is 3 attempts with a backoff of a second; a
+// maxAttempts below 1 is treated as 1.
+func (m *TCPMsgRing) SetSendRetry(maxAttempts int, backoff time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	m.lock.Lock()
+	m.sendAttempts = maxAttempts
+	m.sendBackoff = backoff
+	m.lock.Unlock()
+}
+
+// sendAttemptsFor returns the number of attempts MsgToNode should make to
+// send the message and the backoff before the first retry.
+func (m *TCPMsgRing) sendAttemptsFor(msg Msg) (int, time.Duration) {
+	if rm, ok := msg.(RetryableMsg); !ok || !rm.Retryable() {
+		return 1, 0
+	}
+	m.lock.RLock()
+	attempts := m.sendAttempts
+	backoff := m.sendBackoff
+	m.lock.RUnlock()
+	return attempts, backoff
+}
+
+// SetFlushInterval sets how often the connections are flushed when batching
+// flushes; zero or less, the default, flushes each message as it is written.
+// Batching trades latency for throughput: at high message rates many messages
+// go out in each network write rather than one write each, but a message may
+// wait up to the interval before being sent, unless it implements UrgentMsg
+// and is urgent, in which case it and anything buffered before it are flushed
+// at once. A few milliseconds or less is usual. Buffered messages are also
+// flushed when a connection's buffer fills and before a connection is closed
+// by Shutdown or a drain.
+func (m *TCPMsgRing) SetFlushInterval(d time.Duration) {
+	m.lock.Lock()
+	m.flushInterval = d
+	start := d > 0 && !m.flushing
+	if start {
+		m.flushing = true
+	}
+	m.lock.Unlock()
+	if start {
+		go m.flushForever()
+	}
+}
+
+// flushForever flushes the connections every flush interval until flushes
+// are no longer batched or the TCPMsgRing shuts down.
+func (m *TCPMsgRing) flushForever() {
+	for {
+		m.lock.Lock()
+		interval := m.flushInterval
+		if interval <= 0 || m.isShuttingDown() {
+			m.flushing = false
+			m.lock.Unlock()
+			return
+		}
+		m.lock.Unlock()
+		time.Sleep(interval)
+		m.lock.RLock()
+		conns := make([]*ringConn, 0, len(m.conns))
+		for _, conn := range m.conns {
+			conns = append(conns, conn)
+		}
+		m.lock.RUnlock()
+		for _, conn := range conns {
+			m.flushConn(conn)
+		}
+	}
+}
+
+// flushConn flushes anything buffered for the connection, removing the
+// connection should that fail.
+func (m *TCPMsgRing) flushConn(conn *ringConn) {
+	m.lock.RLock()
+	writer := conn.writer
+	m.lock.RUnlock()
+	if writer == nil {
+		// Still dialing.
+		return
+	}
+	conn.writerLock.Lock()
+	defer conn.writerLock.Unlock()
+	if writer.Buffered() == 0 {
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		log.Println("flush error:", err)
+		if conn.nodeID != 0 {
+			m.nodeConnStats(conn.nodeID).add(ConnStats{SendErrors: 1})
+		}
+		m.removeConn(conn.addr, conn)
+		writer.release()
+	}
+}
+
+// reconnectDelay returns the jittered delay to use for the given backoff.
+func (m *TCPMsgRing) reconnectDelay(backoff time.Duration) time.Duration {
+	m.lock.RLock()
+	jitter := m.reconnectJitter
+	m.lock.RUnlock()
+	return backoff - time.Duration(rand.Float64()*jitter*float64(backoff))
+}
+
+// MsgToNode sends the message to the node, retrying with backoff if the send
+// fails and the message is retryable; see SetSendRetry. If there is no
+// connection to the node, one is dialed first, waiting up to the connection
+// timeout; should that fail, the error matching ErrNodeUnreachable is
+// returned straight away rather than retrying, and a later send will dial
+// again. A message to the local node is given straight to the local handler
+// for its type, without touching the network; see loopback.
+func (m *TCPMsgRing) MsgToNode(nodeID uint64, msg Msg) error {
+	_, err := m.sendToNode(nodeID, msg, false)
+	return err
+}
+
+// MsgToNodeTimed is the same as MsgToNode but also returns the bytes written
+// to the connection, including the frame header and any checksum, and the
+// time taken from getting the connection, dialing it if need be, through
+// flushing the message, which is always flushed straight away regardless of
+// SetFlushInterval. Should the send be retried, the time includes the earlier
+// attempts and their backoff, and the bytes are those of the final attempt.
+// The bytes are 0 for a message to the local node, which doesn't touch the
+// network, or one skipped as a duplicate. Unlike the stats from Stats, this
+// suits measuring and logging individual slow sends to specific nodes.
+func (m *TCPMsgRing) MsgToNodeTimed(nodeID uint64, msg Msg) (uint64, time.Duration, error) {
+	start := time.Now()
+	written, err := m.sendToNode(nodeID, msg, true)
+	return written, time.Since(start), err
+}
+
+// sendToNode does the work of MsgToNode, returning the bytes written; if flush
+// is set the message is flushed even if sends are being batched.
+func (m *TCPMsgRing) sendToNode(nodeID uint64, msg Msg, flush bool) (uint64, error) {
+	defer msg.Done()
+	return m.deliverToNode(nodeID, msg, flush)
+}
+
+// deliverToNode is sendToNode without calling msg.Done, for sending the same
+// message to several nodes: the connection is dialed, and waited on, if
+// needed, and failed sends are retried as the message allows.
+func (m *TCPMsgRing) deliverToNode(nodeID uint64, msg Msg, flush bool) (uint64, error) {
+	if local := m.Ring().LocalNode(); local != nil && local.ID() == nodeID {
+		return 0, m.loopback(msg)
+	}
+	attempts, backoff := m.sendAttemptsFor(msg)
+	var written uint64
+	var err error
+	for attempt := 1; ; attempt++ {
+		node := m.Ring().Node(nodeID)
+		if node == nil {
+			err = &transportError{kind: ErrNodeNotFound, err: fmt.Errorf("node %016x not in ring", nodeID)}
+		} else {
+			if err = m.ensureConnection(node); err != nil {
+				return 0, err
+			}
+			if written, err = m.flushMsgToNode(msg, node, flush); err == nil || err == ErrNodePaused {
+				return written, err
+			}
+		}
+		if attempt >= attempts {
+			return 0, err
+		}
+		if m.isShuttingDown() {
+			return 0, ErrShuttingDown
+		}
+		time.Sleep(m.reconnectDelay(backoff))
+		backoff *= 2
+	}
+}
+
+// loopback delivers the message to the local handler for its type, as if it
+// had been received from another node, returning the handler's error; this
+// suits single node deployments and tests. The content is buffered and given
+// to the handler as is, without any MsgEncoder, MsgDecoder, compression,
+// sequencing, or checksums, as those only apply on the wire.
+func (m *TCPMsgRing) loopback(msg Msg) error {
+	if m.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	msgType := msg.MsgType()
+	m.lock.RLock()
+	handler := m.msgHandlers[msgType]
+	m.lock.RUnlock()
+	if handler == nil {
+		return fmt.Errorf("no handler for MsgType %x", msgType)
+	}
+	var buf bytes.Buffer
+	fw := &frameWriter{w: &buf, limit: msg.MsgLength()}
+	if _, err := msg.WriteContent(fw); err != nil {
+		return fmt.Errorf("message type %x: %s", msgType, err)
+	}
+	if fw.written != fw.limit {
+		return fmt.Errorf("message type %x wrote %d content bytes instead of its declared %d", msgType, fw.written, fw.limit)
+	}
+	atomic.AddUint64(&m.typeStats(msgType).msgsSent, 1)
+	atomic.AddUint64(&m.typeStats(msgType).msgsReceived, 1)
+	_, err := handler(&buf, fw.written)
+	return err
+}
+
+// ensureConnection dials the node and waits for the result if there is no
+// connection to it; if a dial is already under way elsewhere, its result is
+// waited on instead, for up to the connection timeout. The dial is skipped
+// when shutting down or sends to the node have been stopped or paused,
+// leaving msgToNode to report that.
+func (m *TCPMsgRing) ensureConnection(node Node) error {
+	m.lock.RLock()
+	open := m.openCircuits[node.ID()]
+	paused := m.pausedNodes[node.ID()]
+	m.lock.RUnlock()
+	if open || paused {
+		return nil
+	}
+	addr := node.Address(m.addressIndex)
+	conn, dial := m.connecting(addr, node.ID())
+	if conn == nil {
+		return nil
+	}
+	var err error
+	if dial {
+		err = m.dial(addr, conn)
+	} else if conn.dialDone != nil && atomic.LoadInt32(&conn.state) == _STATE_CONNECTING {
+		m.lock.RLock()
+		timeout := m.connectionTimeout
+		m.lock.RUnlock()
+		timer := time.NewTimer(timeout)
+		select {
+		case <-conn.dialDone:
+			err = conn.dialErr
+		case <-timer.C:
+			err = &transportError{kind: ErrDialFailed, err: fmt.Errorf("timed out waiting on the dial of %s", addr)}
+		}
+		timer.Stop()
+	}
+	if err != nil {
+		return &nodeUnreachableError{nodeID: node.ID(), err: err}
+	}
+	return nil
+}
+
+func (m *TCPMsgRing) connection(addr string, nodeID uint64) *ringConn {
+	conn, dial := m.connecting(addr, nodeID)
+	if conn == nil {
+		return nil
+	}
+	if dial {
+		go m.dial(addr, conn)
+	}
+	if atomic.LoadInt32(&conn.state) != _STATE_CONNECTED {
+		return nil
+	}
+	return conn
+}
+
+// connecting returns the connection for the address, creating one in the
+// connecting state if there wasn't one already; in that case true is also
+// returned and the caller is responsible for calling dial. Once shutting down,
+// no new connections are created and nil is returned instead.
+func (m *TCPMsgRing) connecting(addr string, nodeID uint64) (*ringConn, bool) {
+	m.lock.RLock()
+	conn := m.conns[addr]
+	m.lock.RUnlock()
+	if conn != nil {
+		return conn, false
+	}
+	m.lock.Lock()
+	conn = m.conns[addr]
+	if conn != nil || m.isShuttingDown() {
+		m.lock.Unlock()
+		return conn, false
+	}
+	conn = &ringConn{
+		state:    _STATE_CONNECTING,
+		addr:     addr,
+		nodeID:   nodeID,
+		dialed:   true,
+		dialDone: make(chan struct{}),
+	}
+	m.conns[addr] = conn
+	m.lock.Unlock()
+	return conn, true
+}
+
+// dial establishes a connection returned by connecting. On failure the
+// connection is removed so that a later message will try again.
+func (m *TCPMsgRing) dial(addr string, conn *ringConn) error {
+	err := m.dialConn(addr, conn)
+	conn.dialErr = err
+	close(conn.dialDone)
+	return err
+}
+
+func (m *TCPMsgRing) dialConn(addr string, conn *ringConn) error {
+	tcpconn, err := net.DialTimeout("tcp", addr, m.connectionTimeout)
+	if err != nil {
+		m.removeConn(addr, conn)
+		return &transportError{kind: ErrDialFailed, err: err}
+	}
+	m.lock.RLock()
+	options := m.tcpOptions
+	m.lock.RUnlock()
+	applyTCPOptions(tcpconn, options)
+	m.lock.Lock()
+	if m.conns[addr] != conn {
+		// The connection was replaced or removed while dialing.
+		m.lock.Unlock()
+		tcpconn.Close()
+		return &transportError{kind: ErrDialFailed, err: fmt.Errorf("connection to %s replaced while dialing", addr)}
+	}
+	conn.conn = tcpconn
+	conn.reader = newTimeoutReader(tcpconn, m.chunkSize, m.intraMessageTimeout)
+	conn.writer = newTimeoutWriter(tcpconn, m.chunkSize, m.intraMessageTimeout)
+	m.lock.Unlock()
+	err = m.authenticate(tcpconn, m.Ring().Node(conn.nodeID))
+	if err != nil {
+		m.removeConn(addr, conn)
+		return &transportError{kind: ErrDialFailed, err: fmt.Errorf("authentication with %s failed: %s", addr, err)}
+	}
+	err = m.negotiateStreamCompression(conn)
+	if err != nil {
+		m.removeConn(addr, conn)
+		return &transportError{kind: ErrDialFailed, err: err}
+	}
+	err = m.handshake(conn)
+	if err != nil {
+		m.removeConn(addr, conn)
+		return &transportError{kind: ErrDialFailed, err: err}
+	}
+	m.nodeConnStats(conn.nodeID).add(ConnStats{Connects: 1})
+	go m.handleForever(conn)
+	return nil
+}
+
+// WarmConnections dials all the other active, unpaused nodes in the ring that
+// aren't already connected, waiting for the dials to complete; this can be
+// called during startup so the first messages sent don't have to wait on
+// connection setup. All dials are attempted even if some fail, and an error
+// describing all the failures is returned. Failed connections will be tried
+// again as usual once messages are sent to those nodes.
+func (m *TCPMsgRing) WarmConnections() error {
+	if m.isShuttingDown() {
+		return ErrShuttingDown
+	}
+	r := m.Ring()
+	var localID uint64
+	if n := r.LocalNode(); n != nil {
+		localID = n.ID()
+	}
+	wg := &sync.WaitGroup{}
+	failuresLock := sync.Mutex{}
+	var failures []string
+	attempts := 0
+	for _, n := range r.Nodes() {
+		if n.ID() == localID || !n.Active() {
+			continue
+		}
+		addr := n.Address(m.addressIndex)
+		if addr == "" {
+			continue
+		}
+		m.lock.RLock()
+		paused := m.pausedNodes[n.ID()]
+		m.lock.RUnlock()
+		if paused {
+			continue
+		}
+		conn, dial := m.connecting(addr, n.ID())
+		if !dial {
+			continue
+		}
+		attempts++
+		wg.Add(1)
+		go func(addr string, conn *ringConn) {
+			if err := m.dial(addr, conn); err != nil {
+				failuresLock.Lock()
+				failures = append(failures, fmt.Sprintf("%s: %s", addr, err))
+				failuresLock.Unlock()
+			}
+			wg.Done()
+		}(addr, conn)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d connections failed: %s", len(failures), attempts, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// setConn stores the connection for the address, draining any other
+// connection it replaces.
+func (m *TCPMsgRing) setConn(addr string, conn *ringConn) {
+	m.lock.Lock()
+	c := m.conns[addr]
+	m.conns[addr] = conn
+	m.lock.Unlock()
+	if c != nil && c != conn {
+		m.drainConn(c)
+	}
+}
+
+// drainConn closes the connection, which should no longer be in the conns
+// map, once the sends in progress on it have finished or the drain timeout
+// has passed, whichever is first. Sends still in progress then fail, so their
+// messages are retried or given up on as usual rather than silently lost.
+func (m *TCPMsgRing) drainConn(conn *ringConn) {
+	atomic.StoreInt32(&conn.state, _STATE_DISCONNECTING)
+	m.lock.RLock()
+	deadline := time.Now().Add(m.drainTimeout)
+	m.lock.RUnlock()
+	go func() {
+		// A send still holding the writer after the drain timeout may never
+		// release it, so the flush is skipped then.
+		if conn.waitIdle(deadline, nil) {
+			m.flushConn(conn)
+		}
+		m.lock.Lock()
+		conn.close()
+		m.lock.Unlock()
+	}()
+}
+
+// Shutdown stops the TCPMsgRing: from then on sends return ErrShuttingDown,
+// or are discarded for the methods without a return value, rather than
+// dialing or queuing, and Listen stops accepting connections. The sends
+// already in progress are given until the drain timeout, see
+// SetDrainTimeout, to complete before all the connections are closed; an
+// error is returned if the context is done first, though the connections are
+// still closed. A TCPMsgRing cannot be restarted once shut down.
+func (m *TCPMsgRing) Shutdown(ctx context.Context) error {
+	m.lock.Lock()
+	atomic.StoreInt32(&m.shuttingDown, 1)
+	if m.listener != nil {
+		m.listener.Close()
+		m.listener = nil
+	}
+	conns := make([]*ringConn, 0, len(m.conns))
+	for addr, conn := range m.conns {
+		atomic.StoreInt32(&conn.state, _STATE_DISCONNECTING)
+		conns = append(conns, conn)
+		delete(m.conns, addr)
+	}
+	deadline := time.Now().Add(m.drainTimeout)
+	m.lock.Unlock()
+	var err error
+	for _, conn := range conns {
+		if !conn.waitIdle(deadline, ctx.Done()) {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+		}
+	}
+	for _, conn := range conns {
+		if atomic.LoadInt32(&conn.pending) == 0 {
+			m.flushConn(conn)
+		}
+	}
+	m.lock.Lock()
+	for _, conn := range conns {
+		conn.close()
+	}
+	m.lock.Unlock()
+	return err
+}
+
+func (m *TCPMsgRing) isShuttingDown() bool {
+	return atomic.LoadInt32(&m.shuttingDown) == 1
+}
+
+// removeConn removes and closes the connection for the address, but only if
+// it is still the connection given; this keeps a failing old connection from
+// removing a newer replacement.
+func (m *TCPMsgRing) removeConn(addr string, conn *ringConn) {
+	m.lock.Lock()
+	if m.conns[addr] == conn {
+		delete(m.conns, addr)
+	}
+	conn.close()
+	m.lock.Unlock()
+}
+
+// close must be called with the TCPMsgRing's lock held, as the connection
+// fields are set under that lock once dialing completes.
+func (c *ringConn) close() {
+	atomic.StoreInt32(&c.state, _STATE_DISCONNECTING)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Authenticator is called with each new connection before any messages are
+// exchanged on it, such as to run an application level challenge-response
+// over it; returning an error closes the connection. Remote is the node
+// dialed or, for connections accepted, the node with the connection's remote
+// address or host if exactly one does, otherwise nil.
+type Authenticator func(conn net.Conn, remote Node) error
+
+// SetAuthenticator sets the function called with each connection dialed or
+// accepted by Listen; nil, the default, accepts all connections. It is called
+// as soon as the connection is established, before the stream compression
+// negotiation and protocol handshake and before the connection is used for
+// any messages, so it has the connection to itself; it runs with a deadline
+// of the connection timeout. As it runs on both ends at once, the
+// authenticators of dialing and accepting nodes must agree on who speaks
+// first. Connections accepted by a SharedListener are authenticated by its
+// own Authenticator instead; see SharedListener.SetAuthenticator.
+func (m *TCPMsgRing) SetAuthenticator(authenticator Authenticator) {
+	m.lock.Lock()
+	m.authenticator = authenticator
+	m.lock.Unlock()
+}
+
+// authenticate runs the Authenticator, if set, on the connection.
+func (m *TCPMsgRing) authenticate(netconn net.Conn, remote Node) error {
+	m.lock.RLock()
+	authenticator := m.authenticator
+	timeout := m.connectionTimeout
+	m.lock.RUnlock()
+	return authenticate(authenticator, timeout, netconn, remote)
+}
+
+// authenticate runs the authenticator, if not nil, on the connection with a
+// deadline of the timeout given.
+func authenticate(authenticator Authenticator, timeout time.Duration, netconn net.Conn, remote Node) error {
+	if authenticator == nil {
+		return nil
+	}
+	netconn.SetDeadline(time.Now().Add(timeout))
+	err := authenticator(netconn, remote)
+	netconn.SetDeadline(time.Time{})
+	return err
+}
+
+// TCPOptions are the socket options set on each TCP connection dialed or
+// accepted; see TCPMsgRing.SetTCPOptions.
+type TCPOptions struct {
+	// NoDelay disables Nagle's algorithm so small writes, such as control
+	// messages, are sent straight away rather than held back to be coalesced
+	// with later writes; as messages are already buffered and flushed whole,
+	// this is rarely worth disabling.
+	NoDelay bool
+	// KeepAlive enables TCP keep-alive probes, so a connection to a node that
+	// has vanished without closing it is eventually noticed.
+	KeepAlive bool
+	// KeepAlivePeriod is the time between keep-alive probes; 0 leaves the
+	// default of the Go runtime.
+	KeepAlivePeriod time.Duration
+	// LingerSeconds is how long closing a connection waits for unsent data
+	// to be delivered: less than 0 leaves the operating system's default of
+	// delivering it in the background, 0 discards it and resets the
+	// connection, and more than 0 waits up to that many seconds.
+	LingerSeconds int
+}
+
+// DefaultTCPOptions returns the TCPOptions a new TCPMsgRing or SharedListener
+// uses: NoDelay and KeepAlive enabled, with the default keep-alive period and
+// linger behavior.
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{NoDelay: true, KeepAlive: true, LingerSeconds: -1}
+}
+
+// SetTCPOptions sets the socket options for the connections dialed or
+// accepted by Listen from then on; the default is DefaultTCPOptions.
+// Connections accepted by a SharedListener get its own options instead; see
+// SharedListener.SetTCPOptions. The options only apply to *net.TCPConn
+// connections, so other net.Conn implementations, such as in-memory test
+// connections, are left as they are.
+func (m *TCPMsgRing) SetTCPOptions(options TCPOptions) {
+	m.lock.Lock()
+	m.tcpOptions = options
+	m.lock.Unlock()
+}
+
+// applyTCPOptions sets the options on the connection if it is a
+// *net.TCPConn; failures are logged, leaving the connection usable with the
+// options it had.
+func applyTCPOptions(netconn net.Conn, options TCPOptions) {
+	tcpconn, ok := netconn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	var errs []string
+	if err := tcpconn.SetNoDelay(options.NoDelay); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := tcpconn.SetKeepAlive(options.KeepAlive); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if options.KeepAlive && options.KeepAlivePeriod > 0 {
+		if err := tcpconn.SetKeepAlivePeriod(options.KeepAlivePeriod); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if options.LingerSeconds >= 0 {
+		if err := tcpconn.SetLinger(options.LingerSeconds); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("setting TCP options on the connection with %s failed: %s", tcpconn.RemoteAddr(), strings.Join(errs, "; "))
+	}
+}
+
+func (m *TCPMsgRing) handshake(conn *ringConn) error {
+	// TODO: trade version numbers and local ids
+	atomic.StoreInt32(&conn.state, _STATE_CONNECTED)
+	return nil
+}
+
+// negotiateStreamCompression requests stream compression of a dialed
+// connection, if set, and waits for the remote node's reply; the connection's
+// writer is set to compress if the remote node agreed.
+func (m *TCPMsgRing) negotiateStreamCompression(conn *ringConn) error {
+	m.lock.RLock()
+	compressing := m.streamCompressing
+	c := m.streamCompression
+	shared := m.sharedListener != nil
+	ringID := m.ringID
+	m.lock.RUnlock()
+	if !compressing {
+		return nil
+	}
+	h := &MsgHeader{MsgType: _MSG_TYPE_STREAM_COMPRESSION, Length: 1}
+	if shared {
+		h.Flags = MsgFlagRingID
+		h.RingID = ringID
+	}
+	WriteMsgHeader(conn.writer, h)
+	conn.writer.Write([]byte{byte(c)})
+	if err := conn.writer.Flush(); err != nil {
+		return err
+	}
+	h2, err := readMsgHeader(conn, m.connectionTimeout, m.intraMessageTimeout)
+	if err != nil {
+		return err
+	}
+	if h2.MsgType != _MSG_TYPE_STREAM_COMPRESSION || h2.Length != 1 {
+		return fmt.Errorf("expected stream compression reply; got message type %x of length %d", h2.MsgType, h2.Length)
+	}
+	reply, err := conn.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch reply {
+	case byte(c):
+		return conn.writer.compress(c)
+	case _STREAM_COMPRESSION_DECLINED:
+		return nil
+	}
+	return fmt.Errorf("unexpected stream compression reply %d", reply)
+}
+
+// handleStreamCompression replies to a stream compression request from the
+// remote node, agreeing if this node has set the same stream compression, in
+// which case further reads from the connection are decompressed.
+func (m *TCPMsgRing) handleStreamCompression(conn *ringConn, length uint64) error {
+	if length != 1 {
+		return fmt.Errorf("stream compression request of length %d", length)
+	}
+	requested, err := conn.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	m.lock.RLock()
+	agree := m.streamCompressing && byte(m.streamCompression) == requested
+	m.lock.RUnlock()
+	reply := byte(_STREAM_COMPRESSION_DECLINED)
+	if agree {
+		reply = requested
+	}
+	conn.writerLock.Lock()
+	WriteMsgHeader(conn.writer, &MsgHeader{MsgType: _MSG_TYPE_STREAM_COMPRESSION, Length: 1})
+	conn.writer.Write([]byte{reply})
+	err = conn.writer.Flush()
+	conn.writerLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if agree {
+		conn.reader.decompress(Compression(requested))
+	}
+	return nil
 }
 
-func (m *TCPMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) {
-	m.lock.Lock()
-	m.msgHandlers[uint64(msgType)] = handler
-	m.lock.Unlock()
+// encodedMsg is the content of a message after it has been transformed by a
+// MsgEncoder and/or compressed.
+type encodedMsg struct {
+	io.Reader
+	compressed bool
 }
 
-func (m *TCPMsgRing) MsgToNode(nodeID uint64, msg Msg) {
-	for i := time.Second; i <= 4*time.Second; i *= 2 {
-		node := m.Ring().Node(nodeID)
-		if node != nil && m.msgToNode(msg, node) == nil {
-			break
+// encodeMsg applies any MsgEncoder and compression to the message's content,
+// returning the transformed content and its length; if no transformation is
+// needed the content returned will be nil and the message should write its
+// content directly.
+func (m *TCPMsgRing) encodeMsg(msg Msg) (*encodedMsg, uint64, error) {
+	msgLength := msg.MsgLength()
+	m.lock.RLock()
+	encoder := m.msgEncoder
+	threshold := m.compressionThreshold
+	m.lock.RUnlock()
+	compress := threshold > 0 && msgLength > uint64(threshold)
+	if encoder == nil && !compress {
+		return nil, msgLength, nil
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, msgLength))
+	length, err := msg.WriteContent(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if length != msgLength {
+		return nil, 0, fmt.Errorf("incorrect message length given to encoder: %d != %d", length, msgLength)
+	}
+	content := &encodedMsg{Reader: buf}
+	if encoder != nil {
+		content.Reader, msgLength, err = encoder(msg.MsgType(), content.Reader)
+		if err != nil {
+			return nil, 0, err
 		}
-		time.Sleep(i)
 	}
-	msg.Done()
+	if compress {
+		cbuf := bytes.NewBuffer(make([]byte, 0, msgLength/2+8))
+		binary.Write(cbuf, binary.BigEndian, msgLength)
+		gw := gzip.NewWriter(cbuf)
+		if _, err = io.Copy(gw, content.Reader); err != nil {
+			return nil, 0, err
+		}
+		if err = gw.Close(); err != nil {
+			return nil, 0, err
+		}
+		content.Reader = cbuf
+		content.compressed = true
+		msgLength = uint64(cbuf.Len())
+	}
+	return content, msgLength, nil
+}
+
+// msgToNode sends the message to the node unless the TCPMsgRing is shutting
+// down, sends to the node have been stopped or paused, or the message is a
+// duplicate, calling the send error handler if the send fails.
+func (m *TCPMsgRing) msgToNode(msg Msg, node Node) error {
+	_, err := m.flushMsgToNode(msg, node, false)
+	return err
 }
 
-func (m *TCPMsgRing) connection(addr string) *ringConn {
+// flushMsgToNode is the same as msgToNode but returns the bytes written; if
+// flush is set the message is flushed even if sends are being batched.
+func (m *TCPMsgRing) flushMsgToNode(msg Msg, node Node, flush bool) (uint64, error) {
+	if m.isShuttingDown() {
+		return 0, ErrShuttingDown
+	}
 	m.lock.RLock()
-	conn := m.conns[addr]
+	open := m.openCircuits[node.ID()]
+	paused := m.pausedNodes[node.ID()]
+	handler := m.sendErrorHandler
 	m.lock.RUnlock()
-	if conn == nil {
-		m.lock.Lock()
-		conn = m.conns[addr]
-		if conn == nil {
-			conn = &ringConn{
-				state: _STATE_CONNECTING,
-				addr:  addr,
-			}
-			m.conns[addr] = conn
-			m.lock.Unlock()
-			go func() {
-				tcpconn, err := net.DialTimeout("tcp", addr, m.connectionTimeout)
-				if err != nil {
-					m.lock.Lock()
-					delete(m.conns, addr)
-					m.lock.Unlock()
-					// TODO: log error
-					return
-				}
-				conn.conn = tcpconn
-				conn.reader = newTimeoutReader(tcpconn, m.chunkSize, m.intraMessageTimeout)
-				conn.writer = newTimeoutWriter(tcpconn, m.chunkSize, m.intraMessageTimeout)
-				err = m.handshake(conn)
-				if err != nil {
-					m.lock.Lock()
-					delete(m.conns, addr)
-					m.lock.Unlock()
-					// TODO: log error
-					return
-				}
-				go m.handleForever(conn)
-			}()
-		} else {
-			m.lock.Unlock()
-		}
+	if paused {
+		return 0, ErrNodePaused
 	}
-	if atomic.LoadInt32(&conn.state) != _STATE_CONNECTED {
-		return nil
+	if open {
+		return 0, ErrNodeCircuitOpen
 	}
-	return conn
-}
-
-func (m *TCPMsgRing) disconnection(addr string) {
-	m.lock.Lock()
-	conn := m.conns[addr]
-	delete(m.conns, addr)
-	m.lock.Unlock()
-	if conn != nil {
-		conn.conn.Close()
+	skip, key, recorded := m.dedup(msg, node.ID())
+	if skip {
+		return 0, nil
+	}
+	written, err := m.writeMsg(msg, node, flush)
+	if err != nil && recorded {
+		m.undedup(key, node.ID())
+	}
+	if err != nil && handler != nil && !handler(node.ID(), err) {
+		m.lock.Lock()
+		m.openCircuits[node.ID()] = true
+		m.lock.Unlock()
 	}
+	return written, err
 }
 
-func (m *TCPMsgRing) handshake(conn *ringConn) error {
-	// TODO: trade version numbers and local ids
-	atomic.StoreInt32(&conn.state, _STATE_CONNECTED)
-	return nil
+// writeMsg sends the message to the node over its connection, returning the
+// bytes written.
+func (m *TCPMsgRing) writeMsg(msg Msg, node Node, flush bool) (uint64, error) {
+	conn := m.connection(node.Address(m.addressIndex), node.ID())
+	if conn == nil {
+		return 0, &transportError{kind: ErrConnClosed, err: fmt.Errorf("no connection to %s", node.Address(m.addressIndex))}
+	}
+	return m.writeConnMsg(msg, conn, node.Address(m.addressIndex), node.ID(), flush)
 }
 
-func (m *TCPMsgRing) msgToNode(msg Msg, node Node) error {
-	conn := m.connection(node.Address(m.addressIndex))
-	if conn == nil {
-		return fmt.Errorf("no connection")
+// writeConnMsg sends the message over the connection given, kept under the
+// address given, to the node identified, which is 0 if unknown, returning the
+// bytes written; the connection is closed if the send fails. If flush is set
+// the message is flushed even if sends are being batched.
+func (m *TCPMsgRing) writeConnMsg(msg Msg, conn *ringConn, addr string, nodeID uint64, flush bool) (uint64, error) {
+	content, msgLength, err := m.encodeMsg(msg)
+	if err != nil {
+		return 0, err
+	}
+	if msgLength > _MSG_MAX_LENGTH {
+		return 0, fmt.Errorf("message type %x of %d bytes is too long; max is %d", msg.MsgType(), msgLength, _MSG_MAX_LENGTH)
 	}
+	atomic.AddInt32(&conn.pending, 1)
+	defer conn.sendDone()
 	conn.writerLock.Lock()
+	defaultTimeout := conn.writer.Timeout
+	if tm, ok := msg.(TimeoutMsg); ok && tm.Timeout() > 0 {
+		conn.writer.Timeout = tm.Timeout()
+	}
+	// The sequence number is assigned while holding the writer lock so
+	// sequence order matches the order written. Responses to requests may go
+	// over a connection the remote node dialed, apart from the node's other
+	// messages, and so are not sequenced.
+	rm, streamed := msg.(*requestMsg)
+	var sequence uint64
+	m.lock.Lock()
+	conn.writer.limiter = m.rateLimits[nodeID]
+	if m.sequencing && (!streamed || !rm.response) {
+		sequence = conn.sendSequence + 1
+	}
+	shared := m.sharedListener != nil
+	ringID := m.ringID
+	checksummed := m.frameChecksums
+	batched := m.flushInterval > 0
+	m.lock.Unlock()
 	disconnect := func(err error) error {
 		log.Println("msgToNode error:", err)
-		m.disconnection(node.Address(m.addressIndex))
+		counts := ConnStats{SendErrors: 1}
+		if errors.Is(err, ErrWriteTimeout) {
+			counts.SendTimeouts = 1
+		}
+		m.nodeConnStats(nodeID).add(counts)
+		m.removeConn(addr, conn)
+		conn.writer.Timeout = defaultTimeout
+		conn.writer.release()
 		conn.writerLock.Unlock()
 		return err
 	}
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, msg.MsgType())
-	_, err := conn.writer.Write(b)
-	if err != nil {
-		return disconnect(err)
+	h := &MsgHeader{MsgType: msg.MsgType(), Length: msgLength, RingID: ringID, Sequence: sequence}
+	if content != nil && content.compressed {
+		h.Flags |= MsgFlagCompressed
 	}
-	binary.BigEndian.PutUint64(b, msg.MsgLength())
-	_, err = conn.writer.Write(b)
-	if err != nil {
-		return disconnect(err)
+	if sequence != 0 {
+		h.Flags |= MsgFlagSequenced
+	}
+	if shared {
+		h.Flags |= MsgFlagRingID
+	}
+	if checksummed {
+		h.Flags |= MsgFlagChecksummed
+	}
+	if streamed {
+		h.Flags |= MsgFlagStreamID
+		h.StreamID = rm.streamID
 	}
-	length, err := msg.WriteContent(conn.writer)
+	err = WriteMsgHeader(conn.writer, h)
 	if err != nil {
-		return disconnect(err)
+		return 0, disconnect(connError(err, ErrWriteTimeout))
+	}
+	// The content's length is verified before flushing so that a Msg that
+	// writes more or less than its declared length doesn't send a corrupt
+	// frame; the connection is closed instead, discarding anything buffered.
+	fw := &frameWriter{w: conn.writer, limit: msgLength}
+	crc := crc32.NewIEEE()
+	if checksummed {
+		fw.w = io.MultiWriter(conn.writer, crc)
+	}
+	if content != nil {
+		_, err = io.Copy(fw, content)
+	} else {
+		_, err = msg.WriteContent(fw)
+	}
+	if fw.err != nil {
+		return 0, disconnect(connError(fw.err, ErrWriteTimeout))
 	}
-	err = conn.writer.Flush()
 	if err != nil {
-		return disconnect(err)
+		return 0, disconnect(fmt.Errorf("message type %x: %s", msg.MsgType(), err))
 	}
-	if length != msg.MsgLength() {
-		return disconnect(fmt.Errorf("incorrect message length sent: %d != %d", length, msg.MsgLength()))
+	if fw.written != msgLength {
+		return 0, disconnect(fmt.Errorf("message type %x wrote %d content bytes instead of its declared %d", msg.MsgType(), fw.written, msgLength))
 	}
+	if checksummed {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, crc.Sum32())
+		_, err = conn.writer.Write(b)
+		if err != nil {
+			return 0, disconnect(connError(err, ErrWriteTimeout))
+		}
+	}
+	if um, ok := msg.(UrgentMsg); flush || !batched || ok && um.Urgent() {
+		err = conn.writer.Flush()
+		if err != nil {
+			return 0, disconnect(connError(err, ErrWriteTimeout))
+		}
+	}
+	if sequence != 0 {
+		conn.sendSequence = sequence
+	}
+	conn.writer.Timeout = defaultTimeout
 	conn.writerLock.Unlock()
-	return nil
+	atomic.StoreInt64(&m.lastSend, time.Now().UnixNano())
+	wire := 16 + msgLength
+	if shared {
+		wire += 4
+	}
+	if sequence != 0 {
+		wire += 8
+	}
+	if streamed {
+		wire += 8
+	}
+	if checksummed {
+		wire += 4
+	}
+	m.nodeConnStats(nodeID).add(ConnStats{MsgsSent: 1, BytesSent: wire})
+	atomic.AddUint64(&m.typeStats(msg.MsgType()).msgsSent, 1)
+	return wire, nil
+}
+
+// readContent reads the length bytes of a message's content that must be
+// buffered whole. The buffer grows as the content arrives rather than being
+// allocated upfront from the length the remote node claims, so a bogus length
+// can't exhaust memory without the bytes actually being sent; SetReadBudget
+// bounds how many may be.
+func readContent(r io.Reader, length uint64) ([]byte, error) {
+	if length > _MSG_MAX_LENGTH {
+		return nil, fmt.Errorf("message length %d is too large; max is %d", length, _MSG_MAX_LENGTH)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+// frameWriter passes on at most limit bytes of a message's content, failing
+// any write that would go beyond, so a message cannot write past the end of
+// its frame.
+type frameWriter struct {
+	w       io.Writer
+	limit   uint64
+	written uint64
+	// err is the last error from w, to tell connection failures apart from
+	// the message's own errors.
+	err error
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	if fw.written+uint64(len(p)) > fw.limit {
+		return 0, fmt.Errorf("content exceeds the declared length of %d bytes", fw.limit)
+	}
+	n, err := fw.w.Write(p)
+	fw.written += uint64(n)
+	if err != nil {
+		fw.err = err
+	}
+	return n, err
+}
+
+// msgToNodeChan sends the message to the node, then sends the result to the
+// channel: nil on success or the error from the send, so scatter-gather
+// callers can tell which nodes failed.
+func (m *TCPMsgRing) msgToNodeChan(msg Msg, node Node, retchan chan error) {
+	retchan <- m.msgToNode(msg, node)
 }
 
-func (m *TCPMsgRing) msgToNodeChan(msg Msg, node Node, retchan chan struct{}) {
-	m.msgToNode(msg, node)
-	retchan <- struct{}{}
+// MsgToTier sends the message to every active node, other than the local
+// node, with the value at the tier level given, such as all the nodes in a
+// data center, returning the number of nodes the message was sent to
+// successfully. As with MsgToNode, nodes not yet connected are dialed and
+// waited on, so the count is meaningful even on the first call.
+func (m *TCPMsgRing) MsgToTier(level int, value string, msg Msg) int {
+	if m.isShuttingDown() {
+		msg.Done()
+		return 0
+	}
+	r := m.Ring()
+	nodes := r.NodesInTier(level, value)
+	retchan := make(chan error, len(nodes))
+	var localID uint64
+	if localNode := r.LocalNode(); localNode != nil {
+		localID = localNode.ID()
+	}
+	sent := 0
+	for _, node := range nodes {
+		if node.ID() != localID {
+			go func(nodeID uint64) {
+				_, err := m.deliverToNode(nodeID, msg, false)
+				retchan <- err
+			}(node.ID())
+			sent++
+		}
+	}
+	succeeded := 0
+	for ; sent > 0; sent-- {
+		if err := <-retchan; err == nil {
+			succeeded++
+		}
+	}
+	msg.Done()
+	return succeeded
 }
 
-func (m *TCPMsgRing) MsgToOtherReplicas(ringVersion int64, partition uint32, msg Msg) {
+func (m *TCPMsgRing) MsgToOtherReplicas(ringVersion int64, partition uint32, msg Msg) error {
 	r := m.Ring()
+	if m.isShuttingDown() {
+		msg.Done()
+		return ErrShuttingDown
+	}
 	if ringVersion != r.Version() {
 		msg.Done()
-		return
+		return &transportError{kind: ErrRingVersionMismatch, err: fmt.Errorf("message for ring version %d; ring is version %d", ringVersion, r.Version())}
 	}
 	nodes := r.ResponsibleNodes(partition)
-	retchan := make(chan struct{}, len(nodes))
+	retchan := make(chan error, len(nodes))
 	localNode := r.LocalNode()
 	var localID uint64
 	if localNode != nil {
@@ -207,99 +1970,448 @@ func (m *TCPMsgRing) MsgToOtherReplicas(ringVersion int64, partition uint32, msg
 			sent++
 		}
 	}
+	var err error
 	for ; sent > 0; sent-- {
-		<-retchan
+		if e := <-retchan; e != nil && err == nil {
+			err = e
+		}
 	}
 	msg.Done()
+	return err
 }
 
-func (m *TCPMsgRing) handleOne(conn *ringConn) error {
-	var msgType uint64
-	conn.reader.Timeout = m.interMessageTimeout
+// readMsgHeader reads a message's header from the connection, waiting up to
+// the inter-message timeout for it to begin and then the intra-message timeout
+// for the rest of it.
+func readMsgHeader(conn *ringConn, interMessageTimeout time.Duration, intraMessageTimeout time.Duration) (MsgHeader, error) {
+	conn.reader.Timeout = interMessageTimeout
 	b, err := conn.reader.ReadByte()
-	conn.reader.Timeout = m.intraMessageTimeout
+	conn.reader.Timeout = intraMessageTimeout
+	if err != nil {
+		return MsgHeader{}, connError(err, ErrReadTimeout)
+	}
+	h, err := readMsgHeaderRest(conn.reader, b)
+	if err != nil {
+		if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return h, connError(err, ErrReadTimeout)
+		}
+	}
+	return h, err
+}
+
+func (m *TCPMsgRing) handleOne(conn *ringConn) error {
+	h, err := readMsgHeader(conn, m.interMessageTimeout, m.intraMessageTimeout)
 	if err != nil {
 		return err
 	}
-	msgType = uint64(b)
-	for i := 1; i < 8; i++ {
-		b, err = conn.reader.ReadByte()
+	m.lock.RLock()
+	localRingID := m.ringID
+	m.lock.RUnlock()
+	if h.RingID != localRingID {
+		return fmt.Errorf("message for ring ID %d received by ring ID %d", h.RingID, localRingID)
+	}
+	return m.handleMsg(conn, h)
+}
+
+// handleMsg reads the remainder of a message, after its header, and gives it
+// to the message handler for its type.
+func (m *TCPMsgRing) handleMsg(conn *ringConn, h MsgHeader) error {
+	m.lock.RLock()
+	budgetBytes := m.readBudgetBytes
+	budgetTime := m.readBudgetTime
+	m.lock.RUnlock()
+	msgType := h.MsgType
+	length := h.Length
+	checksummed := h.Flags&MsgFlagChecksummed != 0
+	sequenced := h.Flags&MsgFlagSequenced != 0
+	compressed := h.Flags&MsgFlagCompressed != 0
+	streamed := h.Flags&MsgFlagStreamID != 0
+	// The header is the type, length, and any ring ID, sequence number, and
+	// stream ID; the trailer is any checksum.
+	wire := 16 + length
+	if h.Flags&MsgFlagRingID != 0 {
+		wire += 4
+	}
+	if sequenced {
+		wire += 8
+	}
+	if streamed {
+		wire += 8
+	}
+	if checksummed {
+		wire += 4
+	}
+	if budgetBytes > 0 && wire > budgetBytes {
+		return fmt.Errorf("message type %x of %d bytes exceeds the read budget of %d bytes", msgType, wire, budgetBytes)
+	}
+	if budgetTime > 0 {
+		conn.reader.Deadline = time.Now().Add(budgetTime)
+		defer func() { conn.reader.Deadline = time.Time{} }()
+	}
+	if msgType == _MSG_TYPE_STREAM_COMPRESSION {
+		return m.handleStreamCompression(conn, length)
+	}
+	var handler MsgUnmarshaller
+	if streamed {
+		handler = m.streamMsgHandler(conn, msgType, h.StreamID)
+	} else {
+		m.lock.RLock()
+		handler = m.msgHandlers[msgType]
+		m.lock.RUnlock()
+	}
+	if handler == nil {
+		return fmt.Errorf("no handler for MsgType %x", msgType)
+	}
+	var err error
+	var sequence uint64
+	if sequenced {
+		sequence = h.Sequence
+		m.checkSequence(conn, sequence)
+	}
+	m.lock.RLock()
+	decoder := m.msgDecoder
+	checksumClose := m.checksumClose
+	m.lock.RUnlock()
+	var src io.Reader = conn.reader
+	if checksummed {
+		// The content is buffered so it can be verified before the handler
+		// sees any of it.
+		byts, err := readContent(conn.reader, length)
+		if err != nil {
+			return err
+		}
+		var checksum uint32
+		err = binary.Read(conn.reader, binary.BigEndian, &checksum)
 		if err != nil {
 			return err
 		}
-		msgType <<= 8
-		msgType |= uint64(b)
+		if sum := crc32.ChecksumIEEE(byts); sum != checksum {
+			atomic.AddUint64(&m.checksumMismatches, 1)
+			err = fmt.Errorf("message type %x from %s has checksum %08x instead of %08x", msgType, conn.addr, checksum, sum)
+			if checksumClose {
+				return err
+			}
+			log.Printf("%s; dropping the message", err)
+			return nil
+		}
+		src = bytes.NewReader(byts)
 	}
-	handler := m.msgHandlers[msgType]
-	if handler == nil {
-		return fmt.Errorf("no handler for MsgType %x", msgType)
+	// raw is used to read the exact bytes of the message from the connection,
+	// so a handler cannot read beyond the message and any bytes left over after
+	// handling can be discarded, keeping in sync with the message framing.
+	var raw *io.LimitedReader
+	var content io.Reader
+	if !compressed {
+		raw = &io.LimitedReader{R: src, N: int64(length)}
+		content = raw
+	} else {
+		raw = &io.LimitedReader{R: src, N: int64(length)}
+		err = binary.Read(raw, binary.BigEndian, &length)
+		if err != nil {
+			return err
+		}
+		gr, err := gzip.NewReader(raw)
+		if err != nil {
+			return err
+		}
+		// The decompressed content is buffered so the handler sees the same
+		// read behavior as with uncompressed content.
+		byts, err := ioutil.ReadAll(io.LimitReader(gr, int64(length)))
+		if err != nil {
+			return err
+		}
+		if uint64(len(byts)) != length {
+			return fmt.Errorf("compressed content was %d bytes instead of %d", len(byts), length)
+		}
+		content = bytes.NewReader(byts)
 	}
-	var length uint64
-	for i := 0; i < 8; i++ {
-		b, err = conn.reader.ReadByte()
+	if decoder != nil {
+		content, length, err = decoder(msgType, &io.LimitedReader{R: content, N: int64(length)})
 		if err != nil {
 			return err
 		}
-		length <<= 8
-		length |= uint64(b)
 	}
-	consumed, err := handler(conn.reader, length)
-	if consumed != length {
-		if err == nil {
-			err = fmt.Errorf("did not read %d bytes; only read %d", length, consumed)
+	m.lock.RLock()
+	handlerTimeout := m.handlerTimeout
+	handlerTimeoutClose := m.handlerTimeoutClose
+	m.lock.RUnlock()
+	if handlerTimeout > 0 {
+		byts, err := ioutil.ReadAll(io.LimitReader(content, int64(length)))
+		if err != nil {
+			return err
+		}
+		if uint64(len(byts)) != length {
+			return fmt.Errorf("message type %x content was %d bytes instead of %d", msgType, len(byts), length)
+		}
+		if _, err = io.Copy(ioutil.Discard, raw); err != nil {
+			return err
+		}
+		content = bytes.NewReader(byts)
+	}
+	if sequence != 0 {
+		content = &sequencedReader{Reader: content, sequence: sequence}
+	}
+	var consumed uint64
+	if handlerTimeout > 0 {
+		type result struct {
+			consumed uint64
+			err      error
+		}
+		results := make(chan result, 1)
+		// done is set by whichever of the handler returning or the timeout
+		// happens first; a handler returning after its timeout no longer
+		// counts as abandoned.
+		var done int32
+		go func() {
+			consumed, err := handler(content, length)
+			results <- result{consumed, err}
+			if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+				atomic.AddInt32(&conn.abandoned, -1)
+			}
+		}()
+		timer := time.NewTimer(handlerTimeout)
+		select {
+		case res := <-results:
+			timer.Stop()
+			consumed, err = res.consumed, res.err
+		case <-timer.C:
+			if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+				res := <-results
+				consumed, err = res.consumed, res.err
+				break
+			}
+			err = fmt.Errorf("handler for MsgType %x from %s did not return within %s", msgType, conn.addr, handlerTimeout)
+			if atomic.AddInt32(&conn.abandoned, 1) > _MAX_ABANDONED_HANDLERS {
+				return fmt.Errorf("%s with %d handlers already left running", err, _MAX_ABANDONED_HANDLERS)
+			}
+			if handlerTimeoutClose {
+				return err
+			}
+			log.Printf("%s; moving on to the next message", err)
+			return nil
 		}
+	} else {
+		consumed, err = handler(content, length)
+	}
+	if err != nil {
+		return err
 	}
+	if consumed != length {
+		log.Printf("handler for MsgType %x read %d bytes instead of %d; discarding the rest of the message", msgType, consumed, length)
+	}
+	_, err = io.Copy(ioutil.Discard, raw)
 	if err != nil {
 		return err
 	}
+	m.nodeConnStats(conn.nodeID).add(ConnStats{MsgsReceived: 1, BytesReceived: wire})
+	atomic.AddUint64(&m.typeStats(msgType).msgsReceived, 1)
 	return nil
 }
 
+// checkSequence records the sequence number received on the connection,
+// calling any SequenceGapHandler if it wasn't the one expected.
+func (m *TCPMsgRing) checkSequence(conn *ringConn, sequence uint64) {
+	expected := conn.receiveSequence + 1
+	conn.receiveSequence = sequence
+	m.lock.RLock()
+	handler := m.sequenceGapHandler
+	m.lock.RUnlock()
+	if handler != nil && sequence != expected {
+		handler(conn.nodeID, expected, sequence)
+	}
+}
+
 func (m *TCPMsgRing) handleForever(conn *ringConn) {
 	for {
 		if err := m.handleOne(conn); err != nil {
 			log.Println("handleForever error:", err)
-			m.disconnection(conn.addr)
+			m.removeConn(conn.addr, conn)
+			conn.reader.Close()
 			break
 		}
+		atomic.StoreInt64(&m.lastReceive, time.Now().UnixNano())
+	}
+}
+
+// HealthReport is an overview of the state of a TCPMsgRing, suitable for
+// serializing to JSON for an admin endpoint. It is returned by the
+// TCPMsgRing.Health method.
+type HealthReport struct {
+	RingVersion int64
+	NodeCount   int
+	// LiveConnections is the number of remote nodes that currently have an
+	// established connection and DeadConnections is the number that do not.
+	LiveConnections int
+	DeadConnections int
+	// LastSend and LastReceive are the times of the last successful message
+	// send and receive; they will be zero if there hasn't been one yet.
+	LastSend    time.Time
+	LastReceive time.Time
+	// InboundConnections is the number of connections accepted by Listen
+	// that are currently open; see TCPMsgRing.SetMaxInboundConns.
+	InboundConnections int
+	// Listening indicates whether the Listen method, or the SharedListener the
+	// ring is registered on, is accepting connections.
+	Listening bool
+}
+
+// Health returns an overview of the ring and connection states.
+func (m *TCPMsgRing) Health() *HealthReport {
+	h := &HealthReport{
+		Listening:          m.Listening(),
+		InboundConnections: int(atomic.LoadInt32(&m.inbound)),
+	}
+	if t := atomic.LoadInt64(&m.lastSend); t != 0 {
+		h.LastSend = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&m.lastReceive); t != 0 {
+		h.LastReceive = time.Unix(0, t)
+	}
+	r := m.Ring()
+	if r == nil {
+		return h
+	}
+	h.RingVersion = r.Version()
+	nodes := r.Nodes()
+	h.NodeCount = len(nodes)
+	var localID uint64
+	if localNode := r.LocalNode(); localNode != nil {
+		localID = localNode.ID()
+	}
+	m.lock.RLock()
+	for _, n := range nodes {
+		if n.ID() == localID {
+			continue
+		}
+		live := false
+		for addr, conn := range m.conns {
+			if (conn.nodeID == n.ID() || addr == n.Address(m.addressIndex)) && atomic.LoadInt32(&conn.state) == _STATE_CONNECTED {
+				live = true
+				break
+			}
+		}
+		if live {
+			h.LiveConnections++
+		} else {
+			h.DeadConnections++
+		}
+	}
+	m.lock.RUnlock()
+	return h
+}
+
+// SetListenCallback sets a function called by Listen once it is accepting
+// connections on the local node's address, with a nil error, or with the
+// error if it could not listen on the address. This can be used to report the
+// process ready only once peers are able to connect.
+func (m *TCPMsgRing) SetListenCallback(callback func(addr string, err error)) {
+	m.lock.Lock()
+	m.listenCallback = callback
+	m.lock.Unlock()
+}
+
+// Listening returns true if the Listen method, or the SharedListener the ring
+// is registered on, is accepting connections.
+func (m *TCPMsgRing) Listening() bool {
+	if atomic.LoadInt32(&m.listening) == 1 {
+		return true
 	}
+	m.lock.RLock()
+	l := m.sharedListener
+	m.lock.RUnlock()
+	return l != nil && atomic.LoadInt32(&l.listening) == 1
 }
 
 func (m *TCPMsgRing) Listen() error {
-	node := m.ring.LocalNode()
-	tcpAddr, err := net.ResolveTCPAddr("tcp", node.Address(m.addressIndex))
-	if err != nil {
-		return err
+	node := m.Ring().LocalNode()
+	if node == nil {
+		return fmt.Errorf("no local node set to listen as")
 	}
-	server, err := net.ListenTCP("tcp", tcpAddr)
+	m.lock.RLock()
+	callback := m.listenCallback
+	m.lock.RUnlock()
+	addr := node.Address(m.addressIndex)
+	server, err := m.listenTCP(addr)
 	if err != nil {
+		if callback != nil {
+			callback(addr, err)
+		}
 		return err
 	}
+	m.lock.Lock()
+	if m.isShuttingDown() {
+		m.lock.Unlock()
+		server.Close()
+		return ErrShuttingDown
+	}
+	m.listener = server
+	m.lock.Unlock()
+	atomic.StoreInt32(&m.listening, 1)
+	if callback != nil {
+		callback(addr, nil)
+	}
+	defer atomic.StoreInt32(&m.listening, 0)
 	for {
 		tcpconn, err := server.AcceptTCP()
 		if err != nil {
-			log.Println("Listen/AcceptTCP error:", err)
 			server.Close()
+			if m.isShuttingDown() {
+				return ErrShuttingDown
+			}
+			log.Println("Listen/AcceptTCP error:", err)
 			return err
 		}
-		addr := tcpconn.RemoteAddr().String()
-		conn := &ringConn{
-			state:  _STATE_CONNECTING,
-			addr:   addr,
-			conn:   tcpconn,
-			reader: newTimeoutReader(tcpconn, m.chunkSize, m.intraMessageTimeout),
-			writer: newTimeoutWriter(tcpconn, m.chunkSize, m.intraMessageTimeout),
-		}
-		m.lock.Lock()
-		c := m.conns[addr]
-		if c != nil {
-			c.conn.Close()
-		}
-		m.conns[addr] = conn
-		m.lock.Unlock()
-		go func() {
-			m.handshake(conn)
-			go m.handleForever(conn)
-		}()
+		m.accept(tcpconn)
+	}
+}
+
+func (m *TCPMsgRing) listenTCP(addr string) (*net.TCPListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tcpAddr)
+}
+
+// accept starts handling a connection accepted by Listen, unless that would
+// exceed the SetMaxInboundConns limit, in which case the connection is
+// closed.
+func (m *TCPMsgRing) accept(netconn net.Conn) {
+	m.lock.RLock()
+	max := m.maxInboundConns
+	options := m.tcpOptions
+	m.lock.RUnlock()
+	if inbound := atomic.AddInt32(&m.inbound, 1); max > 0 && int(inbound) > max {
+		atomic.AddInt32(&m.inbound, -1)
+		log.Printf("Listen rejected connection from %s; already at the limit of %d inbound connections", netconn.RemoteAddr(), max)
+		netconn.Close()
+		return
+	}
+	applyTCPOptions(netconn, options)
+	addr := netconn.RemoteAddr().String()
+	var nodeID uint64
+	remote, ok := m.Ring().NodeByAddress(addr)
+	if ok {
+		nodeID = remote.ID()
 	}
+	conn := &ringConn{
+		state:  _STATE_CONNECTING,
+		addr:   addr,
+		nodeID: nodeID,
+		conn:   netconn,
+		reader: newTimeoutReader(netconn, m.chunkSize, m.intraMessageTimeout),
+		writer: newTimeoutWriter(netconn, m.chunkSize, m.intraMessageTimeout),
+	}
+	m.setConn(addr, conn)
+	go func() {
+		if err := m.authenticate(netconn, remote); err != nil {
+			log.Printf("Listen rejected connection from %s; authentication failed: %s", addr, err)
+			m.removeConn(addr, conn)
+			atomic.AddInt32(&m.inbound, -1)
+			return
+		}
+		m.handshake(conn)
+		m.handleForever(conn)
+		atomic.AddInt32(&m.inbound, -1)
+	}()
 }
@@ -1,9 +1,11 @@
 package ring
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"testing"
 	"time"
 )
@@ -19,7 +21,7 @@ func Benchmark_MsgToNode(b *testing.B) {
 	r, _, nB := newTestRing()
 	msgring := NewTCPMsgRing(r)
 	addr := nB.Address(0)
-	msgring.conns[addr] = newRingConn(conn)
+	msgring.setConn(addr, newRingConn(conn))
 	msg := TestMsg{}
 	msgId := uint64(1)
 	b.ResetTimer()
@@ -28,6 +30,46 @@ func Benchmark_MsgToNode(b *testing.B) {
 	}
 }
 
+// benchmarkMsgToNodeTCP sends messages over a loopback TCP connection, so
+// the cost of each network write is included, with the flush interval given.
+func benchmarkMsgToNodeTCP(b *testing.B, flushInterval time.Duration) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.SetFlushInterval(flushInterval)
+	defer msgring.Shutdown(context.Background())
+	msg := TestMsg{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msgring.MsgToNode(nB.ID(), &msg)
+	}
+}
+
+func Benchmark_MsgToNodeTCP(b *testing.B) {
+	benchmarkMsgToNodeTCP(b, 0)
+}
+
+func Benchmark_MsgToNodeTCPFlushInterval(b *testing.B) {
+	benchmarkMsgToNodeTCP(b, time.Millisecond)
+}
+
 func noopmarshaller(reader io.Reader, size uint64) (uint64, error) {
 	return size, nil
 }
@@ -0,0 +1,273 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// _MSG_TYPE_HANDOFF_REQUEST is the reserved message type a node sends to ask
+// another for a partition's data; see TCPMsgRing.EnableHandoffProtocol.
+const _MSG_TYPE_HANDOFF_REQUEST = ReservedMsgTypeStart + 1
+
+// _MSG_TYPE_HANDOFF_RESPONSE is the reserved message type carrying the reply
+// to a handoff request.
+const _MSG_TYPE_HANDOFF_RESPONSE = ReservedMsgTypeStart + 2
+
+// _HANDOFF_OK and _HANDOFF_FAILED are the status of a handoff response; a
+// failed response carries the error text instead of the partition's data.
+const (
+	_HANDOFF_OK     = 0
+	_HANDOFF_FAILED = 1
+)
+
+// _HANDOFF_MAX_ERROR_LENGTH is the most of a failed response's error text
+// kept; the rest is discarded.
+const _HANDOFF_MAX_ERROR_LENGTH = 4096
+
+// HandoffHandler supplies the partition data moved by the handoff protocol;
+// see TCPMsgRing.EnableHandoffProtocol. The methods may be called
+// concurrently. Partitions are given in the ring's own numbering from 0; see
+// Ring.ExternalPartition for the externally exposed numbers.
+type HandoffHandler interface {
+	// WritePartition writes the local data for the partition, to be sent to
+	// the node requesting it. The data is buffered in memory and must fit
+	// within MaxMsgLength, so applications with larger partitions should
+	// write a manifest here and move the bulk of the data with their own
+	// messages.
+	WritePartition(partition uint32, w io.Writer) error
+	// ReadPartition reads the data for the partition sent by the node given,
+	// as written by its WritePartition.
+	ReadPartition(partition uint32, fromNodeID uint64, r io.Reader) error
+	// HandoffFailed is called when the node given could not supply the
+	// partition's data; the request may be retried with RequestHandoff.
+	HandoffFailed(partition uint32, fromNodeID uint64, err error)
+}
+
+// bufferedMsg is a message with its content buffered, such as a handoff
+// request or response.
+type bufferedMsg struct {
+	msgType uint64
+	content []byte
+}
+
+func (m *bufferedMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *bufferedMsg) MsgLength() uint64 {
+	return uint64(len(m.content))
+}
+
+func (m *bufferedMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.content)
+	return uint64(n), err
+}
+
+func (m *bufferedMsg) Done() {
+}
+
+// EnableHandoffProtocol sets the handler for the built in handoff protocol,
+// with which a node that has gained a partition requests its data from a node
+// that has lost it; nil, the default, disables the protocol and handoff
+// requests received are discarded. Both nodes must have the protocol enabled.
+// Requests are sent with RequestHandoff, or with RequestHandoffs to request
+// every partition gained since a previous ring. The responding node calls its
+// handler's WritePartition and the requesting node gets the data with its
+// handler's ReadPartition, or HandoffFailed if the responding node's
+// WritePartition returned an error.
+func (m *TCPMsgRing) EnableHandoffProtocol(handler HandoffHandler) {
+	m.lock.Lock()
+	m.handoffHandler = handler
+	m.lock.Unlock()
+	m.setMsgHandler(_MSG_TYPE_HANDOFF_REQUEST, m.handleHandoffRequest)
+	m.setMsgHandler(_MSG_TYPE_HANDOFF_RESPONSE, m.handleHandoffResponse)
+}
+
+// RequestHandoff asks the node given to send its data for the partition; the
+// reply is given to the HandoffHandler once it arrives. An error is returned
+// if the protocol isn't enabled, the ring has no local node, or the request
+// could not be sent.
+func (m *TCPMsgRing) RequestHandoff(partition uint32, fromNodeID uint64) error {
+	m.lock.RLock()
+	handler := m.handoffHandler
+	m.lock.RUnlock()
+	if handler == nil {
+		return fmt.Errorf("handoff protocol not enabled")
+	}
+	local := m.Ring().LocalNode()
+	if local == nil {
+		return fmt.Errorf("handoff requested without a local node")
+	}
+	content := make([]byte, 12)
+	binary.BigEndian.PutUint32(content, partition)
+	binary.BigEndian.PutUint64(content[4:], local.ID())
+	return m.MsgToNode(fromNodeID, &bufferedMsg{msgType: _MSG_TYPE_HANDOFF_REQUEST, content: content})
+}
+
+// RequestHandoffs requests the data for each partition the local node is
+// responsible for in the current ring but was not in the previous ring given,
+// returning the number of requests sent. Each request is sent to a node
+// responsible for the partition in the previous ring that no longer is, if
+// there is one, otherwise to any node that was responsible for it; requests
+// that fail to send are skipped, so the count may be less than the number of
+// partitions gained. An error is returned if the rings have differing
+// partition counts, as partitions can't then be compared directly, or if the
+// ring has no local node.
+func (m *TCPMsgRing) RequestHandoffs(previous Ring) (int, error) {
+	r := m.Ring()
+	if r.PartitionBitCount() != previous.PartitionBitCount() {
+		return 0, fmt.Errorf("partition bit count changed from %d to %d", previous.PartitionBitCount(), r.PartitionBitCount())
+	}
+	local := r.LocalNode()
+	if local == nil {
+		return 0, fmt.Errorf("handoffs requested without a local node")
+	}
+	localID := local.ID()
+	sent := 0
+	for partition := uint32(0); partition < r.PartitionCount(); partition++ {
+		current := r.ResponsibleNodes(partition)
+		if !nodeSliceHas(current, localID) {
+			continue
+		}
+		before := previous.ResponsibleNodes(partition)
+		if nodeSliceHas(before, localID) {
+			continue
+		}
+		var from uint64
+		for _, n := range before {
+			if !nodeSliceHas(current, n.ID()) {
+				from = n.ID()
+				break
+			}
+			if from == 0 {
+				from = n.ID()
+			}
+		}
+		if from == 0 {
+			continue
+		}
+		if err := m.RequestHandoff(partition, from); err != nil {
+			log.Printf("handoff request for partition %d to %016x failed: %s", partition, from, err)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func nodeSliceHas(nodes NodeSlice, nodeID uint64) bool {
+	for _, n := range nodes {
+		if n.ID() == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *TCPMsgRing) handleHandoffRequest(r io.Reader, length uint64) (uint64, error) {
+	if length != 12 {
+		n, err := io.CopyN(ioutil.Discard, r, int64(length))
+		if err == nil {
+			err = fmt.Errorf("handoff request of %d bytes; should be 12", length)
+		}
+		return uint64(n), err
+	}
+	b := make([]byte, 12)
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return uint64(n), err
+	}
+	partition := binary.BigEndian.Uint32(b)
+	requesterID := binary.BigEndian.Uint64(b[4:])
+	m.lock.RLock()
+	handler := m.handoffHandler
+	m.lock.RUnlock()
+	if handler == nil {
+		return uint64(n), nil
+	}
+	// The reply goes out over the connection to the requester, so it is sent
+	// apart from this connection's reader.
+	go m.sendHandoffResponse(handler, partition, requesterID)
+	return uint64(n), nil
+}
+
+func (m *TCPMsgRing) sendHandoffResponse(handler HandoffHandler, partition uint32, requesterID uint64) {
+	var localID uint64
+	if local := m.Ring().LocalNode(); local != nil {
+		localID = local.ID()
+	}
+	buf := bytes.NewBuffer(make([]byte, 13))
+	err := handler.WritePartition(partition, buf)
+	if err == nil && uint64(buf.Len()) > m.MaxMsgLength() {
+		err = fmt.Errorf("partition data of %d bytes exceeds the max message length of %d", buf.Len()-13, m.MaxMsgLength())
+	}
+	content := buf.Bytes()
+	if err != nil {
+		content = append(content[:13], err.Error()...)
+		content[12] = _HANDOFF_FAILED
+	}
+	binary.BigEndian.PutUint32(content, partition)
+	binary.BigEndian.PutUint64(content[4:], localID)
+	if err := m.MsgToNode(requesterID, &bufferedMsg{msgType: _MSG_TYPE_HANDOFF_RESPONSE, content: content}); err != nil {
+		log.Printf("handoff response for partition %d to %016x failed: %s", partition, requesterID, err)
+	}
+}
+
+func (m *TCPMsgRing) handleHandoffResponse(r io.Reader, length uint64) (uint64, error) {
+	if length < 13 {
+		n, err := io.CopyN(ioutil.Discard, r, int64(length))
+		if err == nil {
+			err = fmt.Errorf("handoff response of %d bytes; should be at least 13", length)
+		}
+		return uint64(n), err
+	}
+	b := make([]byte, 13)
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return uint64(n), err
+	}
+	partition := binary.BigEndian.Uint32(b)
+	fromNodeID := binary.BigEndian.Uint64(b[4:])
+	rest := length - 13
+	m.lock.RLock()
+	handler := m.handoffHandler
+	m.lock.RUnlock()
+	if handler == nil {
+		c, err := io.CopyN(ioutil.Discard, r, int64(rest))
+		return uint64(n) + uint64(c), err
+	}
+	if b[12] != _HANDOFF_OK {
+		// Only so much of the error text is kept, the rest being discarded,
+		// as its length is whatever the remote node claims.
+		keep := rest
+		if keep > _HANDOFF_MAX_ERROR_LENGTH {
+			keep = _HANDOFF_MAX_ERROR_LENGTH
+		}
+		msg := make([]byte, keep)
+		c, err := io.ReadFull(r, msg)
+		if err != nil {
+			return uint64(n + c), err
+		}
+		d, err := io.CopyN(ioutil.Discard, r, int64(rest-keep))
+		if err != nil {
+			return uint64(n+c) + uint64(d), err
+		}
+		handler.HandoffFailed(partition, fromNodeID, fmt.Errorf("%s", msg))
+		return length, nil
+	}
+	lr := &io.LimitedReader{R: r, N: int64(rest)}
+	if err := handler.ReadPartition(partition, fromNodeID, lr); err != nil {
+		log.Printf("handoff of partition %d from %016x failed: %s", partition, fromNodeID, err)
+	}
+	// Whatever the handler left unread is discarded to keep the connection in
+	// step.
+	_, err = io.Copy(ioutil.Discard, lr)
+	if err == nil && lr.N > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return length - uint64(lr.N), err
+}
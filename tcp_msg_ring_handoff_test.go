@@ -0,0 +1,137 @@
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testHandoffHandler struct {
+	data     map[uint32]string
+	received chan string
+	failed   chan error
+}
+
+func (h *testHandoffHandler) WritePartition(partition uint32, w io.Writer) error {
+	data, ok := h.data[partition]
+	if !ok {
+		return errors.New("no such partition")
+	}
+	_, err := io.WriteString(w, data)
+	return err
+}
+
+func (h *testHandoffHandler) ReadPartition(partition uint32, fromNodeID uint64, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	h.received <- string(b)
+	return err
+}
+
+func (h *testHandoffHandler) HandoffFailed(partition uint32, fromNodeID uint64, err error) {
+	h.failed <- err
+}
+
+func TestHandoffProtocol(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	ha := &testHandoffHandler{received: make(chan string, 1), failed: make(chan error, 1)}
+	hb := &testHandoffHandler{data: map[uint32]string{0: "partition zero"}}
+	if err := a.RequestHandoff(0, b.Ring().LocalNode().ID()); err == nil {
+		t.Fatal("RequestHandoff should have failed without the protocol enabled")
+	}
+	a.EnableHandoffProtocol(ha)
+	b.EnableHandoffProtocol(hb)
+	if err := a.RequestHandoff(0, b.Ring().LocalNode().ID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-ha.received:
+		if data != "partition zero" {
+			t.Fatalf("received %q instead of %q", data, "partition zero")
+		}
+	case err := <-ha.failed:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("no handoff response received")
+	}
+	if err := a.RequestHandoff(1, b.Ring().LocalNode().ID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-ha.received:
+		t.Fatalf("received %q for a partition the handler had no data for", data)
+	case err := <-ha.failed:
+		if err.Error() != "no such partition" {
+			t.Fatalf("handoff failed with %q instead of %q", err, "no such partition")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no handoff response received")
+	}
+}
+
+func TestRequestHandoffs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	ha := &testHandoffHandler{received: make(chan string, 16), failed: make(chan error, 16)}
+	hb := &testHandoffHandler{data: map[uint32]string{}}
+	a.EnableHandoffProtocol(ha)
+	b.EnableHandoffProtocol(hb)
+	// The previous ring has only b, so a has gained every partition it now
+	// has.
+	builder := NewBuilder()
+	builder.AddNodeWithID(b.Ring().LocalNode().ID(), true, 1, nil, []string{"pipe-b"}, "", nil)
+	previous, err := builder.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, partition := range a.Ring().LocalPartitions() {
+		hb.data[partition] = "data"
+	}
+	n, err := a.RequestHandoffs(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(hb.data) || n == 0 {
+		t.Fatalf("%d handoffs requested instead of %d", n, len(hb.data))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-ha.received:
+		case err := <-ha.failed:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d handoffs received", i, n)
+		}
+	}
+	if n, err = a.RequestHandoffs(a.Ring()); err != nil || n != 0 {
+		t.Fatalf("RequestHandoffs against the same ring gave %d, %v", n, err)
+	}
+}
+
+func TestHandoffResponseLongError(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	h := &testHandoffHandler{failed: make(chan error, 1)}
+	msgring.EnableHandoffProtocol(h)
+	text := strings.Repeat("x", 2*_HANDOFF_MAX_ERROR_LENGTH)
+	content := append(make([]byte, 12), _HANDOFF_FAILED)
+	content = append(content, text...)
+	n, err := msgring.handleHandoffResponse(bytes.NewReader(content), uint64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != uint64(len(content)) {
+		t.Fatalf("consumed %d bytes instead of %d", n, len(content))
+	}
+	if err = <-h.failed; err.Error() != text[:_HANDOFF_MAX_ERROR_LENGTH] {
+		t.Fatalf("error text was %d bytes instead of %d", len(err.Error()), _HANDOFF_MAX_ERROR_LENGTH)
+	}
+}
@@ -0,0 +1,53 @@
+package ring
+
+import "net"
+
+// NewTestMsgRingPair returns two TCPMsgRings connected to each other with
+// in-memory connections, for testing message handlers without real sockets.
+// Each has a Ring of the same two nodes, with its own node as the local node,
+// so messages sent with MsgToNode or MsgToOtherReplicas are delivered to the
+// other's handlers. As with dialed connections, each side also reads the
+// connection it sends on, such as for responses to requests. The cleanup
+// function closes the connections.
+func NewTestMsgRingPair() (a, b *TCPMsgRing, cleanup func()) {
+	builder := NewBuilder()
+	nodeA, _ := builder.AddNode(true, 1, []string{"a"}, []string{"pipe-a"}, "", nil)
+	nodeB, _ := builder.AddNode(true, 1, []string{"b"}, []string{"pipe-b"}, "", nil)
+	ringA, _ := builder.Ring()
+	ringA.SetLocalNode(nodeA.ID())
+	ringB, _ := builder.Ring()
+	ringB.SetLocalNode(nodeB.ID())
+	a = NewTCPMsgRing(ringA)
+	b = NewTCPMsgRing(ringB)
+	var conns []net.Conn
+	connect := func(from, to *TCPMsgRing, fromNode, toNode Node) {
+		out, in := net.Pipe()
+		conns = append(conns, out, in)
+		outConn := &ringConn{
+			state:  _STATE_CONNECTED,
+			addr:   toNode.Address(0),
+			nodeID: toNode.ID(),
+			conn:   out,
+			reader: newTimeoutReader(out, from.chunkSize, from.intraMessageTimeout),
+			writer: newTimeoutWriter(out, from.chunkSize, from.intraMessageTimeout),
+		}
+		from.setConn(toNode.Address(0), outConn)
+		go from.handleForever(outConn)
+		go to.handleForever(&ringConn{
+			state:  _STATE_CONNECTED,
+			addr:   fromNode.Address(0),
+			nodeID: fromNode.ID(),
+			conn:   in,
+			reader: newTimeoutReader(in, to.chunkSize, to.intraMessageTimeout),
+			writer: newTimeoutWriter(in, to.chunkSize, to.intraMessageTimeout),
+		})
+	}
+	connect(a, b, nodeA, nodeB)
+	connect(b, a, nodeB, nodeA)
+	cleanup = func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	return a, b, cleanup
+}
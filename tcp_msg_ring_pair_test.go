@@ -0,0 +1,106 @@
+package ring
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestNewTestMsgRingPair(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	received := make(chan string, 2)
+	handler := func(name string) MsgUnmarshaller {
+		return func(reader io.Reader, size uint64) (uint64, error) {
+			n, err := test_stringmarshaller(reader, size)
+			received <- name
+			return n, err
+		}
+	}
+	a.SetMsgHandler(1, handler("a"))
+	b.SetMsgHandler(1, handler("b"))
+	a.MsgToNode(b.Ring().LocalNode().ID(), &TestMsg{})
+	b.MsgToNode(a.Ring().LocalNode().ID(), &TestMsg{})
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-received:
+			got[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of 2 messages were delivered", i)
+		}
+	}
+	if !got["a"] || !got["b"] {
+		t.Fatalf("messages were delivered to %v instead of both a and b", got)
+	}
+}
+
+func TestMsgRingPairConnStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	received := make(chan struct{}, 10)
+	b.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		n, err := test_stringmarshaller(reader, size)
+		received <- struct{}{}
+		return n, err
+	})
+	bID := b.Ring().LocalNode().ID()
+	aID := a.Ring().LocalNode().ID()
+	for i := 0; i < 3; i++ {
+		a.MsgToNode(bID, &TestMsg{})
+		<-received
+	}
+	if s := a.ResetConnStats(bID); s.MsgsSent != 3 || s.BytesSent != 3*23 {
+		t.Fatalf("sender stats were %#v", s)
+	}
+	if s := a.ConnStats(bID); s.MsgsSent != 0 {
+		t.Fatalf("stats after reset were %#v", s)
+	}
+	a.MsgToNode(bID, &TestMsg{})
+	<-received
+	if all := b.ResetAllStats(); all[aID].MsgsReceived != 4 || all[aID].BytesReceived != 4*23 {
+		t.Fatalf("receiver stats were %#v", all)
+	}
+	if s := a.ConnStats(bID); s.MsgsSent != 1 {
+		t.Fatalf("stats after one more send were %#v", s)
+	}
+	// Reading the stats of a node without any doesn't add an entry for it.
+	if s := a.ConnStats(12345); s != (ConnStats{}) {
+		t.Fatalf("stats for an unknown node were %#v", s)
+	}
+	a.ResetConnStats(12345)
+	if _, ok := a.Stats().Nodes[12345]; ok {
+		t.Fatal("reading the stats of an unknown node added it")
+	}
+}
+
+func TestMsgRingPairStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	received := make(chan struct{}, 10)
+	b.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		n, err := test_stringmarshaller(reader, size)
+		received <- struct{}{}
+		return n, err
+	})
+	bID := b.Ring().LocalNode().ID()
+	aID := a.Ring().LocalNode().ID()
+	for i := 0; i < 2; i++ {
+		a.MsgToNode(bID, &TestMsg{})
+		<-received
+	}
+	s := a.Stats()
+	if s.Nodes[bID].MsgsSent != 2 || s.MsgTypes[1].MsgsSent != 2 || s.MsgTypes[1].MsgsReceived != 0 {
+		t.Fatalf("sender stats were %#v", s)
+	}
+	// The first message is counted by the time the second is handled.
+	s = b.Stats()
+	if s.Nodes[aID].MsgsReceived < 1 || s.MsgTypes[1].MsgsReceived < 1 || s.MsgTypes[1].MsgsSent != 0 {
+		t.Fatalf("receiver stats were %#v", s)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build prometheus
+// +build prometheus
+
+package ring
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promMsgsSent = prometheus.NewDesc(
+		"ring_msgs_sent_total", "Messages sent to the node.",
+		[]string{"node"}, nil)
+	promBytesSent = prometheus.NewDesc(
+		"ring_bytes_sent_total", "Message bytes sent to the node.",
+		[]string{"node"}, nil)
+	promMsgsReceived = prometheus.NewDesc(
+		"ring_msgs_received_total", "Messages received from the node.",
+		[]string{"node"}, nil)
+	promBytesReceived = prometheus.NewDesc(
+		"ring_bytes_received_total", "Message bytes received from the node.",
+		[]string{"node"}, nil)
+	promSendErrors = prometheus.NewDesc(
+		"ring_send_errors_total", "Sends to the node that failed once under way.",
+		[]string{"node"}, nil)
+	promSendTimeouts = prometheus.NewDesc(
+		"ring_send_timeouts_total", "Sends to the node that timed out.",
+		[]string{"node"}, nil)
+	promConnects = prometheus.NewDesc(
+		"ring_connects_total", "Connections dialed to the node, including reconnections.",
+		[]string{"node"}, nil)
+	promTypeMsgsSent = prometheus.NewDesc(
+		"ring_msg_type_sent_total", "Messages of the type sent.",
+		[]string{"msg_type"}, nil)
+	promTypeMsgsReceived = prometheus.NewDesc(
+		"ring_msg_type_received_total", "Messages of the type received.",
+		[]string{"msg_type"}, nil)
+	promChecksumMismatches = prometheus.NewDesc(
+		"ring_checksum_mismatches_total", "Messages dropped because their frame checksums did not match.",
+		nil, nil)
+)
+
+// msgRingCollector exposes a TCPMsgRing's Stats as Prometheus metrics.
+type msgRingCollector struct {
+	m *TCPMsgRing
+}
+
+// MetricsCollector returns a prometheus.Collector that exposes the counters
+// from Stats, labeled by node ID or message type as 16 hex digits; register
+// it with prometheus.MustRegister to have them scraped with the process's
+// other metrics. The node counters restart from zero when reset with
+// ResetConnStats or ResetAllStats, which Prometheus treats as a counter
+// reset. This is only available when built with the prometheus build tag, so
+// that the Prometheus client is not a dependency otherwise.
+func (m *TCPMsgRing) MetricsCollector() prometheus.Collector {
+	return &msgRingCollector{m: m}
+}
+
+func (c *msgRingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- promMsgsSent
+	ch <- promBytesSent
+	ch <- promMsgsReceived
+	ch <- promBytesReceived
+	ch <- promSendErrors
+	ch <- promSendTimeouts
+	ch <- promConnects
+	ch <- promTypeMsgsSent
+	ch <- promTypeMsgsReceived
+	ch <- promChecksumMismatches
+}
+
+func (c *msgRingCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.m.Stats()
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	for nodeID, s := range stats.Nodes {
+		node := fmt.Sprintf("%016x", nodeID)
+		counter(promMsgsSent, s.MsgsSent, node)
+		counter(promBytesSent, s.BytesSent, node)
+		counter(promMsgsReceived, s.MsgsReceived, node)
+		counter(promBytesReceived, s.BytesReceived, node)
+		counter(promSendErrors, s.SendErrors, node)
+		counter(promSendTimeouts, s.SendTimeouts, node)
+		counter(promConnects, s.Connects, node)
+	}
+	for msgType, s := range stats.MsgTypes {
+		t := fmt.Sprintf("%016x", msgType)
+		counter(promTypeMsgsSent, s.MsgsSent, t)
+		counter(promTypeMsgsReceived, s.MsgsReceived, t)
+	}
+	counter(promChecksumMismatches, stats.ChecksumMismatches)
+}
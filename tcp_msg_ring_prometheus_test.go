@@ -0,0 +1,62 @@
+//go:build prometheus
+// +build prometheus
+
+package ring
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	received := make(chan struct{}, 10)
+	b.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		n, err := test_stringmarshaller(reader, size)
+		received <- struct{}{}
+		return n, err
+	})
+	bID := b.Ring().LocalNode().ID()
+	for i := 0; i < 3; i++ {
+		a.MsgToNode(bID, &TestMsg{})
+		<-received
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(a.MetricsCollector()); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				key += fmt.Sprintf(" %s=%s", label.GetName(), label.GetValue())
+			}
+			values[key] = metric.GetCounter().GetValue()
+		}
+	}
+	node := fmt.Sprintf("node=%016x", bID)
+	if v := values["ring_msgs_sent_total "+node]; v != 3 {
+		t.Fatalf("ring_msgs_sent_total was %v instead of 3: %v", v, values)
+	}
+	if v := values["ring_bytes_sent_total "+node]; v != 3*23 {
+		t.Fatalf("ring_bytes_sent_total was %v instead of %d: %v", v, 3*23, values)
+	}
+	if v := values["ring_msg_type_sent_total msg_type=0000000000000001"]; v != 3 {
+		t.Fatalf("ring_msg_type_sent_total was %v instead of 3: %v", v, values)
+	}
+	if v, ok := values["ring_checksum_mismatches_total"]; !ok || v != 0 {
+		t.Fatalf("ring_checksum_mismatches_total was %v, %v: %v", v, ok, values)
+	}
+}
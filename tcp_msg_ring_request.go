@@ -0,0 +1,269 @@
+package ring
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// _MSG_TYPE_RESPONSE is the reserved message type carrying the reply to a
+// request sent with TCPMsgRing.Request; the StreamID in its header is that of
+// the request.
+const _MSG_TYPE_RESPONSE = ReservedMsgTypeStart + 3
+
+// _RESPONSE_OK and _RESPONSE_FAILED are the status of a response; a failed
+// response carries the error text instead of the response content.
+const (
+	_RESPONSE_OK     = 0
+	_RESPONSE_FAILED = 1
+)
+
+// DefaultMaxRequestsInFlight is the number of requests received over a
+// connection that may be handled at once for a new TCPMsgRing; see
+// TCPMsgRing.SetMaxRequestsInFlight.
+const DefaultMaxRequestsInFlight = 256
+
+// ErrRequestFailed is matched, with errors.Is, by the error Request returns
+// when the remote node's RequestHandler returned an error or it had no
+// handler for the request's type.
+var ErrRequestFailed = errors.New("request failed")
+
+// requestError is ErrRequestFailed with the error text from the remote node.
+type requestError struct {
+	nodeID uint64
+	text   string
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("request to node %016x failed: %s", e.nodeID, e.text)
+}
+
+func (e *requestError) Is(target error) bool {
+	return target == ErrRequestFailed
+}
+
+// RequestHandler handles a request sent with TCPMsgRing.Request, returning the
+// content of the response; should it return an error, the error's text is
+// returned to the requester instead. Handlers are called concurrently, each
+// in its own goroutine, so a slow request doesn't hold up others arriving on
+// the same connection.
+type RequestHandler func(request []byte) ([]byte, error)
+
+// requestMsg is a request or response, tagged with the stream ID that matches
+// the two up; see TCPMsgRing.Request.
+type requestMsg struct {
+	Msg
+	streamID uint64
+	response bool
+}
+
+// Urgent is always true so requests and responses aren't held up by
+// SetFlushInterval batching.
+func (m *requestMsg) Urgent() bool {
+	return true
+}
+
+// requestResult is the content of a response, or the error it carried.
+type requestResult struct {
+	content []byte
+	err     error
+}
+
+// pendingRequest is a Request waiting on its response, which is only accepted
+// from the node the request was sent to.
+type pendingRequest struct {
+	nodeID  uint64
+	results chan *requestResult
+}
+
+// SetRequestHandler sets the handler for requests of the message type given
+// sent with Request; nil removes it. Requests and ordinary messages of the
+// same type are handled separately, by this handler and the SetMsgHandler
+// handler respectively. The message type may not be a reserved type.
+func (m *TCPMsgRing) SetRequestHandler(msgType uint64, handler RequestHandler) error {
+	if msgType >= ReservedMsgTypeStart {
+		return fmt.Errorf("message type %x is reserved; types from %x on are for internal use", msgType, ReservedMsgTypeStart)
+	}
+	m.lock.Lock()
+	if handler == nil {
+		delete(m.requestHandlers, msgType)
+	} else {
+		m.requestHandlers[msgType] = handler
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// SetMaxRequestsInFlight limits the requests received over each connection
+// that may be handled at once, as each is handled in a goroutine of its own; a
+// remote node sending more has its connection closed, failing its requests.
+// The default is DefaultMaxRequestsInFlight; a value less than 1 restores it.
+func (m *TCPMsgRing) SetMaxRequestsInFlight(n int) {
+	if n < 1 || n > math.MaxInt32 {
+		n = DefaultMaxRequestsInFlight
+	}
+	m.lock.Lock()
+	m.maxRequestsInFlight = int32(n)
+	m.lock.Unlock()
+}
+
+// Request sends the message to the node as a request and waits for the
+// response from the node's RequestHandler for the message type, returning the
+// response content. Many requests may be in flight to the same node at once:
+// each is tagged with a stream ID in its frame header, the remote node
+// handles each concurrently, and responses come back in whatever order they
+// complete, over the connection the request went out on, to be matched to
+// their waiting Request calls by stream ID. So a slow request holds up
+// neither other requests nor the caller beyond its own wait, though the
+// frames themselves still share the connection.
+//
+// The error returned matches ErrRequestFailed if the remote handler failed or
+// the remote node had no handler for the type. As the connection may be lost
+// with the request or response in flight, the context given should have a
+// deadline; its error is returned if it ends before the response arrives, and
+// a response arriving after is discarded. The remote node must support
+// requests, as older nodes will close the connection on seeing a stream ID.
+// A request to the local node is given straight to the local handler. As with
+// MsgToNode, the message's Done method is called once it has been sent.
+func (m *TCPMsgRing) Request(ctx context.Context, nodeID uint64, msg Msg) ([]byte, error) {
+	if local := m.Ring().LocalNode(); local != nil && local.ID() == nodeID {
+		defer msg.Done()
+		return m.localRequest(msg)
+	}
+	results := make(chan *requestResult, 1)
+	m.lock.Lock()
+	m.lastStreamID++
+	streamID := m.lastStreamID
+	m.requests[streamID] = &pendingRequest{nodeID: nodeID, results: results}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.requests, streamID)
+		m.lock.Unlock()
+	}()
+	if err := m.MsgToNode(nodeID, &requestMsg{Msg: msg, streamID: streamID}); err != nil {
+		return nil, err
+	}
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, &requestError{nodeID: nodeID, text: res.err.Error()}
+		}
+		return res.content, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// localRequest gives the request straight to the local handler for its type.
+func (m *TCPMsgRing) localRequest(msg Msg) ([]byte, error) {
+	if m.isShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+	msgType := msg.MsgType()
+	m.lock.RLock()
+	handler := m.requestHandlers[msgType]
+	m.lock.RUnlock()
+	if handler == nil {
+		return nil, fmt.Errorf("no request handler for MsgType %x", msgType)
+	}
+	var buf bytes.Buffer
+	fw := &frameWriter{w: &buf, limit: msg.MsgLength()}
+	if _, err := msg.WriteContent(fw); err != nil {
+		return nil, fmt.Errorf("message type %x: %s", msgType, err)
+	}
+	if fw.written != fw.limit {
+		return nil, fmt.Errorf("message type %x wrote %d content bytes instead of its declared %d", msgType, fw.written, fw.limit)
+	}
+	return handler(buf.Bytes())
+}
+
+// streamMsgHandler returns the handler for a message with a stream ID received
+// on the connection: either a response, given to the waiting Request, or a
+// request, given to its RequestHandler in a goroutine of its own, as long as
+// the connection's requests in flight are within SetMaxRequestsInFlight.
+func (m *TCPMsgRing) streamMsgHandler(conn *ringConn, msgType uint64, streamID uint64) MsgUnmarshaller {
+	return func(r io.Reader, length uint64) (uint64, error) {
+		content, err := readContent(r, length)
+		if err != nil {
+			return 0, err
+		}
+		if msgType == _MSG_TYPE_RESPONSE {
+			m.deliverResponse(conn, streamID, content)
+			return length, nil
+		}
+		m.lock.RLock()
+		handler := m.requestHandlers[msgType]
+		max := m.maxRequestsInFlight
+		m.lock.RUnlock()
+		if atomic.AddInt32(&conn.requests, 1) > max {
+			atomic.AddInt32(&conn.requests, -1)
+			return length, fmt.Errorf("more than %d requests in flight from %s", max, conn.addr)
+		}
+		go m.respond(conn, handler, msgType, streamID, content)
+		return length, nil
+	}
+}
+
+// deliverResponse gives the response to the Request waiting on the stream, if
+// it's still waiting and the response came from the node the request was sent
+// to; as stream IDs are sequential, another node could otherwise answer it.
+func (m *TCPMsgRing) deliverResponse(conn *ringConn, streamID uint64, content []byte) {
+	res := &requestResult{}
+	switch {
+	case len(content) == 0:
+		res.err = fmt.Errorf("empty response")
+	case content[0] == _RESPONSE_OK:
+		res.content = content[1:]
+	default:
+		res.err = fmt.Errorf("%s", content[1:])
+	}
+	m.lock.RLock()
+	pending := m.requests[streamID]
+	m.lock.RUnlock()
+	if pending == nil {
+		log.Printf("response for stream %d arrived with no request waiting; discarding it", streamID)
+		return
+	}
+	if conn.nodeID != pending.nodeID {
+		log.Printf("response for stream %d arrived from %s rather than node %016x; discarding it", streamID, conn.addr, pending.nodeID)
+		return
+	}
+	select {
+	case pending.results <- res:
+	default:
+	}
+}
+
+// respond calls the handler for the request and sends its response back over
+// the connection the request arrived on.
+func (m *TCPMsgRing) respond(conn *ringConn, handler RequestHandler, msgType uint64, streamID uint64, request []byte) {
+	defer atomic.AddInt32(&conn.requests, -1)
+	if m.isShuttingDown() {
+		return
+	}
+	content := []byte{_RESPONSE_OK}
+	var err error
+	if handler == nil {
+		err = fmt.Errorf("no request handler for MsgType %x", msgType)
+	} else {
+		var response []byte
+		response, err = handler(request)
+		content = append(content, response...)
+	}
+	if err == nil && uint64(len(content)) > m.MaxMsgLength() {
+		err = fmt.Errorf("response of %d bytes exceeds the max message length of %d", len(content)-1, m.MaxMsgLength())
+	}
+	if err != nil {
+		content = append([]byte{_RESPONSE_FAILED}, err.Error()...)
+	}
+	msg := &requestMsg{Msg: &bufferedMsg{msgType: _MSG_TYPE_RESPONSE, content: content}, streamID: streamID, response: true}
+	if _, err = m.writeConnMsg(msg, conn, conn.addr, conn.nodeID, false); err != nil {
+		log.Printf("response for stream %d to %s failed: %s", streamID, conn.addr, err)
+	}
+}
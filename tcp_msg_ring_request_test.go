@@ -0,0 +1,178 @@
+package ring
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	if err := b.SetRequestHandler(ReservedMsgTypeStart, nil); err == nil {
+		t.Fatal("SetRequestHandler should have failed for a reserved type")
+	}
+	b.SetRequestHandler(1, func(request []byte) ([]byte, error) {
+		if string(request) == "fail" {
+			return nil, errors.New("failed as asked")
+		}
+		return append([]byte("echo "), request...), nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bID := b.Ring().LocalNode().ID()
+	response, err := a.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "echo hello" {
+		t.Fatalf("response was %q", response)
+	}
+	if _, err = a.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte("fail")}); !errors.Is(err, ErrRequestFailed) {
+		t.Fatalf("failed request gave %v", err)
+	}
+	if _, err = a.Request(ctx, bID, &bufferedMsg{msgType: 2}); !errors.Is(err, ErrRequestFailed) {
+		t.Fatalf("request with no handler gave %v", err)
+	}
+	// Requests to the local node go straight to the local handler.
+	if response, err = b.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte("me")}); err != nil || string(response) != "echo me" {
+		t.Fatalf("local request gave %q, %v", response, err)
+	}
+	// The connection is still in step after all that.
+	if response, err = a.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte("again")}); err != nil || string(response) != "echo again" {
+		t.Fatalf("request gave %q, %v", response, err)
+	}
+}
+
+func TestRequestConcurrent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	b.SetRequestHandler(1, func(request []byte) ([]byte, error) {
+		if string(request) == "slow" {
+			close(started)
+			<-release
+		}
+		return request, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bID := b.Ring().LocalNode().ID()
+	slow := make(chan error, 1)
+	go func() {
+		response, err := a.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte("slow")})
+		if err == nil && string(response) != "slow" {
+			err = fmt.Errorf("slow request got the response %q", response)
+		}
+		slow <- err
+	}()
+	<-started
+	// Many requests interleaved on the one connection all get their own
+	// responses while the slow request is still waiting.
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := fmt.Sprintf("request %d", i)
+			response, err := a.Request(ctx, bID, &bufferedMsg{msgType: 1, content: []byte(request)})
+			if err == nil && string(response) != request {
+				err = fmt.Errorf("%q got the response %q", request, response)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-slow:
+		t.Fatalf("slow request returned before being released: %v", err)
+	default:
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	a, b, cleanup := NewTestMsgRingPair()
+	defer cleanup()
+	release := make(chan struct{})
+	defer close(release)
+	b.SetRequestHandler(1, func(request []byte) ([]byte, error) {
+		<-release
+		return request, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.Request(ctx, b.Ring().LocalNode().ID(), &bufferedMsg{msgType: 1}); err != context.DeadlineExceeded {
+		t.Fatalf("request gave %v instead of %v", err, context.DeadlineExceeded)
+	}
+	a.lock.RLock()
+	waiting := len(a.requests)
+	a.lock.RUnlock()
+	if waiting != 0 {
+		t.Fatalf("%d requests still waiting", waiting)
+	}
+}
+
+func TestRequestHugeLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	conn := new(testConn)
+	if err := WriteMsgHeader(&conn.readBuf, &MsgHeader{MsgType: 1, Flags: MsgFlagStreamID, Length: 1 << 55, StreamID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgring.handleOne(newRingConn(conn)); err == nil {
+		t.Fatal("a truncated request should have closed the connection")
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetMaxRequestsInFlight(1)
+	conn := newRingConn(new(testConn))
+	conn.requests = 1
+	handler := msgring.streamMsgHandler(conn, 1, 1)
+	if _, err := handler(bytes.NewReader([]byte("x")), 1); err == nil {
+		t.Fatal("a request beyond the limit should have closed the connection")
+	}
+	if conn.requests != 1 {
+		t.Fatalf("%d requests in flight after refusing one", conn.requests)
+	}
+	// Responses are only taken from the node the request went to.
+	results := make(chan *requestResult, 1)
+	msgring.requests[7] = &pendingRequest{nodeID: 2, results: results}
+	msgring.deliverResponse(&ringConn{nodeID: 3}, 7, []byte{_RESPONSE_OK})
+	select {
+	case <-results:
+		t.Fatal("response from another node was delivered")
+	default:
+	}
+	msgring.deliverResponse(&ringConn{nodeID: 2}, 7, []byte{_RESPONSE_OK})
+	select {
+	case <-results:
+	default:
+		t.Fatal("response was not delivered")
+	}
+}
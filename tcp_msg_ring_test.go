@@ -2,12 +2,17 @@ package ring
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,10 +30,10 @@ func newRingConn(conn net.Conn) *ringConn {
 
 func newTestRing() (Ring, Node, Node) {
 	b := NewBuilder()
-	b.SetReplicaCount(3)
-	nA := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", []byte("Conf"))
-	nB := b.AddNode(true, 1, nil, []string{"127.0.0.1:8888"}, "", []byte("Conf"))
-	r := b.Ring()
+	b.SetReplicaCount(2)
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", []byte("Conf"))
+	nB, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:8888"}, "", []byte("Conf"))
+	r, _ := b.Ring()
 	r.SetLocalNode(nA.ID())
 	return r, nA, nB
 }
@@ -93,6 +98,38 @@ func (c *testConn) Close() error {
 	return nil
 }
 
+// blockingConn's writes block until released or closed; its reads block
+// until closed.
+type blockingConn struct {
+	testConn
+	release   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.release:
+		return len(b), nil
+	case <-c.closed:
+		return 0, errors.New("closed")
+	}
+}
+
+func (c *blockingConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *blockingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
 /***** Actual tests start here *****/
 
 func TestTCPMsgRingIsMsgRing(t *testing.T) {
@@ -134,7 +171,7 @@ func Test_MsgToNode(t *testing.T) {
 	conn := new(testConn)
 	r, _, nB := newTestRing()
 	msgring := NewTCPMsgRing(r)
-	msgring.conns[nB.Address(0)] = newRingConn(conn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
 	msg := TestMsg{}
 	msgring.MsgToNode(nB.ID(), &msg)
 	var msgtype uint64
@@ -154,15 +191,474 @@ func Test_MsgToNode(t *testing.T) {
 	}
 }
 
+func Test_MsgToNodeLoopback(t *testing.T) {
+	r, nA, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msg := &doneMsg{}
+	if err := msgring.MsgToNode(nA.ID(), msg); err == nil {
+		t.Fatal("MsgToNode to the local node without a handler should have failed")
+	}
+	var received string
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		b := make([]byte, size)
+		n, err := io.ReadFull(reader, b)
+		received = string(b[:n])
+		return uint64(n), err
+	})
+	if err := msgring.MsgToNode(nA.ID(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if received != testStr {
+		t.Fatalf("handler received %q instead of %q", received, testStr)
+	}
+	if atomic.LoadInt32(&msg.done) != 2 {
+		t.Fatalf("Done called %d times instead of twice", msg.done)
+	}
+	msgring.lock.RLock()
+	conns := len(msgring.conns)
+	msgring.lock.RUnlock()
+	if conns != 0 {
+		t.Fatalf("%d connections were made for the local node", conns)
+	}
+	if s := msgring.Stats().MsgTypes[1]; s.MsgsSent != 1 || s.MsgsReceived != 1 {
+		t.Fatalf("message type stats were %+v", s)
+	}
+}
+
+type doneMsg struct {
+	TestMsg
+	done int32
+}
+
+func (m *doneMsg) Done() {
+	atomic.AddInt32(&m.done, 1)
+}
+
+func Test_MsgToNodeUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{addr}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	msg := &doneMsg{}
+	start := time.Now()
+	err = msgring.MsgToNode(nB.ID(), msg)
+	if !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("MsgToNode gave %v instead of ErrNodeUnreachable", err)
+	}
+	if errors.Unwrap(err) == nil {
+		t.Fatal("ErrNodeUnreachable did not wrap the dial error")
+	}
+	if !errors.Is(err, ErrDialFailed) {
+		t.Fatalf("MsgToNode gave %v instead of ErrDialFailed", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("MsgToNode took %s; it should not have retried", d)
+	}
+	if atomic.LoadInt32(&msg.done) != 1 {
+		t.Fatalf("Done called %d times instead of once", msg.done)
+	}
+	msgring.lock.RLock()
+	conn := msgring.conns[addr]
+	msgring.lock.RUnlock()
+	if conn != nil {
+		t.Fatal("failed connection was left in place")
+	}
+}
+
+func Test_Authenticator(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{l.Addr().String()}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	var remoteID uint64
+	msgring.SetAuthenticator(func(conn net.Conn, remote Node) error {
+		remoteID = remote.ID()
+		return errors.New("rejected")
+	})
+	msg := &doneMsg{}
+	err = msgring.MsgToNode(nB.ID(), msg)
+	if !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("MsgToNode gave %v instead of ErrNodeUnreachable", err)
+	}
+	if remoteID != nB.ID() {
+		t.Fatalf("authenticator was given node %d instead of %d", remoteID, nB.ID())
+	}
+	msgring.lock.RLock()
+	conn := msgring.conns[nB.Address(0)]
+	msgring.lock.RUnlock()
+	if conn != nil {
+		t.Fatal("rejected connection was left in place")
+	}
+}
+
+// failConn fails every write, as a connection the remote end just dropped
+// would.
+type failConn struct {
+	testConn
+}
+
+func (c *failConn) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func (c *failConn) Close() error {
+	return nil
+}
+
+type retryableMsg struct {
+	TestMsg
+	retryable bool
+}
+
+func (m *retryableMsg) Retryable() bool {
+	return m.retryable
+}
+
+func Test_SendRetry(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 16+len(testMsg))
+		if _, err := io.ReadFull(conn, b); err == nil {
+			received <- b
+		}
+	}()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{l.Addr().String()}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	msgring.SetSendRetry(2, time.Millisecond)
+	msgring.setConn(nB.Address(0), newRingConn(&failConn{}))
+	if err := msgring.MsgToNode(nB.ID(), &retryableMsg{}); err == nil {
+		t.Fatal("message that is not retryable was resent")
+	}
+	msgring.setConn(nB.Address(0), newRingConn(&failConn{}))
+	if err := msgring.MsgToNode(nB.ID(), &retryableMsg{retryable: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		if !bytes.Equal(b[16:], testMsg) {
+			t.Fatalf("received %q instead of %q", b[16:], testMsg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retried message was not received")
+	}
+}
+
+// timeoutError is a net.Error for a timed out operation.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// timeoutConn times out every write.
+type timeoutConn struct {
+	failConn
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	return 0, timeoutError{}
+}
+
+func Test_TransportErrors(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	if err := msgring.MsgToNode(12345, &TestMsg{}); !errors.Is(err, ErrNodeNotFound) {
+		t.Fatalf("MsgToNode gave %v instead of ErrNodeNotFound", err)
+	}
+	msgring.setConn(nB.Address(0), newRingConn(&failConn{}))
+	err := msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if !errors.Is(err, ErrConnClosed) || errors.Unwrap(err) == nil {
+		t.Fatalf("MsgToNode gave %v instead of ErrConnClosed", err)
+	}
+	msgring.setConn(nB.Address(0), newRingConn(&timeoutConn{}))
+	err = msgring.MsgToNode(nB.ID(), &TestMsg{})
+	var ne net.Error
+	if !errors.Is(err, ErrWriteTimeout) || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("MsgToNode gave %v instead of ErrWriteTimeout", err)
+	}
+	if stats := msgring.ConnStats(nB.ID()); stats.SendTimeouts != 1 || stats.SendErrors != 2 {
+		t.Fatalf("ConnStats gave %d send timeouts of %d send errors instead of 1 of 2", stats.SendTimeouts, stats.SendErrors)
+	}
+	if err := msgring.MsgToOtherReplicas(r.Version()+1, 0, &TestMsg{}); !errors.Is(err, ErrRingVersionMismatch) {
+		t.Fatalf("MsgToOtherReplicas gave %v instead of ErrRingVersionMismatch", err)
+	}
+	if _, err := readMsgHeader(newRingConn(new(testConn)), time.Second, time.Second); !errors.Is(err, ErrConnClosed) || errors.Unwrap(err) != io.EOF {
+		t.Fatalf("readMsgHeader gave %v instead of ErrConnClosed", err)
+	}
+}
+
+// lockedConn is a testConn safe for writes from a flusher concurrent with
+// the test checking what was written.
+type lockedConn struct {
+	testConn
+	lock sync.Mutex
+}
+
+func (c *lockedConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.testConn.Write(b)
+}
+
+func (c *lockedConn) written() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.writeBuf.Len()
+}
+
+type urgentMsg struct {
+	TestMsg
+}
+
+func (m *urgentMsg) Urgent() bool {
+	return true
+}
+
+func Test_FlushInterval(t *testing.T) {
+	conn := new(lockedConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.SetFlushInterval(50 * time.Millisecond)
+	defer msgring.SetFlushInterval(0)
+	size := 16 + len(testMsg)
+	if err := msgring.MsgToNode(nB.ID(), &TestMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.written(); n != 0 {
+		t.Fatalf("%d bytes were flushed before the flush interval", n)
+	}
+	for i := 0; i < 100 && conn.written() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := conn.written(); n != size {
+		t.Fatalf("%d bytes were flushed after the flush interval instead of %d", n, size)
+	}
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if err := msgring.MsgToNode(nB.ID(), &urgentMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.written(); n != 3*size {
+		t.Fatalf("urgent message left %d of %d bytes unflushed", 3*size-n, 3*size)
+	}
+}
+
+func Test_MsgToNodeTimed(t *testing.T) {
+	conn := new(lockedConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	// Timed sends are flushed even with batching.
+	msgring.SetFlushInterval(time.Hour)
+	defer msgring.SetFlushInterval(0)
+	written, elapsed, err := msgring.MsgToNodeTimed(nB.ID(), &TestMsg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := 16 + len(testMsg); written != uint64(size) || conn.written() != size {
+		t.Fatalf("%d bytes were reported and %d flushed instead of %d", written, conn.written(), size)
+	}
+	if elapsed <= 0 {
+		t.Fatalf("elapsed was %s", elapsed)
+	}
+	if stats := msgring.ConnStats(nB.ID()); stats.BytesSent != written {
+		t.Fatalf("%d bytes were reported but the stats gave %d", written, stats.BytesSent)
+	}
+	if written, _, err = msgring.MsgToNodeTimed(12345, &TestMsg{}); err == nil || written != 0 {
+		t.Fatalf("send to an unknown node gave %d bytes and %v", written, err)
+	}
+	// On a shared listener the ring ID is counted on both ends.
+	conn2 := new(testConn)
+	msgring.setConn(nB.Address(0), newRingConn(conn2))
+	msgring.sharedListener = &SharedListener{}
+	msgring.ringID = 3
+	if written, _, err = msgring.MsgToNodeTimed(nB.ID(), &TestMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if size := 20 + len(testMsg); written != uint64(size) || conn2.writeBuf.Len() != size {
+		t.Fatalf("%d bytes were reported and %d written instead of %d", written, conn2.writeBuf.Len(), size)
+	}
+	receiver := NewTCPMsgRing(r)
+	receiver.ringID = 3
+	receiver.SetMsgHandler(1, test_stringmarshaller)
+	conn3 := new(testConn)
+	conn3.readBuf.Write(conn2.writeBuf.Bytes())
+	if err = receiver.handleOne(newRingConn(conn3)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := receiver.ConnStats(0); stats.BytesReceived != written {
+		t.Fatalf("%d bytes were sent but the receiver's stats gave %d", written, stats.BytesReceived)
+	}
+}
+
+func Test_RegisteredMsgTypes(t *testing.T) {
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	if v := msgring.RegisteredMsgTypes(); len(v) != 0 {
+		t.Fatalf("RegisteredMsgTypes gave %v with no handlers set", v)
+	}
+	msgring.SetMsgHandler(3, test_stringmarshaller)
+	msgring.SetMsgHandler(1, test_stringmarshaller)
+	msgring.SetMsgHandler(2, nil)
+	msgring.EnableHandoffProtocol(&testHandoffHandler{})
+	v := msgring.RegisteredMsgTypes()
+	if len(v) != 4 || v[0] != 1 || v[1] != 3 || v[2] != _MSG_TYPE_HANDOFF_REQUEST || v[3] != _MSG_TYPE_HANDOFF_RESPONSE {
+		t.Fatalf("RegisteredMsgTypes gave %x", v)
+	}
+}
+
+func Test_PauseNode(t *testing.T) {
+	conn := new(testConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.PauseNode(nB.ID())
+	msg := &doneMsg{}
+	start := time.Now()
+	if err := msgring.MsgToNode(nB.ID(), msg); err != ErrNodePaused {
+		t.Fatalf("MsgToNode gave %v instead of ErrNodePaused", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("MsgToNode took %s; it should not have retried", d)
+	}
+	if atomic.LoadInt32(&msg.done) != 1 {
+		t.Fatalf("Done called %d times instead of once", msg.done)
+	}
+	if conn.writeBuf.Len() != 0 {
+		t.Fatalf("%d bytes were sent to the paused node", conn.writeBuf.Len())
+	}
+	if n := msgring.MsgToTier(0, "", &TestMsg{}); n != 0 {
+		t.Fatalf("MsgToTier sent to %d nodes instead of 0", n)
+	}
+	msgring.ResumeNode(nB.ID())
+	if err := msgring.MsgToNode(nB.ID(), &TestMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writeBuf.Len() != 23 {
+		t.Fatalf("Wrote %d bytes instead of 23", conn.writeBuf.Len())
+	}
+}
+
+func Test_PauseNodeNoDial(t *testing.T) {
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.PauseNode(nB.ID())
+	if err := msgring.WarmConnections(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgring.MsgToNode(nB.ID(), &TestMsg{}); err != ErrNodePaused {
+		t.Fatalf("MsgToNode gave %v instead of ErrNodePaused", err)
+	}
+	msgring.lock.RLock()
+	conns := len(msgring.conns)
+	msgring.lock.RUnlock()
+	if conns != 0 {
+		t.Fatalf("%d connections were made to the paused node", conns)
+	}
+}
+
+func Test_MsgToNodeConcurrentDial(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			netconn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, netconn)
+		}
+	}()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{listener.Addr().String()}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	// The authenticator holds the first send's dial open until the second
+	// send has had to find it under way.
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	msgring.SetAuthenticator(func(netconn net.Conn, remote Node) error {
+		close(dialing)
+		<-release
+		return nil
+	})
+	errs := make(chan error, 2)
+	go func() {
+		errs <- msgring.MsgToNode(nB.ID(), &TestMsg{})
+	}()
+	<-dialing
+	go func() {
+		errs <- msgring.MsgToNode(nB.ID(), &TestMsg{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("send %d gave %v", i, err)
+		}
+	}
+	if s := msgring.ConnStats(nB.ID()); s.MsgsSent != 2 || s.Connects != 1 {
+		t.Fatalf("ConnStats gave %#v", s)
+	}
+}
+
 func Test_MsgToNodeChan(t *testing.T) {
 	conn := new(testConn)
 	r, _, nB := newTestRing()
 	msgring := NewTCPMsgRing(r)
-	msgring.conns[nB.Address(0)] = newRingConn(conn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
 	msg := TestMsg{}
-	retch := make(chan struct{})
+	retch := make(chan error)
 	go msgring.msgToNodeChan(&msg, nB, retch)
-	<-retch
+	if err := <-retch; err != nil {
+		t.Fatal(err)
+	}
 	var msgtype uint64
 	binary.Read(&conn.writeBuf, binary.BigEndian, &msgtype)
 	if int(msgtype) != 1 {
@@ -178,13 +674,18 @@ func Test_MsgToNodeChan(t *testing.T) {
 	if !bytes.Equal(msgcontent, testMsg) {
 		t.Error("Incorrect message contents")
 	}
+	log.SetOutput(ioutil.Discard)
+	go msgring.msgToNodeChan(&badLengthMsg{content: []byte("Test")}, nB, retch)
+	if err := <-retch; err == nil {
+		t.Fatal("failed send did not give an error")
+	}
 }
 
 func Test_MsgToOtherReplicas(t *testing.T) {
 	conn := new(testConn)
 	r, _, nB := newTestRing()
 	msgring := NewTCPMsgRing(r)
-	msgring.conns[nB.Address(0)] = newRingConn(conn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
 	msg := TestMsg{}
 	msgring.MsgToOtherReplicas(r.Version(), uint32(1), &msg)
 	var msgtype uint64
@@ -206,3 +707,1046 @@ func Test_MsgToOtherReplicas(t *testing.T) {
 		t.Error("Incorrect message contents")
 	}
 }
+
+func Test_SetNodeRateLimit(t *testing.T) {
+	conn := new(testConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	rc := newRingConn(conn)
+	msgring.setConn(nB.Address(0), rc)
+	msgring.SetNodeRateLimit(nB.ID(), 1000)
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if rc.writer.limiter == nil {
+		t.Fatal("Rate limit not applied to connection")
+	}
+	if conn.writeBuf.Len() != 23 {
+		t.Errorf("Wrote %d bytes instead of 23", conn.writeBuf.Len())
+	}
+	msgring.SetNodeRateLimit(nB.ID(), 0)
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if rc.writer.limiter != nil {
+		t.Fatal("Rate limit not removed from connection")
+	}
+}
+
+func Test_MsgEncoderDecoder(t *testing.T) {
+	conn := new(testConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.SetMsgEncoder(func(msgType uint64, content io.Reader) (io.Reader, uint64, error) {
+		byts, err := ioutil.ReadAll(content)
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(append(byts, '!')), uint64(len(byts) + 1), nil
+	})
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	var msgtype uint64
+	binary.Read(bytes.NewReader(conn.writeBuf.Bytes()), binary.BigEndian, &msgtype)
+	if msgtype != 1 {
+		t.Error("Message type not written correctly")
+	}
+	var msgsize uint64
+	binary.Read(bytes.NewReader(conn.writeBuf.Bytes()[8:]), binary.BigEndian, &msgsize)
+	if msgsize != 8 {
+		t.Errorf("Encoded message size was %d instead of 8", msgsize)
+	}
+	if !bytes.Equal(conn.writeBuf.Bytes()[16:], []byte("Testing!")) {
+		t.Errorf("Encoded message content was %q", conn.writeBuf.Bytes()[16:])
+	}
+	conn2 := new(testConn)
+	conn2.readBuf.Write(conn.writeBuf.Bytes())
+	msgring.SetMsgHandler(1, test_stringmarshaller)
+	msgring.SetMsgDecoder(func(msgType uint64, content io.Reader) (io.Reader, uint64, error) {
+		return io.LimitReader(content, 7), 7, nil
+	})
+	rc := newRingConn(conn2)
+	if err := msgring.handleOne(rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.reader.ReadByte(); err != io.EOF {
+		t.Error("Decoded message was not fully consumed from the connection")
+	}
+}
+
+func Test_CompressionThreshold(t *testing.T) {
+	for _, threshold := range []int{0, 6, 7, 100} {
+		conn := new(testConn)
+		r, _, nB := newTestRing()
+		msgring := NewTCPMsgRing(r)
+		msgring.setConn(nB.Address(0), newRingConn(conn))
+		msgring.SetCompressionThreshold(threshold)
+		msgring.MsgToNode(nB.ID(), &TestMsg{})
+		msgsize := binary.BigEndian.Uint64(conn.writeBuf.Bytes()[8:16])
+		compressed := msgsize>>_MSG_FLAGS_SHIFT&uint64(MsgFlagCompressed) != 0
+		if compressed != (threshold == 6) {
+			t.Fatalf("Threshold %d gave compressed %v", threshold, compressed)
+		}
+		if !compressed && msgsize != 7 {
+			t.Fatalf("Threshold %d gave message size %d instead of 7", threshold, msgsize)
+		}
+		if compressed && int(msgsize&_MSG_MAX_LENGTH) != conn.writeBuf.Len()-16 {
+			t.Fatalf("Compressed message size %d did not match content length %d", msgsize&_MSG_MAX_LENGTH, conn.writeBuf.Len()-16)
+		}
+		conn2 := new(testConn)
+		conn2.readBuf.Write(conn.writeBuf.Bytes())
+		msgring.SetMsgHandler(1, test_stringmarshaller)
+		rc := newRingConn(conn2)
+		if err := msgring.handleOne(rc); err != nil {
+			t.Fatalf("Threshold %d: %s", threshold, err)
+		}
+		if _, err := rc.reader.ReadByte(); err != io.EOF {
+			t.Fatalf("Threshold %d: message was not fully consumed from the connection", threshold)
+		}
+	}
+}
+
+func Test_Health(t *testing.T) {
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	h := msgring.Health()
+	if h.RingVersion != r.Version() || h.NodeCount != 2 || h.LiveConnections != 0 || h.DeadConnections != 1 || !h.LastSend.IsZero() || h.Listening {
+		t.Fatalf("Health gave %#v", h)
+	}
+	msgring.setConn(nB.Address(0), newRingConn(new(testConn)))
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	h = msgring.Health()
+	if h.LiveConnections != 1 || h.DeadConnections != 0 || h.LastSend.IsZero() {
+		t.Fatalf("Health gave %#v", h)
+	}
+	if _, err := json.Marshal(h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ConnsConcurrentAccess(t *testing.T) {
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	addr := nB.Address(0)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			for j := 0; j < 100; j++ {
+				msgring.msgToNode(&TestMsg{}, nB)
+			}
+			wg.Done()
+		}()
+		go func() {
+			for j := 0; j < 100; j++ {
+				rc := newRingConn(new(testConn))
+				msgring.setConn(addr, rc)
+				msgring.Health()
+				msgring.removeConn(addr, rc)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_ReconnectJitter(t *testing.T) {
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	backoff := 4 * time.Second
+	for _, fraction := range []float64{0, 0.25, 1} {
+		msgring.SetReconnectJitter(fraction)
+		min := backoff - time.Duration(fraction*float64(backoff))
+		for i := 0; i < 1000; i++ {
+			d := msgring.reconnectDelay(backoff)
+			if d < min || d > backoff {
+				t.Fatalf("jitter %v gave delay %v outside [%v, %v]", fraction, d, min, backoff)
+			}
+		}
+	}
+	msgring.SetReconnectJitter(0)
+	if d := msgring.reconnectDelay(backoff); d != backoff {
+		t.Fatalf("no jitter gave delay %v", d)
+	}
+}
+
+func Test_WarmConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	b.AddNode(true, 1, nil, []string{listener.Addr().String()}, "", nil)
+	b.AddNode(true, 1, nil, []string{closedAddr}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	err = msgring.WarmConnections()
+	if err == nil || !strings.Contains(err.Error(), closedAddr) || strings.Contains(err.Error(), listener.Addr().String()) {
+		t.Fatalf("WarmConnections gave %v", err)
+	}
+	if msgring.connection(listener.Addr().String(), 0) == nil {
+		t.Fatal("connection was not warmed")
+	}
+	msgring.lock.RLock()
+	_, failed := msgring.conns[closedAddr]
+	_, local := msgring.conns["127.0.0.1:9999"]
+	msgring.lock.RUnlock()
+	if failed || local {
+		t.Fatal("failed or local connection was left in place")
+	}
+}
+
+func Test_TCPOptions(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	b.AddNode(true, 1, nil, []string{addr}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	if msgring.tcpOptions != DefaultTCPOptions() {
+		t.Fatalf("new TCPMsgRing has options %+v", msgring.tcpOptions)
+	}
+	// A linger of 0 resets the connection on close, which the other end sees
+	// as an error rather than EOF.
+	for _, linger := range []int{-1, 0} {
+		options := DefaultTCPOptions()
+		options.KeepAlivePeriod = time.Minute
+		options.LingerSeconds = linger
+		msgring.SetTCPOptions(options)
+		if err = msgring.WarmConnections(); err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgring.removeConn(addr, msgring.connection(addr, 0))
+		accepted.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = accepted.Read(make([]byte, 1))
+		accepted.Close()
+		if linger < 0 && err != io.EOF || linger == 0 && (err == io.EOF || isTimeout(err)) {
+			t.Fatalf("closing with a linger of %d gave %v", linger, err)
+		}
+	}
+	// Connections other than TCP ones are left alone.
+	applyTCPOptions(new(testConn), DefaultTCPOptions())
+}
+
+func Test_SetRingAddressChange(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var listeners []net.Listener
+	accepted := make(chan net.Conn, 2)
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- conn
+			}
+		}()
+	}
+	oldAddr := listeners[0].Addr().String()
+	newAddr := listeners[1].Addr().String()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{oldAddr}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	if err := msgring.WarmConnections(); err != nil {
+		t.Fatal(err)
+	}
+	var oldConn net.Conn
+	select {
+	case oldConn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("no connection to the old address")
+	}
+	defer oldConn.Close()
+	if err := b.SetNodeAddresses(nB.ID(), []string{newAddr}); err != nil {
+		t.Fatal(err)
+	}
+	r2, _ := b.Ring()
+	r2.SetLocalNode(nA.ID())
+	msgring.SetRing(r2)
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("no connection to the new address")
+	}
+	oldConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := oldConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection to the old address gave %v instead of being closed", err)
+	}
+	msgring.lock.RLock()
+	_, ok := msgring.conns[oldAddr]
+	msgring.lock.RUnlock()
+	if ok {
+		t.Fatal("connection to the old address was left in place")
+	}
+}
+
+func Test_RingGeneration(t *testing.T) {
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	if r2, generation := msgring.RingGeneration(); r2 != r || generation != 0 {
+		t.Fatalf("RingGeneration gave generation %d", generation)
+	}
+	r3, _, _ := newTestRing()
+	msgring.SetRing(r3)
+	msgring.SetRing(r3)
+	if r2, generation := msgring.RingGeneration(); r2 != r3 || generation != 2 || msgring.Generation() != 2 {
+		t.Fatalf("RingGeneration gave generation %d after two swaps", generation)
+	}
+}
+
+func Test_Sequencing(t *testing.T) {
+	conn := new(testConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.EnableSequencing(true)
+	for i := 0; i < 3; i++ {
+		msgring.MsgToNode(nB.ID(), &TestMsg{})
+	}
+	// Each message is its type, length, and sequence followed by content.
+	size := 8 + 8 + 8 + len(testMsg)
+	if conn.writeBuf.Len() != 3*size {
+		t.Fatalf("wrote %d bytes instead of %d", conn.writeBuf.Len(), 3*size)
+	}
+	// Deliver the first and third messages, losing the second.
+	sent := conn.writeBuf.Bytes()
+	conn2 := new(testConn)
+	conn2.readBuf.Write(sent[:size])
+	conn2.readBuf.Write(sent[2*size:])
+	var sequences []uint64
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		if sr, ok := reader.(SequencedReader); ok {
+			sequences = append(sequences, sr.MsgSequence())
+		}
+		return test_stringmarshaller(reader, size)
+	})
+	var gaps [][2]uint64
+	msgring.SetSequenceGapHandler(func(nodeID uint64, expected uint64, received uint64) {
+		gaps = append(gaps, [2]uint64{expected, received})
+	})
+	rc := newRingConn(conn2)
+	for i := 0; i < 2; i++ {
+		if err := msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sequences) != 2 || sequences[0] != 1 || sequences[1] != 3 {
+		t.Fatalf("handler saw sequences %v", sequences)
+	}
+	if len(gaps) != 1 || gaps[0] != [2]uint64{2, 3} {
+		t.Fatalf("gap handler saw %v", gaps)
+	}
+	// Each connection, even from unidentified nodes, is sequenced apart.
+	gaps = nil
+	rcA := newRingConn(new(testConn))
+	rcB := newRingConn(new(testConn))
+	for _, rc := range []*ringConn{rcA, rcB} {
+		rc.conn.(*testConn).readBuf.Write(sent[:2*size])
+	}
+	for _, rc := range []*ringConn{rcA, rcB, rcA, rcB} {
+		if err := msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(gaps) != 0 {
+		t.Fatalf("gap handler saw %v", gaps)
+	}
+	// A new connection starts over, and a failed send doesn't use up a
+	// sequence number.
+	conn = new(testConn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	failing := newRingConn(&failConn{})
+	msgring.setConn(nB.Address(0), failing)
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if failing.sendSequence != 0 {
+		t.Fatalf("failed send advanced the sequence to %d", failing.sendSequence)
+	}
+	h, err := ReadMsgHeader(&conn.writeBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Sequence != 1 {
+		t.Fatalf("new connection started at sequence %d", h.Sequence)
+	}
+}
+
+func Test_DrainConn(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, release := range []bool{true, false} {
+		r, _, nB := newTestRing()
+		msgring := NewTCPMsgRing(r)
+		msgring.SetDrainTimeout(100 * time.Millisecond)
+		conn := newBlockingConn()
+		msgring.setConn(nB.Address(0), newRingConn(conn))
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				errs <- msgring.msgToNode(&TestMsg{}, nB)
+			}()
+		}
+		// Replacing the connection drains the old one.
+		for i := 0; i < 100 && atomic.LoadInt32(&msgring.connection(nB.Address(0), 0).pending) != 3; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		msgring.setConn(nB.Address(0), newRingConn(new(testConn)))
+		if release {
+			close(conn.release)
+		}
+		for i := 0; i < 3; i++ {
+			err := <-errs
+			if release && err != nil {
+				t.Fatalf("drained send gave %v", err)
+			}
+			if !release && err == nil {
+				t.Fatal("send past the drain timeout should have failed")
+			}
+		}
+		if release {
+			select {
+			case <-conn.closed:
+			case <-time.After(time.Second):
+				t.Fatal("drained connection was not closed")
+			}
+		}
+	}
+}
+
+type timeoutTestMsg struct {
+	TestMsg
+	timeout time.Duration
+}
+
+func (m *timeoutTestMsg) Timeout() time.Duration {
+	return m.timeout
+}
+
+// deadlineConn records the latest write deadline set.
+type deadlineConn struct {
+	testConn
+	writeDeadline time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	if t.After(c.writeDeadline) {
+		c.writeDeadline = t
+	}
+	return nil
+}
+
+func Test_MsgTimeout(t *testing.T) {
+	r, _, nB := newTestRing()
+	for _, timeout := range []time.Duration{0, time.Minute, time.Hour} {
+		conn := new(deadlineConn)
+		msgring := NewTCPMsgRing(r)
+		rc := newRingConn(conn)
+		msgring.setConn(nB.Address(0), rc)
+		defaultTimeout := rc.writer.Timeout
+		start := time.Now()
+		msgring.MsgToNode(nB.ID(), &timeoutTestMsg{timeout: timeout})
+		expected := timeout
+		if expected == 0 {
+			expected = defaultTimeout
+		}
+		if conn.writeDeadline.Before(start.Add(expected)) || conn.writeDeadline.After(time.Now().Add(expected)) {
+			t.Fatalf("timeout %s gave write deadline %s after the start", timeout, conn.writeDeadline.Sub(start))
+		}
+		if rc.writer.Timeout != defaultTimeout {
+			t.Fatalf("timeout %s was not reverted; writer timeout is %s", timeout, rc.writer.Timeout)
+		}
+	}
+}
+
+// badLengthMsg writes content bytes other than the length it declares.
+type badLengthMsg struct {
+	TestMsg
+	content []byte
+}
+
+func (m *badLengthMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.content)
+	return uint64(n), err
+}
+
+func Test_MsgLengthMismatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	for _, content := range [][]byte{[]byte("Test"), []byte("Testing!")} {
+		conn := new(testConn)
+		msgring := NewTCPMsgRing(r)
+		msgring.setConn(nB.Address(0), newRingConn(conn))
+		err := msgring.msgToNode(&badLengthMsg{content: content}, nB)
+		if err == nil {
+			t.Fatalf("%d bytes of content for a length of 7 should have errored", len(content))
+		}
+		if conn.writeBuf.Len() != 0 {
+			t.Fatalf("%d bytes of a corrupt frame were sent", conn.writeBuf.Len())
+		}
+		msgring.lock.RLock()
+		_, ok := msgring.conns[nB.Address(0)]
+		msgring.lock.RUnlock()
+		if ok {
+			t.Fatal("connection was not closed")
+		}
+	}
+}
+
+func Test_MaxInboundConns(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetMaxInboundConns(1)
+	conn1 := newBlockingConn()
+	msgring.accept(conn1)
+	conn2 := newBlockingConn()
+	msgring.accept(conn2)
+	select {
+	case <-conn2.closed:
+	default:
+		t.Fatal("connection beyond the limit was not closed")
+	}
+	if h := msgring.Health(); h.InboundConnections != 1 {
+		t.Fatalf("Health gave %d inbound connections instead of 1", h.InboundConnections)
+	}
+	conn1.Close()
+	for i := 0; msgring.Health().InboundConnections != 0; i++ {
+		if i > 100 {
+			t.Fatal("closed connection was still counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn3 := newBlockingConn()
+	msgring.accept(conn3)
+	defer conn3.Close()
+	select {
+	case <-conn3.closed:
+		t.Fatal("connection within the limit was closed")
+	default:
+	}
+}
+
+func Test_SetMsgHandlerReserved(t *testing.T) {
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	if err := msgring.SetMsgHandler(ReservedMsgTypeStart-1, test_stringmarshaller); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgring.SetMsgHandler(ReservedMsgTypeStart, test_stringmarshaller); err == nil {
+		t.Fatal("SetMsgHandler for a reserved type should have errored")
+	}
+	if msgring.msgHandlers[ReservedMsgTypeStart] != nil {
+		t.Fatal("handler for a reserved type was set")
+	}
+}
+
+func Test_StreamCompression(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	for _, agree := range []bool{true, false} {
+		mA := NewTCPMsgRing(r)
+		if err := mA.SetStreamCompression(CompressionGzip); err != nil {
+			t.Fatal(err)
+		}
+		mB := NewTCPMsgRing(r)
+		if agree {
+			mB.SetStreamCompression(CompressionGzip)
+		}
+		received := make(chan struct{}, 3)
+		mB.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+			received <- struct{}{}
+			return test_stringmarshaller(reader, size)
+		})
+		c1, c2 := net.Pipe()
+		connA := newRingConn(c1)
+		connB := newRingConn(c2)
+		go mB.handleForever(connB)
+		if err := mA.negotiateStreamCompression(connA); err != nil {
+			t.Fatal(err)
+		}
+		if (connA.writer.compressor != nil) != agree {
+			t.Fatalf("agree %v gave compressor %v", agree, connA.writer.compressor)
+		}
+		mA.setConn(nB.Address(0), connA)
+		for i := 0; i < 3; i++ {
+			mA.MsgToNode(nB.ID(), &TestMsg{})
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("agree %v only received %d messages", agree, i)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+	if err := NewTCPMsgRing(r).SetStreamCompression(Compression(99)); err == nil {
+		t.Fatal("SetStreamCompression with an unknown compression should have errored")
+	}
+}
+
+func Test_HandlerWrongByteCount(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(ioutil.Discard)
+	conn := new(testConn)
+	for i := 0; i < 3; i++ {
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(1))
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(7))
+		conn.readBuf.WriteString(testStr)
+	}
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	var reads []string
+	readSizes := []int{3, 100, 7}
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		buf := make([]byte, readSizes[len(reads)])
+		n, _ := io.ReadFull(reader, buf)
+		reads = append(reads, string(buf[:n]))
+		return uint64(n), nil
+	})
+	rc := newRingConn(conn)
+	for i := 0; i < 3; i++ {
+		if err := msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reads) != 3 || reads[0] != "Tes" || reads[1] != testStr || reads[2] != testStr {
+		t.Fatalf("handler read %q", reads)
+	}
+	if !strings.Contains(logged.String(), "read 3 bytes instead of 7") {
+		t.Fatalf("under-read was not logged: %q", logged.String())
+	}
+}
+
+func Test_MsgToTier(t *testing.T) {
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, []string{"server2", "zone1"}, []string{"127.0.0.1:8888"}, "", nil)
+	nC, _ := b.AddNode(true, 1, []string{"server3", "zone2"}, []string{"127.0.0.1:7777"}, "", nil)
+	b.AddNode(false, 1, []string{"server4", "zone1"}, []string{"127.0.0.1:6666"}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	connB := new(testConn)
+	msgring.setConn(nB.Address(0), newRingConn(connB))
+	connC := new(testConn)
+	msgring.setConn(nC.Address(0), newRingConn(connC))
+	if sent := msgring.MsgToTier(1, "zone1", &TestMsg{}); sent != 1 {
+		t.Fatalf("MsgToTier gave %d instead of 1", sent)
+	}
+	if connB.writeBuf.Len() == 0 || connC.writeBuf.Len() != 0 {
+		t.Fatalf("zone1 node got %d bytes and zone2 node got %d", connB.writeBuf.Len(), connC.writeBuf.Len())
+	}
+}
+
+func Test_MsgToTierCold(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			netconn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, netconn)
+		}
+	}()
+	b := NewBuilder()
+	nA, _ := b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"127.0.0.1:9999"}, "", nil)
+	nB, _ := b.AddNode(true, 1, []string{"server2", "zone1"}, []string{listener.Addr().String()}, "", nil)
+	b.AddNode(true, 1, []string{"server3", "zone2"}, []string{"127.0.0.1:7777"}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring := NewTCPMsgRing(r)
+	if sent := msgring.MsgToTier(1, "zone1", &TestMsg{}); sent != 1 {
+		t.Fatalf("MsgToTier gave %d instead of 1", sent)
+	}
+	if s := msgring.ConnStats(nB.ID()); s.MsgsSent != 1 || s.Connects != 1 {
+		t.Fatalf("ConnStats gave %#v", s)
+	}
+}
+
+func Test_ReadBudget(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetMsgHandler(1, test_stringmarshaller)
+	for _, budget := range []uint64{8 + 8 + 7, 8 + 8 + 6} {
+		conn := new(testConn)
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(1))
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(7))
+		conn.readBuf.WriteString(testStr)
+		msgring.SetReadBudget(budget, 0)
+		err := msgring.handleOne(newRingConn(conn))
+		if (err == nil) != (budget == 23) {
+			t.Fatalf("read budget of %d bytes gave %v", budget, err)
+		}
+	}
+	// A message trickled in slower than the time budget allows is cut off,
+	// even though each individual read is within the read timeout.
+	msgring.SetReadBudget(0, 50*time.Millisecond)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		binary.Write(c1, binary.BigEndian, uint64(1))
+		binary.Write(c1, binary.BigEndian, uint64(7))
+		for i := 0; i < len(testMsg); i++ {
+			if _, err := c1.Write(testMsg[i : i+1]); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	rc := newRingConn(c2)
+	rc.reader = newTimeoutReader(c2, 1, 2*time.Second)
+	if err := msgring.handleOne(rc); err == nil {
+		t.Fatal("message exceeding the time budget should have errored")
+	}
+}
+
+func Test_SendErrorHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	var calls int
+	msgring.SetSendErrorHandler(func(nodeID uint64, err error) bool {
+		if nodeID != nB.ID() {
+			t.Fatalf("send error handler called for %016x instead of %016x", nodeID, nB.ID())
+		}
+		calls++
+		return false
+	})
+	msgring.setConn(nB.Address(0), newRingConn(new(testConn)))
+	if err := msgring.msgToNode(&badLengthMsg{content: []byte("Test")}, nB); err == nil || err == ErrNodeCircuitOpen {
+		t.Fatalf("failed send gave %v", err)
+	}
+	conn := new(testConn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	if err := msgring.msgToNode(&TestMsg{}, nB); err != ErrNodeCircuitOpen {
+		t.Fatalf("send with the circuit open gave %v", err)
+	}
+	if calls != 1 || conn.writeBuf.Len() != 0 {
+		t.Fatalf("handler called %d times and %d bytes sent with the circuit open", calls, conn.writeBuf.Len())
+	}
+	msgring.ResetNode(nB.ID())
+	if err := msgring.msgToNode(&TestMsg{}, nB); err != nil {
+		t.Fatalf("send after ResetNode gave %v", err)
+	}
+}
+
+type dedupTestMsg struct {
+	TestMsg
+	key uint64
+}
+
+func (m *dedupTestMsg) DedupKey() (uint64, bool) {
+	return m.key, true
+}
+
+func Test_DedupWindow(t *testing.T) {
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetDedupWindow(50 * time.Millisecond)
+	conn := new(testConn)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	for _, key := range []uint64{1, 1, 2, 1} {
+		if err := msgring.msgToNode(&dedupTestMsg{key: key}, nB); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each message is 8+8+7 bytes; the repeats of key 1 were skipped.
+	if conn.writeBuf.Len() != 2*23 {
+		t.Fatalf("%d bytes were sent instead of 2 messages' worth", conn.writeBuf.Len())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := msgring.msgToNode(&dedupTestMsg{key: 1}, nB); err != nil {
+		t.Fatal(err)
+	}
+	if conn.writeBuf.Len() != 3*23 {
+		t.Fatal("message was skipped after the dedup window passed")
+	}
+}
+
+func Test_Shutdown(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetDrainTimeout(time.Second)
+	conn := newBlockingConn()
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- msgring.msgToNode(&TestMsg{}, nB)
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&msgring.connection(nB.Address(0), 0).pending) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(conn.release)
+	}()
+	if err := msgring.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("in-flight send gave %v", err)
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("connection was not closed")
+	}
+	if err := msgring.msgToNode(&TestMsg{}, nB); err != ErrShuttingDown {
+		t.Fatalf("send after shutdown gave %v", err)
+	}
+	if msgring.MsgToTier(0, "", &TestMsg{}) != 0 {
+		t.Fatal("MsgToTier sent after shutdown")
+	}
+	start := time.Now()
+	msgring.MsgToNode(nB.ID(), &TestMsg{})
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("MsgToNode retried after shutdown")
+	}
+	if err := msgring.WarmConnections(); err != ErrShuttingDown {
+		t.Fatalf("WarmConnections after shutdown gave %v", err)
+	}
+	if err := msgring.Listen(); err != ErrShuttingDown {
+		t.Fatalf("Listen after shutdown gave %v", err)
+	}
+	if len(msgring.conns) != 0 {
+		t.Fatalf("%d connections after shutdown", len(msgring.conns))
+	}
+}
+
+func Test_ShutdownContext(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	conn := newBlockingConn()
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- msgring.msgToNode(&TestMsg{}, nB)
+	}()
+	for i := 0; i < 100 && atomic.LoadInt32(&msgring.connection(nB.Address(0), 0).pending) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := msgring.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown gave %v", err)
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("send cut off by shutdown should have failed")
+	}
+}
+
+func Test_ListenCallback(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	b := NewBuilder()
+	n, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:0"}, "", nil)
+	r, _ := b.Ring()
+	r.SetLocalNode(n.ID())
+	msgring := NewTCPMsgRing(r)
+	listened := make(chan error, 1)
+	msgring.SetListenCallback(func(addr string, err error) {
+		if addr != "127.0.0.1:0" {
+			t.Errorf("listen callback given %q", addr)
+		}
+		if !msgring.Listening() && err == nil {
+			t.Error("not listening when the listen callback was called")
+		}
+		listened <- err
+	})
+	if msgring.Listening() {
+		t.Fatal("listening before Listen")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- msgring.Listen()
+	}()
+	if err := <-listened; err != nil {
+		t.Fatal(err)
+	}
+	msgring.Shutdown(context.Background())
+	if err := <-done; err != ErrShuttingDown {
+		t.Fatalf("Listen gave %v", err)
+	}
+	if msgring.Listening() {
+		t.Fatal("still listening after Listen returned")
+	}
+
+	b = NewBuilder()
+	n, _ = b.AddNode(true, 1, nil, []string{"bad address"}, "", nil)
+	r, _ = b.Ring()
+	r.SetLocalNode(n.ID())
+	msgring = NewTCPMsgRing(r)
+	msgring.SetListenCallback(func(addr string, err error) {
+		listened <- err
+	})
+	if err := msgring.Listen(); err == nil {
+		t.Fatal("Listen on a bad address should have failed")
+	}
+	if err := <-listened; err == nil {
+		t.Fatal("listen callback not given the error")
+	}
+}
+
+func Test_FrameChecksums(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	conn := new(testConn)
+	r, _, nB := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.setConn(nB.Address(0), newRingConn(conn))
+	msgring.EnableFrameChecksums(true)
+	for i := 0; i < 2; i++ {
+		if err := msgring.msgToNode(&TestMsg{}, nB); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each message is its type, length, and content followed by the checksum.
+	size := 8 + 8 + len(testMsg) + 4
+	if conn.writeBuf.Len() != 2*size {
+		t.Fatalf("wrote %d bytes instead of %d", conn.writeBuf.Len(), 2*size)
+	}
+	sent := conn.writeBuf.Bytes()
+	// Corrupt the content of the first message.
+	sent[16] ^= 0xff
+	var handled int
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		handled++
+		return test_stringmarshaller(reader, size)
+	})
+	for _, closeConn := range []bool{false, true} {
+		msgring.SetChecksumMismatchClose(closeConn)
+		conn2 := new(testConn)
+		conn2.readBuf.Write(sent)
+		rc := newRingConn(conn2)
+		handled = 0
+		err := msgring.handleOne(rc)
+		if closeConn {
+			if err == nil {
+				t.Fatal("checksum mismatch should have closed the connection")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+		if handled != 1 {
+			t.Fatalf("handler called %d times instead of once", handled)
+		}
+	}
+	if msgring.ChecksumMismatches() != 2 {
+		t.Fatalf("%d checksum mismatches counted instead of 2", msgring.ChecksumMismatches())
+	}
+	// A header claiming a huge length is not trusted for buffering.
+	conn2 := new(testConn)
+	if err := WriteMsgHeader(&conn2.readBuf, &MsgHeader{MsgType: 1, Flags: MsgFlagChecksummed, Length: 1 << 55}); err != nil {
+		t.Fatal(err)
+	}
+	conn2.readBuf.WriteString("short")
+	if err := msgring.handleOne(newRingConn(conn2)); err == nil {
+		t.Fatal("a truncated checksummed message should have closed the connection")
+	}
+}
+
+func Test_HandlerTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	r, _, _ := newTestRing()
+	msgring := NewTCPMsgRing(r)
+	msgring.SetHandlerTimeout(10 * time.Millisecond)
+	block := make(chan struct{})
+	defer close(block)
+	// Type 2 messages block, reading nothing.
+	msgring.SetMsgHandler(2, func(reader io.Reader, size uint64) (uint64, error) {
+		<-block
+		return 0, nil
+	})
+	var reads []string
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		buf, err := ioutil.ReadAll(reader)
+		reads = append(reads, string(buf))
+		return uint64(len(buf)), err
+	})
+	for _, closeConn := range []bool{false, true} {
+		msgring.SetHandlerTimeoutClose(closeConn)
+		conn := new(testConn)
+		for _, msgType := range []uint64{2, 1} {
+			binary.Write(&conn.readBuf, binary.BigEndian, msgType)
+			binary.Write(&conn.readBuf, binary.BigEndian, uint64(7))
+			conn.readBuf.WriteString(testStr)
+		}
+		rc := newRingConn(conn)
+		err := msgring.handleOne(rc)
+		if closeConn {
+			if err == nil {
+				t.Fatal("handler timeout should have closed the connection")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The blocked handler left the framing intact for the next message.
+		if err = msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+		if len(reads) != 1 || reads[0] != testStr {
+			t.Fatalf("handler read %q", reads)
+		}
+	}
+	// Too many handlers left running closes the connection.
+	msgring.SetHandlerTimeoutClose(false)
+	conn := new(testConn)
+	for i := 0; i <= _MAX_ABANDONED_HANDLERS; i++ {
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(2))
+		binary.Write(&conn.readBuf, binary.BigEndian, uint64(7))
+		conn.readBuf.WriteString(testStr)
+	}
+	rc := newRingConn(conn)
+	for i := 0; i < _MAX_ABANDONED_HANDLERS; i++ {
+		if err := msgring.handleOne(rc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := msgring.handleOne(rc); err == nil {
+		t.Fatal("too many abandoned handlers should have closed the connection")
+	}
+}
@@ -2,36 +2,135 @@ package ring
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 // TODO: Maybe this should go into its own package if it's considered resuable
 // by things other than just TCPMsgRing. For now, I'll just privatize it all.
 
+// errTimeoutIOClosed is returned by reads and writes after Close.
+var errTimeoutIOClosed = errors.New("use of closed timeout reader or writer")
+
+// bufioReaderPool and bufioWriterPool hold the buffers released by Close for
+// reuse by later timeout readers and writers of the same chunk size.
+var bufioReaderPool, bufioWriterPool sync.Pool
+
+func getBufioReader(r io.Reader, size int) *bufio.Reader {
+	if br, ok := bufioReaderPool.Get().(*bufio.Reader); ok && br.Size() == size {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func getBufioWriter(w io.Writer, size int) *bufio.Writer {
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok && bw.Size() == size {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
 // timeoutReader is a bufio.Reader that reads in chunks and will return a
 // timeout error if the chunk is not read in the Timeout time.
 // TODO: Add other bufio functions
 type timeoutReader struct {
 	Timeout time.Duration
-	reader  *bufio.Reader
-	conn    net.Conn
+	// Deadline, if set, is a time no read may go beyond regardless of the
+	// Timeout.
+	Deadline time.Time
+	reader   *bufio.Reader
+	conn     net.Conn
 }
 
 func newTimeoutReader(conn net.Conn, chunkSize int, timeout time.Duration) *timeoutReader {
 	return &timeoutReader{
 		Timeout: timeout,
-		reader:  bufio.NewReaderSize(conn, chunkSize),
+		reader:  getBufioReader(conn, chunkSize),
 		conn:    conn,
 	}
 }
 
+// Close releases the reader's buffer for reuse, discarding anything buffered;
+// it does not close the connection. Further reads return an error, and
+// closing again does nothing. It must not be called while a read is in
+// progress.
+func (r *timeoutReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	r.reader.Reset(nil)
+	bufioReaderPool.Put(r.reader)
+	r.reader = nil
+	return nil
+}
+
+// decompress has all further reads decompress the stream with the
+// compression given; any bytes already buffered are treated as the start of
+// the compressed stream.
+func (r *timeoutReader) decompress(c Compression) {
+	buffered, _ := r.reader.Peek(r.reader.Buffered())
+	src := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), r.conn)
+	size := r.reader.Size()
+	r.reader.Reset(nil)
+	bufioReaderPool.Put(r.reader)
+	r.reader = getBufioReader(&lazyDecompressReader{src: src, compression: c}, size)
+}
+
+// lazyDecompressReader creates its decompressor on the first read, as
+// creating one reads the compression header; this way the header is read
+// under the same deadline as any other read.
+type lazyDecompressReader struct {
+	src         io.Reader
+	compression Compression
+	reader      io.Reader
+}
+
+func (l *lazyDecompressReader) Read(p []byte) (int, error) {
+	if l.reader == nil {
+		var err error
+		switch l.compression {
+		case CompressionGzip:
+			l.reader, err = gzip.NewReader(l.src)
+		case CompressionZstd:
+			if newZstdReader == nil {
+				return 0, fmt.Errorf("zstd compression not available; build with -tags zstd")
+			}
+			l.reader, err = newZstdReader(l.src)
+		default:
+			err = fmt.Errorf("unknown compression %s", l.compression)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return l.reader.Read(p)
+}
+
+// deadline is the time the next read from the network must complete by.
+func (r *timeoutReader) deadline() time.Time {
+	timeout := time.Now().Add(r.Timeout)
+	if !r.Deadline.IsZero() && r.Deadline.Before(timeout) {
+		return r.Deadline
+	}
+	return timeout
+}
+
 func (r *timeoutReader) Read(p []byte) (n int, err error) {
+	if r.reader == nil {
+		return 0, errTimeoutIOClosed
+	}
 	deadline := false
 	if r.reader.Buffered() == 0 {
 		// Buffer is empty, so we will read from the network
-		timeout := time.Now().Add(r.Timeout)
-		r.conn.SetReadDeadline(timeout)
+		r.conn.SetReadDeadline(r.deadline())
 		deadline = true
 	}
 	count, err := r.reader.Read(p)
@@ -42,11 +141,13 @@ func (r *timeoutReader) Read(p []byte) (n int, err error) {
 }
 
 func (r *timeoutReader) ReadByte() (c byte, err error) {
+	if r.reader == nil {
+		return 0, errTimeoutIOClosed
+	}
 	deadline := false
 	if r.reader.Buffered() == 0 {
 		// Buffer is empty, so we will read from the network
-		timeout := time.Now().Add(r.Timeout)
-		r.conn.SetReadDeadline(timeout)
+		r.conn.SetReadDeadline(r.deadline())
 		deadline = true
 	}
 	b, err := r.reader.ReadByte()
@@ -60,19 +161,103 @@ func (r *timeoutReader) ReadByte() (c byte, err error) {
 // timeout error if the chunk is not read in the Timeout time.
 type timeoutWriter struct {
 	Timeout time.Duration
+	// limiter, if set, throttles the bytes sent to the connection. Time spent
+	// waiting on the limiter does not count against the Timeout.
+	limiter *tokenBucket
 	writer  *bufio.Writer
-	conn    net.Conn
+	// compressor, if set, compresses the stream between the writer and the
+	// connection; see compress.
+	compressor io.WriteCloser
+	conn       net.Conn
 }
 
 func newTimeoutWriter(conn net.Conn, chunkSize int, timeout time.Duration) *timeoutWriter {
-	return &timeoutWriter{
+	w := &timeoutWriter{
 		Timeout: timeout,
-		writer:  bufio.NewWriterSize(conn, chunkSize),
 		conn:    conn,
 	}
+	w.writer = getBufioWriter(&throttledConn{w}, chunkSize)
+	return w
+}
+
+// Close flushes anything buffered, ends any compressed stream, and releases
+// the writer's buffer for reuse; it does not close the connection. The buffer
+// is released even if the flush fails, in which case the error is returned.
+// Further writes return an error, and closing again does nothing. It must
+// not be called while a write is in progress.
+func (w *timeoutWriter) Close() error {
+	if w.writer == nil {
+		return nil
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.Timeout))
+	err := w.writer.Flush()
+	if w.compressor != nil {
+		if cerr := w.compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	w.conn.SetWriteDeadline(time.Time{})
+	w.release()
+	return err
+}
+
+// release is the same as Close but discards anything buffered rather than
+// flushing it, such as when the connection has failed.
+func (w *timeoutWriter) release() {
+	if w.writer == nil {
+		return
+	}
+	w.compressor = nil
+	w.writer.Reset(nil)
+	bufioWriterPool.Put(w.writer)
+	w.writer = nil
+}
+
+// compress has all further writes compressed with the compression given; it
+// should only be called with nothing buffered, such as right after a Flush.
+func (w *timeoutWriter) compress(c Compression) error {
+	compressor, err := newCompressWriter(&throttledConn{w}, c)
+	if err != nil {
+		return err
+	}
+	w.compressor = compressor
+	size := w.writer.Size()
+	w.writer.Reset(nil)
+	bufioWriterPool.Put(w.writer)
+	w.writer = getBufioWriter(compressor, size)
+	return nil
+}
+
+// throttledConn is what the timeoutWriter's bufio.Writer actually writes to;
+// it applies any rate limit before passing the bytes on to the connection.
+type throttledConn struct {
+	w *timeoutWriter
+}
+
+func (t *throttledConn) Write(p []byte) (int, error) {
+	limiter := t.w.limiter
+	if limiter == nil {
+		return t.w.conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		c := limiter.take(len(p) - written)
+		// The wait for tokens may have used up some or all of the deadline
+		// set by the caller, so we restart it just for this chunk.
+		t.w.conn.SetWriteDeadline(time.Now().Add(t.w.Timeout))
+		n, err := t.w.conn.Write(p[written : written+c])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 func (w *timeoutWriter) Write(p []byte) (n int, err error) {
+	if w.writer == nil {
+		return 0, errTimeoutIOClosed
+	}
 	deadline := false
 	if len(p) > w.writer.Available() {
 		// Write will flush(), so make sure we wrap in a timeout
@@ -88,6 +273,9 @@ func (w *timeoutWriter) Write(p []byte) (n int, err error) {
 }
 
 func (w *timeoutWriter) WriteByte(c byte) error {
+	if w.writer == nil {
+		return errTimeoutIOClosed
+	}
 	deadline := false
 	if w.writer.Available() <= 0 {
 		// Write will flush(), so make sure we wrap in a timeout
@@ -102,11 +290,74 @@ func (w *timeoutWriter) WriteByte(c byte) error {
 	return err
 }
 
+// Buffered returns the number of bytes written but not yet flushed.
+func (w *timeoutWriter) Buffered() int {
+	if w.writer == nil {
+		return 0
+	}
+	return w.writer.Buffered()
+}
+
 func (w *timeoutWriter) Flush() error {
+	if w.writer == nil {
+		return errTimeoutIOClosed
+	}
 	timeout := time.Now().Add(w.Timeout)
 	w.conn.SetWriteDeadline(timeout)
 	err := w.writer.Flush()
+	if err == nil && w.compressor != nil {
+		// The compressor must also be flushed for the bytes to be sent.
+		if f, ok := w.compressor.(interface {
+			Flush() error
+		}); ok {
+			err = f.Flush()
+		}
+	}
 	w.conn.SetWriteDeadline(time.Time{})
 	return err
 
 }
+
+// tokenBucket is a simple rate limiter; tokens (bytes) are refilled at rate
+// per second up to a burst of one second's worth.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// take blocks until at least one token is available and then takes up to n
+// tokens, returning the number taken.
+func (tb *tokenBucket) take(n int) int {
+	tb.lock.Lock()
+	for {
+		now := time.Now()
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.rate {
+			tb.tokens = tb.rate
+		}
+		tb.last = now
+		if tb.tokens >= 1 {
+			break
+		}
+		wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		tb.lock.Unlock()
+		time.Sleep(wait)
+		tb.lock.Lock()
+	}
+	if float64(n) > tb.tokens {
+		n = int(tb.tokens)
+	}
+	tb.tokens -= float64(n)
+	tb.lock.Unlock()
+	return n
+}
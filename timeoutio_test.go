@@ -2,6 +2,7 @@ package ring
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -137,3 +138,84 @@ func Test_Write(t *testing.T) {
 		t.Error("Read incorrect: ", string(read))
 	}
 }
+
+func Test_Close(t *testing.T) {
+	c := new(testConn)
+	c.readBuf.WriteString("ABCD")
+	writer := newTimeoutWriter(c, 16*1024, 2*time.Second)
+	writer.Write([]byte("ABCD"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.writeBuf.String() != "ABCD" {
+		t.Fatalf("Close flushed %q instead of \"ABCD\"", c.writeBuf.String())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("second Close gave: ", err)
+	}
+	if _, err := writer.Write([]byte("E")); err != errTimeoutIOClosed {
+		t.Fatal("Write after Close gave: ", err)
+	}
+	reader := newTimeoutReader(c, 16*1024, 2*time.Second)
+	if b, _ := reader.ReadByte(); b != 'A' {
+		t.Fatal("Read incorrect byte: ", string(b))
+	}
+	reader.Close()
+	reader.Close()
+	if _, err := reader.Read(make([]byte, 1)); err != errTimeoutIOClosed {
+		t.Fatal("Read after Close gave: ", err)
+	}
+}
+
+func Test_TokenBucket(t *testing.T) {
+	tb := newTokenBucket(1000)
+	if n := tb.take(5000); n != 1000 {
+		t.Fatal("Took incorrect number of tokens: ", n)
+	}
+	// With the bucket empty, 100 more tokens take at least 99ms to refill.
+	start := time.Now()
+	for taken := 0; taken < 100; {
+		n := tb.take(100 - taken)
+		if n < 1 || n > 100-taken {
+			t.Fatal("Took incorrect number of tokens: ", n)
+		}
+		taken += n
+	}
+	if elapsed := time.Since(start); elapsed < 99*time.Millisecond {
+		t.Error("Empty bucket didn't wait for tokens: ", elapsed)
+	}
+}
+
+func Test_WriteThrottledNoTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		ioutil.ReadAll(s)
+	}()
+	c, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	writer := newTimeoutWriter(c, 1024, 50*time.Millisecond)
+	writer.limiter = newTokenBucket(10000)
+	start := time.Now()
+	_, err = writer.Write(make([]byte, 15000))
+	if err != nil {
+		t.Fatal("Throttled write failed: ", err)
+	}
+	if err = writer.Flush(); err != nil {
+		t.Fatal("Throttled flush failed: ", err)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Error("Write wasn't throttled: ", time.Since(start))
+	}
+}
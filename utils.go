@@ -1,11 +1,18 @@
 package ring
 
 import (
-	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // RingOrBuilder attempts to determine whether a file is a Ring or Builder file
@@ -18,8 +25,8 @@ func RingOrBuilder(fileName string) (Ring, *Builder, error) {
 	if f, err = os.Open(fileName); err != nil {
 		return r, b, err
 	}
-	var gf *gzip.Reader
-	if gf, err = gzip.NewReader(f); err != nil {
+	var gf io.ReadCloser
+	if gf, _, err = newDecompressReader(f); err != nil {
 		return r, b, err
 	}
 	header := make([]byte, 16)
@@ -42,6 +49,284 @@ func RingOrBuilder(fileName string) (Ring, *Builder, error) {
 	return r, b, err
 }
 
+// RingFileInfo is the metadata of a persisted Ring, as returned by RingInfo.
+type RingFileInfo struct {
+	// FormatVersion is the persisted format version of the file.
+	FormatVersion     int
+	Version           int64
+	NodeCount         int
+	ReplicaCount      int
+	PartitionBitCount uint16
+	Label             string
+	CreatedAt         time.Time
+	BuilderID         string
+	// Fingerprint is the Ring's Fingerprint, which is only stored by format
+	// version 9 and later; it is all zeros for older files.
+	Fingerprint [32]byte
+}
+
+// RingInfo returns the metadata of the Ring file without loading the Ring, so
+// listing many large ring files is quick and uses little memory. Format
+// version 10 and later store the metadata ahead of the nodes and partition
+// assignments, so only the start of the file is read; older files are read
+// through, skipping over rather than decoding the nodes and assignments, as
+// their metadata is stored throughout. Fields the file's format version
+// predates are left at their zero values.
+func RingInfo(fileName string) (*RingFileInfo, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRingFileInfo(f)
+}
+
+func readRingFileInfo(rd io.Reader) (*RingFileInfo, error) {
+	gr, _, err := newDecompressReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(gr, header); err != nil {
+		return nil, err
+	}
+	if string(header[:5]) != "RINGv" {
+		return nil, fmt.Errorf("unknown header %s", string(header))
+	}
+	info := &RingFileInfo{}
+	info.FormatVersion, err = strconv.Atoi(string(header[5:]))
+	if err != nil || info.FormatVersion < 1 || info.FormatVersion > ringFormatVersion {
+		return nil, fmt.Errorf("unknown header %s", string(header))
+	}
+	readInt32 := func() (int32, error) {
+		var v int32
+		err := binary.Read(gr, binary.BigEndian, &v)
+		if err == nil && v < 0 {
+			err = fmt.Errorf("invalid count %d", v)
+		}
+		return v, err
+	}
+	skip := func(n int64) error {
+		_, err := io.CopyN(ioutil.Discard, gr, n)
+		return err
+	}
+	skipString := func() error {
+		n, err := readInt32()
+		if err != nil {
+			return err
+		}
+		return skip(int64(n))
+	}
+	readString := func() (string, error) {
+		n, err := readInt32()
+		if err != nil {
+			return "", err
+		}
+		byts := make([]byte, n)
+		_, err = io.ReadFull(gr, byts)
+		return string(byts), err
+	}
+	if err = binary.Read(gr, binary.BigEndian, &info.Version); err != nil {
+		return nil, err
+	}
+	if info.FormatVersion >= 10 {
+		// The info block's length, then the block; see ring.infoBlock.
+		if _, err = readInt32(); err != nil {
+			return nil, err
+		}
+		if err = binary.Read(gr, binary.BigEndian, &info.PartitionBitCount); err != nil {
+			return nil, err
+		}
+		nodeCount, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		info.NodeCount = int(nodeCount)
+		replicaCount, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		info.ReplicaCount = int(replicaCount)
+		if info.Label, err = readString(); err != nil {
+			return nil, err
+		}
+		var createdAt int64
+		if err = binary.Read(gr, binary.BigEndian, &createdAt); err != nil {
+			return nil, err
+		}
+		if createdAt != 0 {
+			info.CreatedAt = time.Unix(0, createdAt)
+		}
+		if info.BuilderID, err = readString(); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(gr, info.Fingerprint[:]); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+	// conf, then localNodeIndex
+	if err = skipString(); err != nil {
+		return nil, err
+	}
+	if err = skip(4); err != nil {
+		return nil, err
+	}
+	if err = binary.Read(gr, binary.BigEndian, &info.PartitionBitCount); err != nil {
+		return nil, err
+	}
+	levels, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	for i := int32(0); i < levels; i++ {
+		values, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		for j := int32(0); j < values; j++ {
+			if err = skipString(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	nodeCount, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	info.NodeCount = int(nodeCount)
+	for i := int32(0); i < nodeCount; i++ {
+		// id, inactive and capacity
+		if err = skip(8 + 1 + 4); err != nil {
+			return nil, err
+		}
+		tierIndexes, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		if err = skip(4 * int64(tierIndexes)); err != nil {
+			return nil, err
+		}
+		addresses, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		for j := int32(0); j < addresses; j++ {
+			if err = skipString(); err != nil {
+				return nil, err
+			}
+		}
+		// meta and conf
+		if err = skipString(); err != nil {
+			return nil, err
+		}
+		if err = skipString(); err != nil {
+			return nil, err
+		}
+	}
+	replicas, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	info.ReplicaCount = int(replicas)
+	for i := int32(0); i < replicas; i++ {
+		partitions, err := readInt32()
+		if err != nil {
+			return nil, err
+		}
+		if err = skip(4 * int64(partitions)); err != nil {
+			return nil, err
+		}
+	}
+	if info.FormatVersion < 4 {
+		return info, nil
+	}
+	// affinityGroupSize, then hashFuncName
+	if err = skip(4); err != nil {
+		return nil, err
+	}
+	if err = skipString(); err != nil {
+		return nil, err
+	}
+	if info.Label, err = readString(); err != nil {
+		return nil, err
+	}
+	var createdAt int64
+	if err = binary.Read(gr, binary.BigEndian, &createdAt); err != nil {
+		return nil, err
+	}
+	if createdAt != 0 {
+		info.CreatedAt = time.Unix(0, createdAt)
+	}
+	if info.FormatVersion < 5 {
+		return info, nil
+	}
+	if info.BuilderID, err = readString(); err != nil {
+		return nil, err
+	}
+	if info.FormatVersion < 6 {
+		return info, nil
+	}
+	tierCosts, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	if err = skip(8 * int64(tierCosts)); err != nil {
+		return nil, err
+	}
+	if info.FormatVersion < 7 {
+		return info, nil
+	}
+	replicaCount, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := readInt32()
+	if err != nil {
+		return nil, err
+	}
+	if ranges > 0 {
+		info.ReplicaCount = int(replicaCount)
+	}
+	// Each range is a start and end uint32 and an int32 count.
+	if err = skip(12 * int64(ranges)); err != nil {
+		return nil, err
+	}
+	if info.FormatVersion < 9 {
+		return info, nil
+	}
+	// partitionOffset, then the fingerprint
+	if err = skip(4); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(gr, info.Fingerprint[:]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// RingOrBuilderValidated is the same as RingOrBuilder but also validates the
+// Ring or Builder loaded, returning the validation error if there are any
+// problems; see Ring.Validate and Builder.Validate. This surfaces a corrupt
+// file immediately rather than as failures later on, at the cost of checking
+// every assignment.
+func RingOrBuilderValidated(fileName string) (Ring, *Builder, error) {
+	r, b, err := RingOrBuilder(fileName)
+	if err != nil {
+		return r, b, err
+	}
+	if r != nil {
+		err = r.Validate()
+	} else if b != nil {
+		err = b.Validate()
+	}
+	if err != nil {
+		return r, b, fmt.Errorf("%s failed validation: %s", fileName, err)
+	}
+	return r, b, nil
+}
+
 // PersistRingOrBuilder persists a given ring/builder to the provided filename
 func PersistRingOrBuilder(r Ring, b *Builder, filename string) error {
 	dir, name := path.Split(filename)
@@ -67,3 +352,74 @@ func PersistRingOrBuilder(r Ring, b *Builder, filename string) error {
 	}
 	return os.Rename(tmp, filename)
 }
+
+// ErrRingLocked is returned by WithRingLock when another process holds the
+// lock for the same file.
+var ErrRingLocked = errors.New("ring file locked by another writer")
+
+// WithRingLock calls fn while holding an advisory lock (flock) on filename
+// plus ".lock", returning ErrRingLocked straight away, without calling fn, if
+// another writer holds it. Loading the file with RingOrBuilder, changing it,
+// and persisting it with PersistRingOrBuilder all within fn keeps processes
+// sharing the file, such as the CLI and a daemon, from clobbering each other's
+// changes, provided all of them do the same. The lock file is left in place
+// for later writers. On platforms without flock no locking is done.
+func WithRingLock(filename string, fn func() error) error {
+	lf, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Closing the lock file releases the lock.
+	defer lf.Close()
+	if err = lockFile(lf); err != nil {
+		return err
+	}
+	return fn()
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int {
+	return len(s)
+}
+
+func (s uint64Slice) Swap(x int, y int) {
+	s[x], s[y] = s[y], s[x]
+}
+
+func (s uint64Slice) Less(x int, y int) bool {
+	return s[x] < s[y]
+}
+
+// newUUID returns a random (version 4) UUID in its usual string form.
+func newUUID() string {
+	u := make([]byte, 16)
+	rand.Read(u)
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// metaValue returns the value for the key from a node's meta, where the meta
+// contains whitespace separated key=value fields, such as "disk=ssd rack=12".
+func metaValue(meta string, key string) (string, bool) {
+	for _, field := range strings.Fields(meta) {
+		if i := strings.Index(field, "="); i >= 0 && field[:i] == key {
+			return field[i+1:], true
+		}
+	}
+	return "", false
+}
+
+// sortedNodeIDs returns the IDs of the nodes in ascending order, skipping
+// inactive nodes unless includeInactive is true.
+func sortedNodeIDs(nodes []*node, includeInactive bool) []uint64 {
+	ids := make([]uint64, 0, len(nodes))
+	for _, n := range nodes {
+		if includeInactive || !n.inactive {
+			ids = append(ids, n.id)
+		}
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
@@ -0,0 +1,64 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWithRingLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := NewBuilder()
+	b.AddNode(true, 1, nil, nil, "", nil)
+	builderFile := path.Join(dir, "test.builder")
+	persist := func() error {
+		return PersistRingOrBuilder(nil, b, builderFile)
+	}
+	// Another writer holding the lock.
+	lf, err := os.OpenFile(builderFile+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lockFile(lf); err != nil {
+		t.Fatal(err)
+	}
+	if err = WithRingLock(builderFile, persist); err != ErrRingLocked {
+		t.Fatalf("WithRingLock gave %v instead of ErrRingLocked", err)
+	}
+	if _, err = os.Stat(builderFile); !os.IsNotExist(err) {
+		t.Fatal("builder was persisted while locked")
+	}
+	lf.Close()
+	// The lock is held from load through persist.
+	if err = WithRingLock(builderFile, func() error {
+		if err := persist(); err != nil {
+			return err
+		}
+		_, b2, err := RingOrBuilder(builderFile)
+		if err != nil {
+			return err
+		}
+		if err = WithRingLock(builderFile, persist); err != ErrRingLocked {
+			t.Fatalf("nested WithRingLock gave %v instead of ErrRingLocked", err)
+		}
+		b2.AddNode(true, 1, nil, nil, "", nil)
+		return PersistRingOrBuilder(nil, b2, builderFile)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, b2, err := RingOrBuilder(builderFile); err != nil || len(b2.Nodes()) != 2 {
+		t.Fatalf("RingOrBuilder gave %v", err)
+	}
+	// The lock is released once fn returns.
+	if err = WithRingLock(builderFile, persist); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package ring
+
+import "os"
+
+// lockFile does nothing on platforms without flock.
+func lockFile(f *os.File) error {
+	return nil
+}